@@ -21,7 +21,6 @@ package cache
 
 import (
 	"github.com/IrineSistiana/mosdns/v5/pkg/concurrent_lru"
-	"github.com/IrineSistiana/mosdns/v5/pkg/concurrent_map"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"sync/atomic"
 	"time"
@@ -39,6 +38,34 @@ type Value interface {
 	any
 }
 
+// Sizer can be implemented by values to report their memory cost in bytes.
+// It is used by Opts.MaxBytes.
+type Sizer interface {
+	Size() int
+}
+
+// Policy is the eviction policy of Cache when it is full.
+type Policy string
+
+const (
+	// PolicyRandom evicts random entries. This is the default policy.
+	PolicyRandom Policy = "random"
+	// PolicyLRU evicts the least recently used entries.
+	PolicyLRU Policy = "lru"
+)
+
+// EvictReason indicates why an entry was removed from Cache.
+type EvictReason string
+
+const (
+	EvictReasonExpired EvictReason = "expired"
+	EvictReasonSize    EvictReason = "size"
+	EvictReasonMemory  EvictReason = "memory"
+	// EvictReasonRejected means the value was not stored because it
+	// is larger than Opts.MaxBytes.
+	EvictReasonRejected EvictReason = "rejected"
+)
+
 // Cache is a simple map cache that stores values in memory.
 // It is safe for concurrent use.
 type Cache[K Key, V Value] struct {
@@ -46,22 +73,42 @@ type Cache[K Key, V Value] struct {
 
 	closed      atomic.Bool
 	closeNotify chan struct{}
-	m           *concurrent_map.Map[K, *elem[V]]
+	m           store[K, V]
 }
 
 type Opts struct {
 	Size            int
 	CleanerInterval time.Duration
+
+	// Policy is the eviction policy. Default is PolicyRandom.
+	Policy Policy
+
+	// MaxBytes is the memory budget of all stored values, computed from
+	// Sizer.Size. Values that don't implement Sizer are counted as 0 bytes.
+	// If MaxBytes > 0, PolicyLRU is always used.
+	MaxBytes int
+
+	// OnEvict, if not nil, will be called when entries were removed from
+	// the cache because they were expired or the cache was full, or when
+	// a value was rejected because it exceeds MaxBytes.
+	OnEvict func(reason EvictReason, n int)
 }
 
 func (opts *Opts) init() {
 	utils.SetDefaultNum(&opts.Size, 1024)
 	utils.SetDefaultNum(&opts.CleanerInterval, defaultCleanerInterval)
+	if opts.MaxBytes > 0 {
+		opts.Policy = PolicyLRU
+	}
+	if opts.OnEvict == nil {
+		opts.OnEvict = func(reason EvictReason, n int) {}
+	}
 }
 
 type elem[V Value] struct {
 	v              V
 	expirationTime time.Time
+	size           int
 }
 
 // New initializes a Cache.
@@ -71,9 +118,17 @@ type elem[V Value] struct {
 // interval will be used.
 func New[K Key, V Value](opts Opts) *Cache[K, V] {
 	opts.init()
+	var m store[K, V]
+	switch opts.Policy {
+	case PolicyLRU:
+		m = newLRUStore[K, V](opts.Size, opts.MaxBytes, opts.OnEvict)
+	default:
+		m = newMapStore[K, V](opts.Size, opts.OnEvict)
+	}
 	c := &Cache[K, V]{
+		opts:        opts,
 		closeNotify: make(chan struct{}),
-		m:           concurrent_map.NewMapCache[K, *elem[V]](opts.Size),
+		m:           m,
 	}
 	go c.gcLoop(opts.CleanerInterval)
 	return c
@@ -88,9 +143,9 @@ func (c *Cache[K, V]) Close() error {
 }
 
 func (c *Cache[K, V]) Get(key K) (v V, expirationTime time.Time, ok bool) {
-	if e, hasEntry := c.m.Get(key); hasEntry {
+	if e, hasEntry := c.m.get(key); hasEntry {
 		if e.expirationTime.Before(time.Now()) {
-			c.m.Del(key)
+			c.m.del(key)
 			return
 		}
 		return e.v, e.expirationTime, true
@@ -101,10 +156,10 @@ func (c *Cache[K, V]) Get(key K) (v V, expirationTime time.Time, ok bool) {
 // Range calls f through all entries. If f returns an error, the same error will be returned
 // by Range.
 func (c *Cache[K, V]) Range(f func(key K, v V, expirationTime time.Time) error) error {
-	cf := func(key K, v *elem[V]) (newV *elem[V], setV bool, delV bool, err error) {
-		return nil, false, false, f(key, v.v, v.expirationTime)
+	cf := func(key K, v *elem[V]) (del bool, err error) {
+		return false, f(key, v.v, v.expirationTime)
 	}
-	return c.m.RangeDo(cf)
+	return c.m.rangeDo(cf)
 }
 
 // Store stores this kv in cache. If expirationTime is before time.Now(),
@@ -119,7 +174,12 @@ func (c *Cache[K, V]) Store(key K, v V, expirationTime time.Time) {
 		v:              v,
 		expirationTime: expirationTime,
 	}
-	c.m.Set(key, e)
+	if c.opts.MaxBytes > 0 {
+		if s, ok := any(v).(Sizer); ok {
+			e.size = s.Size()
+		}
+	}
+	c.m.set(key, e)
 	return
 }
 
@@ -140,18 +200,24 @@ func (c *Cache[K, V]) gcLoop(interval time.Duration) {
 }
 
 func (c *Cache[K, V]) gc(now time.Time) {
-	f := func(key K, v *elem[V]) (newV *elem[V], setV, delV bool, err error) {
-		return nil, false, now.After(v.expirationTime), nil
+	f := func(key K, v *elem[V]) (del bool, err error) {
+		return now.After(v.expirationTime), nil
 	}
-	_ = c.m.RangeDo(f)
+	_ = c.m.rangeDo(f)
 }
 
 // Len returns the current size of this cache.
 func (c *Cache[K, V]) Len() int {
-	return c.m.Len()
+	return c.m.len()
+}
+
+// Bytes returns the current memory cost of stored values.
+// It is only tracked if Opts.MaxBytes > 0.
+func (c *Cache[K, V]) Bytes() int {
+	return c.m.bytes()
 }
 
 // Flush removes all stored entries from this cache.
 func (c *Cache[K, V]) Flush() {
-	c.m.Flush()
+	c.m.flush()
 }
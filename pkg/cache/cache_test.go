@@ -96,3 +96,87 @@ func Test_memCache_race(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+type testSizedValue int
+
+func (v testSizedValue) Size() int {
+	return int(v)
+}
+
+func Test_Cache_LRU(t *testing.T) {
+	evicted := make(map[EvictReason]int)
+	var mu sync.Mutex
+	c := New[testKey, int](Opts{
+		Size:   64, // One entry per shard.
+		Policy: PolicyLRU,
+		OnEvict: func(reason EvictReason, n int) {
+			mu.Lock()
+			defer mu.Unlock()
+			evicted[reason] += n
+		},
+	})
+	defer c.Close()
+
+	// Keys 0 and 64 are in the same shard.
+	c.Store(0, 0, time.Now().Add(time.Minute))
+	c.Store(64, 64, time.Now().Add(time.Minute))
+	if _, _, ok := c.Get(0); ok {
+		t.Fatal("least recently used entry was not evicted")
+	}
+	if _, _, ok := c.Get(64); !ok {
+		t.Fatal("recently used entry was evicted")
+	}
+	if evicted[EvictReasonSize] != 1 {
+		t.Fatalf("want 1 size eviction, got %d", evicted[EvictReasonSize])
+	}
+
+	c.Store(1, 1, time.Now().Add(time.Millisecond))
+	time.Sleep(time.Millisecond * 5)
+	c.gc(time.Now())
+	if evicted[EvictReasonExpired] != 1 {
+		t.Fatalf("want 1 expired eviction, got %d", evicted[EvictReasonExpired])
+	}
+}
+
+func Test_Cache_MaxBytes(t *testing.T) {
+	evicted := make(map[EvictReason]int)
+	c := New[testKey, testSizedValue](Opts{
+		Size:     1024 * 64,
+		MaxBytes: 100, // The budget is shared by all shards.
+		OnEvict: func(reason EvictReason, n int) {
+			evicted[reason] += n
+		},
+	})
+	defer c.Close()
+
+	// Keys are in different shards. Shard 1 is the first one to evict.
+	c.Store(1, 40, time.Now().Add(time.Minute))
+	c.Store(2, 40, time.Now().Add(time.Minute))
+	if c.Bytes() != 80 {
+		t.Fatalf("want 80 bytes, got %d", c.Bytes())
+	}
+	c.Store(3, 40, time.Now().Add(time.Minute))
+	if _, _, ok := c.Get(1); ok {
+		t.Fatal("entry was not evicted")
+	}
+	if _, _, ok := c.Get(3); !ok {
+		t.Fatal("new entry was evicted")
+	}
+	if c.Bytes() != 80 || evicted[EvictReasonMemory] != 1 {
+		t.Fatalf("want 80 bytes and 1 eviction, got %d bytes, %d evictions", c.Bytes(), evicted[EvictReasonMemory])
+	}
+
+	// Value that exceeds the budget won't be stored. The old value is removed.
+	c.Store(2, 101, time.Now().Add(time.Minute))
+	if _, _, ok := c.Get(2); ok {
+		t.Fatal("oversized entry was stored or stale entry was kept")
+	}
+	if c.Bytes() != 40 || evicted[EvictReasonRejected] != 1 {
+		t.Fatalf("want 40 bytes and 1 rejection, got %d bytes, %d rejections", c.Bytes(), evicted[EvictReasonRejected])
+	}
+
+	c.Flush()
+	if c.Bytes() != 0 {
+		t.Fatalf("want 0 bytes after flush, got %d", c.Bytes())
+	}
+}
@@ -0,0 +1,195 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package redis_cache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultClientTimeout    = time.Millisecond * 50
+	defaultFailureThreshold = 3
+	defaultProbeInterval    = time.Second * 5
+)
+
+// RedisCache is a remote cache that stores values in a redis compatible
+// server. It has a simple circuit breaker. After FailureThreshold consecutive
+// failures (including timeouts), the client is disabled and all operations
+// become noop until a background PING succeeds.
+// It is safe for concurrent use.
+type RedisCache struct {
+	opts RedisCacheOpts
+
+	failures    atomic.Int32
+	disabled    atomic.Bool
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+type RedisCacheOpts struct {
+	// Client cannot be nil.
+	Client redis.Cmdable
+
+	// ClientCloser closes Client when RedisCache.Close is called.
+	// Optional.
+	ClientCloser io.Closer
+
+	// ClientTimeout specifies the timeout for each redis operation.
+	// Default is 50ms.
+	ClientTimeout time.Duration
+
+	// FailureThreshold is the number of consecutive failures that will
+	// disable the client. Default is 3.
+	FailureThreshold int
+
+	// ProbeInterval is the interval to probe a disabled server. Default is 5s.
+	ProbeInterval time.Duration
+
+	// Logger is optional.
+	Logger *zap.Logger
+}
+
+func (opts *RedisCacheOpts) init() error {
+	if opts.Client == nil {
+		return errors.New("nil client")
+	}
+	utils.SetDefaultUnsignNum(&opts.ClientTimeout, defaultClientTimeout)
+	utils.SetDefaultUnsignNum(&opts.FailureThreshold, defaultFailureThreshold)
+	utils.SetDefaultUnsignNum(&opts.ProbeInterval, defaultProbeInterval)
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	return nil
+}
+
+func NewRedisCache(opts RedisCacheOpts) (*RedisCache, error) {
+	if err := opts.init(); err != nil {
+		return nil, err
+	}
+	return &RedisCache{
+		opts:        opts,
+		closeNotify: make(chan struct{}),
+	}, nil
+}
+
+// Disabled returns true if the circuit breaker is open.
+func (r *RedisCache) Disabled() bool {
+	return r.disabled.Load()
+}
+
+func (r *RedisCache) onSuccess() {
+	r.failures.Store(0)
+}
+
+func (r *RedisCache) onFailure(err error) {
+	if int(r.failures.Add(1)) < r.opts.FailureThreshold {
+		return
+	}
+	if r.disabled.CompareAndSwap(false, true) {
+		r.opts.Logger.Warn("redis server is unhealthy, client disabled", zap.Error(err))
+		go r.probeLoop()
+	}
+}
+
+// probeLoop pings the server until it is reachable again.
+func (r *RedisCache) probeLoop() {
+	ticker := time.NewTicker(r.opts.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), r.opts.ClientTimeout)
+			err := r.opts.Client.Ping(ctx).Err()
+			cancel()
+			if err != nil {
+				r.opts.Logger.Debug("redis server is still unhealthy", zap.Error(err))
+				continue
+			}
+			r.failures.Store(0)
+			r.disabled.Store(false)
+			r.opts.Logger.Info("redis server is back, client enabled")
+			return
+		case <-r.closeNotify:
+			return
+		}
+	}
+}
+
+// Get returns the value of key. If key does not exist, or the client is
+// disabled, or any error occurred, Get returns nil.
+func (r *RedisCache) Get(ctx context.Context, key string) []byte {
+	if r.Disabled() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.opts.ClientTimeout)
+	defer cancel()
+	b, err := r.opts.Client.Get(ctx, key).Bytes()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			r.onSuccess()
+			return nil
+		}
+		r.opts.Logger.Debug("redis get", zap.Error(err))
+		r.onFailure(err)
+		return nil
+	}
+	r.onSuccess()
+	return b
+}
+
+// Store stores v with its expirationTime. If expirationTime is
+// before time.Now(), or the client is disabled, Store is a noop.
+func (r *RedisCache) Store(ctx context.Context, key string, v []byte, expirationTime time.Time) {
+	if r.Disabled() {
+		return
+	}
+	ttl := time.Until(expirationTime)
+	if ttl <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.opts.ClientTimeout)
+	defer cancel()
+	if err := r.opts.Client.Set(ctx, key, v, ttl).Err(); err != nil {
+		r.opts.Logger.Debug("redis set", zap.Error(err))
+		r.onFailure(err)
+		return
+	}
+	r.onSuccess()
+}
+
+// Close stops the background probe and closes RedisCacheOpts.ClientCloser.
+func (r *RedisCache) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closeNotify)
+	})
+	if c := r.opts.ClientCloser; c != nil {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package redis_cache
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestRedisCache(t *testing.T) (*miniredis.Miniredis, *RedisCache) {
+	t.Helper()
+	s := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: s.Addr(), MaxRetries: -1})
+	c, err := NewRedisCache(RedisCacheOpts{
+		Client:        client,
+		ClientCloser:  client,
+		ClientTimeout: time.Second,
+		ProbeInterval: time.Millisecond * 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return s, c
+}
+
+func Test_RedisCache(t *testing.T) {
+	s, c := newTestRedisCache(t)
+	ctx := context.Background()
+
+	if v := c.Get(ctx, "key"); v != nil {
+		t.Fatalf("want nil, got %v", v)
+	}
+
+	c.Store(ctx, "key", []byte("value"), time.Now().Add(time.Minute))
+	if v := c.Get(ctx, "key"); !bytes.Equal(v, []byte("value")) {
+		t.Fatalf("want value, got %s", v)
+	}
+	if ttl := s.TTL("key"); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("invalid ttl %s", ttl)
+	}
+
+	// Expired value should not be stored.
+	c.Store(ctx, "expired", []byte("value"), time.Now().Add(-time.Second))
+	if s.Exists("expired") {
+		t.Fatal("expired value stored")
+	}
+
+	s.FastForward(time.Minute)
+	if v := c.Get(ctx, "key"); v != nil {
+		t.Fatalf("value should be expired, got %s", v)
+	}
+}
+
+func Test_RedisCache_CircuitBreaker(t *testing.T) {
+	s, c := newTestRedisCache(t)
+	ctx := context.Background()
+
+	s.SetError("server down")
+	for i := 0; i < defaultFailureThreshold; i++ {
+		c.Get(ctx, "key")
+	}
+	if !c.Disabled() {
+		t.Fatal("client should be disabled")
+	}
+
+	s.SetError("")
+	deadline := time.Now().Add(time.Second)
+	for c.Disabled() {
+		if time.Now().After(deadline) {
+			t.Fatal("client was not re-enabled")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	c.Store(ctx, "key", []byte("value"), time.Now().Add(time.Minute))
+	if v := c.Get(ctx, "key"); !bytes.Equal(v, []byte("value")) {
+		t.Fatalf("want value, got %s", v)
+	}
+}
@@ -0,0 +1,263 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/concurrent_map"
+	"github.com/IrineSistiana/mosdns/v5/pkg/lru"
+)
+
+// store is the underlying storage of Cache. Implementations must be
+// safe for concurrent use and report evictions via the callback
+// passed to their constructors.
+type store[K Key, V Value] interface {
+	get(key K) (*elem[V], bool)
+	set(key K, e *elem[V])
+	// del removes an expired entry.
+	del(key K)
+	// rangeDo calls f through all entries. Entries will be deleted
+	// as expired entries if f returns true.
+	rangeDo(f func(key K, e *elem[V]) (del bool, err error)) error
+	len() int
+	bytes() int
+	flush()
+}
+
+// mapStore evicts random entries when it is full.
+type mapStore[K Key, V Value] struct {
+	m       *concurrent_map.Map[K, *elem[V]]
+	onEvict func(reason EvictReason, n int)
+}
+
+func newMapStore[K Key, V Value](size int, onEvict func(reason EvictReason, n int)) *mapStore[K, V] {
+	return &mapStore[K, V]{
+		m:       concurrent_map.NewMapCache[K, *elem[V]](size),
+		onEvict: onEvict,
+	}
+}
+
+func (s *mapStore[K, V]) get(key K) (*elem[V], bool) {
+	return s.m.Get(key)
+}
+
+func (s *mapStore[K, V]) set(key K, e *elem[V]) {
+	if n := s.m.SetAndCount(key, e); n > 0 {
+		s.onEvict(EvictReasonSize, n)
+	}
+}
+
+func (s *mapStore[K, V]) del(key K) {
+	s.m.Del(key)
+	s.onEvict(EvictReasonExpired, 1)
+}
+
+func (s *mapStore[K, V]) rangeDo(f func(key K, e *elem[V]) (del bool, err error)) error {
+	deleted := 0
+	err := s.m.RangeDo(func(key K, e *elem[V]) (newV *elem[V], setV bool, delV bool, err error) {
+		delV, err = f(key, e)
+		if delV {
+			deleted++
+		}
+		return nil, false, delV, err
+	})
+	if deleted > 0 {
+		s.onEvict(EvictReasonExpired, deleted)
+	}
+	return err
+}
+
+func (s *mapStore[K, V]) len() int {
+	return s.m.Len()
+}
+
+// bytes is not tracked by mapStore.
+func (s *mapStore[K, V]) bytes() int {
+	return 0
+}
+
+func (s *mapStore[K, V]) flush() {
+	s.m.Flush()
+}
+
+// lruStore is a sharded lru that evicts the least recently used entries
+// when a shard is full. If maxBytes > 0, it also evicts entries when the
+// total size of all shards exceeds maxBytes. Those entries are taken from
+// the oldest ends of the shards in turn, so it is approximately lru.
+type lruStore[K Key, V Value] struct {
+	shards     []*lruShard[K, V]
+	maxBytes   int // Zero means no limit.
+	totalBytes atomic.Int64
+	nextShard  atomic.Uint32 // the next shard that evicts entries for maxBytes
+	onEvict    func(reason EvictReason, n int)
+}
+
+type lruShard[K Key, V Value] struct {
+	sync.Mutex
+	l     *lru.LRU[K, *elem[V]]
+	bytes int
+	quiet bool // don't report to onEvict, set when removing a stale entry.
+}
+
+func newLRUStore[K Key, V Value](size, maxBytes int, onEvict func(reason EvictReason, n int)) *lruStore[K, V] {
+	const shardNum = concurrent_map.MapShardSize
+	sizePerShard := max(size/shardNum, 1)
+
+	s := &lruStore[K, V]{
+		shards:   make([]*lruShard[K, V], 0, shardNum),
+		maxBytes: maxBytes,
+		onEvict:  onEvict,
+	}
+	for i := 0; i < shardNum; i++ {
+		sh := new(lruShard[K, V])
+		// Called with sh locked, by Add (shard is full), Del and Clean (expired).
+		sh.l = lru.NewLRU[K, *elem[V]](sizePerShard, func(key K, e *elem[V]) {
+			sh.bytes -= e.size
+			s.totalBytes.Add(-int64(e.size))
+			switch {
+			case sh.quiet:
+			case e.expirationTime.Before(time.Now()):
+				onEvict(EvictReasonExpired, 1)
+			default:
+				onEvict(EvictReasonSize, 1)
+			}
+		})
+		s.shards = append(s.shards, sh)
+	}
+	return s
+}
+
+func (s *lruStore[K, V]) getShard(key K) *lruShard[K, V] {
+	return s.shards[key.Sum()%uint64(len(s.shards))]
+}
+
+func (s *lruStore[K, V]) get(key K) (*elem[V], bool) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+	return sh.l.Get(key)
+}
+
+func (s *lruStore[K, V]) set(key K, e *elem[V]) {
+	sh := s.getShard(key)
+	sh.Lock()
+	if s.maxBytes > 0 && e.size > s.maxBytes { // Too big to be cached.
+		// Also remove the old value. It is stale now.
+		sh.quiet = true
+		sh.l.Del(key)
+		sh.quiet = false
+		sh.Unlock()
+		s.onEvict(EvictReasonRejected, 1)
+		return
+	}
+
+	if old, ok := sh.l.Get(key); ok {
+		sh.bytes -= old.size
+		s.totalBytes.Add(-int64(old.size))
+	}
+	sh.l.Add(key, e)
+	sh.bytes += e.size
+	s.totalBytes.Add(int64(e.size))
+	sh.Unlock()
+
+	if s.maxBytes > 0 {
+		s.evictBytes()
+	}
+}
+
+// evictBytes removes the oldest entries of shards in turn until the
+// total size is within maxBytes.
+func (s *lruStore[K, V]) evictBytes() {
+	evicted := 0
+	empty := 0 // consecutive empty shards
+	for s.totalBytes.Load() > int64(s.maxBytes) && empty < len(s.shards) {
+		sh := s.shards[s.nextShard.Add(1)%uint32(len(s.shards))]
+		sh.Lock()
+		_, oldest, ok := sh.l.PopOldest()
+		if ok {
+			sh.bytes -= oldest.size
+			s.totalBytes.Add(-int64(oldest.size))
+		}
+		sh.Unlock()
+		if ok {
+			evicted++
+			empty = 0
+		} else {
+			empty++
+		}
+	}
+	// PopOldest won't call the lru callback. Report it here.
+	if evicted > 0 {
+		s.onEvict(EvictReasonMemory, evicted)
+	}
+}
+
+func (s *lruStore[K, V]) del(key K) {
+	sh := s.getShard(key)
+	sh.Lock()
+	defer sh.Unlock()
+	sh.l.Del(key)
+}
+
+func (s *lruStore[K, V]) rangeDo(f func(key K, e *elem[V]) (del bool, err error)) error {
+	for _, sh := range s.shards {
+		var err error
+		sh.Lock()
+		sh.l.Clean(func(key K, e *elem[V]) (remove bool) {
+			if err != nil {
+				return false
+			}
+			remove, err = f(key, e)
+			return remove
+		})
+		sh.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *lruStore[K, V]) len() int {
+	l := 0
+	for _, sh := range s.shards {
+		sh.Lock()
+		l += sh.l.Len()
+		sh.Unlock()
+	}
+	return l
+}
+
+func (s *lruStore[K, V]) bytes() int {
+	return int(s.totalBytes.Load())
+}
+
+func (s *lruStore[K, V]) flush() {
+	for _, sh := range s.shards {
+		sh.Lock()
+		sh.l.Flush()
+		s.totalBytes.Add(-int64(sh.bytes))
+		sh.bytes = 0
+		sh.Unlock()
+	}
+}
@@ -71,6 +71,12 @@ func (m *Map[K, V]) Set(key K, v V) {
 	m.getShard(key).set(key, v)
 }
 
+// SetAndCount is the same as Set. It also returns the number of entries
+// that were removed because the shard was full.
+func (m *Map[K, V]) SetAndCount(key K, v V) (evicted int) {
+	return m.getShard(key).set(key, v)
+}
+
 func (m *Map[K, V]) Del(key K) {
 	m.getShard(key).del(key)
 }
@@ -122,18 +128,20 @@ func (m *shard[K, V]) get(key K) (V, bool) {
 	return v, ok
 }
 
-func (m *shard[K, V]) set(key K, v V) {
+func (m *shard[K, V]) set(key K, v V) (evicted int) {
 	m.l.Lock()
 	defer m.l.Unlock()
 	if m.max > 0 && len(m.m)+1 > m.max {
 		for k := range m.m {
 			delete(m.m, k)
+			evicted++
 			if len(m.m)+1 <= m.max {
 				break
 			}
 		}
 	}
 	m.m[key] = v
+	return evicted
 }
 
 func (m *shard[K, V]) del(key K) {
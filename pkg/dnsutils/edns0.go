@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"github.com/miekg/dns"
+)
+
+// QueryPaddingBlockSize is the block size of queries that RFC 8467 4.1 recommended.
+const QueryPaddingBlockSize = 128
+
+// nonIdentifyingEDNS0Options are options that do not carry any information
+// about the client.
+var nonIdentifyingEDNS0Options = map[uint16]struct{}{
+	dns.EDNS0NSID:         {},
+	dns.EDNS0DAU:          {},
+	dns.EDNS0DHU:          {},
+	dns.EDNS0N3U:          {},
+	dns.EDNS0EXPIRE:       {},
+	dns.EDNS0TCPKEEPALIVE: {},
+	dns.EDNS0PADDING:      {},
+}
+
+// PadMsg adds an EDNS0 padding option (RFC 7830) to m, so the length of
+// the packed m is a multiple of blockSize. Existing padding options are
+// replaced. If m has no OPT, a new one is added.
+func PadMsg(m *dns.Msg, blockSize int) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		opt = new(dns.OPT)
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
+		opt.SetUDPSize(dns.DefaultMsgSize)
+		m.Extra = append(m.Extra, opt)
+	}
+	removeEDNS0Option(opt, func(o dns.EDNS0) bool { return o.Option() == dns.EDNS0PADDING })
+
+	const optHeaderLen = 4 // option code + option length
+	l := m.Len() + optHeaderLen
+	padLen := 0
+	if r := l % blockSize; r != 0 {
+		padLen = blockSize - r
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, padLen)})
+}
+
+// RemoveIdentifyingEDNS0Options removes EDNS0 options that may identify the
+// client, e.g. ECS (RFC 7871), cookies (RFC 7873) and any unknown or private
+// options. Only a small set of well-known, non-identifying options are kept.
+func RemoveIdentifyingEDNS0Options(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	removeEDNS0Option(opt, func(o dns.EDNS0) bool {
+		_, ok := nonIdentifyingEDNS0Options[o.Option()]
+		return !ok
+	})
+}
+
+func removeEDNS0Option(opt *dns.OPT, remove func(o dns.EDNS0) bool) {
+	s := opt.Option[:0]
+	for _, o := range opt.Option {
+		if !remove(o) {
+			s = append(s, o)
+		}
+	}
+	for i := len(s); i < len(opt.Option); i++ {
+		opt.Option[i] = nil
+	}
+	opt.Option = s
+}
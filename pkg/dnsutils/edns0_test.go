@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnsutils
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_PadMsg(t *testing.T) {
+	for _, name := range []string{".", "example.com.", strings.Repeat("a.", 100)} {
+		for _, edns0 := range []bool{true, false} {
+			q := new(dns.Msg)
+			q.SetQuestion(name, dns.TypeA)
+			if edns0 {
+				q.SetEdns0(1232, true)
+			}
+			// Padding twice should not add another option.
+			PadMsg(q, QueryPaddingBlockSize)
+			PadMsg(q, QueryPaddingBlockSize)
+			b, err := q.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b)%QueryPaddingBlockSize != 0 {
+				t.Fatalf("%s: padded length %d is not a multiple of %d", name, len(b), QueryPaddingBlockSize)
+			}
+			if n := len(q.IsEdns0().Option); n != 1 {
+				t.Fatalf("want 1 option, got %d", n)
+			}
+		}
+	}
+}
+
+func Test_RemoveIdentifyingEDNS0Options(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1232, true)
+	opt := q.IsEdns0()
+	opt.Option = append(opt.Option,
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(192, 0, 2, 0)},
+		&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"},
+		&dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE},
+		&dns.EDNS0_LOCAL{Code: 65001, Data: []byte{1, 2, 3}},
+	)
+	RemoveIdentifyingEDNS0Options(q)
+	if len(opt.Option) != 1 || opt.Option[0].Option() != dns.EDNS0TCPKEEPALIVE {
+		t.Fatalf("unexpected options %v", opt.Option)
+	}
+	if !opt.Do() || opt.UDPSize() != 1232 {
+		t.Fatal("opt header should be kept")
+	}
+}
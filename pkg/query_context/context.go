@@ -48,6 +48,7 @@ type Context struct {
 	resp        *dns.Msg
 	respOpt     *dns.OPT // nil if clientOpt == nil
 	upstreamOpt *dns.OPT // may be nil
+	dropped     bool
 
 	// lazy init.
 	kv    map[uint32]any
@@ -157,6 +158,32 @@ func (ctx *Context) UpstreamOpt() *dns.OPT {
 	return ctx.upstreamOpt
 }
 
+// AddEDE adds an extended dns error (RFC 8914) to RespOpt.
+// It is a noop if the client does not support EDNS0. Options that have
+// the same info code will be replaced.
+func (ctx *Context) AddEDE(code uint16, text string) {
+	if ctx.respOpt == nil {
+		return
+	}
+	for _, o := range ctx.respOpt.Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok && ede.InfoCode == code {
+			ede.ExtraText = text
+			return
+		}
+	}
+	ctx.respOpt.Option = append(ctx.respOpt.Option, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+// Drop tells the server not to reply to this query.
+func (ctx *Context) Drop() {
+	ctx.dropped = true
+}
+
+// Dropped reports whether Drop was called.
+func (ctx *Context) Dropped() bool {
+	return ctx.dropped
+}
+
 // InfoField returns a zap.Field contains a brief summary of this Context.
 // Useful in log.
 func (ctx *Context) InfoField() zap.Field {
@@ -188,6 +215,7 @@ func (ctx *Context) CopyTo(d *Context) *Context {
 		d.respOpt = dns.Copy(ctx.respOpt).(*dns.OPT)
 	}
 	d.upstreamOpt = ctx.upstreamOpt
+	d.dropped = ctx.dropped
 
 	d.kv = copyMap(ctx.kv)
 	d.marks = copyMap(ctx.marks)
@@ -249,6 +277,10 @@ func (ctx *Context) MarshalLogObject(encoder zapcore.ObjectEncoder) error {
 	if r := ctx.resp; r != nil {
 		encoder.AddInt("rcode", r.Rcode)
 	}
+	if e, ok := ctx.ECS(); ok {
+		zap.Stringer("ecs", e.Source).AddTo(encoder)
+		encoder.AddUint8("ecs_scope", e.Scope)
+	}
 	encoder.AddDuration("elapsed", time.Since(ctx.startTime))
 	return nil
 }
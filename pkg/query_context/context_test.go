@@ -0,0 +1,60 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_context
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func Test_Context_AddEDE(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	ctx := NewContext(q)
+	ctx.AddEDE(dns.ExtendedErrorCodeBlocked, "") // noop, client has no edns0
+	if ctx.RespOpt() != nil {
+		t.Fatal("resp opt should be nil")
+	}
+
+	q = new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	ctx = NewContext(q)
+	ctx.AddEDE(dns.ExtendedErrorCodeBlocked, "a")
+	ctx.AddEDE(dns.ExtendedErrorCodeStaleAnswer, "")
+	ctx.AddEDE(dns.ExtendedErrorCodeBlocked, "b") // replaces the first one
+
+	var got []*dns.EDNS0_EDE
+	for _, o := range ctx.RespOpt().Option {
+		if ede, ok := o.(*dns.EDNS0_EDE); ok {
+			got = append(got, ede)
+		}
+	}
+	if len(got) != 2 {
+		t.Fatalf("want 2 edes, got %d", len(got))
+	}
+	if got[0].InfoCode != dns.ExtendedErrorCodeBlocked || got[0].ExtraText != "b" {
+		t.Fatalf("unexpected ede %s", got[0])
+	}
+	if got[1].InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Fatalf("unexpected ede %s", got[1])
+	}
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package query_context
+
+import "net/netip"
+
+// ECS is the client subnet of a query and the scope of its response.
+// See RFC 7871.
+type ECS struct {
+	// Source is the client subnet sent to upstreams, masked to the source
+	// prefix length.
+	Source netip.Prefix
+	// Scope is the scope prefix length of the response. It is never
+	// greater than the source prefix length. 0 means the response is
+	// valid for all clients. Before the response is received, it is the
+	// source prefix length.
+	Scope uint8
+}
+
+var ecsKey = RegKey()
+
+// SetECS stores the ECS of this query.
+func (ctx *Context) SetECS(e ECS) {
+	ctx.StoreValue(ecsKey, e)
+}
+
+// ECS returns the ECS stored by SetECS.
+func (ctx *Context) ECS() (ECS, bool) {
+	v, ok := ctx.GetValue(ecsKey)
+	if !ok {
+		return ECS{}, false
+	}
+	return v.(ECS), true
+}
@@ -38,15 +38,22 @@ type HttpHandlerOpts struct {
 	// e.g. "X-Forwarded-For".
 	GetSrcIPFromHeader string
 
+	// TrustedProxies, if not empty, only reads the header from these
+	// proxies. The rightmost address in the header that is not a trusted
+	// proxy is used as the client address. Otherwise, the leftmost address
+	// is used, which can be forged by clients.
+	TrustedProxies []netip.Prefix
+
 	// Logger specifies the logger which Handler writes its log to.
 	// Default is a nop logger.
 	Logger *zap.Logger
 }
 
 type HttpHandler struct {
-	dnsHandler  Handler
-	logger      *zap.Logger
-	srcIPHeader string
+	dnsHandler     Handler
+	logger         *zap.Logger
+	srcIPHeader    string
+	trustedProxies []netip.Prefix
 }
 
 var _ http.Handler = (*HttpHandler)(nil)
@@ -55,6 +62,7 @@ func NewHttpHandler(h Handler, opts HttpHandlerOpts) *HttpHandler {
 	hh := new(HttpHandler)
 	hh.dnsHandler = h
 	hh.srcIPHeader = opts.GetSrcIPFromHeader
+	hh.trustedProxies = opts.TrustedProxies
 	hh.logger = opts.Logger
 	if hh.logger == nil {
 		hh.logger = nopLogger
@@ -75,13 +83,13 @@ func (h *HttpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 	// read remote addr from header
 	if header := h.srcIPHeader; len(header) != 0 {
-		if xff := req.Header.Get(header); len(xff) != 0 {
-			addr, err := readClientAddrFromXFF(xff)
-			if err != nil {
-				h.warnErr(req, "failed to get client ip from header", fmt.Errorf("failed to prase header %s: %s, %s", header, xff, err))
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
+		addr, err := h.readClientAddrFromHeader(req, header, clientAddr)
+		if err != nil {
+			h.warnErr(req, "failed to get client ip from header", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if addr.IsValid() {
 			clientAddr = addr
 		}
 	}
@@ -123,6 +131,61 @@ func readClientAddrFromXFF(s string) (netip.Addr, error) {
 	return netip.ParseAddr(s)
 }
 
+// readClientAddrFromHeader returns an invalid addr if the header is empty
+// or remoteAddr is not a trusted proxy.
+func (h *HttpHandler) readClientAddrFromHeader(req *http.Request, header string, remoteAddr netip.Addr) (netip.Addr, error) {
+	var xff string
+	var addr netip.Addr
+	var err error
+	if len(h.trustedProxies) == 0 {
+		if xff = req.Header.Get(header); len(xff) != 0 {
+			addr, err = readClientAddrFromXFF(xff)
+		}
+	} else if h.isTrustedProxy(remoteAddr) {
+		if xff = strings.Join(req.Header.Values(header), ","); len(xff) != 0 {
+			addr, err = h.readClientAddrFromTrustedXFF(xff)
+		}
+	}
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("failed to prase header %s: %s, %s", header, xff, err)
+	}
+	return addr, nil
+}
+
+func (h *HttpHandler) isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range h.trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// readClientAddrFromTrustedXFF returns the rightmost address in s that
+// is not a trusted proxy. If all addresses are trusted, the leftmost one
+// is returned.
+func (h *HttpHandler) readClientAddrFromTrustedXFF(s string) (netip.Addr, error) {
+	var addr netip.Addr
+	for len(s) != 0 {
+		field := s
+		if i := strings.LastIndexByte(s, ','); i >= 0 {
+			field, s = s[i+1:], s[:i]
+		} else {
+			s = ""
+		}
+		a, err := netip.ParseAddr(strings.TrimSpace(field))
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		addr = a.Unmap()
+		if !h.isTrustedProxy(addr) {
+			break
+		}
+	}
+	return addr, nil
+}
+
 var errInvalidMediaType = errors.New("missing or invalid media type header")
 
 var bufPool = pool.NewBytesBufPool(512)
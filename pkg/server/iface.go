@@ -21,6 +21,9 @@ type Handler interface {
 
 type QueryMeta struct {
 	FromUDP bool
+	// FromTCP indicates the query is from tcp or dot. Responses of zone
+	// transfers may be sent in multiple messages.
+	FromTCP bool
 
 	// Optional
 	ClientAddr netip.Addr
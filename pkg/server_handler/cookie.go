@@ -0,0 +1,211 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_handler
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/miekg/dns"
+)
+
+const (
+	clientCookieLen = 8
+	serverCookieLen = 16 // version + reserved + timestamp + hash. See RFC 9018 4.
+
+	cookieVersion = 1
+
+	// Server cookies are valid for an hour and may be generated up to
+	// five minutes in the future by another server. See RFC 9018 4.3.
+	cookieLifetime  = time.Hour
+	cookieClockSkew = time.Minute * 5
+
+	defaultCookieRotateInterval = time.Hour * 24
+)
+
+type CookieOpts struct {
+	// Secrets are used to generate and verify server cookies. The first
+	// one generates new cookies, others only verify cookies. Servers that
+	// share an anycast address should have the same secrets.
+	// If empty, a random secret will be generated and rotated every
+	// RotateInterval.
+	Secrets [][]byte
+
+	// RotateInterval is the interval of random secret rotation.
+	// Default is 24h.
+	RotateInterval time.Duration
+
+	// UDPSizeLimit is the maximum size of udp responses to queries that
+	// don't have a valid server cookie. Larger responses will be replaced
+	// by a BADCOOKIE response if the query has a client cookie, or by an
+	// empty truncated response otherwise. 0 means no limit.
+	UDPSizeLimit int
+}
+
+// Cookies implements server side dns cookies. See RFC 7873 and RFC 9018.
+// The cookie hash is a truncated HMAC-SHA256.
+type Cookies struct {
+	opts CookieOpts
+
+	m          sync.RWMutex
+	secrets    [][]byte
+	rotateTime time.Time // zero if secrets are static
+
+	now func() time.Time // for tests
+}
+
+func NewCookies(opts CookieOpts) *Cookies {
+	utils.SetDefaultNum(&opts.RotateInterval, defaultCookieRotateInterval)
+	c := &Cookies{opts: opts, secrets: opts.Secrets, now: time.Now}
+	if len(c.secrets) == 0 {
+		c.secrets = [][]byte{randSecret()}
+		c.rotateTime = c.now().Add(opts.RotateInterval)
+	}
+	return c
+}
+
+func randSecret() []byte {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return b
+}
+
+// getSecrets returns current secrets and rotates the random secret if it
+// is expired. The previous secret is kept to verify existing cookies.
+func (c *Cookies) getSecrets(now time.Time) [][]byte {
+	c.m.RLock()
+	secrets, rotateTime := c.secrets, c.rotateTime
+	c.m.RUnlock()
+	if rotateTime.IsZero() || now.Before(rotateTime) {
+		return secrets
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if now.Before(c.rotateTime) { // rotated by others
+		return c.secrets
+	}
+	c.secrets = [][]byte{randSecret(), c.secrets[0]}
+	c.rotateTime = now.Add(c.opts.RotateInterval)
+	return c.secrets
+}
+
+func cookieHash(secret, clientCookie, header []byte, client netip.Addr) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write(clientCookie)
+	h.Write(header)
+	h.Write(client.Unmap().AsSlice())
+	return h.Sum(nil)[:8]
+}
+
+// genServerCookie generates a server cookie for the client.
+func (c *Cookies) genServerCookie(clientCookie []byte, client netip.Addr, now time.Time) []byte {
+	b := make([]byte, serverCookieLen)
+	b[0] = cookieVersion
+	binary.BigEndian.PutUint32(b[4:8], uint32(now.Unix()))
+	copy(b[8:], cookieHash(c.getSecrets(now)[0], clientCookie, b[:8], client))
+	return b
+}
+
+// verifyServerCookie reports whether sc is a valid server cookie for the client.
+func (c *Cookies) verifyServerCookie(clientCookie, sc []byte, client netip.Addr, now time.Time) bool {
+	if len(sc) != serverCookieLen || sc[0] != cookieVersion {
+		return false
+	}
+	t := time.Unix(int64(binary.BigEndian.Uint32(sc[4:8])), 0)
+	if t.After(now.Add(cookieClockSkew)) || t.Add(cookieLifetime).Before(now) {
+		return false
+	}
+	for _, secret := range c.getSecrets(now) {
+		if hmac.Equal(sc[8:], cookieHash(secret, clientCookie, sc[:8], client)) {
+			return true
+		}
+	}
+	return false
+}
+
+type cookieState struct {
+	clientCookie []byte // nil if the query has no cookie
+	malformed    bool
+	valid        bool // has a valid server cookie
+}
+
+// check checks the cookie of the query. See RFC 7873 5.2.
+func (c *Cookies) check(qCtx *query_context.Context) cookieState {
+	opt := qCtx.ClientOpt()
+	if opt == nil {
+		return cookieState{}
+	}
+	for _, o := range opt.Option {
+		co, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		b, err := hex.DecodeString(co.Cookie)
+		if err != nil || len(b) < clientCookieLen || (len(b) > clientCookieLen && (len(b) < 16 || len(b) > 40)) {
+			return cookieState{malformed: true}
+		}
+		cs := cookieState{clientCookie: b[:clientCookieLen]}
+		if len(b) > clientCookieLen {
+			cs.valid = c.verifyServerCookie(cs.clientCookie, b[clientCookieLen:], qCtx.ServerMeta.ClientAddr, c.now())
+		}
+		return cs
+	}
+	return cookieState{}
+}
+
+// apply adds a new server cookie to the response and enforces
+// UDPSizeLimit. It returns the response that should be sent.
+// resp must already have the RespOpt.
+func (c *Cookies) apply(qCtx *query_context.Context, resp *dns.Msg, cs cookieState) *dns.Msg {
+	limited := qCtx.ServerMeta.FromUDP && !cs.valid && c.opts.UDPSizeLimit > 0 && resp.Len() > c.opts.UDPSizeLimit
+	respOpt := qCtx.RespOpt()
+	if limited {
+		resp = new(dns.Msg)
+		resp.SetReply(qCtx.Q())
+		resp.RecursionAvailable = true
+		if respOpt != nil {
+			resp.Extra = []dns.RR{respOpt}
+		}
+		if cs.clientCookie == nil {
+			resp.Truncated = true
+		} else {
+			resp.Rcode = dns.RcodeBadCookie
+		}
+	}
+	if cs.clientCookie == nil {
+		return resp
+	}
+
+	sc := c.genServerCookie(cs.clientCookie, qCtx.ServerMeta.ClientAddr, c.now())
+	respOpt.Option = append(respOpt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(cs.clientCookie) + hex.EncodeToString(sc),
+	})
+	return resp
+}
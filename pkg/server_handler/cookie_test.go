@@ -0,0 +1,216 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_handler
+
+import (
+	"context"
+	"encoding/hex"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+var (
+	testClientCookie = []byte("abcdefgh")
+	testClient       = netip.MustParseAddr("192.0.2.1")
+)
+
+func newTestCookies(opts CookieOpts, now *time.Time) *Cookies {
+	c := NewCookies(opts)
+	c.now = func() time.Time { return *now }
+	c.rotateTime = (*now).Add(c.opts.RotateInterval)
+	if len(opts.Secrets) > 0 {
+		c.rotateTime = time.Time{}
+	}
+	return c
+}
+
+func Test_Cookies_genVerify(t *testing.T) {
+	now := time.Now()
+	c := newTestCookies(CookieOpts{}, &now)
+	sc := c.genServerCookie(testClientCookie, testClient, now)
+	if len(sc) != serverCookieLen || sc[0] != cookieVersion {
+		t.Fatalf("invalid server cookie %x", sc)
+	}
+	if !c.verifyServerCookie(testClientCookie, sc, testClient, now) {
+		t.Fatal("server cookie should be valid")
+	}
+	// An ipv4 mapped client is the same client.
+	if !c.verifyServerCookie(testClientCookie, sc, netip.AddrFrom16(testClient.As16()), now) {
+		t.Fatal("server cookie should be valid for the mapped client")
+	}
+	if c.verifyServerCookie([]byte("12345678"), sc, testClient, now) {
+		t.Fatal("server cookie should be invalid for another client cookie")
+	}
+	if c.verifyServerCookie(testClientCookie, sc, netip.MustParseAddr("192.0.2.2"), now) {
+		t.Fatal("server cookie should be invalid for another client")
+	}
+	bad := append([]byte(nil), sc...)
+	bad[15] ^= 1
+	if c.verifyServerCookie(testClientCookie, bad, testClient, now) {
+		t.Fatal("modified server cookie should be invalid")
+	}
+
+	// Servers with the same secrets accept each other's cookies.
+	secrets := [][]byte{[]byte("new"), []byte("old")}
+	c1 := newTestCookies(CookieOpts{Secrets: secrets[1:]}, &now)
+	c2 := newTestCookies(CookieOpts{Secrets: secrets}, &now)
+	if !c2.verifyServerCookie(testClientCookie, c1.genServerCookie(testClientCookie, testClient, now), testClient, now) {
+		t.Fatal("server cookie of the old secret should be valid")
+	}
+	if c1.verifyServerCookie(testClientCookie, c2.genServerCookie(testClientCookie, testClient, now), testClient, now) {
+		t.Fatal("server cookie of an unknown secret should be invalid")
+	}
+}
+
+func Test_Cookies_rotation(t *testing.T) {
+	now := time.Now()
+	c := newTestCookies(CookieOpts{RotateInterval: time.Minute * 10}, &now)
+	sc := c.genServerCookie(testClientCookie, testClient, now)
+
+	// The previous secret is kept after a rotation.
+	now = now.Add(time.Minute * 11)
+	if !c.verifyServerCookie(testClientCookie, sc, testClient, now) {
+		t.Fatal("server cookie should be valid after one rotation")
+	}
+	if len(c.secrets) != 2 {
+		t.Fatalf("want 2 secrets, got %d", len(c.secrets))
+	}
+
+	now = now.Add(time.Minute * 11)
+	if c.verifyServerCookie(testClientCookie, sc, testClient, now) {
+		t.Fatal("server cookie should be invalid after two rotations")
+	}
+}
+
+func Test_Cookies_clockSkew(t *testing.T) {
+	now := time.Now()
+	c := newTestCookies(CookieOpts{Secrets: [][]byte{[]byte("secret")}}, &now)
+	tests := []struct {
+		name  string
+		genAt time.Duration // relative to now
+		valid bool
+	}{
+		{name: "now", genAt: 0, valid: true},
+		{name: "future in skew", genAt: cookieClockSkew - time.Minute, valid: true},
+		{name: "future out of skew", genAt: cookieClockSkew + time.Minute, valid: false},
+		{name: "past in lifetime", genAt: -cookieLifetime + time.Minute, valid: true},
+		{name: "expired", genAt: -cookieLifetime - time.Minute, valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := c.genServerCookie(testClientCookie, testClient, now.Add(tt.genAt))
+			if got := c.verifyServerCookie(testClientCookie, sc, testClient, now); got != tt.valid {
+				t.Fatalf("want %v, got %v", tt.valid, got)
+			}
+		})
+	}
+}
+
+// respCookie returns the cookie option of r.
+func respCookie(r *dns.Msg) (clientCookie, serverCookie []byte, ok bool) {
+	if opt := r.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if co, isCookie := o.(*dns.EDNS0_COOKIE); isCookie {
+				b, _ := hex.DecodeString(co.Cookie)
+				return b[:clientCookieLen], b[clientCookieLen:], true
+			}
+		}
+	}
+	return nil, nil, false
+}
+
+func newCookieQuery(cookie string) *dns.Msg {
+	q := newQuery("example.com.", dns.TypeTXT)
+	if len(cookie) > 0 {
+		opt := q.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	}
+	return q
+}
+
+func Test_EntryHandler_Cookies(t *testing.T) {
+	// The entry replies a large response.
+	entry := sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+		r := new(dns.Msg)
+		r.SetReply(qCtx.Q())
+		r.Answer = append(r.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{strings.Repeat("a", 255), strings.Repeat("b", 255)},
+		})
+		qCtx.SetResponse(r)
+		return nil
+	})
+	now := time.Now()
+	c := newTestCookies(CookieOpts{UDPSizeLimit: 512}, &now)
+	h := NewEntryHandler(EntryHandlerOpts{Entry: entry, Cookies: c})
+	udpMeta := server.QueryMeta{FromUDP: true, ClientAddr: testClient}
+	clientCookie := hex.EncodeToString(testClientCookie)
+	validCookie := clientCookie + hex.EncodeToString(c.genServerCookie(testClientCookie, testClient, now))
+
+	tests := []struct {
+		name          string
+		cookie        string
+		meta          server.QueryMeta
+		wantRcode     int
+		wantTruncated bool
+		wantAnswer    bool
+		wantCookie    bool
+	}{
+		{name: "malformed", cookie: "abcd", meta: udpMeta, wantRcode: dns.RcodeFormatError},
+		{name: "malformed server cookie", cookie: clientCookie + "00", meta: udpMeta, wantRcode: dns.RcodeFormatError},
+		{name: "client cookie only", cookie: clientCookie, meta: udpMeta, wantRcode: dns.RcodeBadCookie, wantCookie: true},
+		{name: "no cookie", meta: udpMeta, wantTruncated: true},
+		{name: "valid server cookie", cookie: validCookie, meta: udpMeta, wantAnswer: true, wantCookie: true},
+		{name: "tcp", cookie: clientCookie, meta: server.QueryMeta{FromTCP: true, ClientAddr: testClient}, wantAnswer: true, wantCookie: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := handle(t, h, newCookieQuery(tt.cookie), tt.meta)
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("want rcode %d, got %d", tt.wantRcode, r.Rcode)
+			}
+			if r.Truncated != tt.wantTruncated {
+				t.Fatalf("want truncated %v, got %v", tt.wantTruncated, r.Truncated)
+			}
+			if (len(r.Answer) > 0) != tt.wantAnswer {
+				t.Fatalf("want answer %v, got %v", tt.wantAnswer, r.Answer)
+			}
+			cc, sc, ok := respCookie(r)
+			if ok != tt.wantCookie {
+				t.Fatalf("want cookie %v, got %v", tt.wantCookie, ok)
+			}
+			if ok {
+				if string(cc) != string(testClientCookie) {
+					t.Fatalf("want client cookie %x, got %x", testClientCookie, cc)
+				}
+				if !c.verifyServerCookie(cc, sc, testClient, now) {
+					t.Fatalf("invalid server cookie %x", sc)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_handler
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ddrName = "_dns.resolver.arpa."
+	ddrTtl  = 300
+)
+
+// DDREndpoint is an encrypted dns endpoint of this server. It is used to
+// answer the DDR query. See RFC 9462.
+type DDREndpoint struct {
+	// Target is a dns name of the server certificate.
+	Target string
+	// ALPN is the protocol of the endpoint. e.g. "dot", "h2" and "doq".
+	ALPN []string
+	Port uint16
+	// DoHPath is the uri template of a DoH endpoint. e.g. "/dns-query{?dns}".
+	DoHPath string
+	// Addr is the listen address. It is used as a hint if it is specified.
+	Addr netip.Addr
+}
+
+// ddrResponse returns the response of q if it is a DDR query and this
+// server has encrypted endpoints. Otherwise, it returns nil.
+func (h *EntryHandler) ddrResponse(q *dns.Msg) *dns.Msg {
+	question := q.Question[0]
+	if h.opts.DDREndpoints == nil || question.Qtype != dns.TypeSVCB || question.Qclass != dns.ClassINET || !strings.EqualFold(question.Name, ddrName) {
+		return nil
+	}
+	eps := h.opts.DDREndpoints()
+	if len(eps) == 0 {
+		return nil
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	for i, ep := range eps {
+		rr := &dns.SVCB{
+			Hdr:      dns.RR_Header{Name: question.Name, Rrtype: dns.TypeSVCB, Class: dns.ClassINET, Ttl: ddrTtl},
+			Priority: uint16(i + 1),
+			Target:   dns.Fqdn(ep.Target),
+			Value: []dns.SVCBKeyValue{
+				&dns.SVCBAlpn{Alpn: ep.ALPN},
+				&dns.SVCBPort{Port: ep.Port},
+			},
+		}
+		switch {
+		case !ep.Addr.IsValid() || ep.Addr.IsUnspecified():
+		case ep.Addr.Unmap().Is4():
+			rr.Value = append(rr.Value, &dns.SVCBIPv4Hint{Hint: []net.IP{ep.Addr.Unmap().AsSlice()}})
+		default:
+			rr.Value = append(rr.Value, &dns.SVCBIPv6Hint{Hint: []net.IP{ep.Addr.AsSlice()}})
+		}
+		if len(ep.DoHPath) > 0 {
+			rr.Value = append(rr.Value, &dns.SVCBDoHPath{Template: ep.DoHPath})
+		}
+		resp.Answer = append(resp.Answer, rr)
+	}
+	return resp
+}
@@ -0,0 +1,123 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_handler
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+func svcbValue[T dns.SVCBKeyValue](rr *dns.SVCB) (T, bool) {
+	for _, v := range rr.Value {
+		if t, ok := v.(T); ok {
+			return t, true
+		}
+	}
+	var zero T
+	return zero, false
+}
+
+func Test_EntryHandler_DDR(t *testing.T) {
+	eps := []DDREndpoint{
+		{Target: "dns.example.com", ALPN: []string{"dot"}, Port: 853, Addr: netip.MustParseAddr("192.0.2.1")},
+		{Target: "dns.example.com.", ALPN: []string{"h2"}, Port: 443, DoHPath: "/dns-query{?dns}", Addr: netip.MustParseAddr("2001:db8::1")},
+		{Target: "dns.example.com", ALPN: []string{"doq"}, Port: 853, Addr: netip.IPv4Unspecified()},
+	}
+	var entryCalled bool
+	entry := sequence.ExecutableFunc(func(_ context.Context, qCtx *query_context.Context) error {
+		entryCalled = true
+		r := new(dns.Msg)
+		r.SetReply(qCtx.Q())
+		qCtx.SetResponse(r)
+		return nil
+	})
+	h := NewEntryHandler(EntryHandlerOpts{Entry: entry, DDREndpoints: func() []DDREndpoint { return eps }})
+
+	r := handle(t, h, newQuery("_DNS.Resolver.ARPA.", dns.TypeSVCB), server.QueryMeta{})
+	if entryCalled {
+		t.Fatal("ddr query should not be handled by the entry")
+	}
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != len(eps) {
+		t.Fatalf("invalid ddr response %v", r)
+	}
+	for i, ep := range eps {
+		rr, ok := r.Answer[i].(*dns.SVCB)
+		if !ok {
+			t.Fatalf("#%d: want svcb, got %v", i, r.Answer[i])
+		}
+		if rr.Priority != uint16(i+1) || rr.Target != dns.Fqdn(ep.Target) || rr.Hdr.Ttl != ddrTtl {
+			t.Fatalf("#%d: invalid svcb %v", i, rr)
+		}
+		if alpn, ok := svcbValue[*dns.SVCBAlpn](rr); !ok || len(alpn.Alpn) != 1 || alpn.Alpn[0] != ep.ALPN[0] {
+			t.Fatalf("#%d: want alpn %v, got %v", i, ep.ALPN, rr)
+		}
+		if port, ok := svcbValue[*dns.SVCBPort](rr); !ok || port.Port != ep.Port {
+			t.Fatalf("#%d: want port %d, got %v", i, ep.Port, rr)
+		}
+		dohPath, ok := svcbValue[*dns.SVCBDoHPath](rr)
+		if ok != (len(ep.DoHPath) > 0) || (ok && dohPath.Template != ep.DoHPath) {
+			t.Fatalf("#%d: want dohpath %q, got %v", i, ep.DoHPath, rr)
+		}
+		v4, hasV4 := svcbValue[*dns.SVCBIPv4Hint](rr)
+		v6, hasV6 := svcbValue[*dns.SVCBIPv6Hint](rr)
+		switch {
+		case ep.Addr.IsUnspecified():
+			if hasV4 || hasV6 {
+				t.Fatalf("#%d: unspecified addr should have no hint, got %v", i, rr)
+			}
+		case ep.Addr.Is4():
+			if !hasV4 || hasV6 || !v4.Hint[0].Equal(net.IP(ep.Addr.AsSlice())) {
+				t.Fatalf("#%d: want ipv4 hint %s, got %v", i, ep.Addr, rr)
+			}
+		default:
+			if hasV4 || !hasV6 || !v6.Hint[0].Equal(net.IP(ep.Addr.AsSlice())) {
+				t.Fatalf("#%d: want ipv6 hint %s, got %v", i, ep.Addr, rr)
+			}
+		}
+	}
+
+	// Other queries and ddr queries without endpoints go to the entry.
+	tests := []struct {
+		name string
+		h    *EntryHandler
+		q    *dns.Msg
+	}{
+		{name: "other type", h: h, q: newQuery(ddrName, dns.TypeA)},
+		{name: "other name", h: h, q: newQuery("example.com.", dns.TypeSVCB)},
+		{name: "no endpoints", h: NewEntryHandler(EntryHandlerOpts{Entry: entry, DDREndpoints: func() []DDREndpoint { return nil }}), q: newQuery(ddrName, dns.TypeSVCB)},
+		{name: "no ddr", h: NewEntryHandler(EntryHandlerOpts{Entry: entry}), q: newQuery(ddrName, dns.TypeSVCB)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entryCalled = false
+			r := handle(t, tt.h, tt.q, server.QueryMeta{})
+			if !entryCalled || len(r.Answer) != 0 {
+				t.Fatalf("query should be handled by the entry, got %v", r)
+			}
+		})
+	}
+}
@@ -21,6 +21,8 @@ package server_handler
 
 import (
 	"context"
+	"errors"
+	"net"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/mlog"
@@ -60,6 +62,14 @@ type EntryHandlerOpts struct {
 	// QueryTimeout limits the timeout value of each query.
 	// Default is defaultQueryTimeout.
 	QueryTimeout time.Duration
+
+	// Cookies enables server cookies. Optional.
+	Cookies *Cookies
+
+	// DDREndpoints returns the encrypted endpoints that will be used to
+	// answer the DDR query (_dns.resolver.arpa SVCB). If it is nil or
+	// returns nothing, the query will be handled by the entry. Optional.
+	DDREndpoints func() []DDREndpoint
 }
 
 func (opts *EntryHandlerOpts) init() {
@@ -83,9 +93,21 @@ func NewEntryHandler(opts EntryHandlerOpts) *EntryHandler {
 // ServeDNS implements server.Handler.
 // If entry returns an error, a SERVFAIL response will be returned.
 // If entry returns without a response, a REFUSED response will be returned.
+// If the query is dropped, no response will be returned.
+// If Cookies is set and the query has a malformed cookie, a FORMERR
+// response will be returned.
+// DDR queries are answered without the entry if DDREndpoints is set.
 func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server.QueryMeta, packMsgPayload func(m *dns.Msg) (*[]byte, error)) *[]byte {
 	// basic query check.
-	if q.Response || len(q.Question) != 1 || len(q.Answer)+len(q.Ns) > 0 || len(q.Extra) > 1 {
+	if q.Response || len(q.Question) != 1 || len(q.Extra) > 1 {
+		return nil
+	}
+	// NOTIFY messages may have the new SOA in the answer section.
+	if len(q.Answer) > 0 && !(q.Opcode == dns.OpcodeNotify && len(q.Answer) == 1) {
+		return nil
+	}
+	// IXFR queries have the client's SOA in the authority section.
+	if len(q.Ns) > 0 && !(q.Question[0].Qtype == dns.TypeIXFR && len(q.Ns) == 1) {
 		return nil
 	}
 
@@ -96,15 +118,30 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 	qCtx := query_context.NewContext(q)
 	qCtx.ServerMeta = serverMeta
 
+	var cs cookieState
+	if h.opts.Cookies != nil {
+		cs = h.opts.Cookies.check(qCtx)
+	}
+
 	// exec entry
-	err := h.opts.Entry.Exec(ctx, qCtx)
+	var err error
 	var resp *dns.Msg
-	if err != nil {
+	if cs.malformed {
+		resp = new(dns.Msg)
+		resp.SetReply(q)
+		resp.Rcode = dns.RcodeFormatError
+	} else if r := h.ddrResponse(q); r != nil {
+		resp = r
+	} else if err = h.opts.Entry.Exec(ctx, qCtx); err != nil {
 		h.opts.Logger.Warn("entry err", qCtx.InfoField(), zap.Error(err))
 		resp = new(dns.Msg)
 		resp.SetReply(q)
 		resp.Rcode = dns.RcodeServerFailure
+		qCtx.AddEDE(errEDECode(err), "")
 	} else {
+		if qCtx.Dropped() {
+			return nil
+		}
 		resp = qCtx.R()
 	}
 
@@ -112,6 +149,7 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 		resp = new(dns.Msg)
 		resp.SetReply(q)
 		resp.Rcode = dns.RcodeRefused
+		qCtx.AddEDE(dns.ExtendedErrorCodeProhibited, "no response")
 	}
 	// We assume that our server is a forwarder.
 	resp.RecursionAvailable = true
@@ -121,12 +159,21 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 		resp.Extra = append(resp.Extra, respOpt)
 	}
 
+	if h.opts.Cookies != nil && !cs.malformed {
+		resp = h.opts.Cookies.apply(qCtx, resp, cs)
+	}
+
 	if serverMeta.FromUDP {
 		udpSize := getValidUDPSize(qCtx.ClientOpt())
 		resp.Truncate(udpSize)
 	}
 
-	payload, err := packMsgPayload(resp)
+	var payload *[]byte
+	if serverMeta.FromTCP && isXfr(q) {
+		payload, err = packXfr(resp, packMsgPayload)
+	} else {
+		payload, err = packMsgPayload(resp)
+	}
 	if err != nil {
 		h.opts.Logger.Error("internal err: failed to pack resp msg", qCtx.InfoField(), zap.Error(err))
 		return nil
@@ -134,6 +181,19 @@ func (h *EntryHandler) Handle(ctx context.Context, q *dns.Msg, serverMeta server
 	return payload
 }
 
+// errEDECode returns the extended dns error code of an entry error.
+func errEDECode(err error) uint16 {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return dns.ExtendedErrorCodeNoReachableAuthority
+	case errors.As(err, &netErr):
+		return dns.ExtendedErrorCodeNetworkError
+	default:
+		return dns.ExtendedErrorCodeOther
+	}
+}
+
 // opt can be nil.
 func getValidUDPSize(opt *dns.OPT) int {
 	var s uint16
@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+)
+
+// handle sends q to h and returns the unpacked response. It returns
+// nil if h does not reply.
+func handle(t *testing.T, h *EntryHandler, q *dns.Msg, meta server.QueryMeta) *dns.Msg {
+	t.Helper()
+	b := h.Handle(context.Background(), q, meta, pool.PackBuffer)
+	if b == nil {
+		return nil
+	}
+	defer pool.ReleaseBuf(b)
+	r := new(dns.Msg)
+	if err := r.Unpack(*b); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func newQuery(name string, qt uint16) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qt)
+	q.SetEdns0(1232, false)
+	return q
+}
+
+func edeCodes(r *dns.Msg) []uint16 {
+	var codes []uint16
+	if opt := r.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ede, ok := o.(*dns.EDNS0_EDE); ok {
+				codes = append(codes, ede.InfoCode)
+			}
+		}
+	}
+	return codes
+}
+
+func Test_errEDECode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want uint16
+	}{
+		{err: context.DeadlineExceeded, want: dns.ExtendedErrorCodeNoReachableAuthority},
+		{err: fmt.Errorf("upstream failed, %w", context.DeadlineExceeded), want: dns.ExtendedErrorCodeNoReachableAuthority},
+		{err: &net.OpError{Op: "dial", Err: errors.New("refused")}, want: dns.ExtendedErrorCodeNetworkError},
+		{err: errors.New("other"), want: dns.ExtendedErrorCodeOther},
+	}
+	for _, tt := range tests {
+		if got := errEDECode(tt.err); got != tt.want {
+			t.Fatalf("%v: want %d, got %d", tt.err, tt.want, got)
+		}
+	}
+}
+
+func Test_EntryHandler_EDE(t *testing.T) {
+	tests := []struct {
+		name      string
+		entry     sequence.ExecutableFunc
+		wantRcode int
+		wantEDE   []uint16
+	}{
+		{
+			name: "entry err",
+			entry: func(context.Context, *query_context.Context) error {
+				return &net.OpError{Op: "read", Err: errors.New("reset")}
+			},
+			wantRcode: dns.RcodeServerFailure,
+			wantEDE:   []uint16{dns.ExtendedErrorCodeNetworkError},
+		},
+		{
+			name:      "no response",
+			entry:     func(context.Context, *query_context.Context) error { return nil },
+			wantRcode: dns.RcodeRefused,
+			wantEDE:   []uint16{dns.ExtendedErrorCodeProhibited},
+		},
+		{
+			name: "response",
+			entry: func(_ context.Context, qCtx *query_context.Context) error {
+				r := new(dns.Msg)
+				r.SetReply(qCtx.Q())
+				qCtx.SetResponse(r)
+				return nil
+			},
+			wantRcode: dns.RcodeSuccess,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewEntryHandler(EntryHandlerOpts{Entry: tt.entry})
+			r := handle(t, h, newQuery("example.com.", dns.TypeA), server.QueryMeta{})
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("want rcode %d, got %d", tt.wantRcode, r.Rcode)
+			}
+			if got := edeCodes(r); fmt.Sprint(got) != fmt.Sprint(tt.wantEDE) {
+				t.Fatalf("want ede %v, got %v", tt.wantEDE, got)
+			}
+		})
+	}
+}
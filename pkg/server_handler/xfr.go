@@ -0,0 +1,86 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_handler
+
+import (
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+// xfrMsgSize is the target size of each message of a zone transfer response.
+const xfrMsgSize = 16 * 1024
+
+func isXfr(q *dns.Msg) bool {
+	t := q.Question[0].Qtype
+	return t == dns.TypeAXFR || t == dns.TypeIXFR
+}
+
+// packXfr splits a zone transfer response r into messages that are not
+// larger than xfrMsgSize, and packs them into one payload. See RFC 5936 2.2.
+// packMsgPayload must pack messages with a length header.
+func packXfr(r *dns.Msg, packMsgPayload func(m *dns.Msg) (*[]byte, error)) (*[]byte, error) {
+	newMsg := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.MsgHdr = r.MsgHdr
+		m.Compress = true
+		m.Question = r.Question
+		return m
+	}
+	var msgs []*dns.Msg
+	cur := newMsg()
+	cur.Extra = r.Extra
+	size := cur.Len()
+	for _, rr := range r.Answer {
+		l := dns.Len(rr)
+		if len(cur.Answer) > 0 && size+l > xfrMsgSize {
+			msgs = append(msgs, cur)
+			cur = newMsg()
+			size = cur.Len()
+		}
+		cur.Answer = append(cur.Answer, rr)
+		size += l
+	}
+	msgs = append(msgs, cur)
+	if len(msgs) == 1 {
+		return packMsgPayload(r)
+	}
+
+	payloads := make([]*[]byte, 0, len(msgs))
+	defer func() {
+		for _, p := range payloads {
+			pool.ReleaseBuf(p)
+		}
+	}()
+	total := 0
+	for _, m := range msgs {
+		p, err := packMsgPayload(m)
+		if err != nil {
+			return nil, err
+		}
+		payloads = append(payloads, p)
+		total += len(*p)
+	}
+	b := pool.GetBuf(total)
+	off := 0
+	for _, p := range payloads {
+		off += copy((*b)[off:], *p)
+	}
+	return b, nil
+}
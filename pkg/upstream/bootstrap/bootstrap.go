@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"net"
 	"net/netip"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -38,31 +39,45 @@ const (
 	minimumUpdateInterval = time.Minute * 5
 	retryInterval         = time.Second * 2
 	queryTimeout          = time.Second * 5
+
+	// resolutionDelay is the time to wait for the AAAA answer once the
+	// A answer arrived. See RFC 8305 3.
+	resolutionDelay = time.Millisecond * 50
 )
 
+// VerDualStack is the bootstrap version that resolves both A and AAAA.
+const VerDualStack = 46
+
 var (
 	errNoAddrInResp = errors.New("resp does not have ip address")
 )
 
+// New creates a Bootstrap that resolves host by querying bootstrapServers.
+// bootstrapVer is one of 0 (default, equals 4), 4, 6, VerDualStack.
 func New(
 	host string,
 	port uint16,
-	bootstrapServer netip.AddrPort,
-	bootstrapVer int, // 0,4,6
+	bootstrapServers []netip.AddrPort,
+	bootstrapVer int, // 0,4,6,46
 	logger *zap.Logger, // not nil
 ) (*Bootstrap, error) {
 	dp := new(Bootstrap)
 	dp.fqdn = dns.Fqdn(host)
 	dp.port = port
-	if !bootstrapServer.IsValid() {
-		return nil, errors.New("invalid bootstrap server address")
+	if len(bootstrapServers) == 0 {
+		return nil, errors.New("no bootstrap server")
+	}
+	for _, s := range bootstrapServers {
+		if !s.IsValid() {
+			return nil, errors.New("invalid bootstrap server address")
+		}
+		dp.bootstraps = append(dp.bootstraps, net.UDPAddrFromAddrPort(s))
 	}
-	dp.bootstrap = net.UDPAddrFromAddrPort(bootstrapServer)
-	qt, ok := bootstrapVer2Qt(bootstrapVer)
+	qts, ok := bootstrapVer2Qt(bootstrapVer)
 	if !ok {
 		return nil, fmt.Errorf("invalid bootstrap version %d", bootstrapVer)
 	}
-	dp.qt = qt
+	dp.qts = qts
 	dp.logger = logger
 
 	dp.readyNotify = make(chan struct{})
@@ -70,11 +85,11 @@ func New(
 }
 
 type Bootstrap struct {
-	fqdn      string
-	port      uint16
-	bootstrap *net.UDPAddr
-	qt        uint16      // dns.TypeA or dns.TypeAAAA
-	logger    *zap.Logger // not nil
+	fqdn       string
+	port       uint16
+	bootstraps []*net.UDPAddr
+	qts        []uint16    // dns.TypeA and/or dns.TypeAAAA
+	logger     *zap.Logger // not nil
 
 	updating   atomic.Bool
 	nextUpdate time.Time
@@ -82,22 +97,26 @@ type Bootstrap struct {
 	readyNotify chan struct{}
 	m           sync.Mutex
 	ready       bool
-	addrStr     string
+	addrs       []netip.AddrPort
 }
 
-func (sp *Bootstrap) GetAddrPortStr(ctx context.Context) (string, error) {
+// GetAddrPorts returns all resolved addresses. Families are interleaved
+// and ipv6 goes first, as RFC 8305 4 suggested. The first answered
+// family is available before the other one is resolved.
+// The returned slice must not be modified.
+func (sp *Bootstrap) GetAddrPorts(ctx context.Context) ([]netip.AddrPort, error) {
 	sp.tryUpdate()
 
 	select {
 	case <-ctx.Done():
-		return "", context.Cause(ctx)
+		return nil, context.Cause(ctx)
 	case <-sp.readyNotify:
 	}
 
 	sp.m.Lock()
-	addr := sp.addrStr
+	addrs := sp.addrs
 	sp.m.Unlock()
-	return addr, nil
+	return addrs, nil
 }
 
 func (sp *Bootstrap) tryUpdate() {
@@ -108,7 +127,7 @@ func (sp *Bootstrap) tryUpdate() {
 				ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
 				defer cancel()
 				start := time.Now()
-				addr, ttl, err := sp.updateAddr(ctx)
+				addrs, ttl, err := sp.updateAddr(ctx)
 				if err != nil {
 					sp.logger.Check(zap.WarnLevel, "failed to update bootstrap addr").Write(
 						zap.String("fqdn", sp.fqdn),
@@ -122,7 +141,7 @@ func (sp *Bootstrap) tryUpdate() {
 					}
 					sp.logger.Check(zap.DebugLevel, "bootstrap addr updated").Write(
 						zap.String("fqdn", sp.fqdn),
-						zap.Stringer("addr", addr),
+						zap.Any("addrs", addrs),
 						zap.Duration("ttl", updateInterval),
 						zap.Duration("elapse", time.Since(start)),
 					)
@@ -135,33 +154,140 @@ func (sp *Bootstrap) tryUpdate() {
 	}
 }
 
-func (sp *Bootstrap) updateAddr(ctx context.Context) (netip.Addr, uint32, error) {
-	addr, ttl, err := sp.resolve(ctx, sp.qt)
-	if err != nil {
-		return netip.Addr{}, 0, err
+func (sp *Bootstrap) updateAddr(ctx context.Context) ([]netip.AddrPort, uint32, error) {
+	type res struct {
+		qt    uint16
+		addrs []netip.Addr
+		ttl   uint32
+		err   error
+	}
+	resC := make(chan res, len(sp.qts))
+	for _, qt := range sp.qts {
+		go func(qt uint16) {
+			addrs, ttl, err := sp.resolve(ctx, qt)
+			resC <- res{qt: qt, addrs: addrs, ttl: ttl, err: err}
+		}(qt)
 	}
 
-	addrPort := netip.AddrPortFrom(addr, sp.port).String()
+	// Addresses are published as soon as one family is resolved, so
+	// a slow family won't block the dialers.
+	var v4, v6 []netip.Addr
+	var done4, done6, ok bool
+	var ttl uint32
+	var errs []error
+	var addrs []netip.AddrPort
+	var delayC <-chan time.Time
+	for received := 0; received < len(sp.qts); {
+		select {
+		case r := <-resC:
+			received++
+			if r.qt == dns.TypeA {
+				done4 = true
+			} else {
+				done6 = true
+			}
+			if r.err != nil {
+				errs = append(errs, r.err)
+				if !ok {
+					continue
+				}
+			} else {
+				if !ok || r.ttl < ttl {
+					ttl = r.ttl
+				}
+				ok = true
+				if r.qt == dns.TypeA {
+					v4 = r.addrs
+				} else {
+					v6 = r.addrs
+				}
+				if r.qt == dns.TypeA && received < len(sp.qts) {
+					delayC = time.After(resolutionDelay)
+					continue
+				}
+			}
+		case <-delayC:
+		}
+		delayC = nil
+		addrs = sp.publish(v4, v6, !done4, !done6)
+	}
+	if !ok {
+		return nil, 0, errors.Join(errs...)
+	}
+	return addrs, ttl, nil
+}
+
+// publish stores the addresses. Families that are still being resolved
+// keep their previous addresses if keep4/keep6 is set.
+func (sp *Bootstrap) publish(v4, v6 []netip.Addr, keep4, keep6 bool) []netip.AddrPort {
 	sp.m.Lock()
-	sp.addrStr = addrPort
+	defer sp.m.Unlock()
+	for _, ap := range sp.addrs {
+		if keep4 && ap.Addr().Is4() {
+			v4 = append(v4, ap.Addr())
+		}
+		if keep6 && ap.Addr().Is6() {
+			v6 = append(v6, ap.Addr())
+		}
+	}
+
+	addrs := make([]netip.AddrPort, 0, len(v4)+len(v6))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			addrs = append(addrs, netip.AddrPortFrom(v6[i], sp.port))
+		}
+		if i < len(v4) {
+			addrs = append(addrs, netip.AddrPortFrom(v4[i], sp.port))
+		}
+	}
+	sp.addrs = addrs
 	if !sp.ready {
 		sp.ready = true
 		close(sp.readyNotify)
 	}
-	sp.m.Unlock()
-	return addr, ttl, nil
+	return addrs
 }
 
-func (sp *Bootstrap) resolve(ctx context.Context, qt uint16) (netip.Addr, uint32, error) {
+// resolve queries all bootstrap servers at the same time and returns
+// addresses from the first valid response.
+func (sp *Bootstrap) resolve(ctx context.Context, qt uint16) ([]netip.Addr, uint32, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type res struct {
+		addrs []netip.Addr
+		ttl   uint32
+		err   error
+	}
+	resC := make(chan res, len(sp.bootstraps))
+	for _, server := range sp.bootstraps {
+		go func(server *net.UDPAddr) {
+			addrs, ttl, err := sp.resolveFrom(ctx, server, qt)
+			resC <- res{addrs: addrs, ttl: ttl, err: err}
+		}(server)
+	}
+
+	var errs []error
+	for range sp.bootstraps {
+		r := <-resC
+		if r.err == nil {
+			return r.addrs, r.ttl, nil
+		}
+		errs = append(errs, r.err)
+	}
+	return nil, 0, errors.Join(errs...)
+}
+
+func (sp *Bootstrap) resolveFrom(ctx context.Context, server *net.UDPAddr, qt uint16) ([]netip.Addr, uint32, error) {
 	const edns0UdpSize = 1200
 
 	q := new(dns.Msg)
 	q.SetQuestion(sp.fqdn, qt)
 	q.SetEdns0(edns0UdpSize, false)
 
-	c, err := net.DialUDP("udp", nil, sp.bootstrap)
+	c, err := net.DialUDP("udp", nil, server)
 	if err != nil {
-		return netip.Addr{}, 0, err
+		return nil, 0, err
 	}
 	defer c.Close()
 
@@ -202,16 +328,18 @@ func (sp *Bootstrap) resolve(ctx context.Context, qt uint16) (netip.Addr, uint32
 
 	select {
 	case <-ctx.Done():
-		return netip.Addr{}, 0, context.Cause(ctx)
+		return nil, 0, context.Cause(ctx)
 	case err := <-writeErrC:
-		return netip.Addr{}, 0, fmt.Errorf("failed to write query, %w", err)
+		return nil, 0, fmt.Errorf("failed to write query, %w", err)
 	case r := <-readResC:
 		resp := r.resp
 		err := r.err
 		if err != nil {
-			return netip.Addr{}, 0, fmt.Errorf("failed to read resp, %w", err)
+			return nil, 0, fmt.Errorf("failed to read resp, %w", err)
 		}
 
+		var addrs []netip.Addr
+		var minTTL uint32
 		for _, v := range resp.Answer {
 			var ip net.IP
 			var ttl uint32
@@ -226,23 +354,35 @@ func (sp *Bootstrap) resolve(ctx context.Context, qt uint16) (netip.Addr, uint32
 				continue
 			}
 			addr, ok := netip.AddrFromSlice(ip)
-			if ok {
-				return addr, ttl, nil
+			if !ok {
+				continue
+			}
+			addr = addr.Unmap()
+			if slices.Contains(addrs, addr) {
+				continue
 			}
+			if len(addrs) == 0 || ttl < minTTL {
+				minTTL = ttl
+			}
+			addrs = append(addrs, addr)
 		}
 
-		// No ip addr in resp.
-		return netip.Addr{}, 0, errNoAddrInResp
+		if len(addrs) == 0 {
+			return nil, 0, errNoAddrInResp
+		}
+		return addrs, minTTL, nil
 	}
 }
 
-func bootstrapVer2Qt(ver int) (uint16, bool) {
+func bootstrapVer2Qt(ver int) ([]uint16, bool) {
 	switch ver {
 	case 0, 4:
-		return dns.TypeA, true
+		return []uint16{dns.TypeA}, true
 	case 6:
-		return dns.TypeAAAA, true
+		return []uint16{dns.TypeAAAA}, true
+	case VerDualStack:
+		return []uint16{dns.TypeAAAA, dns.TypeA}, true
 	default:
-		return 0, false
+		return nil, false
 	}
 }
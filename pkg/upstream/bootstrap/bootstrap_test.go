@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package bootstrap
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// newTestServer starts a server that answers AAAA queries after aaaaDelay.
+func newTestServer(t *testing.T, aaaaDelay time.Duration) netip.AddrPort {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dns.Server{PacketConn: c, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		hdr := dns.RR_Header{Name: q.Question[0].Name, Rrtype: q.Question[0].Qtype, Class: dns.ClassINET, Ttl: 300}
+		switch q.Question[0].Qtype {
+		case dns.TypeA:
+			r.Answer = append(r.Answer,
+				&dns.A{Hdr: hdr, A: net.ParseIP("192.0.2.1")},
+				&dns.A{Hdr: hdr, A: net.ParseIP("192.0.2.2")},
+			)
+		case dns.TypeAAAA:
+			time.Sleep(aaaaDelay)
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})
+		}
+		_ = w.WriteMsg(r)
+	})}
+	go s.ActivateAndServe()
+	t.Cleanup(func() { _ = s.Shutdown() })
+	return c.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func TestBootstrap_GetAddrPorts(t *testing.T) {
+	server := newTestServer(t, 0)
+	// A dead server should not block the bootstrap.
+	dead := netip.MustParseAddrPort("127.0.0.1:1")
+
+	tests := []struct {
+		ver  int
+		want []string
+	}{
+		{ver: 0, want: []string{"192.0.2.1:853", "192.0.2.2:853"}},
+		{ver: VerDualStack, want: []string{"[2001:db8::1]:853", "192.0.2.1:853", "192.0.2.2:853"}},
+		{ver: 4, want: []string{"192.0.2.1:853", "192.0.2.2:853"}},
+		{ver: 6, want: []string{"[2001:db8::1]:853"}},
+	}
+	for _, tt := range tests {
+		bs, err := New("example.test", 853, []netip.AddrPort{dead, server}, tt.ver, zap.NewNop())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The first answered family may be published alone.
+		var got []string
+		for deadline := time.Now().Add(time.Second * 3); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+			got = getAddrPorts(t, bs)
+			if slices.Equal(got, tt.want) {
+				break
+			}
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Fatalf("ver %d: want %v, got %v", tt.ver, tt.want, got)
+		}
+	}
+
+	if _, err := New("example.test", 853, nil, 0, zap.NewNop()); err == nil {
+		t.Fatal("want err for empty servers")
+	}
+}
+
+func getAddrPorts(t *testing.T, bs *Bootstrap) []string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	aps, err := bs.GetAddrPorts(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s []string
+	for _, ap := range aps {
+		s = append(s, ap.String())
+	}
+	return s
+}
+
+func TestBootstrap_slowFamily(t *testing.T) {
+	server := newTestServer(t, time.Millisecond*500)
+	bs, err := New("example.test", 853, []netip.AddrPort{server}, VerDualStack, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if got, want := getAddrPorts(t, bs), []string{"192.0.2.1:853", "192.0.2.2:853"}; !slices.Equal(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if time.Since(start) > time.Millisecond*300 {
+		t.Fatal("bootstrap was blocked by the slow family")
+	}
+
+	time.Sleep(time.Millisecond * 700)
+	if got, want := getAddrPorts(t, bs), []string{"[2001:db8::1]:853", "192.0.2.1:853", "192.0.2.2:853"}; !slices.Equal(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	errBadClientCookie = errors.New("response has a mismatched client cookie")
+	errMissingCookie   = errors.New("response has no cookie but the server sent one before")
+)
+
+// clientCookie implements client side dns cookies of an upstream.
+// See RFC 7873 5.1 and 5.3.
+type clientCookie struct {
+	cookie [8]byte
+
+	m            sync.Mutex
+	serverCookie []byte // the last server cookie from the upstream
+}
+
+func newClientCookie() *clientCookie {
+	c := new(clientCookie)
+	_, _ = rand.Read(c.cookie[:])
+	return c
+}
+
+// setCookie replaces the cookie option in opt with our cookie.
+func (c *clientCookie) setCookie(opt *dns.OPT) {
+	c.m.Lock()
+	sc := c.serverCookie
+	c.m.Unlock()
+
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0COOKIE {
+			options = append(options, o)
+		}
+	}
+	opt.Option = append(options, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(c.cookie[:]) + hex.EncodeToString(sc),
+	})
+}
+
+// checkResp verifies the cookie of r and stores its server cookie.
+// Responses without cookies are accepted until a server cookie is learned,
+// the upstream may not support it. See RFC 7873 5.3.
+func (c *clientCookie) checkResp(r *dns.Msg) error {
+	var options []dns.EDNS0
+	if opt := r.IsEdns0(); opt != nil {
+		options = opt.Option
+	}
+	for _, o := range options {
+		co, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		b, err := hex.DecodeString(co.Cookie)
+		if err != nil || len(b) < 16 || len(b) > 40 || !bytes.Equal(b[:8], c.cookie[:]) {
+			return errBadClientCookie
+		}
+		c.m.Lock()
+		c.serverCookie = b[8:]
+		c.m.Unlock()
+		return nil
+	}
+
+	c.m.Lock()
+	learned := len(c.serverCookie) > 0
+	c.m.Unlock()
+	if learned {
+		return errMissingCookie
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testServerCookie = "00112233445566778899aabbccddeeff"
+
+// cookieServer responds BADCOOKIE to udp queries without its server cookie.
+// If spoof is set, a response with a wrong client cookie is sent before
+// each udp response. If strip is set, udp responses have no cookie once
+// the client has the server cookie. If truncate is set, udp responses
+// are truncated.
+type cookieServer struct {
+	spoof    bool
+	strip    bool
+	truncate bool
+	queries  atomic.Int32
+
+	tcpCookie atomic.Value // the cookie of the last tcp query
+}
+
+func (s *cookieServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	s.queries.Add(1)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	var clientCookie string
+	for _, o := range q.IsEdns0().Option {
+		if co, ok := o.(*dns.EDNS0_COOKIE); ok {
+			clientCookie = co.Cookie
+		}
+	}
+	udp := w.LocalAddr().Network() == "udp"
+	if !udp {
+		s.tcpCookie.Store(clientCookie)
+	} else if s.truncate {
+		r.Truncated = true
+	}
+	if udp && !strings.HasSuffix(clientCookie, testServerCookie) {
+		r.Rcode = dns.RcodeBadCookie
+	} else if udp && s.strip {
+		_ = w.WriteMsg(r)
+		return
+	}
+	r.SetEdns0(1232, false)
+	if udp && s.spoof {
+		spoofed := r.Copy()
+		spoofed.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "ffffffffffffffff" + testServerCookie}}
+		_ = w.WriteMsg(spoofed)
+	}
+	opt := r.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: clientCookie[:16] + testServerCookie})
+	_ = w.WriteMsg(r)
+}
+
+// exchangeCookie sends a query to u and checks that the response is
+// successful.
+func exchangeCookie(t *testing.T, u Upstream) {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	b, _ := q.Pack()
+	r, err := u.ExchangeContext(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(*r); err != nil || resp.Rcode != dns.RcodeSuccess || resp.Id != q.Id {
+		t.Fatalf("invalid response %v, %v", resp, err)
+	}
+}
+
+func Test_udpWithFallback_Cookie(t *testing.T) {
+	tests := []struct {
+		name        string
+		s           *cookieServer
+		wantQueries int32
+		wantTCP     bool
+	}{
+		// The first exchange retries with the server cookie. The second
+		// one has it already.
+		{name: "udp", s: &cookieServer{}, wantQueries: 3},
+		// Spoofed responses are discarded and queries are retried over tcp.
+		// The server cookie is learned from the tcp response.
+		{name: "spoofed", s: &cookieServer{spoof: true}, wantQueries: 4, wantTCP: true},
+		// The BADCOOKIE response teaches the server cookie, then the
+		// cookie-less responses are retried over tcp.
+		{name: "stripped", s: &cookieServer{strip: true}, wantQueries: 5, wantTCP: true},
+		// The tcp query has the server cookie from the truncated response.
+		{name: "truncated", s: &cookieServer{truncate: true}, wantQueries: 4, wantTCP: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, shutdown := newUDPTCPTestServer(t, tt.s)
+			defer shutdown()
+			u, err := NewUpstream(addr, Opt{ClientCookie: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.Close()
+
+			for i := 0; i < 2; i++ {
+				exchangeCookie(t, u)
+			}
+			if got := tt.s.queries.Load(); got != tt.wantQueries {
+				t.Fatalf("want %d queries, got %d", tt.wantQueries, got)
+			}
+			c, _ := tt.s.tcpCookie.Load().(string)
+			if tt.wantTCP && !strings.HasSuffix(c, testServerCookie) {
+				t.Fatalf("tcp query should have the server cookie, got %q", c)
+			}
+			if !tt.wantTCP && len(c) > 0 {
+				t.Fatal("unexpected tcp query")
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Certificate layout:
+//
+//	cert-magic (4) | es-version (2) | protocol-minor-version (2) | signature (64) |
+//	resolver-pk (32) | client-magic (8) | serial (4) | ts-start (4) | ts-end (4) | extensions
+//
+// The signature covers everything from resolver-pk to the end.
+const (
+	certMagic     = "DNSC"
+	certMinLen    = 124
+	certSignedOff = 72
+
+	clientMagicSize = 8
+)
+
+// resolverMagic is the prefix of encrypted responses.
+var resolverMagic = [8]byte{0x72, 0x36, 0x66, 0x6e, 0x76, 0x57, 0x6a, 0x38}
+
+type cert struct {
+	es          uint16
+	resolverPk  [keySize]byte
+	clientMagic [clientMagicSize]byte
+	serial      uint32
+	notBefore   time.Time
+	notAfter    time.Time
+}
+
+// parseCert parses and verifies a certificate with the provider public key.
+func parseCert(b []byte, providerPk ed25519.PublicKey) (*cert, error) {
+	if len(b) < certMinLen {
+		return nil, fmt.Errorf("cert is too short, length %d", len(b))
+	}
+	if string(b[:4]) != certMagic {
+		return nil, errors.New("invalid cert magic")
+	}
+	c := &cert{es: binary.BigEndian.Uint16(b[4:6])}
+	if !validES(c.es) {
+		return nil, fmt.Errorf("unsupported encryption system %d", c.es)
+	}
+	if !ed25519.Verify(providerPk, b[certSignedOff:], b[8:certSignedOff]) {
+		return nil, errors.New("invalid cert signature")
+	}
+	copy(c.resolverPk[:], b[72:104])
+	copy(c.clientMagic[:], b[104:112])
+	c.serial = binary.BigEndian.Uint32(b[112:116])
+	c.notBefore = time.Unix(int64(binary.BigEndian.Uint32(b[116:120])), 0)
+	c.notAfter = time.Unix(int64(binary.BigEndian.Uint32(b[120:124])), 0)
+	return c, nil
+}
+
+func (c *cert) valid(now time.Time) bool {
+	return !now.Before(c.notBefore) && now.Before(c.notAfter)
+}
+
+// betterThan reports whether c should be preferred over o.
+// Newer serial wins, then the stronger encryption system.
+func (c *cert) betterThan(o *cert) bool {
+	if o == nil {
+		return true
+	}
+	if c.serial != o.serial {
+		return c.serial > o.serial
+	}
+	return c.es > o.es
+}
+
+// unescapeTXT reverses the escaping of miekg/dns on TXT strings,
+// so binary certificates can be recovered.
+func unescapeTXT(s string) ([]byte, error) {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return nil, errors.New("invalid txt escape")
+		}
+		if s[i] >= '0' && s[i] <= '9' {
+			if i+3 > len(s) {
+				return nil, errors.New("invalid txt escape")
+			}
+			n, err := strconv.ParseUint(s[i:i+3], 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid txt escape, %w", err)
+			}
+			b = append(b, byte(n))
+			i += 2
+			continue
+		}
+		b = append(b, s[i])
+	}
+	return b, nil
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// maxPendingQueries limits the number of nonces that are waiting for their
+// responses in a cryptConn. Queries that were never answered leave their
+// nonces, so all nonces are dropped if there are too many.
+const maxPendingQueries = 8192
+
+var errNoSession = errors.New("dnscrypt session is invalidated")
+
+// cryptConn wraps a udp connection. It encrypts queries with the current
+// session of the Upstream and decrypts responses, so it can be used by
+// transport.TraditionalDnsConn.
+type cryptConn struct {
+	net.Conn
+	u    *Upstream
+	rbuf []byte
+
+	m       sync.Mutex
+	pending map[[nonceSize / 2]byte]*session // client nonce -> the session that sent it
+}
+
+func newCryptConn(u *Upstream, c net.Conn) *cryptConn {
+	return &cryptConn{
+		Conn:    c,
+		u:       u,
+		rbuf:    make([]byte, dns.MaxMsgSize),
+		pending: make(map[[nonceSize / 2]byte]*session),
+	}
+}
+
+// Write encrypts q and sends it in one packet.
+func (c *cryptConn) Write(q []byte) (int, error) {
+	s := c.u.s.Load()
+	if s == nil {
+		return 0, errNoSession
+	}
+	b, nonce, err := encryptQuery(s, q, minUDPQueryLen)
+	if err != nil {
+		return 0, err
+	}
+	var cn [nonceSize / 2]byte
+	copy(cn[:], nonce[:])
+	c.m.Lock()
+	if len(c.pending) >= maxPendingQueries {
+		clear(c.pending)
+	}
+	c.pending[cn] = s
+	c.m.Unlock()
+
+	if _, err := c.Conn.Write(b); err != nil {
+		return 0, err
+	}
+	return len(q), nil
+}
+
+// Read reads a response and decrypts it into p. Responses that don't
+// match any pending query are ignored. If a response cannot be decrypted,
+// the session is invalidated and an error is returned.
+func (c *cryptConn) Read(p []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(c.rbuf)
+		if err != nil {
+			return 0, err
+		}
+		resp := c.rbuf[:n]
+		if len(resp) < len(resolverMagic)+nonceSize {
+			continue
+		}
+		var cn [nonceSize / 2]byte
+		copy(cn[:], resp[len(resolverMagic):])
+		c.m.Lock()
+		s := c.pending[cn]
+		delete(c.pending, cn)
+		c.m.Unlock()
+		if s == nil {
+			continue
+		}
+
+		var nonce [nonceSize]byte
+		copy(nonce[:], cn[:])
+		m, err := openResponse(s, &nonce, resp)
+		if err != nil {
+			c.u.invalidateSession(s)
+			return 0, err
+		}
+		return copy(p, m), nil
+	}
+}
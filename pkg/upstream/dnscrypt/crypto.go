@@ -0,0 +1,169 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/poly1305"
+)
+
+// Encryption systems.
+const (
+	esXSalsa20Poly1305  uint16 = 0x0001
+	esXChacha20Poly1305 uint16 = 0x0002
+)
+
+const (
+	keySize   = 32
+	nonceSize = 24
+	tagSize   = poly1305.TagSize
+
+	// Queries are padded to a multiple of paddingBlockSize.
+	paddingBlockSize = 64
+)
+
+var errDecrypt = errors.New("failed to decrypt message")
+
+func validES(es uint16) bool {
+	return es == esXSalsa20Poly1305 || es == esXChacha20Poly1305
+}
+
+// newKeyPair generates a X25519 key pair.
+func newKeyPair() (pk, sk [keySize]byte, err error) {
+	if _, err = rand.Read(sk[:]); err != nil {
+		return
+	}
+	p, err := curve25519.X25519(sk[:], curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+	copy(pk[:], p)
+	return
+}
+
+// sharedKey computes the shared key of es from our secret key
+// and the peer's public key.
+func sharedKey(es uint16, sk, peerPk *[keySize]byte) ([keySize]byte, error) {
+	var k [keySize]byte
+	switch es {
+	case esXSalsa20Poly1305:
+		box.Precompute(&k, peerPk, sk)
+	case esXChacha20Poly1305:
+		s, err := curve25519.X25519(sk[:], peerPk[:])
+		if err != nil {
+			return k, err
+		}
+		hk, err := chacha20.HChaCha20(s, make([]byte, 16))
+		if err != nil {
+			return k, err
+		}
+		copy(k[:], hk)
+	default:
+		return k, fmt.Errorf("unsupported encryption system %d", es)
+	}
+	if subtle.ConstantTimeCompare(k[:], make([]byte, keySize)) == 1 {
+		return k, errors.New("weak public key")
+	}
+	return k, nil
+}
+
+// seal appends the encrypted and authenticated msg to out.
+// Both systems use the NaCl secretbox construction (tag || ciphertext).
+func seal(es uint16, out []byte, nonce *[nonceSize]byte, msg []byte, key *[keySize]byte) []byte {
+	if es == esXSalsa20Poly1305 {
+		return secretbox.Seal(out, msg, nonce, key)
+	}
+
+	// XChaCha20 keystream: the first 32 bytes are the poly1305 key,
+	// the rest encrypts the message.
+	buf := make([]byte, keySize+len(msg))
+	copy(buf[keySize:], msg)
+	c, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	c.XORKeyStream(buf, buf)
+
+	var polyKey [keySize]byte
+	copy(polyKey[:], buf[:keySize])
+	var tag [tagSize]byte
+	poly1305.Sum(&tag, buf[keySize:], &polyKey)
+	out = append(out, tag[:]...)
+	return append(out, buf[keySize:]...)
+}
+
+// open is the reverse of seal.
+func open(es uint16, sealed []byte, nonce *[nonceSize]byte, key *[keySize]byte) ([]byte, error) {
+	if es == esXSalsa20Poly1305 {
+		m, ok := secretbox.Open(nil, sealed, nonce, key)
+		if !ok {
+			return nil, errDecrypt
+		}
+		return m, nil
+	}
+
+	if len(sealed) < tagSize {
+		return nil, errDecrypt
+	}
+	var tag [tagSize]byte
+	copy(tag[:], sealed[:tagSize])
+	ct := sealed[tagSize:]
+
+	c, _ := chacha20.NewUnauthenticatedCipher(key[:], nonce[:])
+	var polyKey [keySize]byte
+	c.XORKeyStream(polyKey[:], polyKey[:])
+	if !poly1305.Verify(&tag, ct, &polyKey) {
+		return nil, errDecrypt
+	}
+	m := make([]byte, len(ct))
+	c.XORKeyStream(m, ct)
+	return m, nil
+}
+
+// pad pads msg with ISO/IEC 7816-4 padding to a multiple of
+// paddingBlockSize and at least minLen bytes.
+func pad(msg []byte, minLen int) []byte {
+	l := len(msg) + 1
+	l = (l + paddingBlockSize - 1) / paddingBlockSize * paddingBlockSize
+	l = max(l, minLen)
+	b := make([]byte, l)
+	copy(b, msg)
+	b[len(msg)] = 0x80
+	return b
+}
+
+func unpad(b []byte) ([]byte, error) {
+	for i := len(b) - 1; i >= 0; i-- {
+		switch b[i] {
+		case 0x00:
+			continue
+		case 0x80:
+			return b[:i], nil
+		default:
+			return nil, errors.New("invalid padding")
+		}
+	}
+	return nil, errors.New("invalid padding")
+}
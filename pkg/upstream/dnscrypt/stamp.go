@@ -0,0 +1,162 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const stampScheme = "sdns://"
+
+// StampProto is the protocol identifier of a server stamp.
+type StampProto byte
+
+const (
+	StampProtoPlain    StampProto = 0x00
+	StampProtoDNSCrypt StampProto = 0x01
+)
+
+// Stamp properties.
+const (
+	StampPropDNSSEC   uint64 = 1 << 0
+	StampPropNoLog    uint64 = 1 << 1
+	StampPropNoFilter uint64 = 1 << 2
+)
+
+const (
+	defaultPlainPort    = "53"
+	defaultDNSCryptPort = "443"
+)
+
+// Stamp is a DNS server stamp. Only plain and DNSCrypt stamps are supported.
+// See https://dnscrypt.info/stamps-specifications.
+type Stamp struct {
+	Proto StampProto
+	Props uint64
+
+	// ServerAddr is the ip address of the server. If it has no port,
+	// the default port of the protocol is implied.
+	ServerAddr string
+
+	// ProviderPk and ProviderName are for DNSCrypt stamps only.
+	ProviderPk   ed25519.PublicKey
+	ProviderName string
+}
+
+// ParseStamp parses a "sdns://" stamp.
+func ParseStamp(s string) (*Stamp, error) {
+	if !strings.HasPrefix(s, stampScheme) {
+		return nil, errors.New("stamp must start with " + stampScheme)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s[len(stampScheme):])
+	if err != nil {
+		return nil, fmt.Errorf("invalid stamp encoding, %w", err)
+	}
+	if len(b) < 9 {
+		return nil, errors.New("stamp is too short")
+	}
+
+	st := &Stamp{
+		Proto: StampProto(b[0]),
+		Props: binary.LittleEndian.Uint64(b[1:9]),
+	}
+	r := &lpReader{b: b[9:]}
+	switch st.Proto {
+	case StampProtoPlain:
+		st.ServerAddr = string(r.next())
+	case StampProtoDNSCrypt:
+		st.ServerAddr = string(r.next())
+		st.ProviderPk = ed25519.PublicKey(r.next())
+		st.ProviderName = string(r.next())
+		if r.err == nil && len(st.ProviderPk) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid provider public key length %d", len(st.ProviderPk))
+		}
+		if r.err == nil && len(st.ProviderName) == 0 {
+			return nil, errors.New("empty provider name")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported stamp protocol %#x", byte(st.Proto))
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.b) != 0 {
+		return nil, errors.New("stamp has trailing data")
+	}
+	if len(st.ServerAddr) == 0 {
+		return nil, errors.New("empty server address")
+	}
+	return st, nil
+}
+
+// String returns the "sdns://" form of the stamp.
+func (st *Stamp) String() string {
+	b := []byte{byte(st.Proto)}
+	b = binary.LittleEndian.AppendUint64(b, st.Props)
+	b = appendLP(b, []byte(st.ServerAddr))
+	if st.Proto == StampProtoDNSCrypt {
+		b = appendLP(b, st.ProviderPk)
+		b = appendLP(b, []byte(st.ProviderName))
+	}
+	return stampScheme + base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ServerAddrPort returns ServerAddr with the default port if it has no port.
+func (st *Stamp) ServerAddrPort() string {
+	if _, _, err := net.SplitHostPort(st.ServerAddr); err == nil {
+		return st.ServerAddr
+	}
+	port := defaultDNSCryptPort
+	if st.Proto == StampProtoPlain {
+		port = defaultPlainPort
+	}
+	return net.JoinHostPort(strings.Trim(st.ServerAddr, "[]"), port)
+}
+
+// lpReader reads length-prefixed fields.
+type lpReader struct {
+	b   []byte
+	err error
+}
+
+func (r *lpReader) next() []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < 1 || len(r.b) < 1+int(r.b[0]) {
+		r.err = errors.New("stamp is truncated")
+		return nil
+	}
+	l := int(r.b[0])
+	v := r.b[1 : 1+l]
+	r.b = r.b[1+l:]
+	return v
+}
+
+func appendLP(b, v []byte) []byte {
+	b = append(b, byte(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,62 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"testing"
+)
+
+func Test_ParseStamp(t *testing.T) {
+	const adguard = "sdns://AQcAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQzINErR_JS3PLCu_iZEIbq95zkSV2LFsigxDIuUso_OQhzIjIuZG5zY3J5cHQuZGVmYXVsdC5uczEuYWRndWFyZC5jb20"
+	st, err := ParseStamp(adguard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Proto != StampProtoDNSCrypt ||
+		st.Props != StampPropDNSSEC|StampPropNoLog|StampPropNoFilter ||
+		st.ServerAddr != "176.103.130.130:5443" ||
+		len(st.ProviderPk) != 32 ||
+		st.ProviderName != "2.dnscrypt.default.ns1.adguard.com" {
+		t.Fatalf("unexpected stamp %+v", st)
+	}
+	if s := st.String(); s != adguard {
+		t.Fatalf("String() = %s", s)
+	}
+
+	plain := &Stamp{Proto: StampProtoPlain, ServerAddr: "[2001:db8::1]"}
+	st, err = ParseStamp(plain.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ap := st.ServerAddrPort(); ap != "[2001:db8::1]:53" {
+		t.Fatalf("ServerAddrPort() = %s", ap)
+	}
+
+	for _, s := range []string{
+		"https://example.com",
+		"sdns://!!!",
+		"sdns://AQcAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQzINErR_JS3PLCu_iZ", // truncated
+		"sdns://AgcAAAAAAAAA", // doh, unsupported
+	} {
+		if _, err := ParseStamp(s); err == nil {
+			t.Fatalf("%s: want err", s)
+		}
+	}
+}
@@ -0,0 +1,383 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/transport"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// Certificates are re-fetched after this interval even if they are
+	// still valid, so rotated certificates can be picked up early.
+	certRefreshInterval = time.Hour
+
+	// Queries over udp are padded to at least this size, so responses
+	// are less likely to be truncated.
+	minUDPQueryLen = 256
+
+	sessionFetchTimeout       = time.Second * 5
+	maxConcurrentQueryPreConn = 4096
+)
+
+// Opts are options for NewUpstream.
+type Opts struct {
+	// DialContext dials the server. network is "udp" or "tcp". Required.
+	DialContext func(ctx context.Context, network string) (net.Conn, error)
+
+	Logger *zap.Logger
+}
+
+// Upstream is a DNSCrypt v2 upstream.
+type Upstream struct {
+	providerName string
+	providerPk   ed25519.PublicKey
+	dial         func(ctx context.Context, network string) (net.Conn, error)
+	logger       *zap.Logger
+
+	udp *transport.PipelineTransport
+
+	s  atomic.Pointer[session] // current session, nil if not fetched or invalidated.
+	sf singleflight.Group      // de-duplicates session fetches.
+}
+
+// session contains the current certificate and the client key pair.
+// It is read-only.
+type session struct {
+	cert      *cert
+	pk        [keySize]byte
+	sharedKey [keySize]byte
+	fetchedAt time.Time
+}
+
+// NewUpstream creates a DNSCrypt upstream from a DNSCrypt stamp.
+// Certificates are fetched lazily by the first query.
+func NewUpstream(stamp *Stamp, opts Opts) (*Upstream, error) {
+	if stamp.Proto != StampProtoDNSCrypt {
+		return nil, errors.New("not a dnscrypt stamp")
+	}
+	if opts.DialContext == nil {
+		return nil, errors.New("nil dial func")
+	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	u := &Upstream{
+		providerName: dns.Fqdn(stamp.ProviderName),
+		providerPk:   stamp.ProviderPk,
+		dial:         opts.DialContext,
+		logger:       opts.Logger,
+	}
+	u.udp = transport.NewPipelineTransport(transport.PipelineOpts{
+		DialContext: func(ctx context.Context) (transport.DnsConn, error) {
+			c, err := u.dial(ctx, "udp")
+			if err != nil {
+				return nil, err
+			}
+			to := transport.TraditionalDnsConnOpts{
+				IdleTimeout:        time.Minute * 5,
+				MaxConcurrentQuery: maxConcurrentQueryPreConn,
+			}
+			return transport.NewDnsConn(to, newCryptConn(u, c)), nil
+		},
+		MaxConcurrentQueryWhileDialing: maxConcurrentQueryPreConn,
+		Logger:                         opts.Logger,
+	})
+	return u, nil
+}
+
+func (u *Upstream) ExchangeContext(ctx context.Context, q []byte) (*[]byte, error) {
+	s, err := u.getSession(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get certificate, %w", err)
+	}
+
+	r, err := u.udp.ExchangeContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if !msgTruncated(*r) {
+		return r, nil
+	}
+	pool.ReleaseBuf(r)
+
+	rb, err := u.exchangeTCP(ctx, s, q)
+	if err != nil {
+		if errors.Is(err, errDecrypt) {
+			// The server may have rotated its key. Re-fetch the certificate
+			// next time.
+			u.invalidateSession(s)
+		}
+		return nil, err
+	}
+	if len(rb) < dnsutils.DnsHeaderLen {
+		return nil, dnsutils.ErrPayloadTooSmall
+	}
+	payload := pool.GetBuf(len(rb))
+	copy(*payload, rb)
+	return payload, nil
+}
+
+// Close closes the udp connections of the Upstream.
+func (u *Upstream) Close() error {
+	return u.udp.Close()
+}
+
+// encryptQuery encrypts q with s. q will be padded to at least minLen.
+// It returns the encrypted query and the client nonce.
+func encryptQuery(s *session, q []byte, minLen int) ([]byte, [nonceSize]byte, error) {
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:nonceSize/2]); err != nil {
+		return nil, nonce, err
+	}
+	b := make([]byte, 0, clientMagicSize+keySize+nonceSize/2+tagSize+len(q)+paddingBlockSize+minLen)
+	b = append(b, s.cert.clientMagic[:]...)
+	b = append(b, s.pk[:]...)
+	b = append(b, nonce[:nonceSize/2]...)
+	b = seal(s.cert.es, b, &nonce, pad(q, minLen), &s.sharedKey)
+	return b, nonce, nil
+}
+
+// exchangeTCP sends q over a new tcp connection. It is only used when the
+// udp response was truncated.
+func (u *Upstream) exchangeTCP(ctx context.Context, s *session, q []byte) ([]byte, error) {
+	b, nonce, err := encryptQuery(s, q, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.roundTrip(ctx, "tcp", b)
+	if err != nil {
+		return nil, err
+	}
+	return openResponse(s, &nonce, resp)
+}
+
+// openResponse decrypts the response of a query that was sent with nonce.
+func openResponse(s *session, nonce *[nonceSize]byte, resp []byte) ([]byte, error) {
+	if len(resp) < len(resolverMagic)+nonceSize+tagSize {
+		return nil, fmt.Errorf("response is too short, %w", errDecrypt)
+	}
+	if !bytes.Equal(resp[:len(resolverMagic)], resolverMagic[:]) {
+		return nil, fmt.Errorf("invalid resolver magic, %w", errDecrypt)
+	}
+	resp = resp[len(resolverMagic):]
+	if !bytes.Equal(resp[:nonceSize/2], nonce[:nonceSize/2]) {
+		return nil, fmt.Errorf("unexpected nonce, %w", errDecrypt)
+	}
+	var respNonce [nonceSize]byte
+	copy(respNonce[:], resp[:nonceSize])
+	m, err := open(s.cert.es, resp[nonceSize:], &respNonce, &s.sharedKey)
+	if err != nil {
+		return nil, err
+	}
+	return unpad(m)
+}
+
+// roundTrip sends b to the server and reads one reply.
+func (u *Upstream) roundTrip(ctx context.Context, network string, b []byte) ([]byte, error) {
+	c, err := u.dial(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if ddl, ok := ctx.Deadline(); ok {
+		_ = c.SetDeadline(ddl)
+	}
+	stop := context.AfterFunc(ctx, func() { _ = c.SetDeadline(time.Unix(1, 0)) })
+	defer stop()
+
+	if network != "tcp" {
+		if _, err := c.Write(b); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, dns.MaxMsgSize)
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	if len(b) > dns.MaxMsgSize {
+		return nil, errors.New("query is too large")
+	}
+	wb := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(wb, uint16(len(b)))
+	copy(wb[2:], b)
+	if _, err := c.Write(wb); err != nil {
+		return nil, err
+	}
+	var h [2]byte
+	if _, err := io.ReadFull(c, h[:]); err != nil {
+		return nil, err
+	}
+	rb := make([]byte, binary.BigEndian.Uint16(h[:]))
+	if _, err := io.ReadFull(c, rb); err != nil {
+		return nil, err
+	}
+	return rb, nil
+}
+
+// getSession returns the current session. If the session needs a
+// refresh but is still valid, it is returned and refreshed in background.
+func (u *Upstream) getSession(ctx context.Context) (*session, error) {
+	now := time.Now()
+	s := u.s.Load()
+	if s != nil && s.cert.valid(now) {
+		if now.Sub(s.fetchedAt) >= certRefreshInterval {
+			u.sf.DoChan("", u.updateSession)
+		}
+		return s, nil
+	}
+
+	select {
+	case res := <-u.sf.DoChan("", u.updateSession):
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*session), nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// updateSession fetches a new session. If it failed, the old session will
+// be kept until it expires.
+func (u *Upstream) updateSession() (any, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionFetchTimeout)
+	defer cancel()
+
+	old := u.s.Load()
+	s, err := u.fetchSession(ctx)
+	now := time.Now()
+	if err != nil {
+		if old != nil && old.cert.valid(now) {
+			u.logger.Warn("failed to refresh dnscrypt certificate, keep using the old one", zap.Error(err))
+			s := *old
+			s.fetchedAt = now
+			u.s.CompareAndSwap(old, &s)
+			return &s, nil
+		}
+		return nil, err
+	}
+	if old == nil || old.cert.serial != s.cert.serial {
+		u.logger.Debug(
+			"dnscrypt certificate updated",
+			zap.Uint32("serial", s.cert.serial),
+			zap.Time("not_after", s.cert.notAfter),
+		)
+	}
+	u.s.Store(s)
+	return s, nil
+}
+
+func (u *Upstream) invalidateSession(s *session) {
+	u.s.CompareAndSwap(s, nil)
+}
+
+// fetchSession fetches certificates from the server and creates
+// a session from the best valid one.
+func (u *Upstream) fetchSession(ctx context.Context) (*session, error) {
+	q := new(dns.Msg)
+	q.SetQuestion(u.providerName, dns.TypeTXT)
+	qb, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	rb, err := u.roundTrip(ctx, "udp", qb)
+	if err == nil && msgTruncated(rb) {
+		rb, err = u.roundTrip(ctx, "tcp", qb)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(rb); err != nil {
+		return nil, fmt.Errorf("invalid certificate response, %w", err)
+	}
+	if r.Id != q.Id {
+		return nil, errors.New("certificate response id mismatched")
+	}
+
+	now := time.Now()
+	var best *cert
+	var lastErr error
+	for _, rr := range r.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok || !strings.EqualFold(txt.Hdr.Name, u.providerName) {
+			continue
+		}
+		b, err := unescapeTXT(strings.Join(txt.Txt, ""))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c, err := parseCert(b, u.providerPk)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !c.valid(now) {
+			lastErr = fmt.Errorf("certificate %d is not valid now", c.serial)
+			continue
+		}
+		if c.betterThan(best) {
+			best = c
+		}
+	}
+	if best == nil {
+		if lastErr != nil {
+			return nil, lastErr
+		}
+		return nil, errors.New("no certificate")
+	}
+
+	pk, sk, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	k, err := sharedKey(best.es, &sk, &best.resolverPk)
+	if err != nil {
+		return nil, err
+	}
+	return &session{cert: best, pk: pk, sharedKey: k, fetchedAt: now}, nil
+}
+
+func msgTruncated(b []byte) bool {
+	return len(b) > 2 && b[2]&(1<<1) != 0
+}
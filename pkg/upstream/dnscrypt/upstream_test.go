@@ -0,0 +1,392 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnscrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+const testProviderName = "2.dnscrypt-cert.example.test."
+
+// testServer is a minimal DNSCrypt server. It answers A queries with
+// 127.0.0.1 and truncates udp responses of "tc.example.test.".
+type testServer struct {
+	providerPk ed25519.PublicKey
+	providerSk ed25519.PrivateKey
+
+	udp net.PacketConn
+	tcp net.Listener
+
+	m           sync.Mutex
+	certs       [][]byte
+	keys        map[[clientMagicSize]byte]*serverKey // client magic -> resolver key
+	certQueries int
+}
+
+type serverKey struct {
+	es uint16
+	sk [keySize]byte
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{
+		providerPk: pk,
+		providerSk: sk,
+		udp:        udp,
+		tcp:        tcp,
+		keys:       make(map[[clientMagicSize]byte]*serverKey),
+	}
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+// setCerts replaces server certificates with new keys.
+func (s *testServer) setCerts(t *testing.T, certs ...*cert) {
+	t.Helper()
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.certs = nil
+	s.keys = make(map[[clientMagicSize]byte]*serverKey)
+	for _, c := range certs {
+		pk, sk, err := newKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.resolverPk = pk
+		if _, err := rand.Read(c.clientMagic[:]); err != nil {
+			t.Fatal(err)
+		}
+		s.keys[c.clientMagic] = &serverKey{es: c.es, sk: sk}
+		s.certs = append(s.certs, marshalCert(c, s.providerSk))
+	}
+}
+
+func (s *testServer) upstream(t *testing.T) *Upstream {
+	t.Helper()
+	stamp := &Stamp{
+		Proto:        StampProtoDNSCrypt,
+		ServerAddr:   s.udp.LocalAddr().String(),
+		ProviderPk:   s.providerPk,
+		ProviderName: testProviderName,
+	}
+	u, err := NewUpstream(stamp, Opts{DialContext: func(ctx context.Context, network string) (net.Conn, error) {
+		addr := s.udp.LocalAddr().String()
+		if network == "tcp" {
+			addr = s.tcp.Addr().String()
+		}
+		return new(net.Dialer).DialContext(ctx, network, addr)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func (s *testServer) serveUDP() {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if r := s.handle(buf[:n], false); r != nil {
+			_, _ = s.udp.WriteTo(r, addr)
+		}
+	}
+}
+
+func (s *testServer) serveTCP() {
+	for {
+		c, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			var h [2]byte
+			if _, err := io.ReadFull(c, h[:]); err != nil {
+				return
+			}
+			b := make([]byte, binary.BigEndian.Uint16(h[:]))
+			if _, err := io.ReadFull(c, b); err != nil {
+				return
+			}
+			if r := s.handle(b, true); r != nil {
+				wb := binary.BigEndian.AppendUint16(nil, uint16(len(r)))
+				_, _ = c.Write(append(wb, r...))
+			}
+		}()
+	}
+}
+
+func (s *testServer) handle(b []byte, isTCP bool) []byte {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var magic [clientMagicSize]byte
+	if len(b) >= clientMagicSize {
+		copy(magic[:], b)
+	}
+	k, encrypted := s.keys[magic]
+	if !encrypted { // Certificate query.
+		q := new(dns.Msg)
+		if err := q.Unpack(b); err != nil || len(q.Question) != 1 || q.Question[0].Name != testProviderName {
+			return nil
+		}
+		s.certQueries++
+		r := new(dns.Msg)
+		r.SetReply(q)
+		for _, c := range s.certs {
+			r.Answer = append(r.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: testProviderName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{escapeTXT(c)},
+			})
+		}
+		rb, _ := r.Pack()
+		return rb
+	}
+
+	if len(b) < clientMagicSize+keySize+nonceSize/2 {
+		return nil
+	}
+	var clientPk [keySize]byte
+	copy(clientPk[:], b[clientMagicSize:])
+	var nonce [nonceSize]byte
+	copy(nonce[:], b[clientMagicSize+keySize:clientMagicSize+keySize+nonceSize/2])
+	key, err := sharedKey(k.es, &k.sk, &clientPk)
+	if err != nil {
+		return nil
+	}
+	m, err := open(k.es, b[clientMagicSize+keySize+nonceSize/2:], &nonce, &key)
+	if err != nil {
+		return nil
+	}
+	m, err = unpad(m)
+	if err != nil {
+		return nil
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	if q.Question[0].Name == "tc.example.test." && !isTCP {
+		r.Truncated = true
+	} else {
+		r.Answer = append(r.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(127, 0, 0, 1),
+		})
+	}
+	rb, _ := r.Pack()
+
+	if _, err := rand.Read(nonce[nonceSize/2:]); err != nil {
+		return nil
+	}
+	out := append([]byte(nil), resolverMagic[:]...)
+	out = append(out, nonce[:]...)
+	return seal(k.es, out, &nonce, pad(rb, 0), &key)
+}
+
+// marshalCert builds and signs a certificate.
+func marshalCert(c *cert, providerSk ed25519.PrivateKey) []byte {
+	b := make([]byte, certMinLen)
+	copy(b, certMagic)
+	binary.BigEndian.PutUint16(b[4:], c.es)
+	copy(b[72:], c.resolverPk[:])
+	copy(b[104:], c.clientMagic[:])
+	binary.BigEndian.PutUint32(b[112:], c.serial)
+	binary.BigEndian.PutUint32(b[116:], uint32(c.notBefore.Unix()))
+	binary.BigEndian.PutUint32(b[120:], uint32(c.notAfter.Unix()))
+	copy(b[8:], ed25519.Sign(providerSk, b[certSignedOff:]))
+	return b
+}
+
+func escapeTXT(b []byte) string {
+	sb := new(strings.Builder)
+	for _, c := range b {
+		fmt.Fprintf(sb, "\\%03d", c)
+	}
+	return sb.String()
+}
+
+func newTestCert(serial uint32, es uint16, notBefore, notAfter time.Time) *cert {
+	return &cert{es: es, serial: serial, notBefore: notBefore, notAfter: notAfter}
+}
+
+func exchangeA(t *testing.T, u *Upstream, name string) *dns.Msg {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	qb, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	rb, err := u.ExchangeContext(ctx, qb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.ReleaseBuf(rb)
+	r := new(dns.Msg)
+	if err := r.Unpack(*rb); err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != q.Id || len(r.Answer) != 1 {
+		t.Fatalf("unexpected response %s", r)
+	}
+	return r
+}
+
+func Test_Upstream(t *testing.T) {
+	now := time.Now()
+	for _, es := range []uint16{esXSalsa20Poly1305, esXChacha20Poly1305} {
+		t.Run(fmt.Sprintf("es_%d", es), func(t *testing.T) {
+			s := newTestServer(t)
+			s.setCerts(t, newTestCert(1, es, now.Add(-time.Hour), now.Add(time.Hour)))
+			u := s.upstream(t)
+			exchangeA(t, u, "example.test.")
+			exchangeA(t, u, "tc.example.test.") // tcp fallback
+		})
+	}
+}
+
+func Test_Upstream_certSelection(t *testing.T) {
+	now := time.Now()
+	s := newTestServer(t)
+	s.setCerts(t,
+		newTestCert(1, esXChacha20Poly1305, now.Add(-time.Hour), now.Add(time.Hour)),
+		newTestCert(2, esXSalsa20Poly1305, now.Add(-time.Hour), now.Add(time.Hour)),
+		newTestCert(2, esXChacha20Poly1305, now.Add(-time.Hour), now.Add(time.Hour)),
+		newTestCert(3, esXChacha20Poly1305, now.Add(-time.Hour*2), now.Add(-time.Hour)), // expired
+	)
+	u := s.upstream(t)
+	exchangeA(t, u, "example.test.")
+	if c := u.s.Load().cert; c.serial != 2 || c.es != esXChacha20Poly1305 {
+		t.Fatalf("unexpected cert, serial %d, es %d", c.serial, c.es)
+	}
+
+	// Certificates signed by others are rejected.
+	s.providerSk = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	s.setCerts(t, newTestCert(4, esXChacha20Poly1305, now.Add(-time.Hour), now.Add(time.Hour)))
+	u = s.upstream(t)
+	if _, err := u.getSession(context.Background()); err == nil {
+		t.Fatal("cert with invalid signature is accepted")
+	}
+}
+
+func Test_Upstream_rotation(t *testing.T) {
+	now := time.Now()
+	s := newTestServer(t)
+	s.setCerts(t, newTestCert(1, esXChacha20Poly1305, now.Add(-time.Hour), now.Add(time.Hour)))
+	u := s.upstream(t)
+	exchangeA(t, u, "example.test.")
+
+	// Server rotates its key, and the old cert expires.
+	s.setCerts(t, newTestCert(2, esXChacha20Poly1305, now.Add(-time.Hour), now.Add(time.Hour)))
+	u.s.Load().cert.notAfter = now
+	exchangeA(t, u, "example.test.")
+	if u.s.Load().cert.serial != 2 {
+		t.Fatalf("cert was not rotated, serial %d", u.s.Load().cert.serial)
+	}
+}
+
+func Test_Upstream_sessionRefresh(t *testing.T) {
+	now := time.Now()
+	s := newTestServer(t)
+	s.setCerts(t, newTestCert(1, esXChacha20Poly1305, now.Add(-time.Hour), now.Add(time.Hour)))
+	u := s.upstream(t)
+	certQueries := func() int {
+		s.m.Lock()
+		defer s.m.Unlock()
+		return s.certQueries
+	}
+
+	// Concurrent queries share one fetch.
+	var wg sync.WaitGroup
+	var failed atomic.Bool
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := u.getSession(context.Background()); err != nil {
+				failed.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+	if failed.Load() || certQueries() != 1 {
+		t.Fatalf("want 1 cert query, got %d, failed %v", certQueries(), failed.Load())
+	}
+
+	// The old session is served while it is being refreshed.
+	old := *u.s.Load()
+	old.fetchedAt = now.Add(-certRefreshInterval)
+	u.s.Store(&old)
+	if got, err := u.getSession(context.Background()); err != nil || got != &old {
+		t.Fatalf("old session should be served, %v", err)
+	}
+	for i := 0; u.s.Load() == &old; i++ {
+		if i > 100 {
+			t.Fatal("session was not refreshed")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if certQueries() != 2 {
+		t.Fatalf("want 2 cert queries, got %d", certQueries())
+	}
+	exchangeA(t, u, "example.test.")
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package doh
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const tlsHandshakeTimeout = time.Second * 3
+
+// NewH2Transport creates a http/2 transport. All connections are
+// dialed by dial, regardless of the request url.
+func NewH2Transport(dial func(ctx context.Context) (net.Conn, error), tlsConfig *tls.Config, idleConnTimeout time.Duration) (*http.Transport, error) {
+	t1 := &http.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) { // overwrite server addr
+			return dial(ctx)
+		},
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: tlsHandshakeTimeout,
+		IdleConnTimeout:     idleConnTimeout,
+
+		// Following opts are for http/1 only.
+		// MaxConnsPerHost:     2,
+		// MaxIdleConnsPerHost: 2,
+	}
+
+	t2, err := http2.ConfigureTransports(t1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upgrade http2 support, %w", err)
+	}
+	t2.MaxHeaderListSize = 4 * 1024
+	t2.MaxReadFrameSize = 16 * 1024
+	t2.ReadIdleTimeout = time.Second * 30
+	t2.PingTimeout = time.Second * 5
+	return t1, nil
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/transport"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	pipelineProbeTimeout = time.Second * 5
+	// pipelineProbeRetryInterval is the minimum interval between two probes
+	// if the previous one could not reach the server.
+	pipelineProbeRetryInterval = time.Second * 10
+
+	// h3FallbackTTL is how long a DoH upstream stays on http/2 after
+	// a http/3 connection failed.
+	h3FallbackTTL = time.Minute * 10
+	// h3AutoDialTimeout limits the quic dial in auto mode, so there is
+	// still time left for the http/2 fallback.
+	h3AutoDialTimeout = time.Second * 2
+)
+
+const (
+	pipelineUnknown int32 = iota
+	pipelineSupported
+	pipelineUnsupported
+)
+
+// autoPipeline uses a PipelineTransport if the server supports query
+// pipelining, otherwise a ReuseConnTransport. The support is detected on
+// first use. Queries use the ReuseConnTransport while the probe is running.
+type autoPipeline struct {
+	p      *transport.PipelineTransport
+	r      *transport.ReuseConnTransport
+	dial   func(ctx context.Context) (transport.NetConn, error)
+	logger *zap.Logger
+
+	state       atomic.Int32
+	probing     atomic.Bool
+	lastProbe   atomic.Int64 // unix nano
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+}
+
+func newAutoPipeline(p *transport.PipelineTransport, r *transport.ReuseConnTransport, dial func(ctx context.Context) (transport.NetConn, error), logger *zap.Logger) *autoPipeline {
+	return &autoPipeline{
+		p:           p,
+		r:           r,
+		dial:        dial,
+		logger:      logger,
+		closeNotify: make(chan struct{}),
+	}
+}
+
+func (u *autoPipeline) ExchangeContext(ctx context.Context, q []byte) (*[]byte, error) {
+	switch u.state.Load() {
+	case pipelineSupported:
+		return u.p.ExchangeContext(ctx, q)
+	case pipelineUnsupported:
+		return u.r.ExchangeContext(ctx, q)
+	}
+	u.tryProbe()
+	return u.r.ExchangeContext(ctx, q)
+}
+
+func (u *autoPipeline) tryProbe() {
+	if time.Since(time.Unix(0, u.lastProbe.Load())) < pipelineProbeRetryInterval {
+		return
+	}
+	if !u.probing.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer u.probing.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), pipelineProbeTimeout)
+		defer cancel()
+		go func() {
+			select {
+			case <-u.closeNotify:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		ok, err := probePipeline(ctx, u.dial)
+		u.lastProbe.Store(time.Now().UnixNano())
+		if err != nil {
+			u.logger.Check(zap.DebugLevel, "failed to probe query pipelining").Write(zap.Error(err))
+			return
+		}
+		if ok {
+			u.state.Store(pipelineSupported)
+			u.logger.Info("server supports query pipelining")
+		} else {
+			u.state.Store(pipelineUnsupported)
+			u.logger.Info("server does not support query pipelining, fallback to connection reuse")
+		}
+	}()
+}
+
+func (u *autoPipeline) Stats() transport.Stats {
+	s := u.p.Stats()
+	s.Add(u.r.Stats())
+	return s
+}
+
+func (u *autoPipeline) Close() error {
+	u.closeOnce.Do(func() { close(u.closeNotify) })
+	u.p.Close()
+	u.r.Close()
+	return nil
+}
+
+// probePipeline sends two queries without waiting for the first response,
+// as RFC 7766 6.2.1.1 suggested, and checks both of them are answered
+// correctly. Responses may be out of order.
+// It returns a non-nil error if the server could not be reached, in which
+// case the result is unknown.
+func probePipeline(ctx context.Context, dial func(ctx context.Context) (transport.NetConn, error)) (bool, error) {
+	c, err := dial(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to dial, %w", err)
+	}
+	defer c.Close()
+	if ddl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(ddl)
+	}
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(time.Now()) })
+	defer stop()
+
+	id := uint16(rand.Uint32())
+	pending := make(map[uint16]struct{}, 2)
+	buf := make([]byte, 0, 64)
+	for i := uint16(0); i < 2; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion(".", dns.TypeNS)
+		q.Id = id + i
+		b, err := q.Pack()
+		if err != nil {
+			return false, err
+		}
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(b)))
+		buf = append(buf, b...)
+		pending[q.Id] = struct{}{}
+	}
+	// Write both queries at once.
+	if _, err := c.Write(buf); err != nil {
+		return false, fmt.Errorf("failed to write probe queries, %w", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		b, err := dnsutils.ReadRawMsgFromTCP(c)
+		if err != nil {
+			if i == 0 {
+				return false, fmt.Errorf("failed to read probe response, %w", err)
+			}
+			// The second query was dropped.
+			return false, nil
+		}
+		ok := checkProbeResp(*b, pending)
+		pool.ReleaseBuf(b)
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func checkProbeResp(b []byte, pending map[uint16]struct{}) bool {
+	r := new(dns.Msg)
+	if err := r.Unpack(b); err != nil {
+		return false
+	}
+	if _, ok := pending[r.Id]; !ok {
+		return false
+	}
+	delete(pending, r.Id)
+	return r.Response && len(r.Question) == 1 && r.Question[0].Name == "." && r.Question[0].Qtype == dns.TypeNS
+}
+
+// h3DialErr indicates the quic connection of a http/3 request could not
+// be established.
+type h3DialErr struct {
+	err error
+}
+
+func (e *h3DialErr) Error() string {
+	return fmt.Sprintf("http3 dial failed, %s", e.err)
+}
+
+func (e *h3DialErr) Unwrap() error {
+	return e.err
+}
+
+// h3Fallback is a http.RoundTripper that sends requests with http/3 and
+// falls back to http/2 if the quic connection could not be established.
+// The fallback is cached for h3FallbackTTL.
+type h3Fallback struct {
+	h3     http.RoundTripper
+	h2     http.RoundTripper
+	logger *zap.Logger
+
+	h2Until atomic.Int64 // unix nano
+}
+
+func (t *h3Fallback) RoundTrip(req *http.Request) (*http.Response, error) {
+	if time.Now().UnixNano() < t.h2Until.Load() {
+		return t.h2.RoundTrip(req)
+	}
+	resp, err := t.h3.RoundTrip(req)
+	if err == nil {
+		return resp, nil
+	}
+	var dialErr *h3DialErr
+	if !errors.As(err, &dialErr) || req.Context().Err() != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if prev := t.h2Until.Swap(now.Add(h3FallbackTTL).UnixNano()); prev < now.UnixNano() {
+		t.logger.Warn("http3 is unavailable, fallback to http2", zap.Error(err))
+	}
+	return t.h2.RoundTrip(req)
+}
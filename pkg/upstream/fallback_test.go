@@ -0,0 +1,211 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/transport"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// newRawTCPTestServer calls serve for every incoming connection.
+func newRawTCPTestServer(t testing.TB, serve func(c net.Conn)) (addr string, shutdownFunc func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				serve(c)
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func Test_probePipeline(t *testing.T) {
+	// Answers the first query only, then closes the connection.
+	oneShot := func(c net.Conn) {
+		q, _, err := dnsutils.ReadMsgFromTCP(c)
+		if err != nil {
+			return
+		}
+		r := new(dns.Msg)
+		r.SetReply(q)
+		dnsutils.WriteMsgToTCP(c, r)
+	}
+	// Answers all queries with a wrong id.
+	badId := func(c net.Conn) {
+		for {
+			q, _, err := dnsutils.ReadMsgFromTCP(c)
+			if err != nil {
+				return
+			}
+			r := new(dns.Msg)
+			r.SetReply(q)
+			r.Id = 0
+			dnsutils.WriteMsgToTCP(c, r)
+		}
+	}
+
+	tcpAddr, shutdown := newTCPTestServer(t, &vServer{})
+	defer shutdown()
+	oneShotAddr, shutdown := newRawTCPTestServer(t, oneShot)
+	defer shutdown()
+	badIdAddr, shutdown := newRawTCPTestServer(t, badId)
+	defer shutdown()
+	noReplyAddr, shutdown := newRawTCPTestServer(t, func(c net.Conn) { io.Copy(io.Discard, c) })
+	defer shutdown()
+
+	tests := []struct {
+		name    string
+		addr    string
+		want    bool
+		wantErr bool
+	}{
+		{name: "pipeline", addr: tcpAddr, want: true},
+		{name: "one shot", addr: oneShotAddr, want: false},
+		{name: "bad id", addr: badIdAddr, want: false},
+		{name: "no reply", addr: noReplyAddr, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dial := func(ctx context.Context) (transport.NetConn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, "tcp", tt.addr)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+			defer cancel()
+			got, err := probePipeline(ctx, dial)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_autoPipeline(t *testing.T) {
+	tcpAddr, shutdown := newTCPTestServer(t, &vServer{})
+	defer shutdown()
+
+	u, err := NewUpstream("tcp://"+tcpAddr, Opt{AutoPipeline: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	ap := u.(*autoPipeline)
+
+	// Queries are answered while the probe is running.
+	if err := testUpstream(u); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 2)
+	for ap.state.Load() == pipelineUnknown {
+		if time.Now().After(deadline) {
+			t.Fatal("probe timed out")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if ap.state.Load() != pipelineSupported {
+		t.Fatal("pipeline should be supported")
+	}
+	if err := testUpstream(u); err != nil {
+		t.Fatal(err)
+	}
+	if ap.p.Stats().OpenConns == 0 {
+		t.Fatal("pipeline transport is not used")
+	}
+}
+
+type fakeRoundTripper struct {
+	name  string
+	err   error
+	calls int
+}
+
+func (f *fakeRoundTripper) RoundTrip(*http.Request) (*http.Response, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(f.name))}, nil
+}
+
+func Test_h3Fallback(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "https://127.0.0.1/dns-query", nil)
+	roundTrip := func(rt http.RoundTripper) (string, error) {
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b), nil
+	}
+
+	// Other errors are not fallen back.
+	h3 := &fakeRoundTripper{name: "h3", err: errors.New("stream reset")}
+	h2 := &fakeRoundTripper{name: "h2"}
+	rt := &h3Fallback{h3: h3, h2: h2, logger: zap.NewNop()}
+	if _, err := roundTrip(rt); err == nil {
+		t.Fatal("want error")
+	}
+
+	// Dial error falls back to h2 and the result is cached.
+	h3.err = &h3DialErr{err: errors.New("no recent network activity")}
+	for i := 0; i < 3; i++ {
+		got, err := roundTrip(rt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "h2" {
+			t.Fatalf("want h2, got %s", got)
+		}
+	}
+	if h3.calls != 2 {
+		t.Fatalf("h3 should not be used after the fallback, calls %d", h3.calls)
+	}
+
+	// Retries h3 after the fallback expires.
+	h3.err = nil
+	rt.h2Until.Store(time.Now().Add(-time.Second).UnixNano())
+	if got, _ := roundTrip(rt); got != "h3" {
+		t.Fatalf("want h3, got %s", got)
+	}
+}
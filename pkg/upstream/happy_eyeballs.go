@@ -0,0 +1,113 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// connectionAttemptDelay is the delay between two connection attempts.
+// See RFC 8305 5.
+const connectionAttemptDelay = time.Millisecond * 250
+
+// dialParallel dials addrs one by one with a connectionAttemptDelay
+// interval and returns the first established connection. A new attempt
+// starts immediately if the previous one failed. addrs should already
+// be sorted. (e.g. by bootstrap.Bootstrap)
+func dialParallel(ctx context.Context, addrs []netip.AddrPort, dial func(ctx context.Context, addr string) (net.Conn, error)) (net.Conn, error) {
+	return raceDial(ctx, addrs, func(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
+		return dial(ctx, addr.String())
+	}, func(c net.Conn) { c.Close() })
+}
+
+// raceDial is dialParallel for any kind of connection. Connections
+// that lose the race are closed by closeConn.
+func raceDial[T any](
+	ctx context.Context,
+	addrs []netip.AddrPort,
+	dial func(ctx context.Context, addr netip.AddrPort) (T, error),
+	closeConn func(c T),
+) (T, error) {
+	var zero T
+	if len(addrs) == 0 {
+		return zero, errors.New("no address to dial")
+	}
+	if len(addrs) == 1 {
+		return dial(ctx, addrs[0])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type res struct {
+		c   T
+		err error
+	}
+	resC := make(chan res)
+	attempt := func(addr netip.AddrPort) {
+		c, err := dial(ctx, addr)
+		select {
+		case resC <- res{c: c, err: err}:
+		case <-ctx.Done():
+			if err == nil {
+				closeConn(c)
+			}
+		}
+	}
+
+	var next, pending int
+	var timerC <-chan time.Time
+	start := func() {
+		go attempt(addrs[next])
+		next++
+		pending++
+		if next < len(addrs) {
+			timerC = time.After(connectionAttemptDelay)
+		} else {
+			timerC = nil
+		}
+	}
+
+	start()
+	var errs []error
+	for {
+		select {
+		case <-ctx.Done():
+			return zero, context.Cause(ctx)
+		case <-timerC:
+			start()
+		case r := <-resC:
+			pending--
+			if r.err == nil {
+				return r.c, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(addrs) {
+				start()
+			} else if pending == 0 {
+				return zero, errors.Join(errs...)
+			}
+		}
+	}
+}
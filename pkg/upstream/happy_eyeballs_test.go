@@ -0,0 +1,111 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func Test_dialParallel(t *testing.T) {
+	a1 := netip.MustParseAddrPort("[2001:db8::1]:53")
+	a2 := netip.MustParseAddrPort("192.0.2.1:53")
+	a3 := netip.MustParseAddrPort("192.0.2.2:53")
+
+	// behaviors of the fake dialer.
+	type behavior struct {
+		delay time.Duration
+		fail  bool
+	}
+	newDial := func(bs map[string]behavior) func(ctx context.Context, addr string) (net.Conn, error) {
+		return func(ctx context.Context, addr string) (net.Conn, error) {
+			b := bs[addr]
+			select {
+			case <-time.After(b.delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if b.fail {
+				return nil, errors.New("dial failed")
+			}
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return &fakeRemoteConn{Conn: c1, addr: addr}, nil
+		}
+	}
+
+	tests := []struct {
+		name     string
+		bs       map[string]behavior
+		want     string
+		wantErr  bool
+		maxDelay time.Duration
+	}{
+		{
+			name: "first ok",
+			bs:   map[string]behavior{},
+			want: a1.String(),
+		},
+		{
+			name:     "first fails, fail over immediately",
+			bs:       map[string]behavior{a1.String(): {fail: true}},
+			want:     a2.String(),
+			maxDelay: connectionAttemptDelay / 2,
+		},
+		{
+			name: "first is slow, second wins the race",
+			bs:   map[string]behavior{a1.String(): {delay: time.Second}},
+			want: a2.String(),
+		},
+		{
+			name:    "all fail",
+			bs:      map[string]behavior{a1.String(): {fail: true}, a2.String(): {fail: true}, a3.String(): {fail: true}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			c, err := dialParallel(context.Background(), []netip.AddrPort{a1, a2, a3}, newDial(tt.bs))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			if got := c.(*fakeRemoteConn).addr; got != tt.want {
+				t.Fatalf("want %s, got %s", tt.want, got)
+			}
+			if tt.maxDelay > 0 && time.Since(start) > tt.maxDelay {
+				t.Fatalf("fail over is too slow, %s", time.Since(start))
+			}
+		})
+	}
+}
+
+type fakeRemoteConn struct {
+	net.Conn
+	addr string
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// HPKE (RFC 9180) algorithm identifiers. Only the base mode with
+// DHKEM(X25519, HKDF-SHA256) and HKDF-SHA256 is implemented.
+const (
+	kemX25519HKDFSHA256 uint16 = 0x0020
+	kdfHKDFSHA256       uint16 = 0x0001
+
+	aeadAES128GCM        uint16 = 0x0001
+	aeadAES256GCM        uint16 = 0x0002
+	aeadChaCha20Poly1305 uint16 = 0x0003
+)
+
+const (
+	hpkeNonceSize = 12
+	hpkeHashSize  = sha256.Size
+	hpkeModeBase  = 0x00
+)
+
+type hpkeSuite struct {
+	kem, kdf, aead uint16
+}
+
+func (s hpkeSuite) supported() bool {
+	return s.kem == kemX25519HKDFSHA256 && s.kdf == kdfHKDFSHA256 && s.keySize() > 0
+}
+
+// keySize returns the key size of the aead. Zero means unsupported.
+func (s hpkeSuite) keySize() int {
+	switch s.aead {
+	case aeadAES128GCM:
+		return 16
+	case aeadAES256GCM, aeadChaCha20Poly1305:
+		return 32
+	}
+	return 0
+}
+
+func (s hpkeSuite) newAEAD(key []byte) (cipher.AEAD, error) {
+	switch s.aead {
+	case aeadAES128GCM, aeadAES256GCM:
+		b, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(b)
+	case aeadChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	}
+	return nil, fmt.Errorf("unsupported aead %#x", s.aead)
+}
+
+func (s hpkeSuite) id() []byte {
+	b := []byte("HPKE")
+	b = binary.BigEndian.AppendUint16(b, s.kem)
+	b = binary.BigEndian.AppendUint16(b, s.kdf)
+	return binary.BigEndian.AppendUint16(b, s.aead)
+}
+
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	b := make([]byte, 0, 7+len(suiteID)+len(label)+len(ikm))
+	b = append(b, "HPKE-v1"...)
+	b = append(b, suiteID...)
+	b = append(b, label...)
+	b = append(b, ikm...)
+	return hkdf.Extract(sha256.New, b, salt)
+}
+
+func labeledExpand(suiteID, prk []byte, label string, info []byte, l int) []byte {
+	b := make([]byte, 0, 9+len(suiteID)+len(label)+len(info))
+	b = binary.BigEndian.AppendUint16(b, uint16(l))
+	b = append(b, "HPKE-v1"...)
+	b = append(b, suiteID...)
+	b = append(b, label...)
+	b = append(b, info...)
+	return expand(prk, b, l)
+}
+
+func expand(prk, info []byte, l int) []byte {
+	out := make([]byte, l)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, info), out); err != nil {
+		panic(err) // l is always small enough.
+	}
+	return out
+}
+
+// hpkeContext is an HPKE encryption context.
+type hpkeContext struct {
+	suite          hpkeSuite
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+	seq            uint64
+}
+
+// setupBaseS sets up a sender context to the receiver public key pkR.
+func setupBaseS(suite hpkeSuite, pkR, info []byte) (enc []byte, c *hpkeContext, err error) {
+	skE, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return setupBaseSWithKey(suite, pkR, info, skE)
+}
+
+func setupBaseSWithKey(suite hpkeSuite, pkR, info []byte, skE *ecdh.PrivateKey) (enc []byte, c *hpkeContext, err error) {
+	pk, err := ecdh.X25519().NewPublicKey(pkR)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid public key, %w", err)
+	}
+	dh, err := skE.ECDH(pk)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc = skE.PublicKey().Bytes()
+	c, err = keySchedule(suite, kemSharedSecret(dh, enc, pkR), info)
+	return enc, c, err
+}
+
+// kemSharedSecret is the ExtractAndExpand of DHKEM.
+func kemSharedSecret(dh, enc, pkR []byte) []byte {
+	kemSuiteID := binary.BigEndian.AppendUint16([]byte("KEM"), kemX25519HKDFSHA256)
+	kemContext := append(append([]byte(nil), enc...), pkR...)
+	prk := labeledExtract(kemSuiteID, nil, "eae_prk", dh)
+	return labeledExpand(kemSuiteID, prk, "shared_secret", kemContext, hpkeHashSize)
+}
+
+func keySchedule(suite hpkeSuite, sharedSecret, info []byte) (*hpkeContext, error) {
+	suiteID := suite.id()
+	ksc := []byte{hpkeModeBase}
+	ksc = append(ksc, labeledExtract(suiteID, nil, "psk_id_hash", nil)...)
+	ksc = append(ksc, labeledExtract(suiteID, nil, "info_hash", info)...)
+	secret := labeledExtract(suiteID, sharedSecret, "secret", nil)
+
+	aead, err := suite.newAEAD(labeledExpand(suiteID, secret, "key", ksc, suite.keySize()))
+	if err != nil {
+		return nil, err
+	}
+	return &hpkeContext{
+		suite:          suite,
+		aead:           aead,
+		baseNonce:      labeledExpand(suiteID, secret, "base_nonce", ksc, hpkeNonceSize),
+		exporterSecret: labeledExpand(suiteID, secret, "exp", ksc, hpkeHashSize),
+	}, nil
+}
+
+func (c *hpkeContext) nonce() []byte {
+	nonce := make([]byte, hpkeNonceSize)
+	binary.BigEndian.PutUint64(nonce[hpkeNonceSize-8:], c.seq)
+	for i := range nonce {
+		nonce[i] ^= c.baseNonce[i]
+	}
+	return nonce
+}
+
+func (c *hpkeContext) seal(aad, pt []byte) []byte {
+	ct := c.aead.Seal(nil, c.nonce(), pt, aad)
+	c.seq++
+	return ct
+}
+
+func (c *hpkeContext) open(aad, ct []byte) ([]byte, error) {
+	pt, err := c.aead.Open(nil, c.nonce(), ct, aad)
+	if err != nil {
+		return nil, err
+	}
+	c.seq++
+	return pt, nil
+}
+
+func (c *hpkeContext) export(exporterContext []byte, l int) []byte {
+	return labeledExpand(c.suite.id(), c.exporterSecret, "sec", exporterContext, l)
+}
@@ -0,0 +1,89 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"testing"
+)
+
+// setupBaseR sets up a receiver context. It is the target side of setupBaseS.
+func setupBaseR(suite hpkeSuite, enc []byte, skR *ecdh.PrivateKey, info []byte) (*hpkeContext, error) {
+	pkE, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+	dh, err := skR.ECDH(pkE)
+	if err != nil {
+		return nil, err
+	}
+	return keySchedule(suite, kemSharedSecret(dh, enc, skR.PublicKey().Bytes()), info)
+}
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// RFC 9180 A.1.1. DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM, base mode.
+func Test_hpke_vector(t *testing.T) {
+	suite := hpkeSuite{kem: kemX25519HKDFSHA256, kdf: kdfHKDFSHA256, aead: aeadAES128GCM}
+	skE, err := ecdh.X25519().NewPrivateKey(mustHex("52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	skR, err := ecdh.X25519().NewPrivateKey(mustHex("4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := mustHex("4f6465206f6e2061204772656369616e2055726e")
+
+	enc, c, err := setupBaseSWithKey(suite, skR.PublicKey().Bytes(), info, skE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := mustHex("37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431"); !bytes.Equal(enc, want) {
+		t.Fatalf("enc: want %x, got %x", want, enc)
+	}
+	if want := mustHex("45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8"); !bytes.Equal(c.exporterSecret, want) {
+		t.Fatalf("exporter_secret: want %x, got %x", want, c.exporterSecret)
+	}
+
+	pt := mustHex("4265617574792069732074727574682c20747275746820626561757479")
+	aad := mustHex("436f756e742d30")
+	ct := c.seal(aad, pt)
+	if want := mustHex("f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a"); !bytes.Equal(ct, want) {
+		t.Fatalf("ct: want %x, got %x", want, ct)
+	}
+
+	r, err := setupBaseR(suite, enc, skR, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.open(aad, ct)
+	if err != nil || !bytes.Equal(got, pt) {
+		t.Fatalf("open failed, %v", err)
+	}
+}
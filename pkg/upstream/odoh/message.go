@@ -0,0 +1,221 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Wire formats of RFC 9230.
+const (
+	odohVersion = 0x0001
+
+	messageTypeQuery    byte = 0x01
+	messageTypeResponse byte = 0x02
+
+	// Queries are padded to a multiple of this size, as RFC 8467 suggested.
+	queryPaddingBlockSize = 128
+)
+
+var (
+	labelQuery      = []byte("odoh query")
+	labelResponse   = []byte("odoh response")
+	labelKeyID      = []byte("odoh key id")
+	labelRespKey    = []byte("odoh key")
+	labelRespNonce  = []byte("odoh nonce")
+	errShortMessage = errors.New("message is too short")
+)
+
+// targetConfig is an ObliviousDoHConfig of the target.
+type targetConfig struct {
+	suite     hpkeSuite
+	publicKey []byte
+	keyID     []byte
+}
+
+// parseConfigs parses ObliviousDoHConfigs and returns the first
+// supported config.
+func parseConfigs(b []byte) (*targetConfig, error) {
+	r := &reader{b: b}
+	configs := &reader{b: r.vec16()}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid configs, %w", r.err)
+	}
+	for len(configs.b) > 0 {
+		version := configs.uint16()
+		contents := configs.vec16()
+		if configs.err != nil {
+			return nil, fmt.Errorf("invalid config, %w", configs.err)
+		}
+		if version != odohVersion {
+			continue
+		}
+		cr := &reader{b: contents}
+		c := &targetConfig{suite: hpkeSuite{kem: cr.uint16(), kdf: cr.uint16(), aead: cr.uint16()}}
+		c.publicKey = cr.vec16()
+		if cr.err != nil {
+			return nil, fmt.Errorf("invalid config contents, %w", cr.err)
+		}
+		if !c.suite.supported() {
+			continue
+		}
+		c.keyID = expand(hkdf.Extract(sha256.New, contents, nil), labelKeyID, hpkeHashSize)
+		return c, nil
+	}
+	return nil, errors.New("no supported config")
+}
+
+// marshalMessage builds an ObliviousDoHMessage.
+func marshalMessage(typ byte, keyID, encrypted []byte) []byte {
+	b := make([]byte, 0, 5+len(keyID)+len(encrypted))
+	b = append(b, typ)
+	b = appendVec16(b, keyID)
+	return appendVec16(b, encrypted)
+}
+
+func parseMessage(b []byte) (typ byte, keyID, encrypted []byte, err error) {
+	if len(b) < 1 {
+		return 0, nil, nil, errShortMessage
+	}
+	r := &reader{b: b[1:]}
+	keyID = r.vec16()
+	encrypted = r.vec16()
+	if r.err == nil && len(r.b) > 0 {
+		r.err = errors.New("message has trailing data")
+	}
+	return b[0], keyID, encrypted, r.err
+}
+
+// marshalPlaintext builds an ObliviousDoHMessagePlaintext.
+func marshalPlaintext(dnsMsg []byte, paddingLen int) []byte {
+	b := make([]byte, 0, 4+len(dnsMsg)+paddingLen)
+	b = appendVec16(b, dnsMsg)
+	b = binary.BigEndian.AppendUint16(b, uint16(paddingLen))
+	return append(b, make([]byte, paddingLen)...)
+}
+
+func parsePlaintext(b []byte) ([]byte, error) {
+	r := &reader{b: b}
+	m := r.vec16()
+	padding := r.vec16()
+	if r.err != nil {
+		return nil, r.err
+	}
+	for _, p := range padding {
+		if p != 0 {
+			return nil, errors.New("invalid padding")
+		}
+	}
+	return m, nil
+}
+
+// queryContext keeps the states that are needed to decrypt the response.
+type queryContext struct {
+	hc        *hpkeContext
+	plaintext []byte
+}
+
+// encryptQuery encrypts a dns query to the target.
+func encryptQuery(c *targetConfig, dnsMsg []byte) ([]byte, *queryContext, error) {
+	l := len(dnsMsg)
+	paddingLen := (l+queryPaddingBlockSize-1)/queryPaddingBlockSize*queryPaddingBlockSize - l
+	plaintext := marshalPlaintext(dnsMsg, paddingLen)
+
+	enc, hc, err := setupBaseS(c.suite, c.publicKey, labelQuery)
+	if err != nil {
+		return nil, nil, err
+	}
+	aad := appendVec16([]byte{messageTypeQuery}, c.keyID)
+	ct := hc.seal(aad, plaintext)
+	return marshalMessage(messageTypeQuery, c.keyID, append(enc, ct...)), &queryContext{hc: hc, plaintext: plaintext}, nil
+}
+
+// responseKey derives the response key and nonce.
+func (q *queryContext) responseKey(respNonce []byte) (key, nonce []byte) {
+	nk := q.hc.suite.keySize()
+	secret := q.hc.export(labelResponse, nk)
+	salt := appendVec16(append([]byte(nil), q.plaintext...), respNonce)
+	prk := hkdf.Extract(sha256.New, secret, salt)
+	return expand(prk, labelRespKey, nk), expand(prk, labelRespNonce, hpkeNonceSize)
+}
+
+// decryptResponse decrypts an ObliviousDoHMessage response.
+func (q *queryContext) decryptResponse(b []byte) ([]byte, error) {
+	typ, respNonce, ct, err := parseMessage(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response message, %w", err)
+	}
+	if typ != messageTypeResponse {
+		return nil, fmt.Errorf("unexpected message type %d", typ)
+	}
+	key, nonce := q.responseKey(respNonce)
+	aead, err := q.hc.suite.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	aad := appendVec16([]byte{messageTypeResponse}, respNonce)
+	pt, err := aead.Open(nil, nonce, ct, aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt response, %w", err)
+	}
+	return parsePlaintext(pt)
+}
+
+func appendVec16(b, v []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(v)))
+	return append(b, v...)
+}
+
+type reader struct {
+	b   []byte
+	err error
+}
+
+func (r *reader) uint16() uint16 {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) < 2 {
+		r.err = errShortMessage
+		return 0
+	}
+	v := binary.BigEndian.Uint16(r.b)
+	r.b = r.b[2:]
+	return v
+}
+
+func (r *reader) vec16() []byte {
+	l := int(r.uint16())
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < l {
+		r.err = errShortMessage
+		return nil
+	}
+	v := r.b[:l]
+	r.b = r.b[l:]
+	return v
+}
@@ -0,0 +1,269 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	urlpkg "net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultODoHTimeout = time.Second * 6
+
+	// Target configs are re-fetched after this interval.
+	configRefreshInterval = time.Hour
+
+	configPath  = "/.well-known/odohconfigs"
+	contentType = "application/oblivious-dns-message"
+)
+
+var errConfigRejected = errors.New("target rejected the config key")
+
+// Upstream is an Oblivious DNS over HTTPS (RFC 9230) upstream.
+// Queries are encrypted to the target and sent through the proxy.
+// Target configs are also fetched through the proxy.
+type Upstream struct {
+	proxyURL       string // With target query parameters.
+	proxyConfigURL string // With target config query parameters.
+	rt             http.RoundTripper
+	logger         *zap.Logger
+
+	c  atomic.Pointer[fetchedConfig] // nil if not fetched or invalidated.
+	sf singleflight.Group            // de-duplicates config fetches.
+}
+
+type fetchedConfig struct {
+	config    *targetConfig
+	fetchedAt time.Time
+}
+
+// NewUpstream creates an ODoH upstream. target and proxy are https urls.
+// rt is used to connect to the proxy.
+func NewUpstream(target, proxy string, rt http.RoundTripper, logger *zap.Logger) (*Upstream, error) {
+	tu, err := urlpkg.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target url, %w", err)
+	}
+	pu, err := urlpkg.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url, %w", err)
+	}
+	if tu.Scheme != "https" || pu.Scheme != "https" {
+		return nil, errors.New("target and proxy must be https urls")
+	}
+	targetPath := tu.Path
+	if len(targetPath) == 0 {
+		targetPath = "/dns-query"
+	}
+	withTarget := func(path string) string {
+		u := *pu
+		qv := u.Query()
+		qv.Set("targethost", tu.Host)
+		qv.Set("targetpath", path)
+		u.RawQuery = qv.Encode()
+		return u.String()
+	}
+
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+	return &Upstream{
+		proxyURL:       withTarget(targetPath),
+		proxyConfigURL: withTarget(configPath),
+		rt:             rt,
+		logger:         logger,
+	}, nil
+}
+
+func (u *Upstream) ExchangeContext(ctx context.Context, q []byte) (*[]byte, error) {
+	wire := make([]byte, len(q))
+	copy(wire, q)
+	// Same as DoH, use a DNS ID of 0 in every query.
+	wire[0] = 0
+	wire[1] = 0
+
+	type res struct {
+		r   *[]byte
+		err error
+	}
+	resChan := make(chan res, 1)
+	go func() {
+		// Fixed timeout context to improve the connection reuse efficiency.
+		// See the same comment in doh.Upstream.
+		ctx, cancel := context.WithTimeout(context.Background(), defaultODoHTimeout)
+		defer cancel()
+		r, err := u.exchange(ctx, wire)
+		if err != nil {
+			u.logger.Check(zap.WarnLevel, "exchange failed").Write(zap.Error(err))
+		}
+		resChan <- res{r: r, err: err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	case res := <-resChan:
+		r := res.r
+		if r != nil {
+			binary.BigEndian.PutUint16(*r, binary.BigEndian.Uint16(q))
+		}
+		return r, res.err
+	}
+}
+
+func (u *Upstream) exchange(ctx context.Context, wire []byte) (*[]byte, error) {
+	c, err := u.getConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get target config, %w", err)
+	}
+	body, qc, err := encryptQuery(c, wire)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt query, %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.proxyURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header["Content-Type"] = []string{contentType}
+	req.Header["Accept"] = []string{contentType}
+	req.Header["User-Agent"] = nil
+	resp, err := u.rt.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("http request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized {
+			// The target has rotated its key.
+			u.invalidateConfig(c)
+			return nil, errConfigRejected
+		}
+		body1k, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("bad http status codes %d with body [%s]", resp.StatusCode, body1k)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize+1024))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read http body: %w", err)
+	}
+	m, err := qc.decryptResponse(b)
+	if err != nil {
+		u.invalidateConfig(c)
+		return nil, err
+	}
+	if len(m) < dnsutils.DnsHeaderLen {
+		return nil, dnsutils.ErrPayloadTooSmall
+	}
+	payload := pool.GetBuf(len(m))
+	copy(*payload, m)
+	return payload, nil
+}
+
+// getConfig returns the current target config. If the config needs a
+// refresh, it is returned and refreshed in background.
+func (u *Upstream) getConfig(ctx context.Context) (*targetConfig, error) {
+	if fc := u.c.Load(); fc != nil {
+		if time.Since(fc.fetchedAt) >= configRefreshInterval {
+			u.sf.DoChan("", u.updateConfig)
+		}
+		return fc.config, nil
+	}
+
+	select {
+	case res := <-u.sf.DoChan("", u.updateConfig):
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*targetConfig), nil
+	case <-ctx.Done():
+		return nil, context.Cause(ctx)
+	}
+}
+
+// updateConfig fetches the target config. If it failed, the old config
+// will be kept.
+func (u *Upstream) updateConfig() (any, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultODoHTimeout)
+	defer cancel()
+
+	old := u.c.Load()
+	c, err := u.fetchConfig(ctx)
+	if err != nil {
+		if old != nil {
+			u.logger.Warn("failed to refresh odoh config, keep using the old one", zap.Error(err))
+			u.c.CompareAndSwap(old, &fetchedConfig{config: old.config, fetchedAt: time.Now()})
+			return old.config, nil
+		}
+		return nil, err
+	}
+	u.c.Store(&fetchedConfig{config: c, fetchedAt: time.Now()})
+	return c, nil
+}
+
+func (u *Upstream) invalidateConfig(c *targetConfig) {
+	if fc := u.c.Load(); fc != nil && fc.config == c {
+		u.c.CompareAndSwap(fc, nil)
+	}
+}
+
+func (u *Upstream) fetchConfig(ctx context.Context) (*targetConfig, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.proxyConfigURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header["User-Agent"] = nil
+	resp, err := u.rt.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("http request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad http status codes %d", resp.StatusCode)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read http body: %w", err)
+	}
+	return parseConfigs(b)
+}
+
+// Close closes idle connections of the transport.
+func (u *Upstream) Close() error {
+	if c, ok := u.rt.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package odoh
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+// testTarget is an ODoH target and proxy in one server.
+type testTarget struct {
+	suite hpkeSuite
+
+	m        sync.Mutex
+	sk       *ecdh.PrivateKey
+	config   *targetConfig
+	contents []byte
+
+	configFetched atomic.Int32
+	proxied       atomic.Int32
+}
+
+func newTestTarget(t *testing.T, aead uint16) *testTarget {
+	tt := &testTarget{suite: hpkeSuite{kem: kemX25519HKDFSHA256, kdf: kdfHKDFSHA256, aead: aead}}
+	tt.rotate(t)
+	return tt
+}
+
+// rotate generates a new target key.
+func (tt *testTarget) rotate(t *testing.T) {
+	sk, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := binary.BigEndian.AppendUint16(nil, tt.suite.kem)
+	contents = binary.BigEndian.AppendUint16(contents, tt.suite.kdf)
+	contents = binary.BigEndian.AppendUint16(contents, tt.suite.aead)
+	contents = appendVec16(contents, sk.PublicKey().Bytes())
+	c, err := parseConfigs(tt.marshalConfigs(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tt.m.Lock()
+	defer tt.m.Unlock()
+	tt.sk, tt.config, tt.contents = sk, c, contents
+}
+
+func (tt *testTarget) marshalConfigs(contents []byte) []byte {
+	// An unsupported version goes first, it should be skipped.
+	var configs []byte
+	configs = binary.BigEndian.AppendUint16(configs, 0xff00)
+	configs = appendVec16(configs, []byte{1, 2, 3})
+	configs = binary.BigEndian.AppendUint16(configs, odohVersion)
+	configs = appendVec16(configs, contents)
+	return appendVec16(nil, configs)
+}
+
+func (tt *testTarget) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	tt.m.Lock()
+	sk, config, contents := tt.sk, tt.config, tt.contents
+	tt.m.Unlock()
+
+	switch req.URL.Path {
+	case "/proxy":
+		if req.Method == http.MethodGet && req.URL.Query().Get("targetpath") == configPath {
+			tt.configFetched.Add(1)
+			_, _ = w.Write(tt.marshalConfigs(contents))
+			return
+		}
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != contentType ||
+			req.URL.Query().Get("targethost") != req.Host || req.URL.Query().Get("targetpath") != "/dns-query" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		tt.proxied.Add(1)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	b, _ := io.ReadAll(req.Body)
+	typ, keyID, encrypted, err := parseMessage(b)
+	if err != nil || typ != messageTypeQuery || len(encrypted) < 32 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if string(keyID) != string(config.keyID) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	hc, err := setupBaseR(tt.suite, encrypted[:32], sk, labelQuery)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	plaintext, err := hc.open(appendVec16([]byte{messageTypeQuery}, keyID), encrypted[32:])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	qb, err := parsePlaintext(plaintext)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(qb); err != nil || q.Id != 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Answer = append(r.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(127, 0, 0, 1),
+	})
+	rb, _ := r.Pack()
+
+	respNonce := make([]byte, max(hpkeNonceSize, tt.suite.keySize()))
+	_, _ = rand.Read(respNonce)
+	qc := &queryContext{hc: hc, plaintext: plaintext}
+	key, nonce := qc.responseKey(respNonce)
+	aead, _ := tt.suite.newAEAD(key)
+	ct := aead.Seal(nil, nonce, marshalPlaintext(rb, 0), appendVec16([]byte{messageTypeResponse}, respNonce))
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(marshalMessage(messageTypeResponse, respNonce, ct))
+}
+
+func exchangeA(t *testing.T, u *Upstream) {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("example.test.", dns.TypeA)
+	qb, err := q.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	rb, err := u.ExchangeContext(ctx, qb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.ReleaseBuf(rb)
+	r := new(dns.Msg)
+	if err := r.Unpack(*rb); err != nil {
+		t.Fatal(err)
+	}
+	if r.Id != q.Id || len(r.Answer) != 1 {
+		t.Fatalf("unexpected response %s", r)
+	}
+}
+
+func Test_Upstream(t *testing.T) {
+	for _, aead := range []uint16{aeadAES128GCM, aeadAES256GCM, aeadChaCha20Poly1305} {
+		tt := newTestTarget(t, aead)
+		s := httptest.NewTLSServer(tt)
+		t.Cleanup(s.Close)
+
+		rt := s.Client().Transport
+		u, err := NewUpstream(s.URL+"/dns-query", s.URL+"/proxy", rt, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exchangeA(t, u)
+		exchangeA(t, u)
+		if n := tt.configFetched.Load(); n != 1 {
+			t.Fatalf("config should be cached, fetched %d times", n)
+		}
+
+		// Target rotates its key. The first query fails with 401,
+		// then the new config is fetched.
+		tt.rotate(t)
+		ctx := context.Background()
+		if _, err := u.ExchangeContext(ctx, make([]byte, 12)); err == nil {
+			t.Fatal("want err")
+		}
+		exchangeA(t, u)
+		if n := tt.configFetched.Load(); n != 2 {
+			t.Fatalf("config should be re-fetched, fetched %d times", n)
+		}
+		if n := tt.proxied.Load(); n != 4 {
+			t.Fatalf("want 4 proxied queries, got %d", n)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+const proxyHandshakeTimeout = time.Second * 5
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// socks5Server is a parsed Opt.Socks5.
+type socks5Server struct {
+	addr string
+	auth *proxy.Auth // nil if no auth.
+}
+
+// parseSocks5 parses "[socks5://][user:pass@]host:port".
+func parseSocks5(s string) (*socks5Server, error) {
+	if !strings.Contains(s, "://") {
+		s = "socks5://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" {
+		return nil, fmt.Errorf("invalid socks5 scheme %s", u.Scheme)
+	}
+	if len(u.Port()) == 0 {
+		return nil, errors.New("socks5 server port is required")
+	}
+	ss := &socks5Server{addr: u.Host}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		ss.auth = &proxy.Auth{User: u.User.Username(), Password: pass}
+	}
+	return ss, nil
+}
+
+// newTcpDialer returns a dialer that connects to the target through the socks5 server.
+func (ss *socks5Server) newTcpDialer(forward *net.Dialer) (dialFunc, error) {
+	d, err := proxy.SOCKS5("tcp", ss.addr, ss.auth, forward)
+	if err != nil {
+		return nil, err
+	}
+	return d.(proxy.ContextDialer).DialContext, nil
+}
+
+// Socks5 protocol constants. See RFC 1928 and RFC 1929.
+const (
+	socks5Version          = 0x05
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+	socks5CmdUDPAssociate  = 0x03
+	socks5AtypIPv4         = 0x01
+	socks5AtypDomain       = 0x03
+	socks5AtypIPv6         = 0x04
+)
+
+// udpAssociate performs a socks5 UDP ASSOCIATE handshake on c and
+// returns the relay address.
+func (ss *socks5Server) udpAssociate(c net.Conn) (netip.AddrPort, error) {
+	methods := []byte{socks5AuthNone}
+	if ss.auth != nil {
+		methods = []byte{socks5AuthPassword}
+	}
+	b := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := c.Write(b); err != nil {
+		return netip.AddrPort{}, err
+	}
+	h := make([]byte, 2)
+	if _, err := io.ReadFull(c, h); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if h[0] != socks5Version || h[1] == socks5AuthNoAcceptable || (h[1] != socks5AuthNone && h[1] != socks5AuthPassword) {
+		return netip.AddrPort{}, errors.New("socks5 server has no acceptable auth method")
+	}
+	if h[1] == socks5AuthPassword {
+		if ss.auth == nil {
+			return netip.AddrPort{}, errors.New("socks5 server requires auth")
+		}
+		b := []byte{0x01, byte(len(ss.auth.User))}
+		b = append(b, ss.auth.User...)
+		b = append(b, byte(len(ss.auth.Password)))
+		b = append(b, ss.auth.Password...)
+		if _, err := c.Write(b); err != nil {
+			return netip.AddrPort{}, err
+		}
+		if _, err := io.ReadFull(c, h); err != nil {
+			return netip.AddrPort{}, err
+		}
+		if h[1] != 0x00 {
+			return netip.AddrPort{}, errors.New("socks5 auth failed")
+		}
+	}
+
+	// Client address is unknown, use 0.0.0.0:0.
+	req := []byte{socks5Version, socks5CmdUDPAssociate, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := c.Write(req); err != nil {
+		return netip.AddrPort{}, err
+	}
+	rh := make([]byte, 4)
+	if _, err := io.ReadFull(c, rh); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if rh[1] != 0x00 {
+		return netip.AddrPort{}, fmt.Errorf("socks5 udp associate failed, reply code %d", rh[1])
+	}
+	var ipLen int
+	switch rh[3] {
+	case socks5AtypIPv4:
+		ipLen = 4
+	case socks5AtypIPv6:
+		ipLen = 16
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unsupported relay address type %d", rh[3])
+	}
+	ab := make([]byte, ipLen+2)
+	if _, err := io.ReadFull(c, ab); err != nil {
+		return netip.AddrPort{}, err
+	}
+	addr, _ := netip.AddrFromSlice(ab[:ipLen])
+	port := binary.BigEndian.Uint16(ab[ipLen:])
+	if addr.IsUnspecified() {
+		// Relay is on the socks5 server.
+		if ra, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			addr, _ = netip.AddrFromSlice(ra.IP)
+		}
+	}
+	return netip.AddrPortFrom(addr.Unmap(), port), nil
+}
+
+// socks5PacketConn is a net.PacketConn that relays packets through a socks5
+// server. The association is established lazily and re-established if its
+// control connection is closed.
+type socks5PacketConn struct {
+	net.PacketConn // local udp socket
+	ss             *socks5Server
+	dialTcp        dialFunc
+
+	m        sync.Mutex
+	ctrl     net.Conn // nil if not associated.
+	relay    netip.AddrPort
+	closed   bool
+	closeErr error
+}
+
+func newSocks5PacketConn(pc net.PacketConn, ss *socks5Server, dialTcp dialFunc) *socks5PacketConn {
+	return &socks5PacketConn{PacketConn: pc, ss: ss, dialTcp: dialTcp}
+}
+
+func (c *socks5PacketConn) associate() (netip.AddrPort, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.closed {
+		return netip.AddrPort{}, net.ErrClosed
+	}
+	if c.ctrl != nil {
+		return c.relay, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), proxyHandshakeTimeout)
+	defer cancel()
+	ctrl, err := c.dialTcp(ctx, "tcp", c.ss.addr)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("failed to connect socks5 server, %w", err)
+	}
+	_ = ctrl.SetDeadline(time.Now().Add(proxyHandshakeTimeout))
+	relay, err := c.ss.udpAssociate(ctrl)
+	if err != nil {
+		ctrl.Close()
+		return netip.AddrPort{}, err
+	}
+	_ = ctrl.SetDeadline(time.Time{})
+	c.ctrl, c.relay = ctrl, relay
+
+	// The association terminates when the control connection is closed.
+	go func() {
+		_, _ = io.Copy(io.Discard, ctrl)
+		c.m.Lock()
+		if c.ctrl == ctrl {
+			c.ctrl = nil
+		}
+		c.m.Unlock()
+		ctrl.Close()
+	}()
+	return relay, nil
+}
+
+func (c *socks5PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("unsupported addr type %T", addr)
+	}
+	relay, err := c.associate()
+	if err != nil {
+		return 0, err
+	}
+	dst := ua.AddrPort()
+	b := make([]byte, 0, 22+len(p))
+	b = append(b, 0, 0, 0) // RSV, FRAG
+	if dst.Addr().Unmap().Is4() {
+		b = append(b, socks5AtypIPv4)
+		b = append(b, dst.Addr().Unmap().AsSlice()...)
+	} else {
+		b = append(b, socks5AtypIPv6)
+		b = append(b, dst.Addr().AsSlice()...)
+	}
+	b = binary.BigEndian.AppendUint16(b, dst.Port())
+	b = append(b, p...)
+	if _, err := c.PacketConn.WriteTo(b, net.UDPAddrFromAddrPort(relay)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *socks5PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(p)+262)
+	for {
+		n, from, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		c.m.Lock()
+		relay := c.relay
+		c.m.Unlock()
+		if ua, ok := from.(*net.UDPAddr); !ok || unmapAddrPort(ua.AddrPort()) != relay {
+			continue // Not from the relay.
+		}
+		data, src, ok := parseSocks5UDPHeader(buf[:n])
+		if !ok {
+			continue
+		}
+		return copy(p, data), net.UDPAddrFromAddrPort(src), nil
+	}
+}
+
+func (c *socks5PacketConn) Close() error {
+	c.m.Lock()
+	if !c.closed {
+		c.closed = true
+		if c.ctrl != nil {
+			c.ctrl.Close()
+			c.ctrl = nil
+		}
+		c.closeErr = c.PacketConn.Close()
+	}
+	c.m.Unlock()
+	return c.closeErr
+}
+
+// parseSocks5UDPHeader parses a relayed udp packet. Fragments and
+// domain addresses are not supported.
+func parseSocks5UDPHeader(b []byte) (data []byte, src netip.AddrPort, ok bool) {
+	if len(b) < 4 || b[2] != 0 {
+		return nil, netip.AddrPort{}, false
+	}
+	var ipLen int
+	switch b[3] {
+	case socks5AtypIPv4:
+		ipLen = 4
+	case socks5AtypIPv6:
+		ipLen = 16
+	default:
+		return nil, netip.AddrPort{}, false
+	}
+	if len(b) < 4+ipLen+2 {
+		return nil, netip.AddrPort{}, false
+	}
+	addr, _ := netip.AddrFromSlice(b[4 : 4+ipLen])
+	port := binary.BigEndian.Uint16(b[4+ipLen:])
+	return b[4+ipLen+2:], netip.AddrPortFrom(addr.Unmap(), port), true
+}
+
+func unmapAddrPort(ap netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+}
+
+// packetConnWithRemote turns a net.PacketConn to a net.Conn that
+// sends to and receives from raddr only.
+type packetConnWithRemote struct {
+	net.PacketConn
+	raddr *net.UDPAddr
+}
+
+func (c *packetConnWithRemote) Read(p []byte) (int, error) {
+	for {
+		n, from, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return 0, err
+		}
+		if ua, ok := from.(*net.UDPAddr); ok && unmapAddrPort(ua.AddrPort()) == unmapAddrPort(c.raddr.AddrPort()) {
+			return n, nil
+		}
+	}
+}
+
+func (c *packetConnWithRemote) Write(p []byte) (int, error) {
+	return c.PacketConn.WriteTo(p, c.raddr)
+}
+
+func (c *packetConnWithRemote) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+// httpProxy is a parsed Opt.HTTPProxy.
+type httpProxy struct {
+	u         *url.URL
+	authValue string // Proxy-Authorization header value. Maybe empty.
+}
+
+// parseHTTPProxy parses "http[s]://[user:pass@]host[:port]".
+func parseHTTPProxy(s string) (*httpProxy, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid http proxy scheme %s", u.Scheme)
+	}
+	if len(u.Port()) == 0 {
+		if u.Scheme == "http" {
+			u.Host = net.JoinHostPort(u.Hostname(), "80")
+		} else {
+			u.Host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	}
+	hp := &httpProxy{u: u}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		hp.authValue = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+pass))
+	}
+	return hp, nil
+}
+
+// newTcpDialer returns a dialer that connects to the target through
+// a http CONNECT tunnel.
+func (hp *httpProxy) newTcpDialer(forward *net.Dialer) dialFunc {
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		c, err := forward.DialContext(ctx, "tcp", hp.u.Host)
+		if err != nil {
+			return nil, err
+		}
+		if hp.u.Scheme == "https" {
+			tlsConn := tls.Client(c, &tls.Config{ServerName: hp.u.Hostname()})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				c.Close()
+				return nil, fmt.Errorf("proxy tls handshake failed, %w", err)
+			}
+			c = tlsConn
+		}
+		tc, err := hp.connect(ctx, c, addr)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return tc, nil
+	}
+}
+
+func (hp *httpProxy) connect(ctx context.Context, c net.Conn, addr string) (net.Conn, error) {
+	ddl := time.Now().Add(proxyHandshakeTimeout)
+	if ctxDdl, ok := ctx.Deadline(); ok && ctxDdl.Before(ddl) {
+		ddl = ctxDdl
+	}
+	_ = c.SetDeadline(ddl)
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if len(hp.authValue) > 0 {
+		req.Header.Set("Proxy-Authorization", hp.authValue)
+	}
+	if err := req.Write(c); err != nil {
+		return nil, fmt.Errorf("failed to write connect request, %w", err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read connect response, %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("http proxy connect failed, status %s", resp.Status)
+	}
+	_ = c.SetDeadline(time.Time{})
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: c, r: br}, nil
+	}
+	return c, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
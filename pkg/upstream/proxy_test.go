@@ -0,0 +1,325 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testSocks5Server is a minimal socks5 server that supports
+// username/password auth, CONNECT and UDP ASSOCIATE.
+type testSocks5Server struct {
+	user, pass string
+	l          net.Listener
+
+	connected  atomic.Int32
+	associated atomic.Int32
+}
+
+func newTestSocks5Server(t testing.TB, user, pass string) *testSocks5Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSocks5Server{user: user, pass: pass, l: l}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(c)
+		}
+	}()
+	return s
+}
+
+func (s *testSocks5Server) handle(c net.Conn) {
+	defer c.Close()
+	h := make([]byte, 2)
+	if _, err := io.ReadFull(c, h); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(c, make([]byte, h[1])); err != nil {
+		return
+	}
+	c.Write([]byte{socks5Version, socks5AuthPassword})
+	if _, err := io.ReadFull(c, h); err != nil {
+		return
+	}
+	user := make([]byte, h[1])
+	io.ReadFull(c, user)
+	io.ReadFull(c, h[:1])
+	pass := make([]byte, h[0])
+	io.ReadFull(c, pass)
+	if string(user) != s.user || string(pass) != s.pass {
+		c.Write([]byte{0x01, 0x01})
+		return
+	}
+	c.Write([]byte{0x01, 0x00})
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(c, req); err != nil || req[3] != socks5AtypIPv4 {
+		return
+	}
+	ab := make([]byte, 6)
+	if _, err := io.ReadFull(c, ab); err != nil {
+		return
+	}
+	switch req[1] {
+	case 0x01: // CONNECT
+		ip, _ := netip.AddrFromSlice(ab[:4])
+		dst := netip.AddrPortFrom(ip, binary.BigEndian.Uint16(ab[4:]))
+		rc, err := net.Dial("tcp", dst.String())
+		if err != nil {
+			c.Write([]byte{socks5Version, 0x05, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+			return
+		}
+		defer rc.Close()
+		s.connected.Add(1)
+		c.Write([]byte{socks5Version, 0, 0, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+		go io.Copy(rc, c)
+		io.Copy(c, rc)
+	case socks5CmdUDPAssociate:
+		relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer relay.Close()
+		s.associated.Add(1)
+		// Reply with an unspecified address. Client should use the server address.
+		rep := []byte{socks5Version, 0, 0, socks5AtypIPv4, 0, 0, 0, 0}
+		rep = binary.BigEndian.AppendUint16(rep, uint16(relay.LocalAddr().(*net.UDPAddr).Port))
+		c.Write(rep)
+		go s.relay(relay)
+		io.Copy(io.Discard, c)
+	}
+}
+
+func (s *testSocks5Server) relay(relay net.PacketConn) {
+	var client net.Addr
+	b := make([]byte, 65535)
+	for {
+		n, from, err := relay.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		if client == nil || from.String() == client.String() {
+			client = from
+			data, dst, ok := parseSocks5UDPHeader(b[:n])
+			if !ok {
+				continue
+			}
+			relay.WriteTo(data, net.UDPAddrFromAddrPort(dst))
+			continue
+		}
+		src := from.(*net.UDPAddr).AddrPort()
+		p := []byte{0, 0, 0, socks5AtypIPv4}
+		p = append(p, src.Addr().Unmap().AsSlice()...)
+		p = binary.BigEndian.AppendUint16(p, src.Port())
+		relay.WriteTo(append(p, b[:n]...), client)
+	}
+}
+
+// newTestHTTPProxy starts a http CONNECT proxy that requires basic auth.
+func newTestHTTPProxy(t testing.TB, user, pass string) (addr string, connected *atomic.Int32) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	connected = new(atomic.Int32)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				u, p, ok := (&http.Request{Header: http.Header{"Authorization": req.Header["Proxy-Authorization"]}}).BasicAuth()
+				if !ok || u != user || p != pass {
+					io.WriteString(c, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				rc, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer rc.Close()
+				connected.Add(1)
+				io.WriteString(c, "HTTP/1.1 200 Connection Established\r\n\r\n")
+				go io.Copy(rc, c)
+				io.Copy(c, rc)
+			}()
+		}
+	}()
+	return l.Addr().String(), connected
+}
+
+func Test_proxy(t *testing.T) {
+	s5 := newTestSocks5Server(t, "user", "pass")
+	hpAddr, hpConnected := newTestHTTPProxy(t, "user", "pass")
+
+	for scheme, f := range m {
+		addr, shutdown := f(t, &vServer{})
+		t.Cleanup(shutdown)
+
+		for _, udp := range []bool{false, true} {
+			associated := s5.associated.Load()
+			opt := Opt{
+				Socks5:    "socks5://user:pass@" + s5.l.Addr().String(),
+				Socks5UDP: udp,
+				TLSConfig: &tls.Config{InsecureSkipVerify: true},
+			}
+			u, err := NewUpstream(scheme+"://"+addr, opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := testUpstream(u); err != nil {
+				t.Fatalf("socks5 %s: %v", scheme, err)
+			}
+			u.Close()
+			if scheme == "udp" && !udp && s5.associated.Load() != associated {
+				t.Fatal("udp should not use the socks5 proxy by default")
+			}
+		}
+
+		// Udp ignores the http proxy.
+		opt := Opt{
+			HTTPProxy: "http://user:pass@" + hpAddr,
+			TLSConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+		u, err := NewUpstream(scheme+"://"+addr, opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testUpstream(u); err != nil {
+			t.Fatalf("http proxy %s: %v", scheme, err)
+		}
+		u.Close()
+	}
+	if s5.connected.Load() == 0 || s5.associated.Load() == 0 || hpConnected.Load() == 0 {
+		t.Fatal("queries were not sent through proxies")
+	}
+
+	// Wrong credentials.
+	u, err := NewUpstream("tcp://127.0.0.1:53", Opt{HTTPProxy: "http://user:bad@" + hpAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := u.ExchangeContext(ctx, make([]byte, 12)); err == nil {
+		t.Fatal("want err")
+	}
+}
+
+func Test_proxy_udpFallback(t *testing.T) {
+	s5 := newTestSocks5Server(t, "user", "pass")
+	hpAddr, hpConnected := newTestHTTPProxy(t, "user", "pass")
+	var tcpQueries atomic.Int32
+	addr, shutdown := newUDPTCPTestServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, q *dns.Msg) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		if w.LocalAddr().Network() == "udp" {
+			r.Truncated = true
+		} else {
+			tcpQueries.Add(1)
+		}
+		_ = w.WriteMsg(r)
+	}))
+	defer shutdown()
+
+	tests := []struct {
+		name      string
+		opt       Opt
+		wantProxy bool
+	}{
+		{name: "socks5", opt: Opt{Socks5: "socks5://user:pass@" + s5.l.Addr().String()}},
+		{name: "socks5 udp", opt: Opt{Socks5: "socks5://user:pass@" + s5.l.Addr().String(), Socks5UDP: true}, wantProxy: true},
+		{name: "http proxy", opt: Opt{HTTPProxy: "http://user:pass@" + hpAddr}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connected := s5.connected.Load() + hpConnected.Load()
+			tcpQueries.Store(0)
+			u, err := NewUpstream("udp://"+addr, tt.opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer u.Close()
+			if err := testUpstream(u); err != nil {
+				t.Fatal(err)
+			}
+			if tcpQueries.Load() == 0 {
+				t.Fatal("truncated queries were not retried over tcp")
+			}
+			if proxied := s5.connected.Load()+hpConnected.Load() > connected; proxied != tt.wantProxy {
+				t.Fatalf("want tcp fallback through the proxy %v, got %v", tt.wantProxy, proxied)
+			}
+		})
+	}
+}
+
+func Test_parseSocks5(t *testing.T) {
+	tests := []struct {
+		s       string
+		addr    string
+		user    string
+		wantErr bool
+	}{
+		{s: "127.0.0.1:1080", addr: "127.0.0.1:1080"},
+		{s: "socks5://u:p@127.0.0.1:1080", addr: "127.0.0.1:1080", user: "u"},
+		{s: "socks5://127.0.0.1", wantErr: true},
+		{s: "http://127.0.0.1:1080", wantErr: true},
+	}
+	for _, tt := range tests {
+		ss, err := parseSocks5(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("parseSocks5(%s) err = %v, wantErr %v", tt.s, err, tt.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if ss.addr != tt.addr || (ss.auth != nil) != (len(tt.user) > 0) || (ss.auth != nil && ss.auth.User != tt.user) {
+			t.Fatalf("parseSocks5(%s) = %+v", tt.s, ss)
+		}
+	}
+}
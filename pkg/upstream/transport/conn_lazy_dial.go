@@ -42,7 +42,7 @@ func newLazyDnsConn(
 	if dialTimeout <= 0 {
 		dialTimeout = defaultDialTimeout
 	}
-	dialCtx, cancelDial := context.WithTimeout(context.Background(), defaultDialTimeout)
+	dialCtx, cancelDial := context.WithTimeout(context.Background(), dialTimeout)
 	lc := &lazyDnsConn{
 		maxConcurrentQuery: maxConcurrentQueryWhileDialing,
 		cancelDial:         cancelDial,
@@ -128,6 +128,33 @@ func (lc *lazyDnsConn) ReserveNewQuery() (_ ReservedExchanger, closed bool) {
 	}
 }
 
+// load returns the load of the dialed connection, or the early reserved
+// queries if it's still dialing.
+func (lc *lazyDnsConn) load() (inFlight, capacity int) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.c == nil {
+		return lc.reservedQuery, lc.maxConcurrentQuery
+	}
+	if l, ok := lc.c.(connLoad); ok {
+		return l.load()
+	}
+	return 0, 0
+}
+
+// isClosed returns true if lc was closed or failed to dial.
+func (lc *lazyDnsConn) isClosed() bool {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.closed || lc.dialErr != nil {
+		return true
+	}
+	if c, ok := lc.c.(interface{ IsClosed() bool }); ok {
+		return c.IsClosed()
+	}
+	return false
+}
+
 type lazyDnsConnEarlyReservedExchanger lazyDnsConn
 
 var _ ReservedExchanger = (*lazyDnsConnEarlyReservedExchanger)(nil)
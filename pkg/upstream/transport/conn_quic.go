@@ -3,6 +3,7 @@ package transport
 import (
 	"context"
 	"encoding/binary"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
@@ -24,7 +25,8 @@ const (
 var _ DnsConn = (*QuicDnsConn)(nil)
 
 type QuicDnsConn struct {
-	c quic.Connection
+	c        quic.Connection
+	inFlight atomic.Int32
 }
 
 func NewQuicDnsConn(c quic.Connection) *QuicDnsConn {
@@ -47,16 +49,28 @@ func (c *QuicDnsConn) ReserveNewQuery() (_ ReservedExchanger, closed bool) {
 	if err != nil {
 		return nil, false
 	}
-	return &quicReservedExchanger{stream: s}, false
+	c.inFlight.Add(1)
+	return &quicReservedExchanger{stream: s, c: c}, false
+}
+
+func (c *QuicDnsConn) IsClosed() bool {
+	return c.c.Context().Err() != nil
+}
+
+// load reports the in-flight queries. The capacity is controlled by the peer.
+func (c *QuicDnsConn) load() (inFlight, capacity int) {
+	return int(c.inFlight.Load()), 0
 }
 
 type quicReservedExchanger struct {
 	stream quic.Stream
+	c      *QuicDnsConn
 }
 
 var _ ReservedExchanger = (*quicReservedExchanger)(nil)
 
 func (ote *quicReservedExchanger) ExchangeReserved(ctx context.Context, q []byte) (resp *[]byte, err error) {
+	defer ote.c.inFlight.Add(-1)
 	stream := ote.stream
 
 	payload, err := copyMsgWithLenHdr(q)
@@ -117,6 +131,7 @@ func (ote *quicReservedExchanger) ExchangeReserved(ctx context.Context, q []byte
 }
 
 func (ote *quicReservedExchanger) WithdrawReserved() {
+	ote.c.inFlight.Add(-1)
 	s := ote.stream
 	s.CancelRead(_DOQ_REQUEST_CANCELLED)
 	s.CancelWrite(_DOQ_REQUEST_CANCELLED)
@@ -24,6 +24,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math/rand/v2"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -44,6 +45,7 @@ var _ DnsConn = (*TraditionalDnsConn)(nil)
 type TraditionalDnsConn struct {
 	c           NetConn
 	isTcp       bool
+	randomQid   bool
 	idleTimeout time.Duration
 	maxCq       int
 
@@ -75,12 +77,17 @@ type TraditionalDnsConnOpts struct {
 	// MaxConcurrentQuery limits the number of maximum concurrent queries
 	// in the connection. Default is defaultTdcMaxConcurrentQuery.
 	MaxConcurrentQuery int
+
+	// RandomQid assigns random query ids instead of sequential ones.
+	// It makes off-path response spoofing harder.
+	RandomQid bool
 }
 
 func NewDnsConn(opt TraditionalDnsConnOpts, conn NetConn) *TraditionalDnsConn {
 	dc := &TraditionalDnsConn{
 		c:           conn,
 		isTcp:       opt.WithLengthHeader,
+		randomQid:   opt.RandomQid,
 		closeNotify: make(chan struct{}),
 		queue:       make(map[uint32]chan *[]byte),
 	}
@@ -92,15 +99,19 @@ func NewDnsConn(opt TraditionalDnsConnOpts, conn NetConn) *TraditionalDnsConn {
 }
 
 // exchange sends q out and waits for its reply.
+// The caller must have reserved a query. The reservation is
+// transferred to the queue once q is added to the queue.
 func (dc *TraditionalDnsConn) exchange(ctx context.Context, q []byte) (*[]byte, error) {
 	select {
 	case <-dc.closeNotify:
+		(*tdcOneTimeExchanger)(dc).WithdrawReserved()
 		return nil, ErrTDCClosed
 	default:
 	}
 
 	assignedQid, respChan := dc.addQueueC()
 	if respChan == nil {
+		(*tdcOneTimeExchanger)(dc).WithdrawReserved()
 		return nil, ErrTDCTooManyQueries
 	}
 	defer dc.deleteQueueC(assignedQid)
@@ -240,19 +251,29 @@ func (dc *TraditionalDnsConn) queueLen() int {
 	return len(dc.queue) + dc.reservedQuery
 }
 
+func (dc *TraditionalDnsConn) load() (inFlight, capacity int) {
+	return dc.queueLen(), dc.maxCq
+}
+
 // addQueueC assigns a qid and add it to the queue.
 // It returns a nil c if queue has too many queries.
+// On success, one reserved query is moved into the queue.
 // Caller must call deleteQueueC to release the qid in queue.
 func (dc *TraditionalDnsConn) addQueueC() (qid uint16, c chan *[]byte) {
 	c = make(chan *[]byte)
 	dc.queueMu.Lock()
 	for i := 0; i < 100; i++ {
-		qid = dc.nextQid
-		dc.nextQid++
+		if dc.randomQid {
+			qid = uint16(rand.Uint32())
+		} else {
+			qid = dc.nextQid
+			dc.nextQid++
+		}
 		if _, dup := dc.queue[uint32(qid)]; dup {
 			continue
 		}
 		dc.queue[uint32(qid)] = c
+		dc.reservedQuery--
 		dc.queueMu.Unlock()
 		return qid, c
 	}
@@ -287,7 +308,6 @@ type tdcOneTimeExchanger TraditionalDnsConn
 var _ ReservedExchanger = (*tdcOneTimeExchanger)(nil)
 
 func (ote *tdcOneTimeExchanger) ExchangeReserved(ctx context.Context, q []byte) (resp *[]byte, err error) {
-	defer ote.WithdrawReserved()
 	return (*TraditionalDnsConn)(ote).exchange(ctx, q)
 }
 
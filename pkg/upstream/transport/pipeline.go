@@ -22,6 +22,7 @@ package transport
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
@@ -33,11 +34,21 @@ type PipelineTransport struct {
 	m      sync.Mutex // protect following fields
 	closed bool
 	conns  map[*lazyDnsConn]struct{}
+	// slotReleased is closed and renewed when a reserved query finished.
+	// Only used if maxConns is set.
+	slotReleased chan struct{}
+
+	// waiting is the number of queries that are looking for a connection
+	// and may wait for slotReleased.
+	waiting atomic.Int32
 
 	dialFunc         func(ctx context.Context) (DnsConn, error)
 	dialTimeout      time.Duration
 	maxLazyConnQueue int
+	maxConns         int
+	minConns         int
 	logger           *zap.Logger // not nil
+	closeNotify      chan struct{}
 }
 
 type PipelineOpts struct {
@@ -55,26 +66,91 @@ type PipelineOpts struct {
 	// queries will fail.
 	MaxConcurrentQueryWhileDialing int
 
+	// MaxConns limits the number of connections. If all connections are
+	// busy, queries wait for a free one. Default is no limit.
+	MaxConns int
+
+	// MinConns is the number of connections that will be dialed in advance
+	// and re-dialed once they are closed. Default is 0.
+	MinConns int
+
 	Logger *zap.Logger
 }
 
 func NewPipelineTransport(opt PipelineOpts) *PipelineTransport {
 	t := &PipelineTransport{
-		conns: make(map[*lazyDnsConn]struct{}),
+		conns:        make(map[*lazyDnsConn]struct{}),
+		slotReleased: make(chan struct{}),
+		maxConns:     opt.MaxConns,
+		minConns:     opt.MinConns,
+		closeNotify:  make(chan struct{}),
 	}
 	t.dialFunc = opt.DialContext
 	setDefaultGZ(&t.dialTimeout, opt.DialTimeout, defaultDialTimeout)
 	setDefaultGZ(&t.maxLazyConnQueue, opt.MaxConcurrentQueryWhileDialing, defaultMaxLazyConnQueue)
 	setNonNilLogger(&t.logger, opt.Logger)
 
+	if t.minConns > 0 {
+		go t.keepWarm()
+	}
 	return t
 }
 
+// keepWarm makes sure there are at least minConns connections.
+func (t *PipelineTransport) keepWarm() {
+	ticker := time.NewTicker(warmConnCheckInterval)
+	defer ticker.Stop()
+	for {
+		t.m.Lock()
+		if t.closed {
+			t.m.Unlock()
+			return
+		}
+		t.pruneClosedConns()
+		for n := len(t.conns); n < t.minConns; n++ {
+			t.conns[newLazyDnsConn(t.dialFunc, t.dialTimeout, t.maxLazyConnQueue, t.logger)] = struct{}{}
+		}
+		t.m.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-t.closeNotify:
+			return
+		}
+	}
+}
+
+// pruneClosedConns removes closed connections. Caller must hold t.m.
+func (t *PipelineTransport) pruneClosedConns() {
+	for c := range t.conns {
+		if c.isClosed() {
+			delete(t.conns, c)
+		}
+	}
+}
+
+// Stats returns the current stats of the connection pool.
+func (t *PipelineTransport) Stats() Stats {
+	t.m.Lock()
+	defer t.m.Unlock()
+	var s Stats
+	for c := range t.conns {
+		if c.isClosed() {
+			continue
+		}
+		inFlight, capacity := c.load()
+		s.OpenConns++
+		s.InFlight += inFlight
+		s.PipelineCapacity += capacity
+	}
+	return s
+}
+
 func (t *PipelineTransport) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
 	const maxRetry = 2
 	retry := 0
 	for {
-		dc, isNewConn, err := t.getReservedExchanger()
+		dc, isNewConn, err := t.getReservedExchanger(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -101,51 +177,104 @@ func (t *PipelineTransport) Close() error {
 		return nil
 	}
 	t.closed = true
+	close(t.closeNotify)
 	for conn := range t.conns {
 		conn.Close()
 	}
 	return nil
 }
 
-func (t *PipelineTransport) getReservedExchanger() (_ ReservedExchanger, isNewConn bool, err error) {
-	t.m.Lock()
-	if t.closed {
-		err = ErrClosedTransport
-		t.m.Unlock()
-		return
+// getReservedExchanger reserves a query from an existing connection, or
+// dials a new one. If there are already maxConns connections, it waits
+// until a reserved query finished.
+func (t *PipelineTransport) getReservedExchanger(ctx context.Context) (_ ReservedExchanger, isNewConn bool, err error) {
+	if t.maxConns > 0 {
+		t.waiting.Add(1)
+		defer t.waiting.Add(-1)
 	}
 
-	var rxc ReservedExchanger
-	const maxReserveAttempt = 16
-	reserveAttempt := 0
-	for c := range t.conns {
-		var closed bool
-		rxc, closed = c.ReserveNewQuery()
-		if closed {
-			delete(t.conns, c)
+	for {
+		t.m.Lock()
+		if t.closed {
+			t.m.Unlock()
+			return nil, false, ErrClosedTransport
 		}
-		if rxc != nil {
-			break
-		} else {
-			reserveAttempt++
-			if reserveAttempt > maxReserveAttempt {
+
+		var rxc ReservedExchanger
+		maxReserveAttempt := max(16, t.maxConns)
+		reserveAttempt := 0
+		for c := range t.conns {
+			var closed bool
+			rxc, closed = c.ReserveNewQuery()
+			if closed {
+				delete(t.conns, c)
+			}
+			if rxc != nil {
 				break
+			} else {
+				reserveAttempt++
+				if reserveAttempt > maxReserveAttempt {
+					break
+				}
+			}
+		}
+
+		if rxc == nil && t.maxConns > 0 && len(t.conns) >= t.maxConns {
+			t.pruneClosedConns()
+			if len(t.conns) >= t.maxConns {
+				slotReleased := t.slotReleased
+				t.m.Unlock()
+				select {
+				case <-slotReleased:
+					continue
+				case <-ctx.Done():
+					return nil, false, context.Cause(ctx)
+				}
 			}
 		}
+
+		// Dial a new connection
+		if rxc == nil {
+			c := newLazyDnsConn(t.dialFunc, t.dialTimeout, t.maxLazyConnQueue, t.logger)
+			rxc, _ = c.ReserveNewQuery() // ignore the closed error for new lazy connection
+			isNewConn = true
+			t.conns[c] = struct{}{}
+		}
+		t.m.Unlock()
+
+		if rxc == nil {
+			return nil, false, ErrNewConnCannotReserveQueryExchanger
+		}
+		if t.maxConns > 0 {
+			rxc = &notifyReservedExchanger{ReservedExchanger: rxc, t: t}
+		}
+		return rxc, isNewConn, nil
 	}
+}
 
-	// Dial a new connection
-	if rxc == nil {
-		c := newLazyDnsConn(t.dialFunc, t.dialTimeout, t.maxLazyConnQueue, t.logger)
-		rxc, _ = c.ReserveNewQuery() // ignore the closed error for new lazy connection
-		isNewConn = true
-		t.conns[c] = struct{}{}
+// notifySlotReleased wakes up queries that are waiting for a connection.
+func (t *PipelineTransport) notifySlotReleased() {
+	if t.waiting.Load() == 0 {
+		return
 	}
+	t.m.Lock()
+	close(t.slotReleased)
+	t.slotReleased = make(chan struct{})
 	t.m.Unlock()
+}
 
-	if rxc == nil {
-		isNewConn = false
-		err = ErrNewConnCannotReserveQueryExchanger
-	}
-	return rxc, isNewConn, err
+// notifyReservedExchanger calls notifySlotReleased once the query finished.
+type notifyReservedExchanger struct {
+	ReservedExchanger
+	t *PipelineTransport
+}
+
+func (e *notifyReservedExchanger) ExchangeReserved(ctx context.Context, q []byte) (*[]byte, error) {
+	defer e.t.notifySlotReleased()
+	return e.ReservedExchanger.ExchangeReserved(ctx, q)
+}
+
+func (e *notifyReservedExchanger) WithdrawReserved() {
+	e.ReservedExchanger.WithdrawReserved()
+	e.t.notifySlotReleased()
 }
@@ -150,3 +150,62 @@ func Test_PipelineTransport(t *testing.T) {
 	pt.m.Unlock()
 	r.Equal(1, pl, "all connection should be remove then one will be opened")
 }
+
+func Test_PipelineTransport_max_min_conns(t *testing.T) {
+	r := require.New(t)
+	var dialed atomic.Int32
+	pt := NewPipelineTransport(PipelineOpts{
+		DialContext: func(ctx context.Context) (DnsConn, error) {
+			dialed.Add(1)
+			to := TraditionalDnsConnOpts{WithLengthHeader: true, MaxConcurrentQuery: 2}
+			return NewDnsConn(to, newDummyEchoNetConn(0, time.Millisecond*50, 0)), nil
+		},
+		MaxConcurrentQueryWhileDialing: 2,
+		MaxConns:                       2,
+		MinConns:                       2,
+	})
+	defer pt.Close()
+
+	r.Eventually(func() bool { return dialed.Load() == 2 }, time.Second, time.Millisecond*10)
+	s := pt.Stats()
+	r.Equal(2, s.OpenConns)
+	r.Equal(4, s.PipelineCapacity)
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.", dns.TypeA)
+	queryPayload, err := q.Pack()
+	r.NoError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	// Queries that exceed the capacity wait for free connections.
+	var failed atomic.Int32
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := pt.ExchangeContext(ctx, queryPayload); err != nil {
+				failed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	r.Equal(int32(0), failed.Load())
+	r.Equal(int32(2), dialed.Load())
+
+	// Waiting queries respect the ctx.
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = pt.ExchangeContext(context.Background(), queryPayload)
+		}()
+	}
+	r.Eventually(func() bool { return pt.Stats().InFlight == 4 }, time.Second, time.Millisecond)
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer shortCancel()
+	_, err = pt.ExchangeContext(shortCtx, queryPayload)
+	r.ErrorIs(err, context.DeadlineExceeded)
+	wg.Wait()
+	r.Equal(0, pt.Stats().InFlight)
+}
@@ -41,6 +41,8 @@ type ReuseConnTransport struct {
 	dialFunc    func(ctx context.Context) (NetConn, error)
 	dialTimeout time.Duration
 	idleTimeout time.Duration
+	maxConns    int
+	minConns    int
 	logger      *zap.Logger // non-nil
 	ctx         context.Context
 	ctxCancel   context.CancelCauseFunc
@@ -49,6 +51,10 @@ type ReuseConnTransport struct {
 	closed    bool
 	idleConns map[*reusableConn]struct{}
 	conns     map[*reusableConn]struct{}
+	dialing   int
+	// connsChanged is closed and renewed when a connection becomes idle
+	// or is removed.
+	connsChanged chan struct{}
 
 	// for testing
 	testWaitRespTimeout time.Duration
@@ -66,42 +72,96 @@ type ReuseConnOpts struct {
 	// Default is defaultIdleTimeout
 	IdleTimeout time.Duration
 
+	// MaxConns limits the number of connections. If all connections are
+	// busy, queries wait for an idle one. Default is no limit.
+	MaxConns int
+
+	// MinConns is the number of connections that will be dialed in advance
+	// and re-dialed once they are closed. Default is 0.
+	MinConns int
+
 	Logger *zap.Logger
 }
 
 func NewReuseConnTransport(opt ReuseConnOpts) *ReuseConnTransport {
 	ctx, cancel := context.WithCancelCause(context.Background())
 	t := &ReuseConnTransport{
-		ctx:       ctx,
-		ctxCancel: cancel,
-		idleConns: make(map[*reusableConn]struct{}),
-		conns:     make(map[*reusableConn]struct{}),
+		ctx:          ctx,
+		ctxCancel:    cancel,
+		idleConns:    make(map[*reusableConn]struct{}),
+		conns:        make(map[*reusableConn]struct{}),
+		connsChanged: make(chan struct{}),
+		maxConns:     opt.MaxConns,
+		minConns:     opt.MinConns,
 	}
 	t.dialFunc = opt.DialContext
 	setDefaultGZ(&t.dialTimeout, opt.DialTimeout, defaultDialTimeout)
 	setDefaultGZ(&t.idleTimeout, opt.IdleTimeout, defaultIdleTimeout)
 	setNonNilLogger(&t.logger, opt.Logger)
 
+	if t.minConns > 0 {
+		go t.keepWarm()
+	}
 	return t
 }
 
+// keepWarm makes sure there are at least minConns connections.
+func (t *ReuseConnTransport) keepWarm() {
+	ticker := time.NewTicker(warmConnCheckInterval)
+	defer ticker.Stop()
+	for {
+		t.m.Lock()
+		if t.closed {
+			t.m.Unlock()
+			return
+		}
+		for n := len(t.conns) + t.dialing; n < t.minConns; n++ {
+			t.dialing++
+			go func() {
+				rc, _ := t.dialConn()
+				if rc != nil {
+					rc.c.SetReadDeadline(time.Now().Add(t.idleTimeout))
+					t.setIdle(rc)
+				}
+			}()
+		}
+		t.m.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-t.ctx.Done():
+			return
+		}
+	}
+}
+
+// Stats returns the current stats of the connection pool.
+func (t *ReuseConnTransport) Stats() Stats {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return Stats{
+		OpenConns: len(t.conns) + t.dialing,
+		IdleConns: len(t.idleConns),
+		InFlight:  len(t.conns) - len(t.idleConns),
+	}
+}
+
+// notifyConnsChanged wakes up queries that are waiting for a connection.
+// Caller must hold t.m.
+func (t *ReuseConnTransport) notifyConnsChanged() {
+	close(t.connsChanged)
+	t.connsChanged = make(chan struct{})
+}
+
 func (t *ReuseConnTransport) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
 	const maxRetry = 2
 
 	retry := 0
 	for {
-		var isNewConn bool
-		c, err := t.getIdleConn()
+		c, isNewConn, err := t.getConn(ctx)
 		if err != nil {
 			return nil, err
 		}
-		if c == nil {
-			isNewConn = true
-			c, err = t.getNewConn(ctx)
-			if err != nil {
-				return nil, err
-			}
-		}
 
 		queryPayload, err := copyMsgWithLenHdr(m)
 		if err != nil {
@@ -120,8 +180,67 @@ func (t *ReuseConnTransport) ExchangeContext(ctx context.Context, m []byte) (*[]
 	}
 }
 
-// getNewConn dial a *reusableConn.
-// The caller must call releaseReusableConn to release the reusableConn.
+// getConn returns an idle connection, or dials a new one. If there are
+// already maxConns connections, it waits for an idle one.
+func (t *ReuseConnTransport) getConn(ctx context.Context) (_ *reusableConn, isNewConn bool, err error) {
+	for {
+		t.m.Lock()
+		if t.closed {
+			t.m.Unlock()
+			return nil, false, ErrClosedTransport
+		}
+		for c := range t.idleConns {
+			delete(t.idleConns, c)
+			t.m.Unlock()
+			return c, false, nil
+		}
+		if t.maxConns <= 0 || len(t.conns)+t.dialing < t.maxConns {
+			t.dialing++
+			t.m.Unlock()
+			c, err := t.getNewConn(ctx)
+			return c, true, err
+		}
+		connsChanged := t.connsChanged
+		t.m.Unlock()
+
+		select {
+		case <-connsChanged:
+		case <-ctx.Done():
+			return nil, false, context.Cause(ctx)
+		}
+	}
+}
+
+// dialConn dials a *reusableConn. The caller must increase t.dialing
+// before calling it.
+func (t *ReuseConnTransport) dialConn() (*reusableConn, error) {
+	dialCtx, cancelDial := context.WithTimeout(t.ctx, t.dialTimeout)
+	defer cancelDial()
+
+	var rc *reusableConn
+	c, err := t.dialFunc(dialCtx)
+	if err != nil {
+		t.logger.Check(zap.WarnLevel, "fail to dial reusable conn").Write(zap.Error(err))
+	}
+	if c != nil {
+		rc = t.newReusableConn(c)
+		if rc == nil { // transport closed
+			c.Close()
+			err = ErrClosedTransport
+		}
+	}
+
+	t.m.Lock()
+	t.dialing--
+	if !t.closed {
+		t.notifyConnsChanged()
+	}
+	t.m.Unlock()
+	return rc, err
+}
+
+// getNewConn dial a *reusableConn. The caller must increase t.dialing
+// before calling it.
 func (t *ReuseConnTransport) getNewConn(ctx context.Context) (*reusableConn, error) {
 	callCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -132,23 +251,7 @@ func (t *ReuseConnTransport) getNewConn(ctx context.Context) (*reusableConn, err
 	}
 	dialChan := make(chan dialRes)
 	go func() {
-		dialCtx, cancelDial := context.WithTimeout(t.ctx, t.dialTimeout)
-		defer cancelDial()
-
-		var rc *reusableConn
-		c, err := t.dialFunc(dialCtx)
-		if err != nil {
-			t.logger.Check(zap.WarnLevel, "fail to dial reusable conn").Write(zap.Error(err))
-		}
-		if c != nil {
-			rc = t.newReusableConn(c)
-			if rc == nil { // transport closed
-				c.Close()
-				rc = nil
-				err = ErrClosedTransport
-			}
-		}
-
+		rc, err := t.dialConn()
 		select {
 		case dialChan <- dialRes{c: rc, err: err}:
 		case <-callCtx.Done(): // caller canceled getNewConn() call
@@ -176,26 +279,10 @@ func (t *ReuseConnTransport) setIdle(c *reusableConn) {
 	}
 	if _, ok := t.conns[c]; ok {
 		t.idleConns[c] = struct{}{}
+		t.notifyConnsChanged()
 	}
 }
 
-// getIdleConn returns a *reusableConn from conn pool, or nil if no conn
-// is idle.
-// The caller must call releaseReusableConn to release the reusableConn.
-func (t *ReuseConnTransport) getIdleConn() (*reusableConn, error) {
-	t.m.Lock()
-	defer t.m.Unlock()
-	if t.closed {
-		return nil, ErrClosedTransport
-	}
-
-	for c := range t.idleConns {
-		delete(t.idleConns, c)
-		return c, nil
-	}
-	return nil, nil
-}
-
 // Close closes ReuseConnTransport and all its connections.
 // It always returns a nil error.
 func (t *ReuseConnTransport) Close() error {
@@ -205,6 +292,7 @@ func (t *ReuseConnTransport) Close() error {
 		return nil
 	}
 	t.closed = true
+	t.notifyConnsChanged()
 	for c := range t.conns {
 		delete(t.conns, c)
 		delete(t.idleConns, c)
@@ -290,6 +378,9 @@ func (c *reusableConn) closeWithErr(err error) {
 		c.t.m.Lock()
 		delete(c.t.conns, c)
 		delete(c.t.idleConns, c)
+		if !c.t.closed {
+			c.t.notifyConnsChanged()
+		}
 		c.t.m.Unlock()
 
 		c.closeErr = err
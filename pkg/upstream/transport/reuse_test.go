@@ -22,6 +22,7 @@ package transport
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -152,3 +153,42 @@ func Test_ReuseConnTransport_conn_lose_and_close(t *testing.T) {
 	r.Equal(0, connNum)
 	r.Equal(0, idledConnNum)
 }
+
+func Test_ReuseConnTransport_max_min_conns(t *testing.T) {
+	r := require.New(t)
+	var dialed atomic.Int32
+	rt := NewReuseConnTransport(ReuseConnOpts{
+		DialContext: func(ctx context.Context) (NetConn, error) {
+			dialed.Add(1)
+			return newDummyEchoNetConn(0, time.Millisecond*20, 0), nil
+		},
+		MaxConns: 2,
+		MinConns: 1,
+	})
+	defer rt.Close()
+
+	// Warm connection.
+	r.Eventually(func() bool { return rt.Stats().IdleConns == 1 }, time.Second, time.Millisecond*10)
+
+	q := new(dns.Msg)
+	q.SetQuestion("test.", dns.TypeA)
+	queryPayload, err := q.Pack()
+	r.NoError(err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := rt.ExchangeContext(ctx, queryPayload); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	r.Equal(int32(2), dialed.Load())
+	s := rt.Stats()
+	r.Equal(2, s.OpenConns)
+	r.Equal(0, s.InFlight)
+}
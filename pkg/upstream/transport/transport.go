@@ -44,8 +44,39 @@ const (
 
 	defaultTdcMaxConcurrentQuery = 32
 	defaultMaxLazyConnQueue      = 16
+
+	// Interval to check and dial warm connections.
+	warmConnCheckInterval = time.Second
 )
 
+// Stats is a snapshot of the connection pool of a transport.
+type Stats struct {
+	// OpenConns is the number of open (and dialing) connections.
+	OpenConns int `json:"open_conns"`
+	// IdleConns is the number of idle connections. Always 0 for
+	// pipeline transports.
+	IdleConns int `json:"idle_conns"`
+	// InFlight is the number of ongoing queries.
+	InFlight int `json:"in_flight"`
+	// PipelineCapacity is the total number of queries that open pipeline
+	// connections can carry. 0 if it's not a pipeline transport or the limit
+	// is controlled by the peer. (e.g. quic)
+	PipelineCapacity int `json:"pipeline_capacity"`
+}
+
+// Add adds s2 to s.
+func (s *Stats) Add(s2 Stats) {
+	s.OpenConns += s2.OpenConns
+	s.IdleConns += s2.IdleConns
+	s.InFlight += s2.InFlight
+	s.PipelineCapacity += s2.PipelineCapacity
+}
+
+// connLoad is an optional interface of DnsConn to report its load.
+type connLoad interface {
+	load() (inFlight, capacity int)
+}
+
 // One method MUST be called in ReservedExchanger.
 type ReservedExchanger interface {
 	// ExchangeReserved sends q to the server and returns it's response.
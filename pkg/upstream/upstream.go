@@ -36,23 +36,23 @@ import (
 	"github.com/IrineSistiana/mosdns/v5/mlog"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/bootstrap"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/dnscrypt"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/doh"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/odoh"
 	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/transport"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/miekg/dns"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 	"go.uber.org/zap"
-	"golang.org/x/net/http2"
-	"golang.org/x/net/proxy"
 )
 
 const (
 	tlsHandshakeTimeout = time.Second * 3
 
-	// Maximum number of concurrent queries in one pipeline connection.
+	// Default maximum number of concurrent queries in one pipeline connection.
 	// See RFC 7766 7. Response Reordering.
-	// TODO: Make this configurable?
-	pipelineConcurrentLimit = 64
+	defaultPipelineConcurrentLimit = 64
 )
 
 // Upstream represents a DNS upstream.
@@ -66,6 +66,12 @@ type Upstream interface {
 	io.Closer
 }
 
+// StatsReporter is implemented by upstreams that have a connection pool.
+// (udp, tcp, tls, quic)
+type StatsReporter interface {
+	Stats() transport.Stats
+}
+
 type Opt struct {
 	// DialAddr specifies the address the upstream will
 	// actually dial to in the network layer by overwriting
@@ -77,10 +83,23 @@ type Opt struct {
 	DialAddr string
 
 	// Socks5 specifies the socks5 proxy server that the upstream
-	// will connect though.
-	// Not implemented for udp based protocols (aka. dns over udp, http3, quic).
+	// will connect though. Format: [socks5://][user:pass@]host:port.
+	// Udp based protocols (aka. dns over udp, http3, quic) connect
+	// directly unless Socks5UDP is set.
 	Socks5 string
 
+	// Socks5UDP makes udp based protocols relay packets through
+	// the Socks5 server by using UDP ASSOCIATE. The tcp fallback of
+	// dns over udp also connects through the Socks5 server.
+	Socks5UDP bool
+
+	// HTTPProxy specifies the http proxy server that the upstream
+	// will connect though by using CONNECT method.
+	// Format: http[s]://[user:pass@]host[:port].
+	// Udp based protocols ignore it and connect directly.
+	// Cannot be used with Socks5.
+	HTTPProxy string
+
 	// SoMark sets the socket SO_MARK option in unix system.
 	SoMark int
 
@@ -94,25 +113,70 @@ type Opt struct {
 	// EnablePipeline enables query pipelining support as RFC 7766 6.2.1.1 suggested.
 	// Available for TCP, DoT upstream.
 	// Note: There is no fallback. Make sure the server supports it.
+	// Use AutoPipeline if unsure.
 	EnablePipeline bool
 
+	// AutoPipeline detects query pipelining support on first use and
+	// falls back to connection reuse if the server does not support it.
+	// Available for TCP, DoT upstream. Ignored if EnablePipeline is set.
+	// MinConns only applies to the connection reuse mode.
+	AutoPipeline bool
+
+	// PipelineLimit is the maximum number of concurrent queries in one
+	// pipeline connection. Available for TCP, DoT upstream.
+	// Default: 64.
+	PipelineLimit int
+
+	// MaxConns limits the number of connections. Available for TCP, DoT, DoQ
+	// upstream. Default: no limit.
+	MaxConns int
+
+	// MinConns is the number of connections that are kept warm.
+	// Available for TCP, DoT, DoQ upstream.
+	MinConns int
+
+	// DialTimeout specifies the timeout for dialing a connection.
+	// Available for UDP (tcp fallback), TCP, DoT, DoQ upstream. Default: 5s.
+	DialTimeout time.Duration
+
+	// ODoHProxy is the https url of the proxy that odoh queries
+	// will be sent through. Required by odoh upstream.
+	// DialAddr, if set, applies to the proxy.
+	ODoHProxy string
+
 	// EnableHTTP3 will use HTTP/3 protocol to connect a DoH upstream. (aka DoH3).
 	// Note: There is no fallback. Make sure the server supports it.
+	// Use AutoHTTP3 if unsure.
 	EnableHTTP3 bool
 
-	// Bootstrap specifies a plain dns server to solve the
-	// upstream server domain address.
-	// It must be an IP address. Port is optional.
+	// AutoHTTP3 tries HTTP/3 first and falls back to HTTP/2 if the QUIC
+	// connection can't be established. The fallback is cached for a while.
+	// Ignored if EnableHTTP3 is set.
+	AutoHTTP3 bool
+
+	// Bootstrap specifies plain dns servers to solve the
+	// upstream server domain address. Multiple servers are
+	// separated by commas and will be queried at the same time.
+	// They must be IP addresses. Port is optional.
 	Bootstrap string
 
-	// Bootstrap version. One of 0 (default equals 4), 4, 6.
-	// TODO: Support dual-stack.
+	// Bootstrap version. One of 0 (default equals 4), 4, 6, 46 (dual-stack).
+	// All resolved addresses are dialed in the RFC 8305 (happy eyeballs) way.
 	BootstrapVer int
 
 	// TLSConfig specifies the tls.Config that the TLS client will use.
 	// Available for DoT, DoH, DoQ upstream.
 	TLSConfig *tls.Config
 
+	// RandomQueryID sends queries with random ids instead of sequential ones.
+	// Available for UDP upstream.
+	RandomQueryID bool
+
+	// ClientCookie sends dns cookies (RFC 7873) in queries that have EDNS0
+	// and drops responses that have mismatched client cookies.
+	// Available for UDP upstream.
+	ClientCookie bool
+
 	// Logger specifies the logger that the upstream will use.
 	Logger *zap.Logger
 
@@ -124,6 +188,8 @@ type Opt struct {
 // NewUpstream creates a upstream.
 // addr has the format of: [protocol://]host[:port][/path].
 // Supported protocol: udp/tcp/tls/https/quic. Default protocol is udp.
+// DNSCrypt upstreams are specified by their "sdns://" stamps.
+// Oblivious DoH upstreams use "odoh://host[:port][/path]" and require opt.ODoHProxy.
 //
 // Helper protocol:
 //   - tcp+pipeline/tls+pipeline: Automatically set opt.EnablePipeline to true.
@@ -135,6 +201,9 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 	if opt.EventObserver == nil {
 		opt.EventObserver = nopEO{}
 	}
+	if opt.PipelineLimit <= 0 {
+		opt.PipelineLimit = defaultPipelineConcurrentLimit
+	}
 
 	// parse protocol and server addr
 	if !strings.Contains(addr, "://") {
@@ -166,67 +235,118 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 		}),
 	}
 
-	var bootstrapAp netip.AddrPort
+	var s5 *socks5Server
+	if s := opt.Socks5; len(s) > 0 {
+		s5, err = parseSocks5(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid socks5 server, %w", err)
+		}
+	}
+	var hp *httpProxy
+	if s := opt.HTTPProxy; len(s) > 0 {
+		if s5 != nil {
+			return nil, errors.New("socks5 and http proxy cannot be used together")
+		}
+		hp, err = parseHTTPProxy(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http proxy, %w", err)
+		}
+	}
+
+	// udpS5 is the socks5 server that udp packets are relayed through.
+	var udpS5 *socks5Server
+	if opt.Socks5UDP {
+		udpS5 = s5
+	}
+
+	// listenPacket opens a udp socket. If udpS5 is set, the socket
+	// relays packets through the socks5 server.
+	listenPacket := func() (net.PacketConn, error) {
+		lc := net.ListenConfig{Control: getSocketControlFunc(socketOpts{so_mark: opt.SoMark, bind_to_device: opt.BindToDevice})}
+		c, err := lc.ListenPacket(context.Background(), "udp", "")
+		if err != nil {
+			return nil, err
+		}
+		if udpS5 != nil {
+			return newSocks5PacketConn(c, udpS5, dialer.DialContext), nil
+		}
+		return c, nil
+	}
+
+	var bootstrapAps []netip.AddrPort
 	if s := opt.Bootstrap; len(s) > 0 {
-		bootstrapAp, err = parseBootstrapAp(s)
+		bootstrapAps, err = parseBootstrapAps(s)
 		if err != nil {
 			return nil, fmt.Errorf("invalid bootstrap, %w", err)
 		}
 	}
 
-	newUdpAddrResolveFunc := func(defaultPort uint16) (func(ctx context.Context) (*net.UDPAddr, error), error) {
+	// newUdpAddrResolveFunc returns a func that resolves all addresses of the
+	// upstream. Callers should fail over to the next address on errors.
+	newUdpAddrResolveFunc := func(defaultPort uint16) (func(ctx context.Context) ([]netip.AddrPort, error), error) {
 		host, port, err := parseDialAddr(addrUrlHost, opt.DialAddr, defaultPort)
 		if err != nil {
 			return nil, err
 		}
 
 		if addr, err := netip.ParseAddr(host); err == nil { // host is an ip.
-			ua := net.UDPAddrFromAddrPort(netip.AddrPortFrom(addr, port))
-			return func(ctx context.Context) (*net.UDPAddr, error) {
-				return ua, nil
+			aps := []netip.AddrPort{netip.AddrPortFrom(addr, port)}
+			return func(ctx context.Context) ([]netip.AddrPort, error) {
+				return aps, nil
 			}, nil
 		} else { // Not an ip, assuming it's a domain name.
-			if bootstrapAp.IsValid() {
+			if len(bootstrapAps) > 0 {
 				// Bootstrap enabled.
-				bs, err := bootstrap.New(host, port, bootstrapAp, opt.BootstrapVer, opt.Logger)
+				bs, err := bootstrap.New(host, port, bootstrapAps, opt.BootstrapVer, opt.Logger)
 				if err != nil {
 					return nil, err
 				}
 
-				return func(ctx context.Context) (*net.UDPAddr, error) {
-					s, err := bs.GetAddrPortStr(ctx)
+				return func(ctx context.Context) ([]netip.AddrPort, error) {
+					aps, err := bs.GetAddrPorts(ctx)
 					if err != nil {
 						return nil, fmt.Errorf("bootstrap failed, %w", err)
 					}
-					return net.ResolveUDPAddr("udp", s)
+					return aps, nil
 				}, nil
 			} else {
 				// Bootstrap disabled.
-				dialAddr := joinPort(host, port)
-				return func(ctx context.Context) (*net.UDPAddr, error) {
-					return net.ResolveUDPAddr("udp", dialAddr)
+				return func(ctx context.Context) ([]netip.AddrPort, error) {
+					addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+					if err != nil {
+						return nil, err
+					}
+					aps := make([]netip.AddrPort, 0, len(addrs))
+					for _, addr := range addrs {
+						aps = append(aps, netip.AddrPortFrom(addr.Unmap(), port))
+					}
+					return aps, nil
 				}, nil
 			}
 		}
 	}
 
-	newTcpDialer := func(dialAddrMustBeIp bool, defaultPort uint16) (func(ctx context.Context) (net.Conn, error), error) {
-		host, port, err := parseDialAddr(addrUrlHost, opt.DialAddr, defaultPort)
+	newTcpDialerTo := func(urlHost, dialAddr string, dialAddrMustBeIp bool, defaultPort uint16) (func(ctx context.Context) (net.Conn, error), error) {
+		host, port, err := parseDialAddr(urlHost, dialAddr, defaultPort)
 		if err != nil {
 			return nil, err
 		}
 
-		// Socks5 enabled.
-		if s5Addr := opt.Socks5; len(s5Addr) > 0 {
-			socks5Dialer, err := proxy.SOCKS5("tcp", s5Addr, nil, dialer)
-			if err != nil {
-				return nil, fmt.Errorf("failed to init socks5 dialer: %w", err)
+		// Proxy enabled.
+		if s5 != nil || hp != nil {
+			var proxyDial dialFunc
+			if s5 != nil {
+				proxyDial, err = s5.newTcpDialer(dialer)
+				if err != nil {
+					return nil, fmt.Errorf("failed to init socks5 dialer: %w", err)
+				}
+			} else {
+				proxyDial = hp.newTcpDialer(dialer)
 			}
 
-			contextDialer := socks5Dialer.(proxy.ContextDialer)
 			dialAddr := net.JoinHostPort(host, strconv.Itoa(int(port)))
 			return func(ctx context.Context) (net.Conn, error) {
-				return contextDialer.DialContext(ctx, "tcp", dialAddr)
+				return proxyDial(ctx, "tcp", dialAddr)
 			}, nil
 		}
 
@@ -241,19 +361,22 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 				return nil, errors.New("addr must be an ip address")
 			}
 			// Host is not an ip addr, assuming it is a domain.
-			if bootstrapAp.IsValid() {
+			if len(bootstrapAps) > 0 {
 				// Bootstrap enabled.
-				bs, err := bootstrap.New(host, port, bootstrapAp, opt.BootstrapVer, opt.Logger)
+				bs, err := bootstrap.New(host, port, bootstrapAps, opt.BootstrapVer, opt.Logger)
 				if err != nil {
 					return nil, err
 				}
 
+				dial := func(ctx context.Context, addr string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "tcp", addr)
+				}
 				return func(ctx context.Context) (net.Conn, error) {
-					dialAddr, err := bs.GetAddrPortStr(ctx)
+					aps, err := bs.GetAddrPorts(ctx)
 					if err != nil {
 						return nil, fmt.Errorf("bootstrap failed, %w", err)
 					}
-					return dialer.DialContext(ctx, "tcp", dialAddr)
+					return dialParallel(ctx, aps, dial)
 				}, nil
 			} else {
 				// Bootstrap disabled.
@@ -265,6 +388,64 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 		}
 	}
 
+	newTcpDialer := func(dialAddrMustBeIp bool, defaultPort uint16) (func(ctx context.Context) (net.Conn, error), error) {
+		return newTcpDialerTo(addrUrlHost, opt.DialAddr, dialAddrMustBeIp, defaultPort)
+	}
+
+	// newH2Transport creates a http/2 transport that dials to tcpDialer.
+	newH2Transport := func(tcpDialer func(ctx context.Context) (net.Conn, error), idleConnTimeout time.Duration) (*http.Transport, error) {
+		return doh.NewH2Transport(func(ctx context.Context) (net.Conn, error) {
+			c, err := tcpDialer(ctx)
+			c = wrapConn(c, opt.EventObserver)
+			return c, err
+		}, opt.TLSConfig, idleConnTimeout)
+	}
+
+	// newStreamTransport creates the transport of tcp and tls upstreams.
+	// Zero idle timeouts use transport defaults.
+	newStreamTransport := func(dialNetConn func(ctx context.Context) (transport.NetConn, error), idleTimeout, reuseIdleTimeout time.Duration) Upstream {
+		newPipeline := func(minConns int) *transport.PipelineTransport {
+			to := transport.TraditionalDnsConnOpts{
+				WithLengthHeader:   true,
+				IdleTimeout:        idleTimeout,
+				MaxConcurrentQuery: opt.PipelineLimit,
+			}
+			dialDnsConn := func(ctx context.Context) (transport.DnsConn, error) {
+				c, err := dialNetConn(ctx)
+				if err != nil {
+					return nil, err
+				}
+				return transport.NewDnsConn(to, c), nil
+			}
+			return transport.NewPipelineTransport(transport.PipelineOpts{
+				DialContext:                    dialDnsConn,
+				MaxConcurrentQueryWhileDialing: opt.PipelineLimit,
+				DialTimeout:                    opt.DialTimeout,
+				MaxConns:                       opt.MaxConns,
+				MinConns:                       minConns,
+				Logger:                         opt.Logger,
+			})
+		}
+		newReuse := func() *transport.ReuseConnTransport {
+			return transport.NewReuseConnTransport(transport.ReuseConnOpts{
+				DialContext: dialNetConn,
+				DialTimeout: opt.DialTimeout,
+				IdleTimeout: reuseIdleTimeout,
+				MaxConns:    opt.MaxConns,
+				MinConns:    opt.MinConns,
+			})
+		}
+
+		switch {
+		case opt.EnablePipeline:
+			return newPipeline(opt.MinConns)
+		case opt.AutoPipeline:
+			return newAutoPipeline(newPipeline(0), newReuse(), dialNetConn, opt.Logger)
+		default:
+			return newReuse()
+		}
+	}
+
 	closeIfFuncErr := func(c io.Closer) {
 		if err != nil {
 			c.Close()
@@ -279,39 +460,66 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 		if err != nil {
 			return nil, err
 		}
-		if _, err := netip.ParseAddr(host); err != nil {
+		ip, err := netip.ParseAddr(host)
+		if err != nil {
 			return nil, fmt.Errorf("addr must be an ip address, %w", err)
 		}
 		dialAddr := joinPort(host, port)
+		// The tcp fallback connects directly, unless udp goes through
+		// the socks5 proxy.
+		tcpDialer := func(ctx context.Context) (net.Conn, error) {
+			return dialer.DialContext(ctx, "tcp", dialAddr)
+		}
+		if udpS5 != nil {
+			tcpDialer, err = newTcpDialer(true, defaultPort)
+			if err != nil {
+				return nil, fmt.Errorf("failed to init tcp dialer, %w", err)
+			}
+		}
 
 		dialUdpPipeline := func(ctx context.Context) (transport.DnsConn, error) {
-			c, err := dialer.DialContext(ctx, "udp", dialAddr)
-			if err != nil {
-				return nil, err
+			var c net.Conn
+			var err error
+			if udpS5 != nil {
+				pc, err := listenPacket()
+				if err != nil {
+					return nil, err
+				}
+				c = &packetConnWithRemote{PacketConn: pc, raddr: net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, port))}
+			} else {
+				c, err = dialer.DialContext(ctx, "udp", dialAddr)
+				if err != nil {
+					return nil, err
+				}
 			}
 			to := transport.TraditionalDnsConnOpts{
 				WithLengthHeader:   false,
 				IdleTimeout:        time.Minute * 5,
 				MaxConcurrentQuery: maxConcurrentQueryPreConn,
+				RandomQid:          opt.RandomQueryID,
 			}
 			return transport.NewDnsConn(to, wrapConn(c, opt.EventObserver)), nil
 		}
 		dialTcpNetConn := func(ctx context.Context) (transport.NetConn, error) {
-			c, err := dialer.DialContext(ctx, "tcp", dialAddr)
+			c, err := tcpDialer(ctx)
 			if err != nil {
 				return nil, err
 			}
 			return wrapConn(c, opt.EventObserver), nil
 		}
 
-		return &udpWithFallback{
+		u := &udpWithFallback{
 			u: transport.NewPipelineTransport(transport.PipelineOpts{
 				DialContext:                    dialUdpPipeline,
 				MaxConcurrentQueryWhileDialing: maxConcurrentQueryPreConn,
 				Logger:                         opt.Logger,
 			}),
-			t: transport.NewReuseConnTransport(transport.ReuseConnOpts{DialContext: dialTcpNetConn}),
-		}, nil
+			t: transport.NewReuseConnTransport(transport.ReuseConnOpts{DialContext: dialTcpNetConn, DialTimeout: opt.DialTimeout}),
+		}
+		if opt.ClientCookie {
+			u.cookie = newClientCookie()
+		}
+		return u, nil
 	case "tcp":
 		const defaultPort = 53
 		tcpDialer, err := newTcpDialer(true, defaultPort)
@@ -330,26 +538,7 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			}
 			return wrapConn(c, opt.EventObserver), nil
 		}
-		if opt.EnablePipeline {
-			to := transport.TraditionalDnsConnOpts{
-				WithLengthHeader:   true,
-				IdleTimeout:        idleTimeout,
-				MaxConcurrentQuery: pipelineConcurrentLimit,
-			}
-			dialDnsConn := func(ctx context.Context) (transport.DnsConn, error) {
-				c, err := dialNetConn(ctx)
-				if err != nil {
-					return nil, err
-				}
-				return transport.NewDnsConn(to, c), nil
-			}
-			return transport.NewPipelineTransport(transport.PipelineOpts{
-				DialContext:                    dialDnsConn,
-				MaxConcurrentQueryWhileDialing: pipelineConcurrentLimit,
-				Logger:                         opt.Logger,
-			}), nil
-		}
-		return transport.NewReuseConnTransport(transport.ReuseConnOpts{DialContext: dialNetConn, IdleTimeout: idleTimeout}), nil
+		return newStreamTransport(dialNetConn, idleTimeout, idleTimeout), nil
 	case "tls":
 		const defaultPort = 853
 		tlsConfig := opt.TLSConfig.Clone()
@@ -379,26 +568,7 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			return wrapConn(tlsConn, opt.EventObserver), nil
 		}
 
-		if opt.EnablePipeline {
-			to := transport.TraditionalDnsConnOpts{
-				WithLengthHeader:   true,
-				IdleTimeout:        opt.IdleTimeout,
-				MaxConcurrentQuery: pipelineConcurrentLimit,
-			}
-			dialDnsConn := func(ctx context.Context) (transport.DnsConn, error) {
-				c, err := dialNetConn(ctx)
-				if err != nil {
-					return nil, err
-				}
-				return transport.NewDnsConn(to, c), nil
-			}
-			return transport.NewPipelineTransport(transport.PipelineOpts{
-				DialContext:                    dialDnsConn,
-				MaxConcurrentQueryWhileDialing: pipelineConcurrentLimit,
-				Logger:                         opt.Logger,
-			}), nil
-		}
-		return transport.NewReuseConnTransport(transport.ReuseConnOpts{DialContext: dialNetConn}), nil
+		return newStreamTransport(dialNetConn, opt.IdleTimeout, 0), nil
 	case "https":
 		const defaultPort = 443
 
@@ -407,18 +577,14 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			idleConnTimeout = opt.IdleTimeout
 		}
 
-		var t http.RoundTripper
-		var addonCloser io.Closer
-		if opt.EnableHTTP3 {
+		newH3Transport := func(auto bool) (http.RoundTripper, io.Closer, error) {
 			udpBootstrap, err := newUdpAddrResolveFunc(defaultPort)
 			if err != nil {
-				return nil, fmt.Errorf("failed to init udp addr bootstrap, %w", err)
+				return nil, nil, fmt.Errorf("failed to init udp addr bootstrap, %w", err)
 			}
-
-			lc := net.ListenConfig{Control: getSocketControlFunc(socketOpts{so_mark: opt.SoMark, bind_to_device: opt.BindToDevice})}
-			conn, err := lc.ListenPacket(context.Background(), "udp", "")
+			conn, err := listenPacket()
 			if err != nil {
-				return nil, fmt.Errorf("failed to init udp socket for quic, %w", err)
+				return nil, nil, fmt.Errorf("failed to init udp socket for quic, %w", err)
 			}
 			quicTransport := &quic.Transport{
 				Conn: conn,
@@ -426,49 +592,68 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			quicConfig := newDefaultClientQuicConfig()
 			quicConfig.MaxIdleTimeout = idleConnTimeout
 
-			defer closeIfFuncErr(quicTransport)
-			addonCloser = quicTransport
-			t = &http3.RoundTripper{
+			dial := func(ctx context.Context, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+				aps, err := udpBootstrap(ctx)
+				if err != nil {
+					return nil, err
+				}
+				return raceDial(ctx, aps, func(ctx context.Context, ap netip.AddrPort) (quic.EarlyConnection, error) {
+					return quicTransport.DialEarly(ctx, net.UDPAddrFromAddrPort(ap), tlsCfg, cfg)
+				}, func(c quic.EarlyConnection) { c.CloseWithError(0, "") })
+			}
+			return &http3.RoundTripper{
 				TLSClientConfig: opt.TLSConfig,
 				QUICConfig:      quicConfig,
 				Dial: func(ctx context.Context, _ string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
-					ua, err := udpBootstrap(ctx)
+					if !auto {
+						return dial(ctx, tlsCfg, cfg)
+					}
+					ctx, cancel := context.WithTimeout(ctx, h3AutoDialTimeout)
+					defer cancel()
+					c, err := dial(ctx, tlsCfg, cfg)
 					if err != nil {
-						return nil, err
+						return nil, &h3DialErr{err: err}
 					}
-					return quicTransport.DialEarly(ctx, ua, tlsCfg, cfg)
+					return c, nil
 				},
 				MaxResponseHeaderBytes: 4 * 1024,
-			}
-		} else {
+			}, quicTransport, nil
+		}
+		newH2 := func() (http.RoundTripper, error) {
 			tcpDialer, err := newTcpDialer(false, defaultPort)
 			if err != nil {
 				return nil, fmt.Errorf("failed to init tcp dialer, %w", err)
 			}
-			t1 := &http.Transport{
-				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) { // overwrite server addr
-					c, err := tcpDialer(ctx)
-					c = wrapConn(c, opt.EventObserver)
-					return c, err
-				},
-				TLSClientConfig:     opt.TLSConfig,
-				TLSHandshakeTimeout: tlsHandshakeTimeout,
-				IdleConnTimeout:     idleConnTimeout,
+			return newH2Transport(tcpDialer, idleConnTimeout)
+		}
 
-				// Following opts are for http/1 only.
-				// MaxConnsPerHost:     2,
-				// MaxIdleConnsPerHost: 2,
+		var t http.RoundTripper
+		var addonCloser io.Closer
+		switch {
+		case opt.EnableHTTP3:
+			t, addonCloser, err = newH3Transport(false)
+			if err != nil {
+				return nil, err
 			}
-
-			t2, err := http2.ConfigureTransports(t1)
+			defer closeIfFuncErr(addonCloser)
+		case opt.AutoHTTP3 && hp == nil && (s5 == nil || udpS5 != nil):
+			// With a tcp only proxy, auto mode sticks to the proxied h2.
+			h3, closer, err := newH3Transport(true)
+			if err != nil {
+				return nil, err
+			}
+			addonCloser = closer
+			defer closeIfFuncErr(addonCloser)
+			h2, err := newH2()
+			if err != nil {
+				return nil, err
+			}
+			t = &h3Fallback{h3: h3, h2: h2, logger: opt.Logger}
+		default:
+			t, err = newH2()
 			if err != nil {
-				return nil, fmt.Errorf("failed to upgrade http2 support, %w", err)
+				return nil, err
 			}
-			t2.MaxHeaderListSize = 4 * 1024
-			t2.MaxReadFrameSize = 16 * 1024
-			t2.ReadIdleTimeout = time.Second * 30
-			t2.PingTimeout = time.Second * 5
-			t = t1
 		}
 
 		u, err := doh.NewUpstream(addrURL.String(), t, opt.Logger)
@@ -509,8 +694,7 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			opt.Logger.Warn("failed to init quic stateless reset key, it will be disabled", zap.Error(err))
 		}
 
-		lc := net.ListenConfig{Control: getSocketControlFunc(socketOpts{so_mark: opt.SoMark, bind_to_device: opt.BindToDevice})}
-		uc, err := lc.ListenPacket(context.Background(), "udp", "")
+		uc, err := listenPacket()
 		if err != nil {
 			return nil, fmt.Errorf("failed to init udp socket for quic, %w", err)
 		}
@@ -520,22 +704,26 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			StatelessResetKey: (*quic.StatelessResetKey)(srk),
 		}
 
-		dialDnsConn := func(ctx context.Context) (transport.DnsConn, error) {
-			ua, err := udpBootstrap(ctx)
-			if err != nil {
-				return nil, fmt.Errorf("bootstrap failed, %w", err)
-			}
-
+		dialQuic := func(ctx context.Context, ua *net.UDPAddr) (quic.Connection, error) {
 			// This is a workaround to
 			// 1. recover from strange 0rtt rejected err.
 			// 2. avoid NextConnection might block forever.
 			// TODO: Remove this workaround.
-			var c quic.Connection
 			ec, err := t.DialEarly(ctx, ua, tlsConfig, quicConfig)
 			if err != nil {
 				return nil, err
 			}
-			c, err = ec.NextConnection(ctx)
+			return ec.NextConnection(ctx)
+		}
+		dialDnsConn := func(ctx context.Context) (transport.DnsConn, error) {
+			aps, err := udpBootstrap(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("bootstrap failed, %w", err)
+			}
+
+			c, err := raceDial(ctx, aps, func(ctx context.Context, ap netip.AddrPort) (quic.Connection, error) {
+				return dialQuic(ctx, net.UDPAddrFromAddrPort(ap))
+			}, func(c quic.Connection) { c.CloseWithError(0, "") })
 			if err != nil {
 				return nil, err
 			}
@@ -546,19 +734,86 @@ func NewUpstream(addr string, opt Opt) (_ Upstream, err error) {
 			DialContext: dialDnsConn,
 			// Quic rfc recommendation is 100. Some implications use 65535.
 			MaxConcurrentQueryWhileDialing: 90,
+			DialTimeout:                    opt.DialTimeout,
+			MaxConns:                       opt.MaxConns,
+			MinConns:                       opt.MinConns,
 			Logger:                         opt.Logger,
 		}), nil
+	case "odoh":
+		const defaultPort = 443
+		if len(opt.ODoHProxy) == 0 {
+			return nil, errors.New("odoh upstream requires a proxy")
+		}
+		proxyURL, err := url.Parse(opt.ODoHProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid odoh proxy, %w", err)
+		}
+		idleConnTimeout := time.Second * 30
+		if opt.IdleTimeout > 0 {
+			idleConnTimeout = opt.IdleTimeout
+		}
+
+		proxyDialer, err := newTcpDialerTo(tryTrimIpv6Brackets(proxyURL.Host), opt.DialAddr, false, defaultPort)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init proxy tcp dialer, %w", err)
+		}
+		// Both queries and target configs are sent through the proxy.
+		proxyT, err := newH2Transport(proxyDialer, idleConnTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		targetURL := *addrURL
+		targetURL.Scheme = "https"
+		return odoh.NewUpstream(targetURL.String(), proxyURL.String(), proxyT, opt.Logger)
+	case "sdns":
+		stamp, err := dnscrypt.ParseStamp(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stamp, %w", err)
+		}
+		if stamp.Proto != dnscrypt.StampProtoDNSCrypt {
+			return nil, errors.New("only dnscrypt stamp is supported")
+		}
+		dialAddr := stamp.ServerAddrPort()
+		if len(opt.DialAddr) > 0 {
+			_, stampPort, err := trySplitHostPort(dialAddr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid stamp server address, %w", err)
+			}
+			host, port, err := parseDialAddr("", opt.DialAddr, stampPort)
+			if err != nil {
+				return nil, err
+			}
+			dialAddr = joinPort(host, port)
+		}
+		return dnscrypt.NewUpstream(stamp, dnscrypt.Opts{
+			DialContext: func(ctx context.Context, network string) (net.Conn, error) {
+				c, err := dialer.DialContext(ctx, network, dialAddr)
+				if err != nil {
+					return nil, err
+				}
+				return wrapConn(c, opt.EventObserver), nil
+			},
+			Logger: opt.Logger,
+		})
 	default:
 		return nil, fmt.Errorf("unsupported protocol [%s]", addrURL.Scheme)
 	}
 }
 
 type udpWithFallback struct {
-	u *transport.PipelineTransport
-	t *transport.ReuseConnTransport
+	u      *transport.PipelineTransport
+	t      *transport.ReuseConnTransport
+	cookie *clientCookie // nil if client cookie is disabled
 }
 
 func (u *udpWithFallback) ExchangeContext(ctx context.Context, q []byte) (*[]byte, error) {
+	if u.cookie != nil {
+		m := new(dns.Msg)
+		if err := m.Unpack(q); err == nil && m.IsEdns0() != nil {
+			return u.exchangeWithCookie(ctx, m)
+		}
+	}
 	r, err := u.u.ExchangeContext(ctx, q)
 	if err != nil {
 		return nil, err
@@ -570,6 +825,63 @@ func (u *udpWithFallback) ExchangeContext(ctx context.Context, q []byte) (*[]byt
 	return r, nil
 }
 
+// exchangeWithCookie sends m with our cookie. If the upstream responds
+// BADCOOKIE, the query will be retried once with the new server cookie,
+// then over tcp. Responses with a bad or missing cookie may be spoofed,
+// they are discarded and the query is retried over tcp. See RFC 7873 5.3.
+func (u *udpWithFallback) exchangeWithCookie(ctx context.Context, m *dns.Msg) (*[]byte, error) {
+	for i := 0; i < 2; i++ {
+		u.cookie.setCookie(m.IsEdns0())
+		b, err := pool.PackBuffer(m)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pack query, %w", err)
+		}
+		r, err := u.u.ExchangeContext(ctx, *b)
+		pool.ReleaseBuf(b)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := new(dns.Msg)
+		if err := resp.Unpack(*r); err != nil {
+			pool.ReleaseBuf(r)
+			return nil, fmt.Errorf("invalid response, %w", err)
+		}
+		if err := u.cookie.checkResp(resp); err != nil || resp.Truncated {
+			pool.ReleaseBuf(r)
+			break
+		}
+		if resp.Rcode == dns.RcodeBadCookie {
+			pool.ReleaseBuf(r)
+			continue
+		}
+		return r, nil
+	}
+
+	// Retry over tcp, with the server cookie we may just learned.
+	u.cookie.setCookie(m.IsEdns0())
+	b, err := pool.PackBuffer(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack query, %w", err)
+	}
+	defer pool.ReleaseBuf(b)
+	r, err := u.t.ExchangeContext(ctx, *b)
+	if err != nil {
+		return nil, err
+	}
+	// Tcp responses can't be spoofed off-path. Learn the server cookie.
+	if resp := new(dns.Msg); resp.Unpack(*r) == nil {
+		_ = u.cookie.checkResp(resp)
+	}
+	return r, nil
+}
+
+func (u *udpWithFallback) Stats() transport.Stats {
+	s := u.u.Stats()
+	s.Add(u.t.Stats())
+	return s
+}
+
 func (u *udpWithFallback) Close() error {
 	u.u.Close()
 	u.t.Close()
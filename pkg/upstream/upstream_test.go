@@ -66,6 +66,28 @@ func newTCPTestServer(t testing.TB, handler dns.Handler) (addr string, shutdownF
 	}
 }
 
+// newUDPTCPTestServer starts handler on udp and tcp of the same port.
+func newUDPTCPTestServer(t testing.TB, handler dns.Handler) (addr string, shutdownFunc func()) {
+	t.Helper()
+	uc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", uc.LocalAddr().String())
+	if err != nil {
+		uc.Close()
+		t.Skipf("failed to listen tcp on the same port, %v", err)
+	}
+	us := &dns.Server{PacketConn: uc, Handler: handler}
+	ts := &dns.Server{Listener: l, Handler: handler}
+	go us.ActivateAndServe()
+	go ts.ActivateAndServe()
+	return uc.LocalAddr().String(), func() {
+		us.Shutdown()
+		ts.Shutdown()
+	}
+}
+
 func newDoTTestServer(t testing.TB, handler dns.Handler) (addr string, shutdownFunc func()) {
 	serverName := "test"
 	cert, err := utils.GenerateCertificate(serverName)
@@ -231,3 +253,17 @@ func (s *vServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 	time.Sleep(s.latency)
 	w.WriteMsg(r)
 }
+
+func Test_tryTrimIpv6Brackets(t *testing.T) {
+	for s, want := range map[string]string{
+		"[::1]":    "::1",
+		"[fe80::]": "fe80::",
+		"::1":      "::1",
+		"1.1.1.1":  "1.1.1.1",
+		"[":        "[",
+	} {
+		if got := tryTrimIpv6Brackets(s); got != want {
+			t.Fatalf("tryTrimIpv6Brackets(%s) = %s, want %s", s, got, want)
+		}
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"net"
 	"net/netip"
 	"strconv"
+	"strings"
 )
 
 type socketOpts struct {
@@ -74,6 +75,23 @@ func trySplitHostPort(s string) (string, uint16, error) {
 	return s, 0, nil
 }
 
+// parseBootstrapAps parses comma separated bootstrap servers.
+func parseBootstrapAps(s string) ([]netip.AddrPort, error) {
+	var aps []netip.AddrPort
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if len(e) == 0 {
+			continue
+		}
+		ap, err := parseBootstrapAp(e)
+		if err != nil {
+			return nil, err
+		}
+		aps = append(aps, ap)
+	}
+	return aps, nil
+}
+
 func parseBootstrapAp(s string) (netip.AddrPort, error) {
 	host, port, err := trySplitHostPort(s)
 	if err != nil {
@@ -94,7 +112,7 @@ func tryTrimIpv6Brackets(s string) string {
 		return s
 	}
 	if s[0] == '[' && s[len(s)-1] == ']' {
-		return s[1 : len(s)-2]
+		return s[1 : len(s)-1]
 	}
 	return s
 }
@@ -22,6 +22,7 @@ package utils
 import (
 	"net"
 	"net/netip"
+	"strings"
 )
 
 // GetIPFromAddr returns a net.IP from the given net.Addr.
@@ -56,3 +57,25 @@ func SplitSchemeAndHost(addr string) (protocol, host string) {
 		return "", addr
 	}
 }
+
+// ParsePrefix parses s as a CIDR or an ip address. The prefix is masked.
+// IPv4-mapped IPv6 addresses are unmapped, so the prefix contains
+// unmapped addresses.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if addr := p.Addr(); addr.Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(addr.Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
@@ -20,6 +20,7 @@
 package utils
 
 import (
+	"net/netip"
 	"reflect"
 	"testing"
 )
@@ -121,3 +122,32 @@ func Test_WeakDecode2(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func Test_ParsePrefix(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{s: "10.0.0.1", want: "10.0.0.1/32"},
+		{s: "::ffff:10.0.0.1", want: "10.0.0.1/32"},
+		{s: "2001:db8::1", want: "2001:db8::1/128"},
+		{s: "10.1.2.3/8", want: "10.0.0.0/8"},
+		{s: "::ffff:10.0.0.0/104", want: "10.0.0.0/8"},
+		{s: "2001:db8::1/32", want: "2001:db8::/32"},
+		{s: "10.0.0.0/33", wantErr: true},
+		{s: "invalid", wantErr: true},
+	}
+	for _, tt := range tests {
+		p, err := ParsePrefix(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: want err %v, got %v", tt.s, tt.wantErr, err)
+		}
+		if err == nil && p != netip.MustParsePrefix(tt.want) {
+			t.Fatalf("%s: want %s, got %s", tt.s, tt.want, p)
+		}
+	}
+	if p, _ := ParsePrefix("::ffff:10.0.0.0/104"); !p.Contains(netip.MustParseAddr("10.1.2.3")) {
+		t.Fatal("mapped prefix should contain unmapped addresses")
+	}
+}
@@ -0,0 +1,336 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zone_file
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	soaQueryTimeout      = time.Second * 5
+	xfrDialTimeout       = time.Second * 5
+	xfrReadTimeout       = time.Second * 30
+	minRefreshInterval   = time.Second
+	initialRetryInterval = time.Second * 10
+	tsigFudge            = 300
+)
+
+// TSIG is a TSIG key. See RFC 8945.
+type TSIG struct {
+	Name      string // canonical key name
+	Algorithm string // canonical algorithm name
+	Secret    string // base64 encoded
+}
+
+// NewTSIG validates the key. The default algorithm is hmac-sha256.
+func NewTSIG(name, algorithm, secret string) (*TSIG, error) {
+	if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+		return nil, fmt.Errorf("invalid tsig secret, %w", err)
+	}
+	if len(algorithm) == 0 {
+		algorithm = dns.HmacSHA256
+	}
+	alg := dns.CanonicalName(algorithm)
+	switch alg {
+	case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+	default:
+		return nil, fmt.Errorf("unsupported tsig algorithm %s", algorithm)
+	}
+	return &TSIG{Name: dns.CanonicalName(name), Algorithm: alg, Secret: secret}, nil
+}
+
+// ParsePrimary parses a primary server address "ip[:port]".
+func ParsePrimary(s string) (netip.AddrPort, error) {
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return netip.AddrPortFrom(addr, 53), nil
+	}
+	return netip.ParseAddrPort(s)
+}
+
+// Client transfers zones from a primary server.
+type Client struct {
+	Primary netip.AddrPort
+	TSIG    *TSIG // optional
+}
+
+func (c *Client) setTsig(m *dns.Msg) map[string]string {
+	if c.TSIG == nil {
+		return nil
+	}
+	m.SetTsig(c.TSIG.Name, c.TSIG.Algorithm, tsigFudge, time.Now().Unix())
+	return map[string]string{c.TSIG.Name: c.TSIG.Secret}
+}
+
+// QuerySerial queries the SOA serial of origin.
+func (c *Client) QuerySerial(ctx context.Context, origin string) (uint32, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(origin, dns.TypeSOA)
+	dc := &dns.Client{Net: "udp", TsigSecret: c.setTsig(m)}
+	r, _, err := dc.ExchangeContext(ctx, m, c.Primary.String())
+	if err == nil && r.Truncated {
+		dc.Net = "tcp"
+		r, _, err = dc.ExchangeContext(ctx, m, c.Primary.String())
+	}
+	if err != nil {
+		return 0, err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("rcode %s", dns.RcodeToString[r.Rcode])
+	}
+	for _, rr := range r.Answer {
+		if soa, ok := rr.(*dns.SOA); ok && dns.CanonicalName(soa.Hdr.Name) == origin {
+			return soa.Serial, nil
+		}
+	}
+	return 0, errors.New("no soa in the response")
+}
+
+// Transfer sends the AXFR or IXFR query m and returns all records.
+func (c *Client) Transfer(m *dns.Msg) ([]dns.RR, error) {
+	t := &dns.Transfer{
+		DialTimeout:  xfrDialTimeout,
+		ReadTimeout:  xfrReadTimeout,
+		WriteTimeout: xfrDialTimeout,
+		TsigSecret:   c.setTsig(m),
+	}
+	env, err := t.In(m, c.Primary.String())
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			err = e.Error
+			continue // drain the channel
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rrs, nil
+}
+
+// Sync checks the serial of primary and transfers origin if it is newer than
+// z. z can be nil. It uses IXFR if z is not nil. If z is up to date, Sync
+// returns a nil zone. diffs are the changes from z to the new zone.
+func (c *Client) Sync(ctx context.Context, origin string, z *Zone) (nz *Zone, diffs []*Diff, err error) {
+	serial, err := c.QuerySerial(ctx, origin)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query soa, %w", err)
+	}
+	if z != nil && !SerialGreater(serial, z.soa.Serial) {
+		return nil, nil, nil
+	}
+
+	m := new(dns.Msg)
+	if z == nil {
+		m.SetAxfr(origin)
+	} else {
+		m.SetIxfr(origin, z.soa.Serial, z.soa.Ns, z.soa.Mbox)
+	}
+	rrs, err := c.Transfer(m)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to transfer zone, %w", err)
+	}
+	if len(rrs) == 1 && z != nil {
+		return nil, nil, nil // A single SOA, z is up to date.
+	}
+
+	if z != nil && IsIncrementalIXFR(rrs) {
+		nz, diffs, err = ApplyIXFR(z, rrs)
+	} else {
+		nz, err = NewZoneFromAXFR(origin, rrs)
+		if err == nil && z != nil {
+			diffs = []*Diff{DiffZones(z, nz)}
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if z != nil && !SerialGreater(nz.soa.Serial, z.soa.Serial) {
+		return nil, nil, nil
+	}
+	return nz, diffs, nil
+}
+
+type SecondaryOpts struct {
+	Origin string
+	Client *Client
+
+	// File is optional. If set, the zone is persisted to it and is loaded
+	// from it at start.
+	File   string
+	Logger *zap.Logger
+
+	// OnUpdate is called when the zone is loaded, transferred or expired.
+	// z is nil if the zone is expired. diffs are the changes from the last
+	// zone, it is nil if the changes are unknown.
+	// OnUpdate is called from one goroutine at a time.
+	OnUpdate func(z *Zone, diffs []*Diff)
+}
+
+// Secondary keeps a zone in sync with its primary, honouring the SOA
+// refresh, retry and expire timers. See RFC 1034 4.3.5.
+type Secondary struct {
+	opts   SecondaryOpts
+	logger *zap.Logger
+
+	notifyC     chan struct{}
+	closeOnce   sync.Once
+	closeNotify chan struct{}
+
+	// only accessed by run after NewSecondary returns.
+	z           *Zone
+	lastRefresh time.Time
+}
+
+// NewSecondary creates a Secondary. If opts.File exists, the zone is loaded
+// from it and opts.OnUpdate is called before NewSecondary returns.
+// Call Start to start syncing.
+func NewSecondary(opts SecondaryOpts) *Secondary {
+	opts.Origin = dns.CanonicalName(opts.Origin)
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	s := &Secondary{
+		opts:        opts,
+		logger:      opts.Logger.With(zap.String("zone", opts.Origin)),
+		notifyC:     make(chan struct{}, 1),
+		closeNotify: make(chan struct{}),
+	}
+
+	if len(opts.File) > 0 {
+		z, err := LoadZoneFile(opts.File, opts.Origin)
+		switch {
+		case err == nil:
+			s.z = z
+			if fi, err := os.Stat(opts.File); err == nil {
+				s.lastRefresh = fi.ModTime()
+			}
+			opts.OnUpdate(z, nil)
+		case errors.Is(err, os.ErrNotExist):
+		default:
+			s.logger.Warn("failed to load persisted zone", zap.String("file", opts.File), zap.Error(err))
+		}
+	}
+	return s
+}
+
+// Primary returns the primary address.
+func (s *Secondary) Primary() netip.AddrPort {
+	return s.opts.Client.Primary
+}
+
+func (s *Secondary) Start() {
+	go s.run()
+}
+
+// Notify triggers an immediate refresh. See RFC 1996.
+func (s *Secondary) Notify() {
+	select {
+	case s.notifyC <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Secondary) Close() {
+	s.closeOnce.Do(func() { close(s.closeNotify) })
+}
+
+func (s *Secondary) run() {
+	for {
+		timer := time.NewTimer(s.refresh())
+		select {
+		case <-timer.C:
+		case <-s.notifyC:
+			timer.Stop()
+		case <-s.closeNotify:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// refresh syncs the zone and returns the interval to the next refresh.
+func (s *Secondary) refresh() time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), soaQueryTimeout)
+	defer cancel()
+	nz, diffs, err := s.opts.Client.Sync(ctx, s.opts.Origin, s.z)
+	if err == nil {
+		s.lastRefresh = time.Now()
+		if nz != nil {
+			s.update(nz, diffs)
+		}
+		return max(time.Duration(s.z.soa.Refresh)*time.Second, minRefreshInterval)
+	}
+
+	s.logger.Warn("failed to refresh zone", zap.Error(err))
+	if s.z == nil {
+		return initialRetryInterval
+	}
+	soa := s.z.soa
+	if time.Since(s.lastRefresh) > time.Duration(soa.Expire)*time.Second {
+		s.logger.Error("zone expired", zap.Uint32("serial", soa.Serial))
+		s.z = nil
+		s.opts.OnUpdate(nil, nil)
+		return initialRetryInterval
+	}
+	return max(time.Duration(soa.Retry)*time.Second, minRefreshInterval)
+}
+
+func (s *Secondary) update(nz *Zone, diffs []*Diff) {
+	s.z = nz
+	s.opts.OnUpdate(nz, diffs)
+	s.logger.Info("zone transferred", zap.Uint32("serial", nz.soa.Serial), zap.Int("records", len(nz.records)))
+	if len(s.opts.File) > 0 {
+		if err := persist(nz, s.opts.File); err != nil {
+			s.logger.Warn("failed to persist zone", zap.String("file", s.opts.File), zap.Error(err))
+		}
+	}
+}
+
+// persist writes z to file atomically.
+func persist(z *Zone, file string) error {
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := z.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
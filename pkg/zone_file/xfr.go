@@ -0,0 +1,182 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zone_file
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Diff is the difference between two versions of a zone. See RFC 1995.
+type Diff struct {
+	From, To *dns.SOA
+	Deleted  []dns.RR // SOA is not included.
+	Added    []dns.RR // SOA is not included.
+}
+
+// DiffZones returns the difference from old to new.
+func DiffZones(old, new *Zone) *Diff {
+	d := &Diff{From: old.soa, To: new.soa}
+	oldSet := make(map[string]struct{}, len(old.records))
+	for _, rr := range old.records {
+		oldSet[rrKey(rr)] = struct{}{}
+	}
+	newSet := make(map[string]struct{}, len(new.records))
+	for _, rr := range new.records {
+		k := rrKey(rr)
+		newSet[k] = struct{}{}
+		if _, ok := oldSet[k]; !ok {
+			d.Added = append(d.Added, rr)
+		}
+	}
+	for _, rr := range old.records {
+		if _, ok := newSet[rrKey(rr)]; !ok {
+			d.Deleted = append(d.Deleted, rr)
+		}
+	}
+	return d
+}
+
+func rrKey(rr dns.RR) string {
+	rr = dns.Copy(rr)
+	rr.Header().Name = dns.CanonicalName(rr.Header().Name)
+	return rr.String()
+}
+
+// SerialGreater reports whether serial a is greater than b. See RFC 1982.
+func SerialGreater(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// IXFR returns the records of an IXFR response to a client that has the
+// version serial. journal must be continuous diffs that end with z.
+// If journal does not cover serial, a full zone in AXFR format is returned.
+// See RFC 1995 4.
+func IXFR(z *Zone, journal []*Diff, serial uint32) []dns.RR {
+	if !SerialGreater(z.soa.Serial, serial) {
+		return []dns.RR{dns.Copy(z.soa)}
+	}
+	start := -1
+	for i, d := range journal {
+		if d.From.Serial == serial {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return z.AXFR()
+	}
+
+	rrs := []dns.RR{dns.Copy(z.soa)}
+	for _, d := range journal[start:] {
+		rrs = append(rrs, dns.Copy(d.From))
+		rrs = append(rrs, copyRRs(d.Deleted, "")...)
+		rrs = append(rrs, dns.Copy(d.To))
+		rrs = append(rrs, copyRRs(d.Added, "")...)
+	}
+	return append(rrs, dns.Copy(z.soa))
+}
+
+// NewZoneFromAXFR builds a zone from the records of an AXFR response, which
+// starts and ends with the SOA.
+func NewZoneFromAXFR(origin string, rrs []dns.RR) (*Zone, error) {
+	if len(rrs) < 2 || rrs[0].Header().Rrtype != dns.TypeSOA || rrs[len(rrs)-1].Header().Rrtype != dns.TypeSOA {
+		return nil, errors.New("invalid axfr response, records are not enclosed by soa")
+	}
+	return NewZone(origin, rrs[:len(rrs)-1])
+}
+
+// IsIncrementalIXFR reports whether rrs is an IXFR response in the incremental
+// format, rather than a single SOA or a full zone.
+func IsIncrementalIXFR(rrs []dns.RR) bool {
+	return len(rrs) > 2 && rrs[0].Header().Rrtype == dns.TypeSOA && rrs[1].Header().Rrtype == dns.TypeSOA
+}
+
+// ApplyIXFR applies an incremental IXFR response to z. It returns the new
+// zone and the diffs in the response. See RFC 1995 4.
+func ApplyIXFR(z *Zone, rrs []dns.RR) (*Zone, []*Diff, error) {
+	if !IsIncrementalIXFR(rrs) {
+		return nil, nil, errors.New("not an incremental ixfr response")
+	}
+	newSOA := rrs[0].(*dns.SOA)
+	if last, ok := rrs[len(rrs)-1].(*dns.SOA); !ok || last.Serial != newSOA.Serial {
+		return nil, nil, errors.New("invalid ixfr response, records are not enclosed by soa")
+	}
+
+	records := make(map[string]dns.RR, len(z.records))
+	order := make([]string, 0, len(z.records))
+	for _, rr := range z.records {
+		k := rrKey(rr)
+		records[k] = rr
+		order = append(order, k)
+	}
+
+	var diffs []*Diff
+	cur := z.soa
+	body := rrs[1 : len(rrs)-1]
+	for len(body) > 0 {
+		d := new(Diff)
+		var ok bool
+		if d.From, ok = body[0].(*dns.SOA); !ok || d.From.Serial != cur.Serial {
+			return nil, nil, fmt.Errorf("invalid ixfr response, diff does not start from serial %d", cur.Serial)
+		}
+		body = body[1:]
+		for len(body) > 0 && body[0].Header().Rrtype != dns.TypeSOA {
+			d.Deleted = append(d.Deleted, body[0])
+			delete(records, rrKey(body[0]))
+			body = body[1:]
+		}
+		if len(body) == 0 {
+			return nil, nil, errors.New("invalid ixfr response, missing the soa of the new version")
+		}
+		d.To = body[0].(*dns.SOA)
+		body = body[1:]
+		for len(body) > 0 && body[0].Header().Rrtype != dns.TypeSOA {
+			k := rrKey(body[0])
+			if _, dup := records[k]; !dup {
+				order = append(order, k)
+			}
+			records[k] = body[0]
+			d.Added = append(d.Added, body[0])
+			body = body[1:]
+		}
+		diffs = append(diffs, d)
+		cur = d.To
+	}
+	if cur.Serial != newSOA.Serial {
+		return nil, nil, fmt.Errorf("invalid ixfr response, diffs end with serial %d", cur.Serial)
+	}
+
+	newRRs := make([]dns.RR, 0, len(records)+1)
+	newRRs = append(newRRs, newSOA)
+	for _, k := range order {
+		if rr, ok := records[k]; ok {
+			newRRs = append(newRRs, rr)
+			delete(records, k) // order may have a key twice
+		}
+	}
+	nz, err := NewZone(z.origin, newRRs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nz, diffs, nil
+}
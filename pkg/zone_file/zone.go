@@ -0,0 +1,339 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zone_file
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain is the max length of in-zone cname chain that Zone.Reply follows.
+const maxCNAMEChain = 8
+
+// Zone is an authoritative zone. It is read-only after built and is
+// concurrent safe.
+type Zone struct {
+	origin  string
+	soa     *dns.SOA
+	nodes   map[string]*node // canonical name -> node, including empty non-terminals
+	records []dns.RR         // all records except the SOA, in loading order
+}
+
+type node struct {
+	rrsets map[uint16][]dns.RR
+}
+
+// NewZone builds a zone from rrs. rrs must have exactly one SOA at origin
+// and the NS records of origin.
+func NewZone(origin string, rrs []dns.RR) (*Zone, error) {
+	z := &Zone{
+		origin: dns.CanonicalName(origin),
+		nodes:  make(map[string]*node),
+	}
+	z.nodes[z.origin] = &node{}
+	for _, rr := range rrs {
+		h := rr.Header()
+		name := dns.CanonicalName(h.Name)
+		if !dns.IsSubDomain(z.origin, name) {
+			return nil, fmt.Errorf("record %s is out of zone %s", h.Name, z.origin)
+		}
+		if soa, ok := rr.(*dns.SOA); ok {
+			if name != z.origin {
+				return nil, fmt.Errorf("soa %s is not at the zone apex", h.Name)
+			}
+			if z.soa != nil {
+				return nil, errors.New("multiple soa records")
+			}
+			z.soa = soa
+		}
+		z.add(name, rr)
+	}
+	if z.soa == nil {
+		return nil, errors.New("no soa record")
+	}
+	if len(z.nodes[z.origin].rrsets[dns.TypeNS]) == 0 {
+		return nil, errors.New("no ns record at the zone apex")
+	}
+	for name, n := range z.nodes {
+		if len(n.rrsets[dns.TypeCNAME]) > 0 && len(n.rrsets) > 1 {
+			return nil, fmt.Errorf("%s has cname and other data", name)
+		}
+	}
+	return z, nil
+}
+
+func (z *Zone) add(name string, rr dns.RR) {
+	n := z.nodes[name]
+	if n == nil {
+		n = &node{}
+		z.nodes[name] = n
+		// Empty non-terminals.
+		for c := parentName(name); c != z.origin; c = parentName(c) {
+			if _, ok := z.nodes[c]; ok {
+				break
+			}
+			z.nodes[c] = &node{}
+		}
+	}
+	if n.rrsets == nil {
+		n.rrsets = make(map[uint16][]dns.RR)
+	}
+	typ := rr.Header().Rrtype
+	for _, e := range n.rrsets[typ] {
+		if dns.IsDuplicate(e, rr) {
+			return
+		}
+	}
+	n.rrsets[typ] = append(n.rrsets[typ], rr)
+	if typ != dns.TypeSOA {
+		z.records = append(z.records, rr)
+	}
+}
+
+// ParseZone parses a zone in RFC 1035 zone file format. If origin is empty,
+// the owner of the SOA is used. file is used for $INCLUDE and error messages.
+func ParseZone(r io.Reader, origin, file string) (*Zone, error) {
+	zpOrigin := origin
+	if len(zpOrigin) == 0 {
+		zpOrigin = "."
+	}
+	zp := dns.NewZoneParser(r, zpOrigin, file)
+	zp.SetDefaultTTL(3600)
+	zp.SetIncludeAllowed(true)
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if len(origin) == 0 && rr.Header().Rrtype == dns.TypeSOA {
+			origin = rr.Header().Name
+		}
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(origin) == 0 {
+		return nil, errors.New("no soa record")
+	}
+	return NewZone(origin, rrs)
+}
+
+// LoadZoneFile loads a zone from file. See ParseZone.
+func LoadZoneFile(file, origin string) (*Zone, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseZone(f, origin, file)
+}
+
+// Origin returns the canonical zone name.
+func (z *Zone) Origin() string {
+	return z.origin
+}
+
+// SOA returns the SOA record. Caller must not modify it.
+func (z *Zone) SOA() *dns.SOA {
+	return z.soa
+}
+
+// Records returns all records except the SOA. Caller must not modify them.
+func (z *Zone) Records() []dns.RR {
+	return z.records
+}
+
+// WriteTo writes the zone in zone file format.
+func (z *Zone) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	n := int64(0)
+	for _, rr := range append([]dns.RR{z.soa}, z.records...) {
+		m, err := bw.WriteString(rr.String() + "\n")
+		n += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Flush()
+}
+
+// AXFR returns a copy of the zone in AXFR format, which starts and
+// ends with the SOA.
+func (z *Zone) AXFR() []dns.RR {
+	rrs := make([]dns.RR, 0, len(z.records)+2)
+	rrs = append(rrs, dns.Copy(z.soa))
+	for _, rr := range z.records {
+		rrs = append(rrs, dns.Copy(rr))
+	}
+	return append(rrs, dns.Copy(z.soa))
+}
+
+// Reply returns the authoritative response to q. The question of q must be
+// in the zone. Answers are copies and can be modified by caller.
+func (z *Zone) Reply(q *dns.Msg) *dns.Msg {
+	question := q.Question[0]
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+
+	name := dns.CanonicalName(question.Name)
+	for i := 0; i <= maxCNAMEChain; i++ {
+		target, follow := z.lookup(r, name, question.Qtype)
+		if !follow || !dns.IsSubDomain(z.origin, target) {
+			break
+		}
+		name = target
+	}
+	z.addAdditional(r)
+	return r
+}
+
+// lookup looks up name and qtype, see RFC 1034 4.3.2. It returns the cname
+// target if name is an alias.
+func (z *Zone) lookup(r *dns.Msg, name string, qtype uint16) (string, bool) {
+	if ns := z.findCut(name, qtype); ns != nil {
+		if len(r.Answer) == 0 {
+			r.Authoritative = false
+		}
+		r.Ns = append(r.Ns, copyRRs(ns, "")...)
+		return "", false
+	}
+
+	n, ok := z.nodes[name]
+	owner := ""
+	if !ok {
+		n, ok = z.nodes["*."+z.closestEncloser(name)]
+		if !ok {
+			r.Rcode = dns.RcodeNameError
+			r.Ns = append(r.Ns, z.negativeSOA())
+			return "", false
+		}
+		owner = name // wildcard synthesis
+	}
+
+	if qtype == dns.TypeANY && len(n.rrsets) > 0 {
+		for _, rrs := range n.rrsets {
+			r.Answer = append(r.Answer, copyRRs(rrs, owner)...)
+		}
+		return "", false
+	}
+	if rrs := n.rrsets[qtype]; len(rrs) > 0 {
+		r.Answer = append(r.Answer, copyRRs(rrs, owner)...)
+		return "", false
+	}
+	if cname := n.rrsets[dns.TypeCNAME]; len(cname) > 0 {
+		r.Answer = append(r.Answer, copyRRs(cname, owner)...)
+		return dns.CanonicalName(cname[0].(*dns.CNAME).Target), true
+	}
+	r.Ns = append(r.Ns, z.negativeSOA()) // NODATA
+	return "", false
+}
+
+// findCut returns the NS records of the highest zone cut between the apex and
+// name. DS records of the cut are answered by this zone.
+func (z *Zone) findCut(name string, qtype uint16) []dns.RR {
+	idx := dns.Split(name)
+	for i := len(idx) - dns.CountLabel(z.origin) - 1; i >= 0; i-- {
+		c := name[idx[i]:]
+		if c == name && qtype == dns.TypeDS {
+			break
+		}
+		n, ok := z.nodes[c]
+		if !ok {
+			break
+		}
+		if ns := n.rrsets[dns.TypeNS]; len(ns) > 0 {
+			return ns
+		}
+	}
+	return nil
+}
+
+func (z *Zone) closestEncloser(name string) string {
+	c := parentName(name)
+	for ; c != z.origin; c = parentName(c) {
+		if _, ok := z.nodes[c]; ok {
+			break
+		}
+	}
+	return c
+}
+
+// negativeSOA returns the SOA for negative responses. See RFC 2308 3.
+func (z *Zone) negativeSOA() dns.RR {
+	soa := dns.Copy(z.soa).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+	return soa
+}
+
+// addAdditional adds the in-zone addresses of NS, MX and SRV targets.
+func (z *Zone) addAdditional(r *dns.Msg) {
+	added := make(map[string]struct{})
+	add := func(target string) {
+		target = dns.CanonicalName(target)
+		if _, ok := added[target]; ok || !dns.IsSubDomain(z.origin, target) {
+			return
+		}
+		added[target] = struct{}{}
+		if n, ok := z.nodes[target]; ok {
+			r.Extra = append(r.Extra, copyRRs(n.rrsets[dns.TypeA], "")...)
+			r.Extra = append(r.Extra, copyRRs(n.rrsets[dns.TypeAAAA], "")...)
+		}
+	}
+	for _, section := range [][]dns.RR{r.Answer, r.Ns} {
+		for _, rr := range section {
+			switch rr := rr.(type) {
+			case *dns.NS:
+				add(rr.Ns)
+			case *dns.MX:
+				add(rr.Mx)
+			case *dns.SRV:
+				add(rr.Target)
+			}
+		}
+	}
+}
+
+// copyRRs deep copies rrs. If owner is not empty, it will be the owner of
+// the copies.
+func copyRRs(rrs []dns.RR, owner string) []dns.RR {
+	c := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		if len(owner) > 0 {
+			rr.Header().Name = owner
+		}
+		c = append(c, rr)
+	}
+	return c
+}
+
+// parentName returns the parent of a canonical name.
+// The parent of root is root.
+func parentName(name string) string {
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[off:]
+}
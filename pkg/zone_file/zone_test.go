@@ -0,0 +1,208 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package zone_file
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `
+$ORIGIN example.com.
+$TTL 3600
+@        IN SOA  ns1 hostmaster 1 3600 600 86400 300
+@        IN NS   ns1
+ns1      IN A    192.0.2.53
+@        IN MX   10 mail
+mail     IN A    192.0.2.25
+www      IN A    192.0.2.1
+alias    IN CNAME www
+ext      IN CNAME www.example.net.
+*.wild   IN A    192.0.2.2
+a.b.c    IN A    192.0.2.3
+sub      IN NS   ns.sub
+sub      IN DS   12345 13 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+ns.sub   IN A    192.0.2.54
+`
+
+func mustParse(t *testing.T, s string) *Zone {
+	t.Helper()
+	z, err := ParseZone(strings.NewReader(s), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func TestZone_Reply(t *testing.T) {
+	z := mustParse(t, testZone)
+	if z.Origin() != "example.com." {
+		t.Fatalf("unexpected origin %s", z.Origin())
+	}
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		wantRcode int
+		wantAA    bool
+		wantAns   []string // owner and type of answers
+		wantNs    []string
+		wantExtra []string
+	}{
+		{name: "a", qname: "www.example.com.", qtype: dns.TypeA, wantAA: true, wantAns: []string{"www.example.com. A"}},
+		{name: "case", qname: "WWW.Example.com.", qtype: dns.TypeA, wantAA: true, wantAns: []string{"www.example.com. A"}},
+		{name: "mx additional", qname: "example.com.", qtype: dns.TypeMX, wantAA: true,
+			wantAns: []string{"example.com. MX"}, wantExtra: []string{"mail.example.com. A"}},
+		{name: "nodata", qname: "www.example.com.", qtype: dns.TypeAAAA, wantAA: true, wantNs: []string{"example.com. SOA"}},
+		{name: "nxdomain", qname: "none.example.com.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError, wantAA: true, wantNs: []string{"example.com. SOA"}},
+		{name: "empty non-terminal", qname: "b.c.example.com.", qtype: dns.TypeA, wantAA: true, wantNs: []string{"example.com. SOA"}},
+		{name: "cname", qname: "alias.example.com.", qtype: dns.TypeA, wantAA: true,
+			wantAns: []string{"alias.example.com. CNAME", "www.example.com. A"}},
+		{name: "cname query", qname: "alias.example.com.", qtype: dns.TypeCNAME, wantAA: true, wantAns: []string{"alias.example.com. CNAME"}},
+		{name: "cname out of zone", qname: "ext.example.com.", qtype: dns.TypeA, wantAA: true, wantAns: []string{"ext.example.com. CNAME"}},
+		{name: "wildcard", qname: "x.wild.example.com.", qtype: dns.TypeA, wantAA: true, wantAns: []string{"x.wild.example.com. A"}},
+		{name: "wildcard nodata", qname: "x.wild.example.com.", qtype: dns.TypeTXT, wantAA: true, wantNs: []string{"example.com. SOA"}},
+		{name: "delegation", qname: "www.sub.example.com.", qtype: dns.TypeA,
+			wantNs: []string{"sub.example.com. NS"}, wantExtra: []string{"ns.sub.example.com. A"}},
+		{name: "delegation apex", qname: "sub.example.com.", qtype: dns.TypeSOA,
+			wantNs: []string{"sub.example.com. NS"}, wantExtra: []string{"ns.sub.example.com. A"}},
+		{name: "ds of delegation", qname: "sub.example.com.", qtype: dns.TypeDS, wantAA: true, wantAns: []string{"sub.example.com. DS"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, tt.qtype)
+			r := z.Reply(q)
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("want rcode %d, got %d", tt.wantRcode, r.Rcode)
+			}
+			if r.Authoritative != tt.wantAA {
+				t.Fatalf("want aa %v, got %v", tt.wantAA, r.Authoritative)
+			}
+			checkSection(t, "answer", r.Answer, tt.wantAns)
+			checkSection(t, "authority", r.Ns, tt.wantNs)
+			checkSection(t, "additional", r.Extra, tt.wantExtra)
+		})
+	}
+}
+
+func checkSection(t *testing.T, section string, rrs []dns.RR, want []string) {
+	t.Helper()
+	var got []string
+	for _, rr := range rrs {
+		got = append(got, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype])
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("want %s %v, got %v", section, want, got)
+	}
+}
+
+func TestZone_negativeTTL(t *testing.T) {
+	z := mustParse(t, testZone)
+	q := new(dns.Msg)
+	q.SetQuestion("none.example.com.", dns.TypeA)
+	if ttl := z.Reply(q).Ns[0].Header().Ttl; ttl != 300 {
+		t.Fatalf("want soa ttl 300, got %d", ttl)
+	}
+}
+
+func TestNewZone_invalid(t *testing.T) {
+	tests := map[string]string{
+		"no soa":       "example.com. NS ns.example.com.",
+		"no ns":        "example.com. SOA ns hostmaster 1 3600 600 86400 300",
+		"out of zone":  "example.com. SOA ns hostmaster 1 3600 600 86400 300\nexample.com. NS ns.\nexample.net. A 192.0.2.1",
+		"cname + data": "example.com. SOA ns hostmaster 1 3600 600 86400 300\nexample.com. NS ns.\nwww.example.com. CNAME a.\nwww.example.com. A 192.0.2.1",
+	}
+	for name, s := range tests {
+		if _, err := ParseZone(strings.NewReader(s), "example.com.", ""); err == nil {
+			t.Fatalf("%s: want err", name)
+		}
+	}
+}
+
+func TestIXFR(t *testing.T) {
+	v1 := mustParse(t, testZone)
+	v2 := mustParse(t, strings.Replace(strings.Replace(testZone, " 1 3600", " 2 3600", 1), "192.0.2.1\n", "192.0.2.100\n", 1))
+	v3 := mustParse(t, strings.Replace(strings.Replace(testZone, " 1 3600", " 3 3600", 1), "192.0.2.1\n", "192.0.2.100\nnew IN A 192.0.2.4\n", 1))
+	journal := []*Diff{DiffZones(v1, v2), DiffZones(v2, v3)}
+	if d := journal[0]; len(d.Deleted) != 1 || len(d.Added) != 1 {
+		t.Fatalf("unexpected diff %v", d)
+	}
+
+	soaSerials := func(rrs []dns.RR) []uint32 {
+		var s []uint32
+		for _, rr := range rrs {
+			if soa, ok := rr.(*dns.SOA); ok {
+				s = append(s, soa.Serial)
+			}
+		}
+		return s
+	}
+
+	// Up to date.
+	if rrs := IXFR(v3, journal, 3); len(rrs) != 1 {
+		t.Fatalf("want a single soa, got %v", rrs)
+	}
+	// Incremental.
+	rrs := IXFR(v3, journal, 1)
+	if got := soaSerials(rrs); len(got) != 6 || got[0] != 3 || got[1] != 1 || got[2] != 2 || got[5] != 3 {
+		t.Fatalf("unexpected ixfr soa sequence %v", got)
+	}
+	if len(rrs) != 6+1+1+1 {
+		t.Fatalf("unexpected ixfr %v", rrs)
+	}
+	// Not in the journal, full zone.
+	if rrs := IXFR(v3, journal[1:], 1); len(rrs) != len(v3.Records())+2 {
+		t.Fatalf("want axfr, got %v", rrs)
+	}
+}
+
+func TestApplyIXFR(t *testing.T) {
+	v1 := mustParse(t, testZone)
+	v2 := mustParse(t, strings.Replace(strings.Replace(testZone, " 1 3600", " 2 3600", 1), "192.0.2.1\n", "192.0.2.100\n", 1))
+	v3 := mustParse(t, strings.Replace(strings.Replace(testZone, " 1 3600", " 3 3600", 1), "192.0.2.1\n", "192.0.2.100\nnew IN A 192.0.2.4\n", 1))
+	journal := []*Diff{DiffZones(v1, v2), DiffZones(v2, v3)}
+
+	nz, diffs, err := ApplyIXFR(v1, IXFR(v3, journal, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != 2 || nz.SOA().Serial != 3 {
+		t.Fatalf("unexpected result, %d diffs, serial %d", len(diffs), nz.SOA().Serial)
+	}
+	if d := DiffZones(v3, nz); len(d.Added) != 0 || len(d.Deleted) != 0 {
+		t.Fatalf("applied zone differs from v3, %v", d)
+	}
+
+	// Diffs that do not start from the serial of the zone.
+	if _, _, err := ApplyIXFR(v2, IXFR(v3, journal, 1)); err == nil {
+		t.Fatal("want err")
+	}
+	// Full zone.
+	if _, _, err := ApplyIXFR(v1, v3.AXFR()); err == nil {
+		t.Fatal("want err")
+	}
+	if _, err := NewZoneFromAXFR("example.com.", v3.AXFR()); err != nil {
+		t.Fatal(err)
+	}
+}
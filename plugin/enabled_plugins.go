@@ -42,9 +42,12 @@ import (
 
 	// executable
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/arbitrary"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/authoritative"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/black_hole"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/cache"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/debug_print"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/dns64"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/dnssec_validate"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/drop_resp"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/dual_selector"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/ecs_handler"
@@ -56,9 +59,11 @@ import (
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/nftset"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/query_summary"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/rate_limiter"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/recursive"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/redirect"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/reverse_lookup"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/ros_addrlist"
+	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/rpz"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence/fallback"
 	_ "github.com/IrineSistiana/mosdns/v5/plugin/executable/sleep"
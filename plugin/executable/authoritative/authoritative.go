@@ -0,0 +1,361 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package authoritative
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/zone_file"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/shared"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "authoritative"
+
+// maxJournal is the max number of diffs kept for IXFR.
+const maxJournal = 32
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.Executable = (*Authoritative)(nil)
+
+type Args struct {
+	Zones      []ZoneArgs `yaml:"zones"`
+	AutoReload bool       `yaml:"auto_reload"`
+	// AllowTransfer is a list of ips or cidrs that can request AXFR and IXFR.
+	// Zone transfers are refused by default.
+	AllowTransfer []string `yaml:"allow_transfer"`
+}
+
+type ZoneArgs struct {
+	// Origin is the zone name. Default is the owner of the SOA.
+	// It is required for secondary zones.
+	Origin string `yaml:"origin"`
+	// File is the zone file. For secondary zones, it is optional and is
+	// where the transferred zone is persisted.
+	File string `yaml:"file"`
+
+	// Primary is the address (ip:port) of the primary server. If set, this
+	// zone is a secondary zone and is transferred from the primary.
+	Primary string   `yaml:"primary"`
+	TSIG    TSIGArgs `yaml:"tsig"`
+}
+
+// Authoritative answers queries from zone files or zones transferred from
+// primaries. Queries that are not in any zone are ignored.
+type Authoritative struct {
+	logger        *zap.Logger
+	zones         []*zone
+	allowTransfer []netip.Prefix
+	fw            *shared.FileWatcher
+}
+
+type zone struct {
+	file   string
+	origin string
+	sec    *zone_file.Secondary // nil if this is a primary zone
+
+	m sync.Mutex                  // serializes reloads
+	v atomic.Pointer[zoneVersion] // nil if a secondary zone is not loaded or expired
+}
+
+type zoneVersion struct {
+	z       *zone_file.Zone
+	journal []*zone_file.Diff // diffs that end with z
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewAuthoritative(args.(*Args), bp.L())
+}
+
+func NewAuthoritative(args *Args, logger *zap.Logger) (*Authoritative, error) {
+	a := &Authoritative{logger: logger}
+	for _, s := range args.AllowTransfer {
+		p, err := utils.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow_transfer %s, %w", s, err)
+		}
+		a.allowTransfer = append(a.allowTransfer, p)
+	}
+
+	var files []string
+	for i, za := range args.Zones {
+		z := &zone{file: za.File, origin: za.Origin}
+		if len(za.Primary) > 0 {
+			if len(za.Origin) == 0 {
+				return nil, fmt.Errorf("zone #%d, origin is required for secondary zones", i)
+			}
+			z.origin = dns.CanonicalName(za.Origin)
+			sec, err := newSecondary(z, za, logger)
+			if err != nil {
+				return nil, fmt.Errorf("invalid secondary zone #%d %s, %w", i, za.Origin, err)
+			}
+			z.sec = sec
+			a.zones = append(a.zones, z)
+			continue
+		}
+
+		if err := z.load(logger); err != nil {
+			return nil, fmt.Errorf("failed to load zone #%d %s, %w", i, za.File, err)
+		}
+		z.origin = z.v.Load().z.Origin()
+		a.zones = append(a.zones, z)
+		if !slices.Contains(files, za.File) {
+			files = append(files, za.File)
+		}
+	}
+
+	if args.AutoReload && len(files) > 0 {
+		a.fw = shared.NewFileWatcher(logger, a.reload, 500*time.Millisecond)
+		if err := a.fw.Start(files); err != nil {
+			return nil, fmt.Errorf("failed to start file watcher: %w", err)
+		}
+	}
+	for _, z := range a.zones {
+		if z.sec != nil {
+			z.sec.Start()
+		}
+	}
+	return a, nil
+}
+
+// reload reloads zones from file.
+func (a *Authoritative) reload(file string) error {
+	for _, z := range a.zones {
+		if z.file != file || z.sec != nil {
+			continue
+		}
+		if err := z.load(a.logger); err != nil {
+			return fmt.Errorf("failed to reload zone from %s, %w", file, err)
+		}
+	}
+	return nil
+}
+
+func (z *zone) load(logger *zap.Logger) error {
+	z.m.Lock()
+	defer z.m.Unlock()
+
+	nz, err := zone_file.LoadZoneFile(z.file, z.origin)
+	if err != nil {
+		return err
+	}
+
+	var diffs []*zone_file.Diff
+	if old := z.v.Load(); old != nil {
+		oldSerial, serial := old.z.SOA().Serial, nz.SOA().Serial
+		if zone_file.SerialGreater(serial, oldSerial) {
+			diffs = []*zone_file.Diff{zone_file.DiffZones(old.z, nz)}
+		} else {
+			logger.Warn(
+				"zone serial is not increased, secondaries may not be notified of the changes",
+				zap.String("zone", nz.Origin()),
+				zap.Uint32("old_serial", oldSerial),
+				zap.Uint32("serial", serial),
+			)
+		}
+	}
+	z.store(nz, diffs)
+	return nil
+}
+
+// store replaces the current version with nz. diffs are the changes from the
+// current version to nz. If diffs is empty, the journal is reset.
+func (z *zone) store(nz *zone_file.Zone, diffs []*zone_file.Diff) {
+	v := &zoneVersion{z: nz}
+	if old := z.v.Load(); old != nil && len(diffs) > 0 {
+		v.journal = append(slices.Clone(old.journal), diffs...)
+		if len(v.journal) > maxJournal {
+			v.journal = v.journal[len(v.journal)-maxJournal:]
+		}
+	}
+	z.v.Store(v)
+}
+
+// match returns the zone of the longest origin that contains name.
+// DS queries of a zone apex are answered by its parent zone, if it is loaded.
+func (a *Authoritative) match(name string, qtype uint16) *zone {
+	name = dns.CanonicalName(name)
+	var best *zone
+	bestScore := -1
+	for _, z := range a.zones {
+		if !dns.IsSubDomain(z.origin, name) {
+			continue
+		}
+		score := dns.CountLabel(z.origin)*2 + 1
+		if qtype == dns.TypeDS && z.origin == name {
+			score = 0
+		}
+		if score > bestScore {
+			best, bestScore = z, score
+		}
+	}
+	return best
+}
+
+func (a *Authoritative) Exec(_ context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	question := q.Question[0]
+	if question.Qclass != dns.ClassINET {
+		return nil
+	}
+	switch q.Opcode {
+	case dns.OpcodeQuery:
+	case dns.OpcodeNotify:
+		a.handleNotify(qCtx)
+		return nil
+	default:
+		return nil
+	}
+
+	z := a.match(question.Name, question.Qtype)
+	if z == nil {
+		return nil
+	}
+	v := z.v.Load()
+	if v == nil { // secondary zone is not available
+		r := new(dns.Msg)
+		r.SetRcode(q, dns.RcodeServerFailure)
+		qCtx.SetResponse(r)
+		return nil
+	}
+
+	var r *dns.Msg
+	switch question.Qtype {
+	case dns.TypeAXFR, dns.TypeIXFR:
+		r = a.transfer(qCtx, v)
+	default:
+		r = v.z.Reply(q)
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+// handleNotify handles NOTIFY messages from primaries. See RFC 1996.
+func (a *Authoritative) handleNotify(qCtx *query_context.Context) {
+	q := qCtx.Q()
+	name := dns.CanonicalName(q.Question[0].Name)
+	var z *zone
+	for _, e := range a.zones {
+		if e.origin == name {
+			z = e
+			break
+		}
+	}
+	if z == nil {
+		return
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	switch {
+	case z.sec == nil:
+		r.Rcode = dns.RcodeNotAuth
+	case qCtx.ServerMeta.ClientAddr.Unmap() != z.sec.Primary().Addr().Unmap():
+		a.logger.Warn("notify from unknown source refused", qCtx.InfoField())
+		r.Rcode = dns.RcodeRefused
+	default:
+		r.Authoritative = true
+		z.sec.Notify()
+	}
+	qCtx.SetResponse(r)
+}
+
+func (a *Authoritative) transferAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range a.allowTransfer {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// transfer answers AXFR and IXFR queries. See RFC 5936 and RFC 1995.
+func (a *Authoritative) transfer(qCtx *query_context.Context, v *zoneVersion) *dns.Msg {
+	q := qCtx.Q()
+	question := q.Question[0]
+	r := new(dns.Msg)
+	r.SetReply(q)
+
+	if dns.CanonicalName(question.Name) != v.z.Origin() {
+		r.Rcode = dns.RcodeNotAuth
+		return r
+	}
+	if !a.transferAllowed(qCtx.ServerMeta.ClientAddr) {
+		a.logger.Warn("zone transfer refused", qCtx.InfoField())
+		r.Rcode = dns.RcodeRefused
+		return r
+	}
+
+	r.Authoritative = true
+	if question.Qtype == dns.TypeAXFR {
+		if !qCtx.ServerMeta.FromTCP {
+			r.Rcode = dns.RcodeRefused
+			return r
+		}
+		r.Answer = v.z.AXFR()
+		return r
+	}
+
+	var clientSOA *dns.SOA
+	for _, rr := range q.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			clientSOA = soa
+		}
+	}
+	if clientSOA == nil {
+		r.Rcode = dns.RcodeFormatError
+		return r
+	}
+	if !qCtx.ServerMeta.FromTCP {
+		// Tells the client to use tcp, or that it is up to date. RFC 1995 2.
+		r.Answer = []dns.RR{dns.Copy(v.z.SOA())}
+		return r
+	}
+	r.Answer = zone_file.IXFR(v.z, v.journal, clientSOA.Serial)
+	return r
+}
+
+// Close stops secondary zones and the optional file watcher.
+func (a *Authoritative) Close() error {
+	for _, z := range a.zones {
+		if z.sec != nil {
+			z.sec.Close()
+		}
+	}
+	if a.fw != nil {
+		return a.fw.Close()
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package authoritative
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	parentZone = `
+example.com. SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300
+example.com. NS ns1.example.com.
+ns1.example.com. A 192.0.2.53
+www.example.com. A 192.0.2.1
+sub.example.com. NS ns1.sub.example.com.
+sub.example.com. DS 12345 13 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+ns1.sub.example.com. A 192.0.2.54
+`
+	childZone = `
+$ORIGIN sub.example.com.
+@ SOA ns1 hostmaster 1 3600 600 86400 300
+@ NS ns1
+ns1 A 192.0.2.54
+www A 192.0.2.2
+`
+)
+
+func writeFile(t *testing.T, name, s string) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(f, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func exec(t *testing.T, a *Authoritative, q *dns.Msg, meta query_context.ServerMeta) *dns.Msg {
+	t.Helper()
+	qCtx := query_context.NewContext(q)
+	qCtx.ServerMeta = meta
+	if err := a.Exec(context.Background(), qCtx); err != nil {
+		t.Fatal(err)
+	}
+	return qCtx.R()
+}
+
+func TestAuthoritative(t *testing.T) {
+	a, err := NewAuthoritative(&Args{
+		Zones: []ZoneArgs{
+			{File: writeFile(t, "parent", parentZone)},
+			{File: writeFile(t, "child", childZone)},
+		},
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		qname  string
+		qtype  uint16
+		wantNo bool // no response
+		wantAA bool
+		want   string // first answer
+	}{
+		{name: "parent", qname: "www.example.com.", qtype: dns.TypeA, wantAA: true, want: "192.0.2.1"},
+		{name: "child", qname: "www.sub.example.com.", qtype: dns.TypeA, wantAA: true, want: "192.0.2.2"},
+		{name: "ds from parent", qname: "sub.example.com.", qtype: dns.TypeDS, wantAA: true, want: "12345"},
+		{name: "soa from child", qname: "sub.example.com.", qtype: dns.TypeSOA, wantAA: true, want: "hostmaster"},
+		{name: "not in zones", qname: "example.net.", qtype: dns.TypeA, wantNo: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, tt.qtype)
+			r := exec(t, a, q, query_context.ServerMeta{})
+			if tt.wantNo {
+				if r != nil {
+					t.Fatalf("unexpected response %v", r)
+				}
+				return
+			}
+			if r.Authoritative != tt.wantAA || len(r.Answer) == 0 {
+				t.Fatalf("unexpected response %v", r)
+			}
+			if s := r.Answer[0].String(); !strings.Contains(s, tt.want) {
+				t.Fatalf("answer %s does not contain %s", s, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthoritative_transfer(t *testing.T) {
+	file := writeFile(t, "parent", parentZone)
+	a, err := NewAuthoritative(&Args{
+		Zones:         []ZoneArgs{{File: file}},
+		AllowTransfer: []string{"127.0.0.1", "2001:db8::/32"},
+	}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := query_context.ServerMeta{FromTCP: true, ClientAddr: netip.MustParseAddr("127.0.0.1")}
+	axfr := new(dns.Msg)
+	axfr.SetAxfr("example.com.")
+	if r := exec(t, a, axfr.Copy(), query_context.ServerMeta{FromTCP: true, ClientAddr: netip.MustParseAddr("127.0.0.2")}); r.Rcode != dns.RcodeRefused {
+		t.Fatalf("want refused, got %v", r)
+	}
+	if r := exec(t, a, axfr.Copy(), query_context.ServerMeta{FromUDP: true, ClientAddr: netip.MustParseAddr("127.0.0.1")}); r.Rcode != dns.RcodeRefused {
+		t.Fatalf("want refused over udp, got %v", r)
+	}
+	r := exec(t, a, axfr.Copy(), allowed)
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) != 8 {
+		t.Fatalf("unexpected axfr %v", r)
+	}
+
+	// Reload a new version, then IXFR from serial 1.
+	v2 := strings.Replace(parentZone, " 1 3600", " 2 3600", 1) + "new.example.com. A 192.0.2.3\n"
+	if err := os.WriteFile(file, []byte(v2), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.reload(file); err != nil {
+		t.Fatal(err)
+	}
+	ixfr := new(dns.Msg)
+	ixfr.SetIxfr("example.com.", 1, "ns1.example.com.", "hostmaster.example.com.")
+	r = exec(t, a, ixfr.Copy(), allowed)
+	if len(r.Answer) != 5 || r.Answer[3].Header().Rrtype != dns.TypeA {
+		t.Fatalf("unexpected ixfr %v", r)
+	}
+	r = exec(t, a, ixfr.Copy(), query_context.ServerMeta{FromUDP: true, ClientAddr: netip.MustParseAddr("2001:db8::1")})
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.SOA).Serial != 2 {
+		t.Fatalf("want a single soa over udp, got %v", r)
+	}
+}
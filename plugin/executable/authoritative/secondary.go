@@ -0,0 +1,66 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package authoritative
+
+import (
+	"github.com/IrineSistiana/mosdns/v5/pkg/zone_file"
+	"go.uber.org/zap"
+)
+
+type TSIGArgs struct {
+	Name string `yaml:"name"`
+	// Algorithm is the hmac algorithm. e.g. hmac-sha256 (default), hmac-sha512.
+	Algorithm string `yaml:"algorithm"`
+	// Secret is the base64 encoded key.
+	Secret string `yaml:"secret"`
+}
+
+// NewTSIG returns nil if args is empty.
+func (args TSIGArgs) NewTSIG() (*zone_file.TSIG, error) {
+	if len(args.Name) == 0 {
+		return nil, nil
+	}
+	return zone_file.NewTSIG(args.Name, args.Algorithm, args.Secret)
+}
+
+// newSecondary makes z a secondary zone. z.origin must be set.
+func newSecondary(z *zone, args ZoneArgs, logger *zap.Logger) (*zone_file.Secondary, error) {
+	primary, err := zone_file.ParsePrimary(args.Primary)
+	if err != nil {
+		return nil, err
+	}
+	tsig, err := args.TSIG.NewTSIG()
+	if err != nil {
+		return nil, err
+	}
+	return zone_file.NewSecondary(zone_file.SecondaryOpts{
+		Origin: z.origin,
+		Client: &zone_file.Client{Primary: primary, TSIG: tsig},
+		File:   z.file,
+		Logger: logger,
+		OnUpdate: func(nz *zone_file.Zone, diffs []*zone_file.Diff) {
+			if nz == nil {
+				z.v.Store(nil)
+				return
+			}
+			z.store(nz, diffs)
+		},
+	}), nil
+}
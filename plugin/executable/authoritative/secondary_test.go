@@ -0,0 +1,210 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package authoritative
+
+import (
+	"net"
+	"net/netip"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/zone_file"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	testTSIGName   = "xfr-key."
+	testTSIGSecret = "c2VjcmV0LWtleS1mb3ItdGVzdHMtb25seQ=="
+)
+
+// testPrimary is a primary server that requires TSIG.
+type testPrimary struct {
+	addr string
+
+	m        sync.Mutex
+	z        *zone_file.Zone
+	journal  []*zone_file.Diff
+	lastXfr  uint16
+	shutdown []func() error
+}
+
+func newTestPrimary(t *testing.T, zone string) *testPrimary {
+	t.Helper()
+	z, err := zone_file.ParseZone(strings.NewReader(zone), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPrimary{z: z}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := net.ListenPacket("udp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.addr = l.Addr().String()
+	secret := map[string]string{testTSIGName: testTSIGSecret}
+	for _, s := range []*dns.Server{{Listener: l, TsigSecret: secret, Handler: p}, {PacketConn: pc, TsigSecret: secret, Handler: p}} {
+		go s.ActivateAndServe()
+		p.shutdown = append(p.shutdown, s.Shutdown)
+	}
+	t.Cleanup(func() {
+		for _, f := range p.shutdown {
+			f()
+		}
+	})
+	return p
+}
+
+func (p *testPrimary) update(t *testing.T, zone string) {
+	t.Helper()
+	nz, err := zone_file.ParseZone(strings.NewReader(zone), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.journal = append(p.journal, zone_file.DiffZones(p.z, nz))
+	p.z = nz
+}
+
+func (p *testPrimary) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	tsig := q.IsTsig()
+	if tsig == nil || w.TsigStatus() != nil {
+		r := new(dns.Msg)
+		w.WriteMsg(r.SetRcode(q, dns.RcodeRefused))
+		return
+	}
+
+	p.m.Lock()
+	z, journal := p.z, p.journal
+	p.m.Unlock()
+
+	var rrs []dns.RR
+	switch qt := q.Question[0].Qtype; qt {
+	case dns.TypeAXFR:
+		rrs = z.AXFR()
+	case dns.TypeIXFR:
+		rrs = zone_file.IXFR(z, journal, q.Ns[0].(*dns.SOA).Serial)
+	default:
+		r := z.Reply(q)
+		r.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+		w.WriteMsg(r)
+		return
+	}
+	p.m.Lock()
+	p.lastXfr = q.Question[0].Qtype
+	p.m.Unlock()
+
+	ch := make(chan *dns.Envelope, 1)
+	ch <- &dns.Envelope{RR: rrs}
+	close(ch)
+	tr := new(dns.Transfer)
+	tr.Out(w, q, ch)
+	w.Close()
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	t.Helper()
+	for ddl := time.Now().Add(time.Second * 5); time.Now().Before(ddl); time.Sleep(time.Millisecond * 20) {
+		if f() {
+			return
+		}
+	}
+	t.Fatal("timeout")
+}
+
+func resolve(t *testing.T, a *Authoritative, name string) *dns.Msg {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion(name, dns.TypeA)
+	return exec(t, a, q, query_context.ServerMeta{})
+}
+
+func TestAuthoritative_secondary(t *testing.T) {
+	p := newTestPrimary(t, parentZone)
+	file := filepath.Join(t.TempDir(), "secondary")
+	za := ZoneArgs{
+		Origin:  "example.com",
+		File:    file,
+		Primary: p.addr,
+		TSIG:    TSIGArgs{Name: testTSIGName, Secret: testTSIGSecret},
+	}
+	a, err := NewAuthoritative(&Args{Zones: []ZoneArgs{za}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	waitFor(t, func() bool { return resolve(t, a, "www.example.com.").Rcode != dns.RcodeServerFailure })
+	if r := resolve(t, a, "www.example.com."); !r.Authoritative || len(r.Answer) != 1 {
+		t.Fatalf("unexpected response %v", r)
+	}
+
+	// Notify from an unknown source.
+	notify := new(dns.Msg)
+	notify.SetNotify("example.com.")
+	r := exec(t, a, notify.Copy(), query_context.ServerMeta{ClientAddr: netip.MustParseAddr("127.0.0.2")})
+	if r.Rcode != dns.RcodeRefused {
+		t.Fatalf("want refused, got %v", r)
+	}
+
+	p.update(t, strings.Replace(parentZone, " 1 3600", " 2 3600", 1)+"new.example.com. A 192.0.2.3\n")
+	r = exec(t, a, notify.Copy(), query_context.ServerMeta{ClientAddr: netip.MustParseAddr("127.0.0.1")})
+	if r.Rcode != dns.RcodeSuccess || !r.Authoritative || r.Opcode != dns.OpcodeNotify {
+		t.Fatalf("unexpected notify response %v", r)
+	}
+	waitFor(t, func() bool { return len(resolve(t, a, "new.example.com.").Answer) == 1 })
+	p.m.Lock()
+	lastXfr := p.lastXfr
+	p.m.Unlock()
+	if lastXfr != dns.TypeIXFR {
+		t.Fatalf("want ixfr, got %s", dns.TypeToString[lastXfr])
+	}
+	if v := a.zones[0].v.Load(); len(v.journal) != 1 {
+		t.Fatalf("want 1 diff in the journal, got %d", len(v.journal))
+	}
+	a.Close()
+
+	// Restart with an unreachable primary. The persisted zone is served immediately.
+	pz, err := zone_file.LoadZoneFile(file, "example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pz.SOA().Serial != 2 {
+		t.Fatalf("want persisted serial 2, got %d", pz.SOA().Serial)
+	}
+	za.Primary = "127.0.0.1:1"
+	a2, err := NewAuthoritative(&Args{Zones: []ZoneArgs{za}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a2.Close()
+	if r := resolve(t, a2, "new.example.com."); len(r.Answer) != 1 {
+		t.Fatalf("unexpected response %v", r)
+	}
+}
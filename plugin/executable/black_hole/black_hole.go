@@ -70,6 +70,7 @@ func NewBlackHole(ips []string) (*BlackHole, error) {
 func (b *BlackHole) Exec(_ context.Context, qCtx *query_context.Context) error {
 	if r := b.Response(qCtx.Q()); r != nil {
 		qCtx.SetResponse(r)
+		qCtx.AddEDE(dns.ExtendedErrorCodeForgedAnswer, "")
 	}
 	return nil
 }
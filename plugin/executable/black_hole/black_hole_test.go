@@ -0,0 +1,53 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package black_hole
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+func Test_BlackHole_EDE(t *testing.T) {
+	b, err := NewBlackHole([]string{"0.0.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for qt, wantEDE := range map[uint16]bool{dns.TypeA: true, dns.TypeAAAA: false} {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", qt)
+		q.SetEdns0(1232, false)
+		qCtx := query_context.NewContext(q)
+		if err := b.Exec(context.Background(), qCtx); err != nil {
+			t.Fatal(err)
+		}
+		var codes []uint16
+		for _, o := range qCtx.RespOpt().Option {
+			if ede, ok := o.(*dns.EDNS0_EDE); ok {
+				codes = append(codes, ede.InfoCode)
+			}
+		}
+		if hasEDE := len(codes) == 1 && codes[0] == dns.ExtendedErrorCodeForgedAnswer; hasEDE != wantEDE {
+			t.Fatalf("qtype %d: want forged answer ede %v, got %v", qt, wantEDE, codes)
+		}
+	}
+}
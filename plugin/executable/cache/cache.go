@@ -22,18 +22,21 @@ package cache
 import (
 	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
+	"github.com/IrineSistiana/mosdns/v5/pkg/cache/redis_cache"
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
@@ -42,6 +45,7 @@ import (
 	"github.com/klauspost/compress/gzip"
 	"github.com/miekg/dns"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
 	"golang.org/x/sync/singleflight"
 	"google.golang.org/protobuf/proto"
@@ -58,12 +62,16 @@ func init() {
 
 const (
 	defaultLazyUpdateTimeout = time.Second * 5
+	defaultL2StoreTimeout    = time.Second
+	l2StoreWorkers           = 4
+	l2StoreQueueSize         = 1024
 	expiredMsgTtl            = 5
 
 	minimumChangesToDump   = 1024
 	dumpHeader             = "mosdns_cache_v2"
 	dumpBlockSize          = 128
 	dumpMaximumBlockLength = 1 << 20 // 1M block. 8kb pre entry. Should be enough.
+	maxLoadDumpSize        = 256 << 20
 )
 
 var _ sequence.RecursiveExecutable = (*Cache)(nil)
@@ -73,6 +81,21 @@ type Args struct {
 	LazyCacheTTL int    `yaml:"lazy_cache_ttl"`
 	DumpFile     string `yaml:"dump_file"`
 	DumpInterval int    `yaml:"dump_interval"`
+
+	// EvictionPolicy can be "random" (default) or "lru".
+	EvictionPolicy string `yaml:"eviction_policy"`
+	// MaxBytes limits the total packed size of cached responses.
+	// It implies "lru" eviction policy.
+	MaxBytes int `yaml:"max_bytes"`
+
+	// Redis enables a redis compatible server as the second tier cache.
+	// Format: redis://[[user]:[password]@]host[:port][/db]
+	Redis        string `yaml:"redis"`
+	RedisTimeout int    `yaml:"redis_timeout"` // In milliseconds. Default is 50.
+
+	// StatsTopNames is the number of names that will be tracked for
+	// the top requested/missed names in the stats api. Zero disables it.
+	StatsTopNames int `yaml:"stats_top_names"`
 }
 
 func (a *Args) init() {
@@ -85,22 +108,32 @@ type Cache struct {
 
 	logger       *zap.Logger
 	backend      *cache.Cache[key, *item]
+	l2           *redis_cache.RedisCache // Maybe nil.
+	l2StoreQueue chan l2StoreTask        // Nil if l2 is nil.
 	lazyUpdateSF singleflight.Group
 	closeOnce    sync.Once
 	closeNotify  chan struct{}
 	updatedKey   atomic.Uint64
+	stats        *stats
 
 	queryTotal   prometheus.Counter
 	hitTotal     prometheus.Counter
 	lazyHitTotal prometheus.Counter
+	l2HitTotal   prometheus.Counter
+	l2DropTotal  prometheus.Counter
+	evictedTotal *prometheus.CounterVec
 	size         prometheus.GaugeFunc
+	sizeBytes    prometheus.GaugeFunc
 }
 
 func Init(bp *coremain.BP, args any) (any, error) {
-	c := NewCache(args.(*Args), Opts{
+	c, err := NewCache(args.(*Args), Opts{
 		Logger:     bp.L(),
 		MetricsTag: bp.Tag(),
 	})
+	if err != nil {
+		return nil, err
+	}
 
 	if err := c.RegMetricsTo(prometheus.WrapRegistererWithPrefix(PluginType+"_", bp.M().GetMetricsReg())); err != nil {
 		return nil, fmt.Errorf("failed to register metrics, %w", err)
@@ -121,7 +154,7 @@ func quickSetupCache(bq sequence.BQ, s string) (any, error) {
 		size = i
 	}
 	// Don't register metrics in quick setup.
-	return NewCache(&Args{Size: size}, Opts{Logger: bq.L()}), nil
+	return NewCache(&Args{Size: size}, Opts{Logger: bq.L()})
 }
 
 type Opts struct {
@@ -129,7 +162,7 @@ type Opts struct {
 	MetricsTag string
 }
 
-func NewCache(args *Args, opts Opts) *Cache {
+func NewCache(args *Args, opts Opts) (*Cache, error) {
 	args.init()
 
 	logger := opts.Logger
@@ -137,13 +170,57 @@ func NewCache(args *Args, opts Opts) *Cache {
 		logger = zap.NewNop()
 	}
 
-	backend := cache.New[key, *item](cache.Opts{Size: args.Size})
+	policy := cache.Policy(args.EvictionPolicy)
+	switch policy {
+	case "", cache.PolicyRandom:
+		if args.MaxBytes > 0 && len(policy) > 0 {
+			return nil, errors.New("max_bytes requires lru eviction policy")
+		}
+	case cache.PolicyLRU:
+	default:
+		return nil, fmt.Errorf("invalid eviction policy %s", args.EvictionPolicy)
+	}
+
+	var l2 *redis_cache.RedisCache
+	if len(args.Redis) > 0 {
+		redisOpt, err := redis.ParseURL(args.Redis)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis url, %w", err)
+		}
+		redisOpt.MaxRetries = -1
+		client := redis.NewClient(redisOpt)
+		l2, err = redis_cache.NewRedisCache(redis_cache.RedisCacheOpts{
+			Client:        client,
+			ClientCloser:  client,
+			ClientTimeout: time.Duration(args.RedisTimeout) * time.Millisecond,
+			Logger:        logger,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to init redis cache, %w", err)
+		}
+	}
+
 	lb := map[string]string{"tag": opts.MetricsTag}
+	evictedTotal := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        "evicted_total",
+		Help:        "The total number of evicted entries by reason",
+		ConstLabels: lb,
+	}, []string{"reason"})
+	backend := cache.New[key, *item](cache.Opts{
+		Size:     args.Size,
+		Policy:   policy,
+		MaxBytes: args.MaxBytes,
+		OnEvict: func(reason cache.EvictReason, n int) {
+			evictedTotal.WithLabelValues(string(reason)).Add(float64(n))
+		},
+	})
 	p := &Cache{
 		args:        args,
 		logger:      logger,
 		backend:     backend,
+		l2:          l2,
 		closeNotify: make(chan struct{}),
+		stats:       newStats(args.StatsTopNames),
 
 		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
 			Name:        "query_total",
@@ -160,6 +237,16 @@ func NewCache(args *Args, opts Opts) *Cache {
 			Help:        "The total number of queries that hit the expired cache",
 			ConstLabels: lb,
 		}),
+		l2HitTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "l2_hit_total",
+			Help:        "The total number of queries that missed the memory cache but hit the redis cache",
+			ConstLabels: lb,
+		}),
+		l2DropTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "l2_store_dropped_total",
+			Help:        "The total number of responses that were not stored to the redis cache because the store queue was full",
+			ConstLabels: lb,
+		}),
 		size: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 			Name:        "size_current",
 			Help:        "Current cache size in records",
@@ -167,6 +254,21 @@ func NewCache(args *Args, opts Opts) *Cache {
 		}, func() float64 {
 			return float64(backend.Len())
 		}),
+		sizeBytes: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "size_bytes",
+			Help:        "Current packed size of cached responses, only tracked if max_bytes is set",
+			ConstLabels: lb,
+		}, func() float64 {
+			return float64(backend.Bytes())
+		}),
+		evictedTotal: evictedTotal,
+	}
+
+	if l2 != nil {
+		p.l2StoreQueue = make(chan l2StoreTask, l2StoreQueueSize)
+		for i := 0; i < l2StoreWorkers; i++ {
+			go p.l2StoreLoop()
+		}
 	}
 
 	if err := p.loadDump(); err != nil {
@@ -174,11 +276,11 @@ func NewCache(args *Args, opts Opts) *Cache {
 	}
 	p.startDumpLoop()
 
-	return p
+	return p, nil
 }
 
 func (c *Cache) RegMetricsTo(r prometheus.Registerer) error {
-	for _, collector := range [...]prometheus.Collector{c.queryTotal, c.hitTotal, c.lazyHitTotal, c.size} {
+	for _, collector := range [...]prometheus.Collector{c.queryTotal, c.hitTotal, c.lazyHitTotal, c.l2HitTotal, c.l2DropTotal, c.evictedTotal, c.size, c.sizeBytes} {
 		if err := r.Register(collector); err != nil {
 			return err
 		}
@@ -192,35 +294,152 @@ func (c *Cache) Exec(ctx context.Context, qCtx *query_context.Context, next sequ
 
 	msgKey := getMsgKey(q)
 	if len(msgKey) == 0 { // skip cache
+		c.stats.record("", false, false)
 		return next.ExecNext(ctx, qCtx)
 	}
 
-	cachedResp, lazyHit := getRespFromCache(msgKey, c.backend, c.args.LazyCacheTTL > 0, expiredMsgTtl)
+	hitKey := msgKey
+	cachedResp, lazyHit := c.lookup(msgKey)
+	if e, ok := qCtx.ECS(); ok && cachedResp == nil && e.Source.IsValid() {
+		hitKey = getECSMsgKey(msgKey, e.Source)
+		cachedResp, lazyHit = c.lookup(hitKey)
+	}
 	if lazyHit {
 		c.lazyHitTotal.Inc()
-		c.doLazyUpdate(msgKey, qCtx, next)
+		c.doLazyUpdate(hitKey, msgKey, qCtx, next)
 	}
 	if cachedResp != nil { // cache hit
 		c.hitTotal.Inc()
 		cachedResp.Id = q.Id // change msg id
 		qCtx.SetResponse(cachedResp)
+		if lazyHit {
+			qCtx.AddEDE(dns.ExtendedErrorCodeStaleAnswer, "")
+		}
 	}
+	var qName string
+	if c.stats.requested != nil {
+		qName = strings.ToLower(q.Question[0].Name)
+	}
+	c.stats.record(qName, cachedResp != nil, lazyHit)
 
 	err := next.ExecNext(ctx, qCtx)
 
 	if r := qCtx.R(); r != nil && cachedResp != r { // pointer compare. r is not cachedResp
-		saveRespToCache(msgKey, r, c.backend, c.args.LazyCacheTTL)
-		c.updatedKey.Add(1)
+		c.saveResp(respKey(msgKey, qCtx), r)
 	}
 	return err
 }
 
+// lookup looks up k from the memory cache. If k is not in the memory
+// cache, it will be loaded from the l2 cache (if enabled).
+func (c *Cache) lookup(k string) (*dns.Msg, bool) {
+	v, _, _ := c.backend.Get(key(k))
+	if v == nil && c.l2 != nil {
+		v = c.loadFromL2(k)
+	}
+	return getRespFromItem(v, c.args.LazyCacheTTL > 0, expiredMsgTtl)
+}
+
+// respKey returns the key that the response of qCtx should be stored with.
+// Responses that have a non-zero ECS scope are only valid for the source
+// subnet. See RFC 7871 7.3.1.
+func respKey(msgKey string, qCtx *query_context.Context) string {
+	if e, ok := qCtx.ECS(); ok && e.Scope > 0 && e.Source.IsValid() {
+		return getECSMsgKey(msgKey, e.Source)
+	}
+	return msgKey
+}
+
+// saveResp saves r to the memory cache and the l2 cache (if enabled).
+func (c *Cache) saveResp(msgKey string, r *dns.Msg) {
+	v, cacheExpirationTime := saveRespToCache(msgKey, r, c.backend, c.args.LazyCacheTTL)
+	if v == nil {
+		return
+	}
+	c.updatedKey.Add(1)
+	if c.l2 != nil {
+		// Don't block the query. Drop the task if redis is too slow.
+		select {
+		case c.l2StoreQueue <- l2StoreTask{msgKey: msgKey, v: v, cacheExpirationTime: cacheExpirationTime}:
+		default:
+			c.l2DropTotal.Inc()
+		}
+	}
+}
+
+// loadFromL2 looks up msgKey from the l2 cache. If found, the entry
+// will be stored into the memory cache and returned. Otherwise, it
+// returns nil.
+func (c *Cache) loadFromL2(msgKey string) *item {
+	// Don't use the query ctx. Client cancellations should not trip the
+	// circuit breaker. RedisCache has its own timeout.
+	b := c.l2.Get(context.Background(), msgKey)
+	if b == nil {
+		return nil
+	}
+	e := new(CachedEntry)
+	if err := proto.Unmarshal(b, e); err != nil {
+		c.logger.Warn("invalid l2 cache entry", zap.Error(err))
+		return nil
+	}
+	v, cacheExpirationTime, err := entryToItem(e)
+	if err != nil {
+		c.logger.Warn("invalid l2 cache entry", zap.Error(err))
+		return nil
+	}
+	c.l2HitTotal.Inc()
+	c.backend.Store(key(msgKey), v, cacheExpirationTime)
+	return v
+}
+
+type l2StoreTask struct {
+	msgKey              string
+	v                   *item
+	cacheExpirationTime time.Time
+}
+
+// l2StoreLoop stores tasks from l2StoreQueue to the l2 cache until the
+// cache is closed.
+func (c *Cache) l2StoreLoop() {
+	for {
+		select {
+		case t := <-c.l2StoreQueue:
+			c.storeToL2(t.msgKey, t.v, t.cacheExpirationTime)
+		case <-c.closeNotify:
+			return
+		}
+	}
+}
+
+// storeToL2 stores v to the l2 cache. The entry expires in the l2 cache
+// when the msg expires, the lazy cache ttl is not applied.
+func (c *Cache) storeToL2(msgKey string, v *item, cacheExpirationTime time.Time) {
+	msg, err := v.resp.Pack()
+	if err != nil {
+		c.logger.Warn("failed to pack msg", zap.Error(err))
+		return
+	}
+	b, err := proto.Marshal(&CachedEntry{
+		Msg:                 msg,
+		CacheExpirationTime: cacheExpirationTime.Unix(),
+		MsgExpirationTime:   v.expirationTime.Unix(),
+		MsgStoredTime:       v.storedTime.Unix(),
+	})
+	if err != nil {
+		c.logger.Warn("failed to marshal protobuf", zap.Error(err))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), defaultL2StoreTimeout)
+	defer cancel()
+	c.l2.Store(ctx, msgKey, b, v.expirationTime)
+}
+
 // doLazyUpdate starts a new goroutine to execute next node and update the cache in the background.
-// It has an inner singleflight.Group to de-duplicate same msgKey.
-func (c *Cache) doLazyUpdate(msgKey string, qCtx *query_context.Context, next sequence.ChainWalker) {
+// It has an inner singleflight.Group to de-duplicate same hitKey.
+func (c *Cache) doLazyUpdate(hitKey, msgKey string, qCtx *query_context.Context, next sequence.ChainWalker) {
 	qCtxCopy := qCtx.Copy()
 	lazyUpdateFunc := func() (any, error) {
-		defer c.lazyUpdateSF.Forget(msgKey)
+		defer c.lazyUpdateSF.Forget(hitKey)
 		qCtx := qCtxCopy
 
 		c.logger.Debug("start lazy cache update", qCtx.InfoField())
@@ -234,13 +453,12 @@ func (c *Cache) doLazyUpdate(msgKey string, qCtx *query_context.Context, next se
 
 		r := qCtx.R()
 		if r != nil {
-			saveRespToCache(msgKey, r, c.backend, c.args.LazyCacheTTL)
-			c.updatedKey.Add(1)
+			c.saveResp(respKey(msgKey, qCtx), r)
 		}
 		c.logger.Debug("lazy cache updated", qCtx.InfoField())
 		return nil, nil
 	}
-	c.lazyUpdateSF.DoChan(msgKey, lazyUpdateFunc) // DoChan won't block this goroutine
+	c.lazyUpdateSF.DoChan(hitKey, lazyUpdateFunc) // DoChan won't block this goroutine
 }
 
 func (c *Cache) Close() error {
@@ -250,23 +468,39 @@ func (c *Cache) Close() error {
 	c.closeOnce.Do(func() {
 		close(c.closeNotify)
 	})
+	if c.l2 != nil {
+		_ = c.l2.Close()
+	}
 	return c.backend.Close()
 }
 
+// loadDump loads the dump file. If it is missing or corrupted, the
+// backup of the previous dump will be loaded. It is not an error if
+// both of them are missing, e.g. on the first start.
 func (c *Cache) loadDump() error {
 	if len(c.args.DumpFile) == 0 {
 		return nil
 	}
-	f, err := os.Open(c.args.DumpFile)
-	if err != nil {
-		return err
+	en, err := readDumpFile(c.args.DumpFile, c.readDump)
+	if err == nil {
+		c.logger.Info("cache dump loaded", zap.Int("entries", en))
+		return nil
 	}
-	defer f.Close()
-	en, err := c.readDump(f)
-	if err != nil {
-		return err
+	if !errors.Is(err, os.ErrNotExist) {
+		c.logger.Warn("failed to load cache dump, trying the previous one", zap.Error(err))
 	}
-	c.logger.Info("cache dump loaded", zap.Int("entries", en))
+	bak := c.args.DumpFile + dumpFileBakSuffix
+	en, bakErr := readDumpFile(bak, c.readDump)
+	if bakErr != nil {
+		if errors.Is(bakErr, os.ErrNotExist) {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		return fmt.Errorf("%w, previous dump: %w", err, bakErr)
+	}
+	c.logger.Info("previous cache dump loaded", zap.String("file", bak), zap.Int("entries", en))
 	return nil
 }
 
@@ -303,13 +537,7 @@ func (c *Cache) dumpCache() error {
 		return nil
 	}
 
-	f, err := os.Create(c.args.DumpFile)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	en, err := c.writeDump(f)
+	en, err := writeDumpFile(c.args.DumpFile, c.writeDump)
 	if err != nil {
 		return fmt.Errorf("failed to write dump, %w", err)
 	}
@@ -322,16 +550,53 @@ func (c *Cache) Api() *chi.Mux {
 	r.Get("/flush", func(w http.ResponseWriter, req *http.Request) {
 		c.backend.Flush()
 	})
+	// Optional query param "top" is the number of top names. Default is 20.
+	r.Get("/stats", func(w http.ResponseWriter, req *http.Request) {
+		topN := 20
+		if s := req.URL.Query().Get("top"); len(s) > 0 {
+			i, err := strconv.Atoi(s)
+			if err != nil || i < 0 {
+				http.Error(w, fmt.Sprintf("invalid top %s", s), http.StatusBadRequest)
+				return
+			}
+			topN = i
+		}
+		w.Header().Set("content-type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(c.statsReport(topN)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	r.Get("/stats/reset", func(w http.ResponseWriter, req *http.Request) {
+		c.stats.reset()
+	})
+	// Optional query param "format" can be "binary" (default), "jsonl" or "zone".
 	r.Get("/dump", func(w http.ResponseWriter, req *http.Request) {
-		w.Header().Set("content-type", "application/octet-stream")
-		_, err := c.writeDump(w)
+		format := req.URL.Query().Get("format")
+		switch format {
+		case "", DumpFormatBinary:
+			w.Header().Set("content-type", "application/octet-stream")
+		case DumpFormatJSONL:
+			w.Header().Set("content-type", "application/jsonl")
+		case DumpFormatZone:
+			w.Header().Set("content-type", "text/plain; charset=utf-8")
+		default:
+			http.Error(w, fmt.Sprintf("unknown dump format %s", format), http.StatusBadRequest)
+			return
+		}
+		_, skipped, err := writeDumpFormat(w, format, c.rangeEntries)
+		if skipped > 0 {
+			c.logger.Warn("entries with invalid keys were skipped", zap.Int("skipped", skipped))
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	})
 	r.Post("/load_dump", func(w http.ResponseWriter, req *http.Request) {
-		if _, err := c.readDump(req.Body); err != nil {
+		body := http.MaxBytesReader(w, req.Body, maxLoadDumpSize)
+		if _, err := readDumpFormat(body, req.URL.Query().Get("format"), c.storeEntry); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -340,7 +605,51 @@ func (c *Cache) Api() *chi.Mux {
 	return r
 }
 
+// writeDump writes all entries to w in binary format.
 func (c *Cache) writeDump(w io.Writer) (int, error) {
+	return writeBinaryDump(w, c.rangeEntries)
+}
+
+// readDump reads dumped data in binary format from r. It returns the number
+// of entries read and any error encountered.
+func (c *Cache) readDump(r io.Reader) (int, error) {
+	return readBinaryDump(r, c.storeEntry)
+}
+
+// rangeEntries calls f through all unexpired entries.
+func (c *Cache) rangeEntries(f func(e *CachedEntry) error) error {
+	now := time.Now()
+	rangeFunc := func(k key, v *item, cacheExpirationTime time.Time) error {
+		if cacheExpirationTime.Before(now) {
+			return nil
+		}
+		msg, err := v.resp.Pack()
+		if err != nil {
+			return fmt.Errorf("failed to pack msg, %w", err)
+		}
+		return f(&CachedEntry{
+			Key:                 []byte(k),
+			CacheExpirationTime: cacheExpirationTime.Unix(),
+			MsgExpirationTime:   v.expirationTime.Unix(),
+			MsgStoredTime:       v.storedTime.Unix(),
+			Msg:                 msg,
+		})
+	}
+	return c.backend.Range(rangeFunc)
+}
+
+// storeEntry stores e into the memory cache.
+func (c *Cache) storeEntry(e *CachedEntry) error {
+	i, cacheExpTime, err := entryToItem(e)
+	if err != nil {
+		return err
+	}
+	c.backend.Store(key(e.GetKey()), i, cacheExpTime)
+	return nil
+}
+
+// writeBinaryDump writes entries from rangeEntries to w in the gzip+protobuf block format.
+func writeBinaryDump(w io.Writer, rangeEntries func(f func(e *CachedEntry) error) error) (int, error) {
 	en := 0
 
 	gw, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
@@ -369,21 +678,7 @@ func (c *Cache) writeDump(w io.Writer) (int, error) {
 		return nil
 	}
 
-	now := time.Now()
-	rangeFunc := func(k key, v *item, cacheExpirationTime time.Time) error {
-		if cacheExpirationTime.Before(now) {
-			return nil
-		}
-		msg, err := v.resp.Pack()
-		if err != nil {
-			return fmt.Errorf("failed to pack msg, %w", err)
-		}
-		e := &CachedEntry{
-			Key:                 []byte(k),
-			CacheExpirationTime: cacheExpirationTime.Unix(),
-			MsgExpirationTime:   v.expirationTime.Unix(),
-			Msg:                 msg,
-		}
+	rangeFunc := func(e *CachedEntry) error {
 		block.Entries = append(block.Entries, e)
 
 		// Block is big enough for a write operation.
@@ -392,7 +687,7 @@ func (c *Cache) writeDump(w io.Writer) (int, error) {
 		}
 		return nil
 	}
-	if err := c.backend.Range(rangeFunc); err != nil {
+	if err := rangeEntries(rangeFunc); err != nil {
 		return en, err
 	}
 
@@ -404,9 +699,9 @@ func (c *Cache) writeDump(w io.Writer) (int, error) {
 	return en, gw.Close()
 }
 
-// readDump reads dumped data from r. It returns the number of bytes read,
-// number of entries read and any error encountered.
-func (c *Cache) readDump(r io.Reader) (int, error) {
+// readBinaryDump reads the gzip+protobuf block format from r and calls f for each entry.
+// It returns the number of entries read and any error encountered.
+func readBinaryDump(r io.Reader, f func(e *CachedEntry) error) (int, error) {
 	en := 0
 	gr, err := gzip.NewReader(r)
 	if err != nil {
@@ -446,20 +741,9 @@ func (c *Cache) readDump(r io.Reader) (int, error) {
 
 		en += len(block.GetEntries())
 		for _, entry := range block.GetEntries() {
-			cacheExpTime := time.Unix(entry.GetCacheExpirationTime(), 0)
-			msgExpTime := time.Unix(entry.GetMsgExpirationTime(), 0)
-			storedTime := time.Unix(entry.GetMsgStoredTime(), 0)
-			resp := new(dns.Msg)
-			if err := resp.Unpack(entry.GetMsg()); err != nil {
-				return fmt.Errorf("failed to decode dns msg, %w", err)
-			}
-
-			i := &item{
-				resp:           resp,
-				storedTime:     storedTime,
-				expirationTime: msgExpTime,
+			if err := f(entry); err != nil {
+				return err
 			}
-			c.backend.Store(key(entry.GetKey()), i, cacheExpTime)
 		}
 		return nil
 	}
@@ -479,3 +763,18 @@ func (c *Cache) readDump(r io.Reader) (int, error) {
 	}
 	return en, gr.Close()
 }
+
+// entryToItem decodes e to an item. It also returns the cache expiration time of e.
+func entryToItem(e *CachedEntry) (*item, time.Time, error) {
+	resp := new(dns.Msg)
+	if err := resp.Unpack(e.GetMsg()); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to decode dns msg, %w", err)
+	}
+	i := &item{
+		resp:           resp,
+		storedTime:     time.Unix(e.GetMsgStoredTime(), 0),
+		expirationTime: time.Unix(e.GetMsgExpirationTime(), 0),
+		size:           len(e.GetMsg()),
+	}
+	return i, time.Unix(e.GetCacheExpirationTime(), 0), nil
+}
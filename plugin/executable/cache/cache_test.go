@@ -21,14 +21,23 @@ package cache
 
 import (
 	"bytes"
-	"github.com/miekg/dns"
+	"context"
+	"net/netip"
 	"strconv"
 	"testing"
 	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/miekg/dns"
 )
 
 func Test_cachePlugin_Dump(t *testing.T) {
-	c := NewCache(&Args{Size: 16 * dumpBlockSize}, Opts{}) // Big enough to create dump fragments.
+	c, err := NewCache(&Args{Size: 16 * dumpBlockSize}, Opts{}) // Big enough to create dump fragments.
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	resp := new(dns.Msg)
 	resp.SetQuestion("test.", dns.TypeA)
@@ -60,3 +69,179 @@ func Test_cachePlugin_Dump(t *testing.T) {
 		t.Fatalf("read err, wrote %d entries, read %d", enw, enr)
 	}
 }
+
+func Test_cachePlugin_L2(t *testing.T) {
+	s := miniredis.RunT(t)
+	newTestCache := func() *Cache {
+		c, err := NewCache(&Args{Redis: "redis://" + s.Addr(), RedisTimeout: 1000, LazyCacheTTL: 86400}, Opts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = c.Close() })
+		return c
+	}
+	c1 := newTestCache()
+	c2 := newTestCache()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   []byte{1, 2, 3, 4},
+	})
+
+	setResp := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		qCtx.SetResponse(resp)
+		return nil
+	})
+	nop := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		return nil
+	})
+
+	ctx := context.Background()
+	if err := c1.Exec(ctx, query_context.NewContext(q), sequence.NewChainWalker([]*sequence.ChainNode{{E: setResp}}, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// L2 store is async.
+	msgKey := getMsgKey(q)
+	deadline := time.Now().Add(time.Second)
+	for !s.Exists(msgKey) {
+		if time.Now().After(deadline) {
+			t.Fatal("response was not stored in l2 cache")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	// Redis ttl is the msg ttl, not the lazy cache ttl.
+	if ttl := s.TTL(msgKey); ttl <= 0 || ttl > 300*time.Second {
+		t.Fatalf("want l2 ttl in (0, 300s], got %s", ttl)
+	}
+
+	qCtx := query_context.NewContext(q)
+	if err := c2.Exec(ctx, qCtx, sequence.NewChainWalker([]*sequence.ChainNode{{E: nop}}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	r := qCtx.R()
+	if r == nil || len(r.Answer) != 1 {
+		t.Fatalf("want response from l2 cache, got %v", r)
+	}
+	if _, _, ok := c2.backend.Get(key(msgKey)); !ok {
+		t.Fatal("l2 hit was not stored in memory cache")
+	}
+}
+
+func Test_getMsgKey(t *testing.T) {
+	newQ := func(qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.", qtype)
+		return q
+	}
+
+	// A (0x0001) and CAA (0x0101) only differ in the high byte.
+	ka, kcaa := getMsgKey(newQ(dns.TypeA)), getMsgKey(newQ(dns.TypeCAA))
+	if ka == kcaa {
+		t.Fatal("A and CAA queries have the same key")
+	}
+	if got := uint16(kcaa[1])<<8 | uint16(kcaa[2]); got != dns.TypeCAA {
+		t.Fatalf("want qtype %d in key, got %d", dns.TypeCAA, got)
+	}
+}
+
+func Test_cachePlugin_ECS(t *testing.T) {
+	c, err := NewCache(&Args{}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	var upstreamCalls int
+	upstream := func(scope uint8) sequence.Executable {
+		return sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+			if qCtx.R() != nil { // cache hit
+				return nil
+			}
+			upstreamCalls++
+			e, _ := qCtx.ECS()
+			qCtx.SetECS(query_context.ECS{Source: e.Source, Scope: scope})
+			resp := new(dns.Msg)
+			resp.SetReply(qCtx.Q())
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: resp.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+				A:   []byte{1, 2, 3, 4},
+			})
+			qCtx.SetResponse(resp)
+			return nil
+		})
+	}
+	exec := func(subnet string, scope uint8) {
+		t.Helper()
+		qCtx := query_context.NewContext(q.Copy())
+		p := netip.MustParsePrefix(subnet)
+		qCtx.SetECS(query_context.ECS{Source: p, Scope: uint8(p.Bits())})
+		if err := c.Exec(context.Background(), qCtx, sequence.NewChainWalker([]*sequence.ChainNode{{E: upstream(scope)}}, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	exec("192.0.2.0/24", 24)
+	exec("192.0.2.0/24", 24) // hit
+	exec("198.51.100.0/24", 24)
+	if upstreamCalls != 2 {
+		t.Fatalf("want 2 upstream calls, got %d", upstreamCalls)
+	}
+
+	// Scope 0 responses are valid for all clients.
+	q.SetQuestion("scope0.example.", dns.TypeA)
+	upstreamCalls = 0
+	exec("192.0.2.0/24", 0)
+	exec("198.51.100.0/24", 0)
+	if upstreamCalls != 1 {
+		t.Fatalf("want 1 upstream call, got %d", upstreamCalls)
+	}
+
+	k := getECSMsgKey(getMsgKey(q), netip.MustParsePrefix("2001:db8::/56"))
+	question, bits, err := parseMsgKey(k)
+	if err != nil || question.Name != "scope0.example." || bits&ecsBit == 0 {
+		t.Fatalf("invalid parsed key %v %d %v", question, bits, err)
+	}
+}
+
+func Test_cachePlugin_StaleEDE(t *testing.T) {
+	c, err := NewCache(&Args{LazyCacheTTL: 3600}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	resp.Extra = nil
+	now := time.Now()
+	c.backend.Store(key(getMsgKey(q)), &item{
+		resp:           resp,
+		storedTime:     now.Add(-time.Hour),
+		expirationTime: now.Add(-time.Minute),
+	}, now.Add(time.Hour))
+
+	qCtx := query_context.NewContext(q)
+	nop := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		return nil
+	})
+	if err := c.Exec(context.Background(), qCtx, sequence.NewChainWalker([]*sequence.ChainNode{{E: nop}}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if qCtx.R() == nil {
+		t.Fatal("want stale response")
+	}
+	opt := qCtx.RespOpt()
+	if len(opt.Option) != 1 || opt.Option[0].(*dns.EDNS0_EDE).InfoCode != dns.ExtendedErrorCodeStaleAnswer {
+		t.Fatalf("want stale answer ede, got %v", opt.Option)
+	}
+}
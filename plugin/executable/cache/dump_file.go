@@ -0,0 +1,188 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Dump file layout:
+//
+//	magic (8 bytes) | sha256 of payload (32 bytes) | payload length (8 bytes, big endian) | payload
+//
+// Payload is the binary dump. Files that don't start with the magic are
+// legacy dumps, which are just the payload.
+const (
+	dumpFileMagic      = "MOSDNSCD"
+	dumpFileHeaderSize = len(dumpFileMagic) + sha256.Size + 8
+
+	dumpFileTmpSuffix = ".tmp"
+	dumpFileBakSuffix = ".bak"
+)
+
+var errDumpFileChecksum = errors.New("dump file checksum mismatched")
+
+// writeDumpFile atomically writes a dump file to path. Data is written to
+// a temp file, synced and renamed over path. The previous file at path,
+// if any and valid, is kept as path + dumpFileBakSuffix. A corrupted
+// previous file won't replace the existing backup.
+func writeDumpFile(path string, write func(w io.Writer) (int, error)) (int, error) {
+	tmp := path + dumpFileTmpSuffix
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp) // Noop if renamed.
+	defer f.Close()
+
+	// Reserve header.
+	if _, err := f.Write(make([]byte, dumpFileHeaderSize)); err != nil {
+		return 0, err
+	}
+	h := sha256.New()
+	cw := &countWriter{w: io.MultiWriter(f, h)}
+	en, err := write(cw)
+	if err != nil {
+		return en, err
+	}
+
+	header := make([]byte, 0, dumpFileHeaderSize)
+	header = append(header, dumpFileMagic...)
+	header = h.Sum(header)
+	header = binary.BigEndian.AppendUint64(header, uint64(cw.n))
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return en, err
+	}
+	if err := f.Sync(); err != nil {
+		return en, err
+	}
+	if err := f.Close(); err != nil {
+		return en, err
+	}
+
+	if _, err := readDumpFile(path, discardDump); err == nil {
+		if err := os.Rename(path, path+dumpFileBakSuffix); err != nil {
+			return en, fmt.Errorf("failed to backup previous dump, %w", err)
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return en, err
+	}
+	syncDir(filepath.Dir(path))
+	return en, nil
+}
+
+// readDumpFile verifies the dump file at path and calls read with its payload.
+// If the checksum mismatched, read won't be called.
+func readDumpFile(path string, read func(r io.Reader) (int, error)) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return readDumpFileFrom(f, read)
+}
+
+// readDumpFileFrom is like readDumpFile but reads the dump file from r.
+func readDumpFileFrom(r io.ReadSeeker, read func(r io.Reader) (int, error)) (int, error) {
+	header := make([]byte, dumpFileHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	if n < len(dumpFileMagic) || string(header[:len(dumpFileMagic)]) != dumpFileMagic { // Legacy dump.
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return read(r)
+	}
+	if n < dumpFileHeaderSize {
+		return 0, fmt.Errorf("dump file header is truncated, %w", errDumpFileChecksum)
+	}
+
+	sum := header[len(dumpFileMagic) : len(dumpFileMagic)+sha256.Size]
+	l := int64(binary.BigEndian.Uint64(header[len(dumpFileMagic)+sha256.Size:]))
+	h := sha256.New()
+	copied, err := io.Copy(h, r)
+	if err != nil {
+		return 0, err
+	}
+	if copied != l || !bytes.Equal(h.Sum(nil), sum) {
+		return 0, errDumpFileChecksum
+	}
+
+	if _, err := r.Seek(int64(dumpFileHeaderSize), io.SeekStart); err != nil {
+		return 0, err
+	}
+	return read(io.LimitReader(r, l))
+}
+
+// writeDumpFileTo writes a dump file to w. The payload is buffered in
+// memory because the header has its checksum.
+func writeDumpFileTo(w io.Writer, write func(w io.Writer) (int, error)) (int, error) {
+	payload := new(bytes.Buffer)
+	en, err := write(payload)
+	if err != nil {
+		return en, err
+	}
+	sum := sha256.Sum256(payload.Bytes())
+	header := make([]byte, 0, dumpFileHeaderSize)
+	header = append(header, dumpFileMagic...)
+	header = append(header, sum[:]...)
+	header = binary.BigEndian.AppendUint64(header, uint64(payload.Len()))
+	if _, err := w.Write(header); err != nil {
+		return en, err
+	}
+	_, err = payload.WriteTo(w)
+	return en, err
+}
+
+func discardDump(r io.Reader) (int, error) {
+	return 0, nil
+}
+
+// syncDir flushes the directory entry. Errors are ignored because
+// not all platforms support it.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
+
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
@@ -0,0 +1,107 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_dumpFile(t *testing.T) {
+	dumpFile := filepath.Join(t.TempDir(), "cache.dump")
+	newTestCache := func() *Cache {
+		c, err := NewCache(&Args{DumpFile: dumpFile}, Opts{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	fill := func(c *Cache, n int) {
+		resp := new(dns.Msg)
+		resp.SetQuestion("test.", dns.TypeA)
+		now := time.Now()
+		v := &item{resp: resp, storedTime: now, expirationTime: now.Add(time.Hour)}
+		for i := 0; i < n; i++ {
+			c.backend.Store(key(strconv.Itoa(i)), v, now.Add(time.Hour))
+		}
+	}
+
+	c := newTestCache()
+	if err := c.loadDump(); err != nil { // First start.
+		t.Fatalf("missing dump file should be ignored, %v", err)
+	}
+	fill(c, 1)
+	if err := c.dumpCache(); err != nil {
+		t.Fatal(err)
+	}
+	fill(c, 2)
+	if err := c.Close(); err != nil { // Dumps on close.
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dumpFile + dumpFileBakSuffix); err != nil {
+		t.Fatalf("previous dump was not retained, %v", err)
+	}
+	if _, err := os.Stat(dumpFile + dumpFileTmpSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("temp file was not removed, %v", err)
+	}
+
+	c = newTestCache()
+	if l := c.backend.Len(); l != 2 {
+		t.Fatalf("want 2 entries from the latest dump, got %d", l)
+	}
+	_ = c.backend.Close()
+
+	// Corrupt the latest dump.
+	b, err := os.ReadFile(dumpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	if err := os.WriteFile(dumpFile, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readDumpFile(dumpFile, func(r io.Reader) (int, error) {
+		t.Fatal("corrupted payload should not be read")
+		return 0, nil
+	}); !errors.Is(err, errDumpFileChecksum) {
+		t.Fatalf("want checksum error, got %v", err)
+	}
+
+	c = newTestCache()
+	if l := c.backend.Len(); l != 1 {
+		t.Fatalf("want 1 entry from the previous dump, got %d", l)
+	}
+	_ = c.backend.Close()
+
+	// The corrupted dump won't replace the backup.
+	if _, err := writeDumpFile(dumpFile, func(w io.Writer) (int, error) { return 0, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readDumpFile(dumpFile+dumpFileBakSuffix, discardDump); err != nil {
+		t.Fatalf("backup was replaced by the corrupted dump, %v", err)
+	}
+}
@@ -0,0 +1,583 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/miekg/dns"
+)
+
+// Cache dump formats.
+const (
+	// DumpFormatBinary is the gzip+protobuf block format with the dump file
+	// header. It is the default format.
+	DumpFormatBinary = "binary"
+	// DumpFormatJSONL is the JSON Lines format. One textEntry per line.
+	DumpFormatJSONL = "jsonl"
+	// DumpFormatZone is a zone file style format. Each entry starts with a
+	// "; entry" comment line that carries its metadata, followed by its
+	// records, and ends with an empty line. Records that are not in an
+	// entry will be grouped by name and type into entries with synthetic ttl.
+	DumpFormatZone = "zone"
+)
+
+const (
+	// defaultSyntheticTtl is used when an imported entry has no times and no ttl.
+	defaultSyntheticTtl = 300
+)
+
+// textEntry is the human-readable form of CachedEntry.
+type textEntry struct {
+	Name       string `json:"name"`
+	Qtype      string `json:"qtype"`
+	QueryFlags string `json:"query_flags,omitempty"` // Space separated. "ad", "cd" and "do".
+
+	Rcode string `json:"rcode,omitempty"`
+	Flags string `json:"flags,omitempty"` // Space separated. "aa", "rd", "ra", "ad" and "cd".
+
+	StoredTime          *time.Time `json:"stored_time,omitempty"`
+	MsgExpirationTime   *time.Time `json:"msg_expiration_time,omitempty"`
+	CacheExpirationTime *time.Time `json:"cache_expiration_time,omitempty"`
+
+	// TTL is only used by imports. If above times are omitted, entry will
+	// be stored with a synthetic ttl. If TTL is also omitted, the minimal
+	// ttl of records will be used.
+	TTL uint32 `json:"ttl,omitempty"`
+
+	Answer []string `json:"answer,omitempty"`
+	Ns     []string `json:"ns,omitempty"`
+	Extra  []string `json:"extra,omitempty"`
+}
+
+var queryFlagBits = []struct {
+	name string
+	bit  byte
+}{
+	{"ad", adBit},
+	{"cd", cdBit},
+	{"do", doBit},
+}
+
+// qtypeToString returns the mnemonic of qtype, or "TYPEn" (RFC 3597) if qtype is unknown.
+func qtypeToString(qtype uint16) string {
+	if s, ok := dns.TypeToString[qtype]; ok {
+		return s
+	}
+	return "TYPE" + strconv.Itoa(int(qtype))
+}
+
+func stringToQtype(s string) (uint16, bool) {
+	s = strings.ToUpper(s)
+	if qtype, ok := dns.StringToType[s]; ok {
+		return qtype, true
+	}
+	if n, ok := strings.CutPrefix(s, "TYPE"); ok {
+		i, err := strconv.ParseUint(n, 10, 16)
+		return uint16(i), err == nil
+	}
+	return 0, false
+}
+
+func toTextEntry(e *CachedEntry) (*textEntry, error) {
+	q, bits, err := parseMsgKey(string(e.GetKey()))
+	if err != nil {
+		return nil, err
+	}
+	if bits&ecsBit != 0 {
+		return nil, fmt.Errorf("client subnet specific entry")
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(e.GetMsg()); err != nil {
+		return nil, fmt.Errorf("failed to decode dns msg, %w", err)
+	}
+
+	var queryFlags []string
+	for _, f := range queryFlagBits {
+		if bits&f.bit != 0 {
+			queryFlags = append(queryFlags, f.name)
+		}
+	}
+	var flags []string
+	for _, f := range [...]struct {
+		name string
+		set  bool
+	}{
+		{"aa", m.Authoritative},
+		{"rd", m.RecursionDesired},
+		{"ra", m.RecursionAvailable},
+		{"ad", m.AuthenticatedData},
+		{"cd", m.CheckingDisabled},
+	} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+
+	storedTime := time.Unix(e.GetMsgStoredTime(), 0).UTC()
+	msgExpirationTime := time.Unix(e.GetMsgExpirationTime(), 0).UTC()
+	cacheExpirationTime := time.Unix(e.GetCacheExpirationTime(), 0).UTC()
+	te := &textEntry{
+		Name:                q.Name,
+		Qtype:               qtypeToString(q.Qtype),
+		QueryFlags:          strings.Join(queryFlags, " "),
+		Rcode:               dns.RcodeToString[m.Rcode],
+		Flags:               strings.Join(flags, " "),
+		StoredTime:          &storedTime,
+		MsgExpirationTime:   &msgExpirationTime,
+		CacheExpirationTime: &cacheExpirationTime,
+	}
+	for _, rr := range m.Answer {
+		te.Answer = append(te.Answer, rr.String())
+	}
+	for _, rr := range m.Ns {
+		te.Ns = append(te.Ns, rr.String())
+	}
+	for _, rr := range m.Extra {
+		te.Extra = append(te.Extra, rr.String())
+	}
+	return te, nil
+}
+
+func (te *textEntry) toCachedEntry(now time.Time) (*CachedEntry, error) {
+	qtype, ok := stringToQtype(te.Qtype)
+	if !ok {
+		return nil, fmt.Errorf("invalid qtype %s", te.Qtype)
+	}
+	if _, ok := dns.IsDomainName(te.Name); !ok {
+		return nil, fmt.Errorf("invalid name %s", te.Name)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(te.Name), qtype)
+	for _, f := range strings.Fields(te.QueryFlags) {
+		switch f {
+		case "ad":
+			q.AuthenticatedData = true
+		case "cd":
+			q.CheckingDisabled = true
+		case "do":
+			q.SetEdns0(dns.MinMsgSize, true)
+		default:
+			return nil, fmt.Errorf("invalid query flag %s", f)
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(q)
+	m.Extra = nil // Remove OPT.
+	m.RecursionDesired = false
+	for _, f := range strings.Fields(te.Flags) {
+		switch f {
+		case "aa":
+			m.Authoritative = true
+		case "rd":
+			m.RecursionDesired = true
+		case "ra":
+			m.RecursionAvailable = true
+		case "ad":
+			m.AuthenticatedData = true
+		case "cd":
+			m.CheckingDisabled = true
+		default:
+			return nil, fmt.Errorf("invalid flag %s", f)
+		}
+	}
+	if len(te.Rcode) > 0 {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(te.Rcode)]
+		if !ok {
+			return nil, fmt.Errorf("invalid rcode %s", te.Rcode)
+		}
+		m.Rcode = rcode
+	}
+	for _, s := range [...]struct {
+		rrs []string
+		dst *[]dns.RR
+	}{{te.Answer, &m.Answer}, {te.Ns, &m.Ns}, {te.Extra, &m.Extra}} {
+		for _, rs := range s.rrs {
+			rr, err := dns.NewRR(rs)
+			if err != nil {
+				return nil, fmt.Errorf("invalid record %q, %w", rs, err)
+			}
+			if rr == nil {
+				continue
+			}
+			*s.dst = append(*s.dst, rr)
+		}
+	}
+
+	var storedTime, msgExpirationTime, cacheExpirationTime time.Time
+	if te.StoredTime != nil && te.MsgExpirationTime != nil {
+		storedTime, msgExpirationTime = *te.StoredTime, *te.MsgExpirationTime
+		cacheExpirationTime = msgExpirationTime
+		if te.CacheExpirationTime != nil {
+			cacheExpirationTime = *te.CacheExpirationTime
+		}
+	} else { // Synthetic ttl.
+		ttl := te.TTL
+		if ttl == 0 {
+			ttl = dnsutils.GetMinimalTTL(m)
+		}
+		if ttl == 0 {
+			ttl = defaultSyntheticTtl
+		}
+		storedTime = now
+		msgExpirationTime = now.Add(time.Duration(ttl) * time.Second)
+		cacheExpirationTime = msgExpirationTime
+	}
+
+	b, err := m.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pack msg, %w", err)
+	}
+	return &CachedEntry{
+		Key:                 []byte(getMsgKey(q)),
+		Msg:                 b,
+		CacheExpirationTime: cacheExpirationTime.Unix(),
+		MsgExpirationTime:   msgExpirationTime.Unix(),
+		MsgStoredTime:       storedTime.Unix(),
+	}, nil
+}
+
+// writeJSONLDump writes entries from rangeEntries to w in DumpFormatJSONL.
+// Entries that have invalid keys will be skipped and counted in skipped.
+func writeJSONLDump(w io.Writer, rangeEntries func(f func(e *CachedEntry) error) error) (en, skipped int, err error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	err = rangeEntries(func(e *CachedEntry) error {
+		te, err := toTextEntry(e)
+		if err != nil {
+			skipped++
+			return nil
+		}
+		if err := enc.Encode(te); err != nil {
+			return err
+		}
+		en++
+		return nil
+	})
+	if err != nil {
+		return en, skipped, err
+	}
+	return en, skipped, bw.Flush()
+}
+
+// readJSONLDump reads DumpFormatJSONL from r and calls f for each entry.
+// Empty lines are ignored.
+func readJSONLDump(r io.Reader, f func(e *CachedEntry) error) (int, error) {
+	en := 0
+	now := time.Now()
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, dumpMaximumBlockLength)
+	line := 0
+	for s.Scan() {
+		line++
+		b := s.Bytes()
+		if len(strings.TrimSpace(string(b))) == 0 {
+			continue
+		}
+		te := new(textEntry)
+		if err := json.Unmarshal(b, te); err != nil {
+			return en, fmt.Errorf("line %d: invalid json, %w", line, err)
+		}
+		e, err := te.toCachedEntry(now)
+		if err != nil {
+			return en, fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := f(e); err != nil {
+			return en, err
+		}
+		en++
+	}
+	return en, s.Err()
+}
+
+const (
+	zoneEntryPrefix      = "; entry "
+	zoneAuthorityMarker  = "; authority"
+	zoneAdditionalMarker = "; additional"
+)
+
+// writeZoneDump writes entries from rangeEntries to w in DumpFormatZone.
+// Entries that have invalid keys will be skipped and counted in skipped.
+func writeZoneDump(w io.Writer, rangeEntries func(f func(e *CachedEntry) error) error) (en, skipped int, err error) {
+	bw := bufio.NewWriter(w)
+	err = rangeEntries(func(e *CachedEntry) error {
+		te, err := toTextEntry(e)
+		if err != nil {
+			skipped++
+			return nil
+		}
+
+		bw.WriteString(zoneEntryPrefix)
+		bw.WriteString(te.Name)
+		bw.WriteByte(' ')
+		bw.WriteString(te.Qtype)
+		for _, kv := range [...][2]string{
+			{"query_flags", strings.ReplaceAll(te.QueryFlags, " ", ",")},
+			{"rcode", te.Rcode},
+			{"flags", strings.ReplaceAll(te.Flags, " ", ",")},
+			{"stored", te.StoredTime.Format(time.RFC3339)},
+			{"msg_expire", te.MsgExpirationTime.Format(time.RFC3339)},
+			{"cache_expire", te.CacheExpirationTime.Format(time.RFC3339)},
+		} {
+			if len(kv[1]) == 0 {
+				continue
+			}
+			bw.WriteByte(' ')
+			bw.WriteString(kv[0])
+			bw.WriteByte('=')
+			bw.WriteString(kv[1])
+		}
+		bw.WriteByte('\n')
+		writeRRs := func(marker string, rrs []string) {
+			if len(rrs) == 0 {
+				return
+			}
+			if len(marker) > 0 {
+				bw.WriteString(marker)
+				bw.WriteByte('\n')
+			}
+			for _, rr := range rrs {
+				bw.WriteString(rr)
+				bw.WriteByte('\n')
+			}
+		}
+		writeRRs("", te.Answer)
+		writeRRs(zoneAuthorityMarker, te.Ns)
+		writeRRs(zoneAdditionalMarker, te.Extra)
+		if _, err := bw.WriteString("\n"); err != nil {
+			return err
+		}
+		en++
+		return nil
+	})
+	if err != nil {
+		return en, skipped, err
+	}
+	return en, skipped, bw.Flush()
+}
+
+// parseZoneEntryHeader parses a "; entry" line.
+func parseZoneEntryHeader(s string) (*textEntry, error) {
+	fs := strings.Fields(strings.TrimPrefix(s, zoneEntryPrefix))
+	if len(fs) < 2 {
+		return nil, fmt.Errorf("invalid entry header, want name and qtype")
+	}
+	te := &textEntry{Name: fs[0], Qtype: fs[1]}
+	for _, kv := range fs[2:] {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry field %s", kv)
+		}
+		parseTime := func() (*time.Time, error) {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid time %s, %w", kv, err)
+			}
+			return &t, nil
+		}
+		var err error
+		switch k {
+		case "query_flags":
+			te.QueryFlags = strings.ReplaceAll(v, ",", " ")
+		case "rcode":
+			te.Rcode = v
+		case "flags":
+			te.Flags = strings.ReplaceAll(v, ",", " ")
+		case "ttl":
+			_, err = fmt.Sscan(v, &te.TTL)
+		case "stored":
+			te.StoredTime, err = parseTime()
+		case "msg_expire":
+			te.MsgExpirationTime, err = parseTime()
+		case "cache_expire":
+			te.CacheExpirationTime, err = parseTime()
+		default:
+			err = fmt.Errorf("unknown entry field %s", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return te, nil
+}
+
+// readZoneDump reads DumpFormatZone from r and calls f for each entry.
+func readZoneDump(r io.Reader, f func(e *CachedEntry) error) (int, error) {
+	en := 0
+	now := time.Now()
+
+	var (
+		current *textEntry // Current entry.
+		section *[]string  // Current section of current entry.
+
+		// Records that are not in an entry, grouped by name and type.
+		looseEntries []*textEntry
+		looseIdx     = make(map[[2]string]*textEntry)
+	)
+	emit := func(te *textEntry) error {
+		e, err := te.toCachedEntry(now)
+		if err != nil {
+			return err
+		}
+		if err := f(e); err != nil {
+			return err
+		}
+		en++
+		return nil
+	}
+
+	s := bufio.NewScanner(r)
+	line := 0
+	for s.Scan() {
+		line++
+		l := strings.TrimSpace(s.Text())
+		var err error
+		switch {
+		case len(l) == 0: // End of an entry.
+			if current != nil {
+				err = emit(current)
+				current = nil
+			}
+		case strings.HasPrefix(l, zoneEntryPrefix):
+			if current != nil {
+				err = emit(current)
+			}
+			if err == nil {
+				current, err = parseZoneEntryHeader(l)
+				if current != nil {
+					section = &current.Answer
+				}
+			}
+		case l == zoneAuthorityMarker && current != nil:
+			section = &current.Ns
+		case l == zoneAdditionalMarker && current != nil:
+			section = &current.Extra
+		case strings.HasPrefix(l, ";"): // Other comments.
+		case current != nil:
+			*section = append(*section, l)
+		default:
+			var rr dns.RR
+			rr, err = dns.NewRR(l)
+			if err != nil || rr == nil {
+				break
+			}
+			h := rr.Header()
+			k := [2]string{dns.CanonicalName(h.Name), qtypeToString(h.Rrtype)}
+			te := looseIdx[k]
+			if te == nil {
+				te = &textEntry{Name: h.Name, Qtype: qtypeToString(h.Rrtype)}
+				looseIdx[k] = te
+				looseEntries = append(looseEntries, te)
+			}
+			te.Answer = append(te.Answer, l)
+		}
+		if err != nil {
+			return en, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return en, err
+	}
+	if current != nil {
+		if err := emit(current); err != nil {
+			return en, err
+		}
+	}
+	for _, te := range looseEntries {
+		if err := emit(te); err != nil {
+			return en, err
+		}
+	}
+	return en, nil
+}
+
+// writeDumpFormat writes entries from rangeEntries to w in format.
+// Binary format is written in the same layout as the dump file.
+// It returns the number of entries written and skipped. Text formats
+// skip entries that have invalid keys.
+func writeDumpFormat(w io.Writer, format string, rangeEntries func(f func(e *CachedEntry) error) error) (en, skipped int, err error) {
+	switch format {
+	case "", DumpFormatBinary:
+		en, err = writeDumpFileTo(w, func(w io.Writer) (int, error) {
+			return writeBinaryDump(w, rangeEntries)
+		})
+		return en, 0, err
+	case DumpFormatJSONL:
+		return writeJSONLDump(w, rangeEntries)
+	case DumpFormatZone:
+		return writeZoneDump(w, rangeEntries)
+	default:
+		return 0, 0, fmt.Errorf("unknown dump format %s", format)
+	}
+}
+
+// readDumpFormat reads entries in format from r and calls f for each entry.
+// Binary format can be a dump file or a legacy dump without the header.
+// It is buffered in memory and verified before f is called.
+func readDumpFormat(r io.Reader, format string, f func(e *CachedEntry) error) (int, error) {
+	switch format {
+	case "", DumpFormatBinary:
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return 0, err
+		}
+		return readDumpFileFrom(bytes.NewReader(b), func(r io.Reader) (int, error) {
+			return readBinaryDump(r, f)
+		})
+	case DumpFormatJSONL:
+		return readJSONLDump(r, f)
+	case DumpFormatZone:
+		return readZoneDump(r, f)
+	default:
+		return 0, fmt.Errorf("unknown dump format %s", format)
+	}
+}
+
+// ConvertDump reads a cache dump in inFormat from r and writes it to w in outFormat.
+// It returns the number of entries written and skipped.
+func ConvertDump(w io.Writer, outFormat string, r io.Reader, inFormat string) (n, skipped int, err error) {
+	var entries []*CachedEntry
+	_, err = readDumpFormat(r, inFormat, func(e *CachedEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read dump, %w", err)
+	}
+	return writeDumpFormat(w, outFormat, func(f func(e *CachedEntry) error) error {
+		for _, e := range entries {
+			if err := f(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/miekg/dns"
+)
+
+func newTestDumpCache(t *testing.T) *Cache {
+	t.Helper()
+	c, err := NewCache(&Args{}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func Test_textDump_roundTrip(t *testing.T) {
+	for _, format := range []string{DumpFormatBinary, DumpFormatJSONL, DumpFormatZone} {
+		t.Run(format, func(t *testing.T) {
+			src := newTestDumpCache(t)
+
+			q := new(dns.Msg)
+			q.SetQuestion("example.", dns.TypeHTTPS)
+			q.SetEdns0(1232, true)
+			resp := new(dns.Msg)
+			resp.SetRcode(q, dns.RcodeNameError)
+			resp.RecursionAvailable = true
+			resp.Ns = []dns.RR{dnsutils.FakeSOA("example.")}
+
+			storedTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+			v := &item{
+				resp:           copyNoOpt(resp),
+				storedTime:     storedTime,
+				expirationTime: storedTime.Add(time.Hour),
+			}
+			msgKey := getMsgKey(q)
+			src.backend.Store(key(msgKey), v, storedTime.Add(time.Hour*2))
+
+			buf := new(bytes.Buffer)
+			if n, _, err := writeDumpFormat(buf, format, src.rangeEntries); err != nil || n != 1 {
+				t.Fatalf("write dump, n=%d, err=%v", n, err)
+			}
+
+			dst := newTestDumpCache(t)
+			if n, err := readDumpFormat(buf, format, dst.storeEntry); err != nil || n != 1 {
+				t.Fatalf("read dump, n=%d, err=%v", n, err)
+			}
+
+			got, cacheExpirationTime, ok := dst.backend.Get(key(msgKey))
+			if !ok {
+				t.Fatal("entry not found")
+			}
+			if !got.storedTime.Equal(storedTime) || !got.expirationTime.Equal(v.expirationTime) || !cacheExpirationTime.Equal(storedTime.Add(time.Hour*2)) {
+				t.Fatalf("times mismatched, got %s %s %s", got.storedTime, got.expirationTime, cacheExpirationTime)
+			}
+			if got.resp.Rcode != dns.RcodeNameError || !got.resp.RecursionAvailable || len(got.resp.Ns) != 1 {
+				t.Fatalf("msg mismatched, got %s", got.resp)
+			}
+		})
+	}
+}
+
+func Test_readZoneDump_preWarm(t *testing.T) {
+	c := newTestDumpCache(t)
+	zone := `
+; synthetic entries
+a.example. 60 IN A 1.1.1.1
+a.example. 30 IN A 1.1.1.2
+a.example. 60 IN AAAA ::1
+
+; entry b.example. A ttl=600
+b.example. 10 IN A 2.2.2.2
+`
+	n, err := readDumpFormat(strings.NewReader(zone), DumpFormatZone, c.storeEntry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Fatalf("want 3 entries, got %d", n)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		qtype uint16
+		ttl   time.Duration
+		ans   int
+	}{
+		{"a.example.", dns.TypeA, time.Second * 30, 2},
+		{"a.example.", dns.TypeAAAA, time.Second * 60, 1},
+		{"b.example.", dns.TypeA, time.Second * 600, 1},
+	} {
+		q := new(dns.Msg)
+		q.SetQuestion(tt.name, tt.qtype)
+		v, _, ok := c.backend.Get(key(getMsgKey(q)))
+		if !ok {
+			t.Fatalf("%s %d not found", tt.name, tt.qtype)
+		}
+		if d := v.expirationTime.Sub(v.storedTime); d != tt.ttl {
+			t.Fatalf("%s %d: want ttl %s, got %s", tt.name, tt.qtype, tt.ttl, d)
+		}
+		if len(v.resp.Answer) != tt.ans {
+			t.Fatalf("%s %d: want %d answers, got %d", tt.name, tt.qtype, tt.ans, len(v.resp.Answer))
+		}
+	}
+}
+
+func Test_writeDumpFormat_skipInvalidKey(t *testing.T) {
+	entries := []*CachedEntry{{Key: []byte("bad")}}
+	rangeEntries := func(f func(e *CachedEntry) error) error {
+		for _, e := range entries {
+			if err := f(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, format := range []string{DumpFormatJSONL, DumpFormatZone} {
+		n, skipped, err := writeDumpFormat(io.Discard, format, rangeEntries)
+		if err != nil || n != 0 || skipped != 1 {
+			t.Fatalf("%s: want 0 written and 1 skipped, got %d, %d, %v", format, n, skipped, err)
+		}
+	}
+}
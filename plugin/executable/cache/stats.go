@@ -0,0 +1,369 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"container/heap"
+	"hash/maphash"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	statsBucketDuration = time.Second * 10
+	statsBucketNum      = int(time.Hour / statsBucketDuration)
+)
+
+// statsWindows are the sliding windows of hit ratio in the stats api.
+var statsWindows = []struct {
+	name string
+	d    time.Duration
+}{
+	{"1m", time.Minute},
+	{"5m", time.Minute * 5},
+	{"15m", time.Minute * 15},
+	{"1h", time.Hour},
+}
+
+// hitCounter counts queries and hits in a ring of time buckets.
+// It is safe for concurrent use. Counts that are added while a bucket is
+// being reused may be lost, which is acceptable for stats.
+type hitCounter struct {
+	buckets [statsBucketNum]hitBucket
+}
+
+type hitBucket struct {
+	start    atomic.Int64 // Unix seconds of the bucket start time.
+	queries  atomic.Uint64
+	hits     atomic.Uint64
+	lazyHits atomic.Uint64
+}
+
+func (c *hitCounter) add(now time.Time, hit, lazyHit bool) {
+	slot := now.Unix() / int64(statsBucketDuration/time.Second)
+	start := slot * int64(statsBucketDuration/time.Second)
+	b := &c.buckets[slot%int64(statsBucketNum)]
+	if old := b.start.Load(); old != start && b.start.CompareAndSwap(old, start) { // Stale bucket, reuse it.
+		b.queries.Store(0)
+		b.hits.Store(0)
+		b.lazyHits.Store(0)
+	}
+	b.queries.Add(1)
+	if hit {
+		b.hits.Add(1)
+	}
+	if lazyHit {
+		b.lazyHits.Add(1)
+	}
+}
+
+func (c *hitCounter) reset() {
+	for i := range c.buckets {
+		b := &c.buckets[i]
+		b.start.Store(0)
+		b.queries.Store(0)
+		b.hits.Store(0)
+		b.lazyHits.Store(0)
+	}
+}
+
+type hitRatio struct {
+	Queries  uint64  `json:"queries"`
+	Hits     uint64  `json:"hits"`
+	LazyHits uint64  `json:"lazy_hits"`
+	Ratio    float64 `json:"ratio"`
+}
+
+// sum returns the hit ratio of the window d, which ends at now.
+func (c *hitCounter) sum(now time.Time, d time.Duration) hitRatio {
+	var r hitRatio
+	since := now.Add(-d).Unix()
+	for i := range c.buckets {
+		b := &c.buckets[i]
+		if start := b.start.Load(); start > since && start <= now.Unix() {
+			r.Queries += b.queries.Load()
+			r.Hits += b.hits.Load()
+			r.LazyHits += b.lazyHits.Load()
+		}
+	}
+	if r.Queries > 0 {
+		r.Ratio = float64(r.Hits) / float64(r.Queries)
+	}
+	return r
+}
+
+const (
+	topKShardNum         = 16
+	topKMinShardCapacity = 8
+)
+
+// topK tracks the most frequent names with bounded memory. It uses the
+// Space-Saving algorithm, so counts are upper bounds of the real counts.
+// Names are sharded by their hash to reduce lock contention.
+// It is safe for concurrent use.
+type topK struct {
+	shards [topKShardNum]topKShard
+}
+
+type topKShard struct {
+	mu       sync.Mutex
+	capacity int
+	m        map[string]*topKCounter
+	h        topKHeap // min-heap by count
+}
+
+type topKCounter struct {
+	name  string
+	count uint64
+	idx   int // index in heap
+}
+
+func newTopK(capacity int) *topK {
+	t := new(topK)
+	shardCapacity := max((capacity+topKShardNum-1)/topKShardNum, topKMinShardCapacity)
+	for i := range t.shards {
+		t.shards[i].capacity = shardCapacity
+		t.shards[i].m = make(map[string]*topKCounter, shardCapacity)
+	}
+	return t
+}
+
+func (t *topK) add(name string) {
+	t.shards[maphash.String(seed, name)%topKShardNum].add(name)
+}
+
+func (t *topKShard) add(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c, ok := t.m[name]; ok {
+		c.count++
+		heap.Fix(&t.h, c.idx)
+		return
+	}
+	if len(t.h) < t.capacity {
+		c := &topKCounter{name: name, count: 1}
+		t.m[name] = c
+		heap.Push(&t.h, c)
+		return
+	}
+	// Replace the least frequent name.
+	c := t.h[0]
+	delete(t.m, c.name)
+	c.name = name
+	c.count++
+	t.m[name] = c
+	heap.Fix(&t.h, 0)
+}
+
+type nameCount struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+// top returns the n most frequent names.
+func (t *topK) top(n int) []nameCount {
+	s := make([]nameCount, 0)
+	for i := range t.shards {
+		sh := &t.shards[i]
+		sh.mu.Lock()
+		for _, c := range sh.h {
+			s = append(s, nameCount{Name: c.name, Count: c.count})
+		}
+		sh.mu.Unlock()
+	}
+	sort.Slice(s, func(i, j int) bool {
+		if s[i].Count != s[j].Count {
+			return s[i].Count > s[j].Count
+		}
+		return s[i].Name < s[j].Name
+	})
+	if len(s) > n {
+		s = s[:n]
+	}
+	return s
+}
+
+func (t *topK) reset() {
+	for i := range t.shards {
+		sh := &t.shards[i]
+		sh.mu.Lock()
+		sh.m = make(map[string]*topKCounter, sh.capacity)
+		sh.h = nil
+		sh.mu.Unlock()
+	}
+}
+
+type topKHeap []*topKCounter
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].idx = i
+	h[j].idx = j
+}
+
+func (h *topKHeap) Push(x any) {
+	c := x.(*topKCounter)
+	c.idx = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *topKHeap) Pop() any {
+	old := *h
+	n := len(old)
+	c := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return c
+}
+
+// stats collects statistics for the stats api.
+type stats struct {
+	hits *hitCounter
+
+	// Maybe nil if name tracking is disabled.
+	requested *topK
+	missed    *topK
+}
+
+func newStats(topNamesCapacity int) *stats {
+	s := &stats{hits: new(hitCounter)}
+	if topNamesCapacity > 0 {
+		s.requested = newTopK(topNamesCapacity)
+		s.missed = newTopK(topNamesCapacity)
+	}
+	return s
+}
+
+// record records a query. qName can be empty if the query is not cacheable.
+func (s *stats) record(qName string, hit, lazyHit bool) {
+	s.hits.add(time.Now(), hit, lazyHit)
+	if s.requested == nil || len(qName) == 0 {
+		return
+	}
+	s.requested.add(qName)
+	if !hit {
+		s.missed.add(qName)
+	}
+}
+
+func (s *stats) reset() {
+	s.hits.reset()
+	if s.requested != nil {
+		s.requested.reset()
+		s.missed.reset()
+	}
+}
+
+// ttlBuckets are the upper bounds of remaining ttl distribution buckets.
+var ttlBuckets = []struct {
+	name string
+	le   time.Duration
+}{
+	{"expired", 0}, // Msg is expired but still in lazy cache.
+	{"10s", time.Second * 10},
+	{"1m", time.Minute},
+	{"5m", time.Minute * 5},
+	{"1h", time.Hour},
+	{"1d", time.Hour * 24},
+	{"inf", 1<<63 - 1},
+}
+
+type bucketCount struct {
+	Le    string `json:"le"`
+	Count int    `json:"count"`
+}
+
+type shareCount struct {
+	Count int     `json:"count"`
+	Share float64 `json:"share"`
+}
+
+type statsReport struct {
+	Entries      int                    `json:"entries"`
+	HitRatio     map[string]hitRatio    `json:"hit_ratio"`
+	TopRequested []nameCount            `json:"top_requested"`
+	TopMissed    []nameCount            `json:"top_missed"`
+	RemainingTTL []bucketCount          `json:"remaining_ttl"`
+	Qtypes       map[string]*shareCount `json:"qtypes"`
+	Rcodes       map[string]*shareCount `json:"rcodes"`
+}
+
+// statsReport generates a statsReport. It ranges over all cached entries.
+func (c *Cache) statsReport(topN int) *statsReport {
+	now := time.Now()
+	s := c.stats
+	r := &statsReport{
+		HitRatio:     make(map[string]hitRatio, len(statsWindows)),
+		TopRequested: []nameCount{},
+		TopMissed:    []nameCount{},
+		RemainingTTL: make([]bucketCount, len(ttlBuckets)),
+		Qtypes:       make(map[string]*shareCount),
+		Rcodes:       make(map[string]*shareCount),
+	}
+	for _, w := range statsWindows {
+		r.HitRatio[w.name] = s.hits.sum(now, w.d)
+	}
+	if s.requested != nil {
+		r.TopRequested = s.requested.top(topN)
+		r.TopMissed = s.missed.top(topN)
+	}
+	for i, b := range ttlBuckets {
+		r.RemainingTTL[i].Le = b.name
+	}
+
+	inc := func(m map[string]*shareCount, k string) {
+		sc := m[k]
+		if sc == nil {
+			sc = new(shareCount)
+			m[k] = sc
+		}
+		sc.Count++
+	}
+	_ = c.backend.Range(func(k key, v *item, cacheExpirationTime time.Time) error {
+		if cacheExpirationTime.Before(now) {
+			return nil
+		}
+		r.Entries++
+		remaining := v.expirationTime.Sub(now)
+		for i, b := range ttlBuckets {
+			if remaining <= b.le {
+				r.RemainingTTL[i].Count++
+				break
+			}
+		}
+		if q, _, err := parseMsgKey(string(k)); err == nil {
+			inc(r.Qtypes, qtypeToString(q.Qtype))
+		}
+		inc(r.Rcodes, dns.RcodeToString[v.resp.Rcode])
+		return nil
+	})
+	for _, m := range [...]map[string]*shareCount{r.Qtypes, r.Rcodes} {
+		for _, sc := range m {
+			sc.Share = float64(sc.Count) / float64(r.Entries)
+		}
+	}
+	return r
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cache
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_topK(t *testing.T) {
+	tk := newTopK(8)
+	for i := 0; i < 10; i++ {
+		tk.add("a")
+	}
+	for i := 0; i < 5; i++ {
+		tk.add("b")
+	}
+	for i := 0; i < 10; i++ { // Noise that exceeds the capacity.
+		tk.add(strconv.Itoa(i))
+	}
+	top := tk.top(2)
+	if len(top) != 2 || top[0].Name != "a" || top[0].Count != 10 || top[1].Name != "b" || top[1].Count != 5 {
+		t.Fatalf("unexpected top names %v", top)
+	}
+}
+
+func Test_hitCounter(t *testing.T) {
+	hc := new(hitCounter)
+	now := time.Now()
+	hc.add(now.Add(-time.Hour*2), true, false) // Out of all windows.
+	hc.add(now.Add(-time.Minute*10), false, false)
+	hc.add(now, true, false)
+	hc.add(now, true, true)
+
+	if r := hc.sum(now, time.Minute); r.Queries != 2 || r.Hits != 2 || r.LazyHits != 1 || r.Ratio != 1 {
+		t.Fatalf("unexpected 1m hit ratio %+v", r)
+	}
+	if r := hc.sum(now, time.Minute*15); r.Queries != 3 || r.Hits != 2 {
+		t.Fatalf("unexpected 15m hit ratio %+v", r)
+	}
+}
+
+func Test_cachePlugin_statsReport(t *testing.T) {
+	c, err := NewCache(&Args{StatsTopNames: 16}, Opts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i, qtype := range []uint16{dns.TypeA, dns.TypeA, dns.TypeAAAA} {
+		q := new(dns.Msg)
+		q.SetQuestion(strconv.Itoa(i)+".example.", qtype)
+		r := new(dns.Msg)
+		r.SetRcode(q, dns.RcodeNameError)
+		saveRespToCache(getMsgKey(q), r, c.backend, 0)
+	}
+	c.stats.record("example.", false, false)
+
+	r := c.statsReport(10)
+	if r.Entries != 3 {
+		t.Fatalf("want 3 entries, got %d", r.Entries)
+	}
+	if sc := r.Qtypes["A"]; sc == nil || sc.Count != 2 {
+		t.Fatalf("unexpected qtypes %v", r.Qtypes)
+	}
+	if sc := r.Rcodes["NXDOMAIN"]; sc == nil || sc.Share != 1 {
+		t.Fatalf("unexpected rcodes %v", r.Rcodes)
+	}
+	if r.RemainingTTL[2].Count != 3 { // NXDOMAIN ttl is 30s.
+		t.Fatalf("unexpected remaining ttl %v", r.RemainingTTL)
+	}
+	if len(r.TopMissed) != 1 || r.HitRatio["1m"].Queries != 1 {
+		t.Fatalf("unexpected report %+v", r)
+	}
+}
@@ -20,7 +20,9 @@
 package cache
 
 import (
+	"fmt"
 	"hash/maphash"
+	"net/netip"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/cache"
@@ -32,6 +34,14 @@ import (
 
 type key string
 
+// Query bits in msg key.
+const (
+	adBit = 1 << iota
+	cdBit
+	doBit
+	ecsBit // The key is specific to a client subnet. See getECSMsgKey.
+)
+
 var seed = maphash.MakeSeed()
 
 func (k key) Sum() uint64 {
@@ -45,12 +55,6 @@ func getMsgKey(q *dns.Msg) string {
 		return ""
 	}
 
-	const (
-		adBit = 1 << iota
-		cdBit
-		doBit
-	)
-
 	question := q.Question[0]
 	buf := make([]byte, 1+2+1+len(question.Name)) // bits + qtype + qname length + qname
 	b := byte(0)
@@ -67,17 +71,52 @@ func getMsgKey(q *dns.Msg) string {
 		b = b | doBit
 	}
 	buf[0] = b
-	buf[1] = byte(question.Qtype << 8)
+	buf[1] = byte(question.Qtype >> 8)
 	buf[2] = byte(question.Qtype)
 	buf[3] = byte(len(question.Name))
 	copy(buf[4:], question.Name)
 	return utils.BytesToStringUnsafe(buf)
 }
 
+// getECSMsgKey returns the key of msgKey that is only valid for clients
+// in subnet p. The subnet is appended after the qname.
+func getECSMsgKey(msgKey string, p netip.Prefix) string {
+	addr := p.Masked().Addr().AsSlice()
+	buf := make([]byte, 0, len(msgKey)+1+len(addr))
+	buf = append(buf, msgKey...)
+	buf[0] |= ecsBit
+	buf = append(buf, byte(p.Bits()))
+	buf = append(buf, addr...)
+	return utils.BytesToStringUnsafe(buf)
+}
+
+// parseMsgKey is the reverse of getMsgKey. It returns the question and the
+// query bits of k. The subnet of keys from getECSMsgKey is ignored.
+func parseMsgKey(k string) (question dns.Question, bits byte, err error) {
+	if len(k) < 4 || len(k) < 4+int(k[3]) || (len(k) != 4+int(k[3]) && k[0]&ecsBit == 0) {
+		return question, 0, fmt.Errorf("invalid msg key length %d", len(k))
+	}
+	question = dns.Question{
+		Name:   k[4 : 4+int(k[3])],
+		Qtype:  uint16(k[1])<<8 | uint16(k[2]),
+		Qclass: dns.ClassINET,
+	}
+	return question, k[0], nil
+}
+
 type item struct {
 	resp           *dns.Msg
 	storedTime     time.Time
 	expirationTime time.Time
+	size           int // packed size of resp, lazy init by Size.
+}
+
+// Size implements cache.Sizer. It is only called if max_bytes is set.
+func (i *item) Size() int {
+	if i.size == 0 {
+		i.size = i.resp.Len()
+	}
+	return i.size
 }
 
 func copyNoOpt(m *dns.Msg) *dns.Msg {
@@ -129,14 +168,11 @@ func min[T constraints.Ordered](a, b T) T {
 	return b
 }
 
-// getRespFromCache returns the cached response from cache.
+// getRespFromItem returns the cached response of v. v can be nil.
 // The ttl of returned msg will be changed properly.
 // Returned bool indicates whether this response is hit by lazy cache.
 // Note: Caller SHOULD change the msg id because it's not same as query's.
-func getRespFromCache(msgKey string, backend *cache.Cache[key, *item], lazyCacheEnabled bool, lazyTtl int) (*dns.Msg, bool) {
-	// Lookup cache
-	v, _, _ := backend.Get(key(msgKey))
-
+func getRespFromItem(v *item, lazyCacheEnabled bool, lazyTtl int) (*dns.Msg, bool) {
 	// Cache hit
 	if v != nil {
 		now := time.Now()
@@ -161,11 +197,12 @@ func getRespFromCache(msgKey string, backend *cache.Cache[key, *item], lazyCache
 	return nil, false
 }
 
-// saveRespToCache saves r to cache backend. It returns false if r
-// should not be cached and was skipped.
-func saveRespToCache(msgKey string, r *dns.Msg, backend *cache.Cache[key, *item], lazyCacheTtl int) bool {
+// saveRespToCache saves r to cache backend. It returns the stored item and
+// its cache expiration time. Returned item is nil if r should not be cached
+// and was skipped.
+func saveRespToCache(msgKey string, r *dns.Msg, backend *cache.Cache[key, *item], lazyCacheTtl int) (*item, time.Time) {
 	if r.Truncated != false {
-		return false
+		return nil, time.Time{}
 	}
 
 	var msgTtl time.Duration
@@ -193,15 +230,17 @@ func saveRespToCache(msgKey string, r *dns.Msg, backend *cache.Cache[key, *item]
 		}
 	}
 	if msgTtl <= 0 || cacheTtl <= 0 {
-		return false
+		return nil, time.Time{}
 	}
 
 	now := time.Now()
+	resp := copyNoOpt(r)
 	v := &item{
-		resp:           copyNoOpt(r),
+		resp:           resp,
 		storedTime:     now,
 		expirationTime: now.Add(msgTtl),
 	}
-	backend.Store(key(msgKey), v, now.Add(cacheTtl))
-	return true
+	cacheExpirationTime := now.Add(cacheTtl)
+	backend.Store(key(msgKey), v, cacheExpirationTime)
+	return v, cacheExpirationTime
 }
@@ -0,0 +1,289 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns64
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/ip_set"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/IrineSistiana/mosdns/v5/plugin/matcher/base_ip"
+	"github.com/miekg/dns"
+)
+
+const PluginType = "dns64"
+
+const defaultPrefix = "64:ff9b::/96"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+	sequence.MustRegExecQuickSetup(PluginType, QuickSetup)
+}
+
+var _ sequence.RecursiveExecutable = (*DNS64)(nil)
+
+type Args struct {
+	// Prefix is the NAT64 prefix. Default is 64:ff9b::/96.
+	// Valid lengths are 32, 40, 48, 56, 64 and 96. See RFC 6052 2.2.
+	Prefix string `yaml:"prefix"`
+	// ExcludeAAAA is the AAAA records that are treated as nonexistent.
+	// ::ffff:0:0/96 is always excluded. See RFC 6147 5.1.4.
+	ExcludeAAAA base_ip.Args `yaml:"exclude_aaaa"`
+	// ExcludeA is the A records that are not synthesised. See RFC 6147 5.1.6.
+	ExcludeA base_ip.Args `yaml:"exclude_a"`
+}
+
+// DNS64 synthesises AAAA records from A records for IPv6-only clients.
+// See RFC 6147.
+type DNS64 struct {
+	prefix      netip.Prefix
+	excludeAAAA ip_set.MatcherGroup
+	excludeA    ip_set.MatcherGroup
+}
+
+var v4Mapped = netip.MustParsePrefix("::ffff:0:0/96")
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewDNS64(sequence.NewBQ(bp.M(), bp.L()), args.(*Args))
+}
+
+// QuickSetup format: [prefix]
+func QuickSetup(bq sequence.BQ, s string) (any, error) {
+	return NewDNS64(bq, &Args{Prefix: s})
+}
+
+func NewDNS64(bq sequence.BQ, args *Args) (*DNS64, error) {
+	s := args.Prefix
+	if len(s) == 0 {
+		s = defaultPrefix
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix, %w", err)
+	}
+	if err := checkPrefix(prefix); err != nil {
+		return nil, fmt.Errorf("invalid prefix %s, %w", s, err)
+	}
+
+	d := &DNS64{prefix: prefix.Masked()}
+	if d.excludeAAAA, err = base_ip.NewIPMatcher(bq, &args.ExcludeAAAA); err != nil {
+		return nil, fmt.Errorf("invalid exclude_aaaa, %w", err)
+	}
+	if d.excludeA, err = base_ip.NewIPMatcher(bq, &args.ExcludeA); err != nil {
+		return nil, fmt.Errorf("invalid exclude_a, %w", err)
+	}
+	return d, nil
+}
+
+func checkPrefix(p netip.Prefix) error {
+	if !p.Addr().Is6() || p.Addr().Is4In6() {
+		return fmt.Errorf("not an ipv6 prefix")
+	}
+	switch p.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		return fmt.Errorf("invalid length %d", p.Bits())
+	}
+	if p.Masked().Addr().As16()[8] != 0 {
+		return fmt.Errorf("bits 64 to 71 must be zero")
+	}
+	return nil
+}
+
+// embed embeds v4 into the prefix. See RFC 6052 2.2.
+func (d *DNS64) embed(v4 netip.Addr) netip.Addr {
+	b := d.prefix.Addr().As16()
+	i := d.prefix.Bits() / 8
+	for _, o := range v4.As4() {
+		if i == 8 { // skip bits 64 to 71
+			i++
+		}
+		b[i] = o
+		i++
+	}
+	return netip.AddrFrom16(b)
+}
+
+// extract extracts the ipv4 address from a synthesised address.
+func (d *DNS64) extract(addr netip.Addr) netip.Addr {
+	b := addr.As16()
+	var v4 [4]byte
+	i := d.prefix.Bits() / 8
+	for j := range v4 {
+		if i == 8 {
+			i++
+		}
+		v4[j] = b[i]
+		i++
+	}
+	return netip.AddrFrom4(v4)
+}
+
+// Exec implements sequence.RecursiveExecutable.
+func (d *DNS64) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	question := qCtx.QQuestion()
+	if question.Qclass != dns.ClassINET {
+		return next.ExecNext(ctx, qCtx)
+	}
+	switch question.Qtype {
+	case dns.TypeAAAA:
+		return d.execAAAA(ctx, qCtx, next)
+	case dns.TypePTR:
+		return d.execPTR(ctx, qCtx, next)
+	default:
+		return next.ExecNext(ctx, qCtx)
+	}
+}
+
+func (d *DNS64) excludedAAAA(rr dns.RR) bool {
+	aaaa, ok := rr.(*dns.AAAA)
+	if !ok {
+		return false
+	}
+	addr, _ := netip.AddrFromSlice(aaaa.AAAA)
+	return v4Mapped.Contains(addr) || d.excludeAAAA.Match(addr)
+}
+
+func (d *DNS64) execAAAA(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	if err := next.ExecNext(ctx, qCtx); err != nil {
+		return err
+	}
+	r := qCtx.R()
+	if r == nil || r.Rcode == dns.RcodeNameError {
+		return nil
+	}
+
+	// The client will validate the response. RFC 6147 5.5.
+	q := qCtx.Q()
+	if clientOpt := qCtx.ClientOpt(); q.CheckingDisabled && clientOpt != nil && clientOpt.Do() {
+		return nil
+	}
+
+	if r.Rcode == dns.RcodeSuccess {
+		hasAAAA := false
+		for _, rr := range r.Answer {
+			if rr.Header().Rrtype == dns.TypeAAAA && !d.excludedAAAA(rr) {
+				hasAAAA = true
+				break
+			}
+		}
+		if hasAAAA {
+			return nil
+		}
+	}
+
+	subCtx := qCtx.Copy()
+	subCtx.Q().Question[0].Qtype = dns.TypeA
+	subCtx.SetResponse(nil)
+	if err := next.ExecNext(ctx, subCtx); err != nil {
+		return err
+	}
+	ar := subCtx.R()
+	if ar == nil || ar.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+
+	// TTL of synthesised records is capped by the SOA minimum of the
+	// negative AAAA response. RFC 6147 5.1.7.
+	maxTTL := uint32(600)
+	for _, rr := range r.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			maxTTL = min(soa.Hdr.Ttl, soa.Minttl)
+		}
+	}
+
+	var answer []dns.RR
+	synthesised := false
+	for _, rr := range ar.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			if t := rr.Header().Rrtype; t == dns.TypeCNAME || t == dns.TypeDNAME {
+				answer = append(answer, rr)
+			}
+			continue
+		}
+		v4, _ := netip.AddrFromSlice(a.A.To4())
+		if !v4.IsValid() || d.excludeA.Match(v4) {
+			continue
+		}
+		answer = append(answer, &dns.AAAA{
+			Hdr: dns.RR_Header{
+				Name:   a.Hdr.Name,
+				Rrtype: dns.TypeAAAA,
+				Class:  dns.ClassINET,
+				Ttl:    min(a.Hdr.Ttl, maxTTL),
+			},
+			AAAA: d.embed(v4).AsSlice(),
+		})
+		synthesised = true
+	}
+	if !synthesised {
+		return nil
+	}
+
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	resp.RecursionAvailable = ar.RecursionAvailable
+	resp.Answer = answer
+	qCtx.SetResponse(resp)
+	return nil
+}
+
+// execPTR answers PTR queries of synthesised addresses with a CNAME to the
+// in-addr.arpa name of the embedded ipv4 address. See RFC 6147 5.3.1.
+func (d *DNS64) execPTR(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	q := qCtx.Q()
+	name := dns.CanonicalName(q.Question[0].Name)
+	addr, err := dnsutils.ParsePTRQName(name)
+	if err != nil || !addr.Is6() || !d.prefix.Contains(addr) {
+		return next.ExecNext(ctx, qCtx)
+	}
+
+	target, err := dns.ReverseAddr(d.extract(addr).String())
+	if err != nil {
+		return next.ExecNext(ctx, qCtx)
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	resp.Answer = []dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 600},
+		Target: target,
+	}}
+
+	subCtx := qCtx.Copy()
+	subCtx.Q().Question[0].Name = target
+	subCtx.SetResponse(nil)
+	if err := next.ExecNext(ctx, subCtx); err != nil {
+		return err
+	}
+	if sr := subCtx.R(); sr != nil {
+		resp.Rcode = sr.Rcode
+		resp.RecursionAvailable = sr.RecursionAvailable
+		resp.Answer = append(resp.Answer, sr.Answer...)
+		resp.Ns = sr.Ns
+	}
+	qCtx.SetResponse(resp)
+	return nil
+}
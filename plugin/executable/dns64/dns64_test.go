@@ -0,0 +1,169 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dns64
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/matcher/netlist"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/IrineSistiana/mosdns/v5/plugin/matcher/base_ip"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+type testIPSet struct {
+	l *netlist.List
+}
+
+func (s *testIPSet) GetIPMatcher() netlist.Matcher {
+	return s.l
+}
+
+// testUpstream answers queries from records.
+type testUpstream map[string][]string
+
+func (u testUpstream) Exec(_ context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	question := q.Question[0]
+	r := new(dns.Msg)
+	r.SetReply(q)
+	rrs, ok := u[question.Name+" "+dns.TypeToString[question.Qtype]]
+	if !ok {
+		r.Ns = append(r.Ns, &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "example.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:     "ns.example.",
+			Mbox:   "root.example.",
+			Minttl: 60,
+		})
+	}
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return err
+		}
+		r.Answer = append(r.Answer, rr)
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func Test_DNS64(t *testing.T) {
+	private := netlist.NewList()
+	private.Append(netip.MustParsePrefix("10.0.0.0/8"))
+	private.Sort()
+	m := coremain.NewTestMosdnsWithPlugins(map[string]any{"private": &testIPSet{l: private}})
+	d, err := NewDNS64(sequence.NewBQ(m, zap.NewNop()), &Args{
+		ExcludeA:    base_ip.Args{IPSets: []string{"private"}},
+		ExcludeAAAA: base_ip.Args{IPs: []string{"2001:db8:bad::/48"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := testUpstream{
+		"v4only.example. A":           {"v4only.example. 300 IN A 192.0.2.1"},
+		"dual.example. A":             {"dual.example. 300 IN A 192.0.2.2"},
+		"dual.example. AAAA":          {"dual.example. 300 IN AAAA 2001:db8::2"},
+		"private.example. A":          {"private.example. 300 IN A 10.0.0.1"},
+		"bad.example. A":              {"bad.example. 300 IN A 192.0.2.3"},
+		"bad.example. AAAA":           {"bad.example. 300 IN AAAA 2001:db8:bad::1"},
+		"alias.example. A":            {"alias.example. 300 IN CNAME v4only.example.", "v4only.example. 30 IN A 192.0.2.1"},
+		"1.2.0.192.in-addr.arpa. PTR": {"1.2.0.192.in-addr.arpa. 300 IN PTR v4only.example."},
+	}
+	ptrName, _ := dns.ReverseAddr("64:ff9b::c000:201")
+
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   uint16
+		cdDO    bool
+		wantAns []string
+	}{
+		{name: "synthesis", qname: "v4only.example.", qtype: dns.TypeAAAA, wantAns: []string{"v4only.example.\t60\tIN\tAAAA\t64:ff9b::c000:201"}},
+		{name: "has aaaa", qname: "dual.example.", qtype: dns.TypeAAAA, wantAns: []string{"2001:db8::2"}},
+		{name: "excluded a", qname: "private.example.", qtype: dns.TypeAAAA},
+		{name: "excluded aaaa", qname: "bad.example.", qtype: dns.TypeAAAA, wantAns: []string{"64:ff9b::c000:203"}},
+		{name: "cname", qname: "alias.example.", qtype: dns.TypeAAAA, wantAns: []string{"CNAME", "v4only.example.\t30\tIN\tAAAA\t64:ff9b::c000:201"}},
+		{name: "cd and do", qname: "v4only.example.", qtype: dns.TypeAAAA, cdDO: true},
+		{name: "a query", qname: "v4only.example.", qtype: dns.TypeA, wantAns: []string{"192.0.2.1"}},
+		{name: "ptr", qname: ptrName, qtype: dns.TypePTR, wantAns: []string{"CNAME\t1.2.0.192.in-addr.arpa.", "v4only.example."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, tt.qtype)
+			if tt.cdDO {
+				q.CheckingDisabled = true
+				q.SetEdns0(1232, true)
+			}
+			qCtx := query_context.NewContext(q)
+			cw := sequence.NewChainWalker([]*sequence.ChainNode{{E: u}}, nil)
+			if err := d.Exec(context.Background(), qCtx, cw); err != nil {
+				t.Fatal(err)
+			}
+			r := qCtx.R()
+			if len(r.Answer) != len(tt.wantAns) {
+				t.Fatalf("want %d answers, got %v", len(tt.wantAns), r.Answer)
+			}
+			for i, s := range tt.wantAns {
+				if !strings.Contains(r.Answer[i].String(), s) {
+					t.Fatalf("answer %s does not contain %s", r.Answer[i], s)
+				}
+			}
+		})
+	}
+}
+
+func Test_DNS64_embed(t *testing.T) {
+	v4 := netip.MustParseAddr("192.0.2.33")
+	tests := map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::c000:221",
+	}
+	for prefix, want := range tests {
+		d, err := NewDNS64(sequence.NewBQ(coremain.NewTestMosdnsWithPlugins(nil), zap.NewNop()), &Args{Prefix: prefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := d.embed(v4)
+		if addr.String() != want {
+			t.Fatalf("%s: want %s, got %s", prefix, want, addr)
+		}
+		if got := d.extract(addr); got != v4 {
+			t.Fatalf("%s: want %s, got %s", prefix, v4, got)
+		}
+	}
+
+	for _, prefix := range []string{"192.0.2.0/24", "2001:db8::/33", "2001:db8:0:0:100::/96"} {
+		if _, err := NewDNS64(sequence.NewBQ(coremain.NewTestMosdnsWithPlugins(nil), zap.NewNop()), &Args{Prefix: prefix}); err == nil {
+			t.Fatalf("%s: want err", prefix)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_validate
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type rrset struct {
+	name string // canonical
+	typ  uint16
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// groupRRsets groups rrs into rrsets and their signatures. OPT and
+// RRSIGs that cover no rrset are ignored.
+func groupRRsets(rrs []dns.RR) []*rrset {
+	var sets []*rrset
+	find := func(name string, typ uint16) *rrset {
+		for _, s := range sets {
+			if s.name == name && s.typ == typ {
+				return s
+			}
+		}
+		return nil
+	}
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == dns.TypeRRSIG || h.Rrtype == dns.TypeOPT {
+			continue
+		}
+		name := dns.CanonicalName(h.Name)
+		s := find(name, h.Rrtype)
+		if s == nil {
+			s = &rrset{name: name, typ: h.Rrtype}
+			sets = append(sets, s)
+		}
+		s.rrs = append(s.rrs, rr)
+	}
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			if s := find(dns.CanonicalName(sig.Hdr.Name), sig.TypeCovered); s != nil {
+				s.sigs = append(s.sigs, sig)
+			}
+		}
+	}
+	return sets
+}
+
+// rrsetOf returns the rrset of name and typ in rrs and its signatures.
+func rrsetOf(rrs []dns.RR, name string, typ uint16) ([]dns.RR, []*dns.RRSIG) {
+	var set []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		h := rr.Header()
+		if !strings.EqualFold(h.Name, name) {
+			continue
+		}
+		if h.Rrtype == typ {
+			set = append(set, rr)
+		} else if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == typ {
+			sigs = append(sigs, sig)
+		}
+	}
+	return set, sigs
+}
+
+func minTTL(rrs []dns.RR) time.Duration {
+	ttl := uint32(0)
+	for i, rr := range rrs {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// parentName returns the parent of a canonical name.
+// The parent of root is root.
+func parentName(name string) string {
+	if name == "." {
+		return name
+	}
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[off:]
+}
+
+// canonicalCompare compares two names in the canonical order. See RFC 4034 6.1.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	return len(la) - len(lb)
+}
+
+// nsecCovers reports whether name is between the owner and the next
+// name of nsec.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner, next := nsec.Hdr.Name, nsec.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// The last nsec of the zone.
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+// nsec3CloserProof looks for a closest encloser proof of name. See RFC 5155 7.2.1.
+// It returns whether the next closer name is covered, and whether the
+// covering nsec3 has the opt-out flag.
+func nsec3CloserProof(nsec3s []*dns.NSEC3, name string) (covered, optOut bool) {
+	idx := dns.Split(name)
+	for i := 1; i <= len(idx); i++ {
+		ce := "."
+		if i < len(idx) {
+			ce = name[idx[i]:]
+		}
+		if !slices.ContainsFunc(nsec3s, func(n *dns.NSEC3) bool { return n.Match(ce) }) {
+			continue
+		}
+		nextCloser := name[idx[i-1]:]
+		for _, n := range nsec3s {
+			if n.Cover(nextCloser) {
+				return true, n.Flags&1 == 1
+			}
+		}
+		return false, false
+	}
+	return false, false
+}
+
+func collectDenial(r *dns.Msg) ([]*dns.NSEC, []*dns.NSEC3) {
+	var nsecs []*dns.NSEC
+	var nsec3s []*dns.NSEC3
+	for _, rr := range r.Ns {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	return nsecs, nsec3s
+}
+
+// denialRRs returns the nsec and nsec3 records and their signatures in
+// the authority section of r.
+func denialRRs(r *dns.Msg) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range r.Ns {
+		t := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			t = sig.TypeCovered
+		}
+		if t == dns.TypeNSEC || t == dns.TypeNSEC3 {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs
+}
+
+// checkWildcardDenial checks that the nsec or nsec3 records in the
+// authority section of r prove that there is no closer match for name
+// than the wildcard of the last labels labels. See RFC 4035 5.3.4 and
+// RFC 5155 8.8. The records must be validated before.
+func checkWildcardDenial(r *dns.Msg, name string, labels int) error {
+	nsecs, nsec3s := collectDenial(r)
+	for _, n := range nsecs {
+		if nsecCovers(n, name) {
+			return nil
+		}
+	}
+	idx := dns.Split(name)
+	nextCloser := name[idx[len(idx)-labels-1]:]
+	for _, n := range nsec3s {
+		if n.Cover(nextCloser) {
+			return nil
+		}
+	}
+	return bogus(dns.ExtendedErrorCodeNSECMissing, "no denial of existence for wildcard expanded %s", name)
+}
+
+// checkDenial checks that the nsec or nsec3 records in the authority
+// section of r prove the non-existence of name or its qtype.
+// The records must be validated before.
+func checkDenial(r *dns.Msg, name string, qtype uint16) error {
+	nsecs, nsec3s := collectDenial(r)
+	if len(nsecs) == 0 && len(nsec3s) == 0 {
+		return bogus(dns.ExtendedErrorCodeNSECMissing, "no nsec record for %s", name)
+	}
+	noType := func(bitmap []uint16) bool {
+		return !slices.Contains(bitmap, qtype) && !slices.Contains(bitmap, dns.TypeCNAME)
+	}
+
+	if r.Rcode == dns.RcodeSuccess {
+		for _, n := range nsecs {
+			if strings.EqualFold(n.Hdr.Name, name) && noType(n.TypeBitMap) {
+				return nil
+			}
+		}
+		for _, n := range nsec3s {
+			if n.Match(name) && noType(n.TypeBitMap) {
+				return nil
+			}
+		}
+	}
+
+	// NXDOMAIN, or NODATA of an empty non-terminal.
+	for _, n := range nsecs {
+		if nsecCovers(n, name) {
+			return nil
+		}
+	}
+	if covered, optOut := nsec3CloserProof(nsec3s, name); covered && (r.Rcode == dns.RcodeNameError || optOut) {
+		return nil
+	}
+	return bogus(dns.ExtendedErrorCodeNSECMissing, "no valid denial of existence for %s %s", name, dns.TypeToString[qtype])
+}
+
+// cutKind checks whether name is an insecure delegation or not a zone cut
+// from a validated negative response of name DS.
+func cutKind(r *dns.Msg, name string) (zoneKind, error) {
+	nsecs, nsec3s := collectDenial(r)
+	var bitmap []uint16
+	matched := false
+	for _, n := range nsecs {
+		if strings.EqualFold(n.Hdr.Name, name) {
+			bitmap, matched = n.TypeBitMap, true
+		}
+	}
+	for _, n := range nsec3s {
+		if n.Match(name) {
+			bitmap, matched = n.TypeBitMap, true
+		}
+	}
+	if matched && r.Rcode == dns.RcodeSuccess {
+		switch {
+		case slices.Contains(bitmap, dns.TypeDS):
+			return 0, bogus(dns.ExtendedErrorCodeDNSBogus, "nsec of %s has ds bit set", name)
+		case slices.Contains(bitmap, dns.TypeNS) && !slices.Contains(bitmap, dns.TypeSOA):
+			return zoneInsecure, nil
+		default:
+			return notZoneCut, nil
+		}
+	}
+
+	// Opt-out span, may be an insecure delegation. RFC 5155 6.
+	if covered, optOut := nsec3CloserProof(nsec3s, name); covered && optOut {
+		return zoneInsecure, nil
+	}
+	if err := checkDenial(r, name, dns.TypeDS); err != nil {
+		return 0, err
+	}
+	return notZoneCut, nil
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_validate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "dnssec_validate"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+// defaultTrustAnchors is the root KSKs from https://data.iana.org/root-anchors/root-anchors.xml
+var defaultTrustAnchors = []string{
+	". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+var _ sequence.RecursiveExecutable = (*Validator)(nil)
+
+type Args struct {
+	// TrustAnchors are DS or DNSKEY records in presentation format.
+	TrustAnchors []string `yaml:"trust_anchors"`
+	// TrustAnchorFile is a file of DS or DNSKEY records in zone file format.
+	// If both TrustAnchors and TrustAnchorFile are empty, the root KSKs are used.
+	TrustAnchorFile string `yaml:"trust_anchor_file"`
+	// CacheSize is the size of validated key cache. Default is 1024.
+	CacheSize int `yaml:"cache_size"`
+}
+
+func (a *Args) init() {
+	utils.SetDefaultNum(&a.CacheSize, 1024)
+}
+
+// Validator validates the response from the following nodes. DNSKEY and
+// DS records are also queried through the following nodes, so they must
+// support DNSSEC (e.g. forward to upstreams that return RRSIGs).
+type Validator struct {
+	v      *validator
+	logger *zap.Logger
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewValidator(args.(*Args), bp.L())
+}
+
+func NewValidator(args *Args, logger *zap.Logger) (*Validator, error) {
+	args.init()
+	anchors, err := loadTrustAnchors(args.TrustAnchors, args.TrustAnchorFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load trust anchors, %w", err)
+	}
+	v, err := newValidator(anchors, args.CacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Validator{v: v, logger: logger}, nil
+}
+
+func loadTrustAnchors(ss []string, file string) ([]dns.RR, error) {
+	if len(ss) == 0 && len(file) == 0 {
+		ss = defaultTrustAnchors
+	}
+	var rrs []dns.RR
+	for _, s := range ss {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor %s, %w", s, err)
+		}
+		if rr != nil {
+			rrs = append(rrs, rr)
+		}
+	}
+	if len(file) > 0 {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		fileRRs, err := parseZone(f, file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s, %w", file, err)
+		}
+		rrs = append(rrs, fileRRs...)
+	}
+	return rrs, nil
+}
+
+func parseZone(r io.Reader, file string) ([]dns.RR, error) {
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(r, ".", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	return rrs, nil
+}
+
+// Exec sets DO and CD bits in the upstream query and validates the response.
+// Secure responses have the AD bit. Bogus responses are replaced with
+// SERVFAIL with an extended dns error.
+// Queries that have the CD bit are not validated.
+func (e *Validator) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	q := qCtx.Q()
+	clientCD := q.CheckingDisabled
+	clientDO := qCtx.ClientOpt() != nil && qCtx.ClientOpt().Do()
+	question := qCtx.QQuestion()
+
+	qCtx.QOpt().SetDo()
+	q.CheckingDisabled = true
+	err := next.ExecNext(ctx, qCtx)
+	q.CheckingDisabled = clientCD
+	if err != nil {
+		return err
+	}
+	r := qCtx.R()
+	if r == nil {
+		return nil
+	}
+	r.CheckingDisabled = clientCD
+
+	if !clientCD && question.Qclass == dns.ClassINET {
+		query := func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+			return subQuery(ctx, next, name, qtype)
+		}
+		secure, err := e.v.validate(ctx, query, question, r)
+		var be *bogusError
+		switch {
+		case errors.As(err, &be):
+			e.logger.Warn("bogus response", qCtx.InfoField(), zap.String("reason", be.reason))
+			qCtx.SetResponse(dnsutils.GenEmptyReply(q, dns.RcodeServerFailure))
+			qCtx.AddEDE(be.code, be.reason)
+			return nil
+		case err != nil:
+			return fmt.Errorf("failed to validate response, %w", err)
+		}
+		r.AuthenticatedData = secure
+	}
+
+	if !clientDO {
+		stripDNSSEC(r, question.Qtype)
+	}
+	return nil
+}
+
+// subQuery sends a DO and CD query through next.
+func subQuery(ctx context.Context, next sequence.ChainWalker, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.CheckingDisabled = true
+	qCtx := query_context.NewContext(m)
+	qCtx.QOpt().SetDo()
+	if err := next.ExecNext(ctx, qCtx); err != nil {
+		return nil, err
+	}
+	r := qCtx.R()
+	if r == nil {
+		return nil, errors.New("no response")
+	}
+	return r, nil
+}
+
+// stripDNSSEC removes DNSSEC records that are not requested. See RFC 4035 3.2.1.
+func stripDNSSEC(m *dns.Msg, qtype uint16) {
+	filter := func(rrs []dns.RR) []dns.RR {
+		n := 0
+		for _, rr := range rrs {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			rrs[n] = rr
+			n++
+		}
+		return rrs[:n]
+	}
+	m.Answer = filter(m.Answer)
+	m.Ns = filter(m.Ns)
+	m.Extra = filter(m.Extra)
+}
@@ -0,0 +1,391 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_validate
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// testZone is a zone signed by a single ECDSA key.
+type testZone struct {
+	name string
+	rrs  []dns.RR
+	key  *dns.DNSKEY // nil if the zone is unsigned
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string, signed bool, records ...string) *testZone {
+	t.Helper()
+	z := &testZone{name: name}
+	z.add(name + " 3600 IN SOA ns. mbox. 1 3600 600 86400 300")
+	z.add(name + " 3600 IN NS ns.")
+	for _, r := range records {
+		z.add(r)
+	}
+	if signed {
+		z.key = &dns.DNSKEY{
+			Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+			Flags:     dns.ZONE | dns.SEP,
+			Protocol:  3,
+			Algorithm: dns.ECDSAP256SHA256,
+		}
+		priv, err := z.key.Generate(256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.priv = priv.(crypto.Signer)
+		z.rrs = append(z.rrs, z.key)
+		z.addNSEC()
+	}
+	return z
+}
+
+func (z *testZone) add(s string) {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	z.rrs = append(z.rrs, rr)
+}
+
+func (z *testZone) ds() string {
+	return z.key.ToDS(dns.SHA256).String()
+}
+
+func (z *testZone) addNSEC() {
+	types := make(map[string][]uint16)
+	var names []string
+	for _, rr := range z.rrs {
+		n := rr.Header().Name
+		if _, ok := types[n]; !ok {
+			names = append(names, n)
+		}
+		types[n] = append(types[n], rr.Header().Rrtype)
+	}
+	slices.SortFunc(names, canonicalCompare)
+	for i, n := range names {
+		bitmap := append(types[n], dns.TypeNSEC, dns.TypeRRSIG)
+		slices.Sort(bitmap)
+		z.rrs = append(z.rrs, &dns.NSEC{
+			Hdr:        dns.RR_Header{Name: n, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 300},
+			NextDomain: names[(i+1)%len(names)],
+			TypeBitMap: slices.Compact(bitmap),
+		})
+	}
+}
+
+func (z *testZone) sign(set []dns.RR, inception, expiration time.Time) *dns.RRSIG {
+	sig := &dns.RRSIG{
+		Algorithm:  z.key.Algorithm,
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if err := sig.Sign(z.priv, set); err != nil {
+		panic(err)
+	}
+	return sig
+}
+
+// rrset returns a copy of the rrset and its signature.
+func (z *testZone) rrset(name string, typ uint16) []dns.RR {
+	var set []dns.RR
+	for _, rr := range z.rrs {
+		if rr.Header().Name == name && rr.Header().Rrtype == typ {
+			set = append(set, dns.Copy(rr))
+		}
+	}
+	// Delegation NS records are not signed.
+	if len(set) == 0 || z.key == nil || (typ == dns.TypeNS && name != z.name) {
+		return set
+	}
+	return append(set, z.sign(set, time.Now().Add(-time.Hour), time.Now().Add(time.Hour)))
+}
+
+func (z *testZone) exists(name string) bool {
+	return slices.ContainsFunc(z.rrs, func(rr dns.RR) bool { return rr.Header().Name == name })
+}
+
+func (z *testZone) answer(q *dns.Msg) *dns.Msg {
+	name, qtype := dns.CanonicalName(q.Question[0].Name), q.Question[0].Qtype
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Authoritative = true
+	for dns.IsSubDomain(z.name, name) {
+		if ans := z.rrset(name, qtype); len(ans) > 0 {
+			r.Answer = append(r.Answer, ans...)
+			return r
+		}
+		cname := z.rrset(name, dns.TypeCNAME)
+		if len(cname) == 0 {
+			break
+		}
+		r.Answer = append(r.Answer, cname...)
+		name = cname[0].(*dns.CNAME).Target
+	}
+	if !z.exists(name) {
+		if ans := z.wildcard(name, qtype); len(ans) > 0 {
+			r.Answer = append(r.Answer, ans...)
+			r.Ns = z.coveringNSEC(name)
+			return r
+		}
+	}
+	r.Ns = z.rrset(z.name, dns.TypeSOA)
+	if z.exists(name) {
+		r.Ns = append(r.Ns, z.rrset(name, dns.TypeNSEC)...)
+		return r
+	}
+	r.Rcode = dns.RcodeNameError
+	r.Ns = append(r.Ns, z.coveringNSEC(name)...)
+	return r
+}
+
+// wildcard returns the rrset expanded from the wildcard of name's parent.
+func (z *testZone) wildcard(name string, qtype uint16) []dns.RR {
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return nil
+	}
+	set := z.rrset("*."+name[off:], qtype)
+	for _, rr := range set {
+		rr.Header().Name = name
+	}
+	return set
+}
+
+func (z *testZone) coveringNSEC(name string) []dns.RR {
+	var rrs []dns.RR
+	for _, rr := range z.rrs {
+		if nsec, ok := rr.(*dns.NSEC); ok && nsecCovers(nsec, name) {
+			rrs = append(rrs, z.rrset(nsec.Hdr.Name, dns.TypeNSEC)...)
+		}
+	}
+	return rrs
+}
+
+// testServer answers queries from the zones.
+type testServer struct {
+	zones []*testZone
+
+	// modify modifies the response of the original query.
+	modify func(r *dns.Msg)
+	target string
+}
+
+func (s *testServer) Exec(_ context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	name, qtype := dns.CanonicalName(q.Question[0].Name), q.Question[0].Qtype
+	var zone *testZone
+	for _, z := range s.zones {
+		if !dns.IsSubDomain(z.name, name) || (qtype == dns.TypeDS && name == z.name && name != ".") {
+			continue
+		}
+		if zone == nil || dns.CountLabel(z.name) > dns.CountLabel(zone.name) {
+			zone = z
+		}
+	}
+	r := zone.answer(q)
+	if s.modify != nil && name == s.target && qtype != dns.TypeDS && qtype != dns.TypeDNSKEY {
+		s.modify(r)
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func newQuery(name string, qtype uint16) *dns.Msg {
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	return q
+}
+
+func Test_Validator(t *testing.T) {
+	example := newTestZone(t, "example.", true,
+		"www.example. 300 IN A 192.0.2.1",
+		"alias.example. 300 IN CNAME www.example.",
+		"*.wild.example. 300 IN A 192.0.2.3",
+		"real.wild.example. 300 IN A 192.0.2.4",
+	)
+	insecure := newTestZone(t, "insecure.", false,
+		"www.insecure. 300 IN A 192.0.2.2",
+	)
+	root := newTestZone(t, ".", true,
+		"example. 3600 IN NS ns.",
+		example.ds(),
+		"insecure. 3600 IN NS ns.",
+	)
+	s := &testServer{zones: []*testZone{root, example, insecure}}
+	walker := sequence.NewChainWalker([]*sequence.ChainNode{{E: s}}, nil)
+
+	// remove removes the signatures of typ, and the rrset if sigOnly is false.
+	remove := func(typ uint16, sigOnly bool) func(r *dns.Msg) {
+		return func(r *dns.Msg) {
+			filter := func(rrs []dns.RR) []dns.RR {
+				return slices.DeleteFunc(rrs, func(rr dns.RR) bool {
+					if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == typ {
+						return true
+					}
+					return !sigOnly && rr.Header().Rrtype == typ
+				})
+			}
+			r.Answer, r.Ns = filter(r.Answer), filter(r.Ns)
+		}
+	}
+	tamper := func(r *dns.Msg) {
+		r.Answer[0].(*dns.A).A = net.IPv4(192, 0, 2, 99)
+	}
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		do, cd    bool
+		modify    func(r *dns.Msg)
+		wantRcode int
+		wantAD    bool
+		wantEDE   uint16
+		wantSig   bool
+	}{
+		{name: "secure", qname: "www.example.", qtype: dns.TypeA, wantAD: true},
+		{name: "secure with do", qname: "www.example.", qtype: dns.TypeA, do: true, wantAD: true, wantSig: true},
+		{name: "secure cname", qname: "alias.example.", qtype: dns.TypeA, wantAD: true},
+		{name: "secure nodata", qname: "www.example.", qtype: dns.TypeAAAA, wantAD: true},
+		{name: "secure nxdomain", qname: "none.example.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError, wantAD: true},
+		{name: "secure root", qname: ".", qtype: dns.TypeSOA, wantAD: true},
+		{name: "insecure", qname: "www.insecure.", qtype: dns.TypeA},
+		{name: "tampered", qname: "www.example.", qtype: dns.TypeA, modify: tamper, wantRcode: dns.RcodeServerFailure, wantEDE: dns.ExtendedErrorCodeDNSBogus},
+		{name: "expired", qname: "www.example.", qtype: dns.TypeA, modify: func(r *dns.Msg) {
+			r.Answer[1] = example.sign(r.Answer[:1], time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+		}, wantRcode: dns.RcodeServerFailure, wantEDE: dns.ExtendedErrorCodeSignatureExpired},
+		{name: "rrsig missing", qname: "www.example.", qtype: dns.TypeA, modify: remove(dns.TypeA, true),
+			wantRcode: dns.RcodeServerFailure, wantEDE: dns.ExtendedErrorCodeRRSIGsMissing},
+		{name: "nsec missing", qname: "none.example.", qtype: dns.TypeA, modify: remove(dns.TypeNSEC, false),
+			wantRcode: dns.RcodeServerFailure, wantEDE: dns.ExtendedErrorCodeNSECMissing},
+		{name: "secure wildcard", qname: "host.wild.example.", qtype: dns.TypeA, wantAD: true},
+		{name: "wildcard without denial", qname: "host.wild.example.", qtype: dns.TypeA, modify: remove(dns.TypeNSEC, false),
+			wantRcode: dns.RcodeServerFailure, wantEDE: dns.ExtendedErrorCodeNSECMissing},
+		{name: "replayed wildcard", qname: "real.wild.example.", qtype: dns.TypeA, modify: func(r *dns.Msg) {
+			// The signed wildcard expansion and its denial of another name.
+			wr := example.answer(newQuery("host.wild.example.", dns.TypeA))
+			for _, rr := range wr.Answer {
+				rr.Header().Name = "real.wild.example."
+			}
+			r.Answer, r.Ns = wr.Answer, wr.Ns
+		}, wantRcode: dns.RcodeServerFailure, wantEDE: dns.ExtendedErrorCodeNSECMissing},
+		{name: "secure cname to nodata", qname: "alias.example.", qtype: dns.TypeAAAA, wantAD: true},
+		{name: "cname to nodata without denial", qname: "alias.example.", qtype: dns.TypeAAAA, modify: func(r *dns.Msg) { r.Ns = nil },
+			wantRcode: dns.RcodeServerFailure, wantEDE: dns.ExtendedErrorCodeNSECMissing},
+		{name: "checking disabled", qname: "www.example.", qtype: dns.TypeA, cd: true, modify: tamper},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := NewValidator(&Args{TrustAnchors: []string{root.key.String()}}, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.modify, s.target = tt.modify, tt.qname
+
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, tt.qtype)
+			q.SetEdns0(1232, tt.do)
+			q.CheckingDisabled = tt.cd
+			qCtx := query_context.NewContext(q)
+			if err := v.Exec(context.Background(), qCtx, walker); err != nil {
+				t.Fatal(err)
+			}
+
+			r := qCtx.R()
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("want rcode %d, got %d", tt.wantRcode, r.Rcode)
+			}
+			if q.CheckingDisabled != tt.cd || r.CheckingDisabled != tt.cd {
+				t.Fatalf("want cd %v, got query cd %v, response cd %v", tt.cd, q.CheckingDisabled, r.CheckingDisabled)
+			}
+			if r.AuthenticatedData != tt.wantAD {
+				t.Fatalf("want ad %v, got %v", tt.wantAD, r.AuthenticatedData)
+			}
+			var ede *dns.EDNS0_EDE
+			for _, o := range qCtx.RespOpt().Option {
+				if o, ok := o.(*dns.EDNS0_EDE); ok {
+					ede = o
+				}
+			}
+			if tt.wantEDE != 0 && (ede == nil || ede.InfoCode != tt.wantEDE) {
+				t.Fatalf("want ede %d, got %v", tt.wantEDE, ede)
+			}
+			if tt.wantEDE == 0 && ede != nil {
+				t.Fatalf("unexpected ede %v", ede)
+			}
+			hasSig := strings.Contains(r.String(), "RRSIG")
+			if hasSig != tt.wantSig {
+				t.Fatalf("want rrsig %v, got %v", tt.wantSig, r)
+			}
+		})
+	}
+}
+
+func Test_Validator_cache(t *testing.T) {
+	example := newTestZone(t, "example.", true, "www.example. 300 IN A 192.0.2.1")
+	root := newTestZone(t, ".", true, "example. 3600 IN NS ns.", example.ds())
+
+	n := 0
+	s := &testServer{zones: []*testZone{root, example}}
+	counter := sequence.ExecutableFunc(func(ctx context.Context, qCtx *query_context.Context) error {
+		n++
+		return s.Exec(ctx, qCtx)
+	})
+	walker := sequence.NewChainWalker([]*sequence.ChainNode{{E: counter}}, nil)
+	v, err := NewValidator(&Args{TrustAnchors: []string{root.ds()}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exec := func() int {
+		n = 0
+		q := new(dns.Msg)
+		q.SetQuestion("www.example.", dns.TypeA)
+		qCtx := query_context.NewContext(q)
+		if err := v.Exec(context.Background(), qCtx, walker); err != nil {
+			t.Fatal(err)
+		}
+		if !qCtx.R().AuthenticatedData {
+			t.Fatal("response is not secure")
+		}
+		return n
+	}
+	if got := exec(); got != 4 { // A, DNSKEY ., DS example., DNSKEY example.
+		t.Fatalf("want 4 queries, got %d", got)
+	}
+	if got := exec(); got != 1 {
+		t.Fatalf("keys are not cached, got %d queries", got)
+	}
+}
@@ -0,0 +1,468 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package dnssec_validate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/concurrent_lru"
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxKeyTTL caps the cache time of zone states.
+	maxKeyTTL = time.Hour * 24
+	// maxNegativeTTL caps the cache time of insecure and non-cut states.
+	maxNegativeTTL = time.Hour
+)
+
+// queryFunc sends a query with DO and CD bits set and returns the response.
+type queryFunc func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)
+
+// bogusError indicates the response fails the validation.
+type bogusError struct {
+	code   uint16 // RFC 8914 info code
+	reason string
+}
+
+func (e *bogusError) Error() string {
+	return e.reason
+}
+
+func bogus(code uint16, format string, a ...any) error {
+	return &bogusError{code: code, reason: fmt.Sprintf(format, a...)}
+}
+
+type zoneKind uint8
+
+const (
+	zoneSecure zoneKind = iota
+	zoneInsecure
+	notZoneCut
+)
+
+// zoneState is the validation state of a name.
+type zoneState struct {
+	kind   zoneKind
+	keys   []*dns.DNSKEY // Validated keys of a secure zone.
+	expire time.Time
+}
+
+var insecureState = &zoneState{kind: zoneInsecure}
+
+// trustAnchor is the DS or DNSKEY records of a zone.
+type trustAnchor struct {
+	ds   []*dns.DS
+	keys []*dns.DNSKEY
+}
+
+type validator struct {
+	anchors map[string]*trustAnchor // zone -> anchor
+	cache   *concurrent_lru.ConcurrentLRU[string, *zoneState]
+	now     func() time.Time
+}
+
+func newValidator(anchorRRs []dns.RR, cacheSize int) (*validator, error) {
+	anchors := make(map[string]*trustAnchor)
+	get := func(name string) *trustAnchor {
+		name = dns.CanonicalName(name)
+		a := anchors[name]
+		if a == nil {
+			a = new(trustAnchor)
+			anchors[name] = a
+		}
+		return a
+	}
+	for _, rr := range anchorRRs {
+		switch rr := rr.(type) {
+		case *dns.DS:
+			a := get(rr.Hdr.Name)
+			a.ds = append(a.ds, rr)
+		case *dns.DNSKEY:
+			a := get(rr.Hdr.Name)
+			a.keys = append(a.keys, rr)
+		default:
+			return nil, fmt.Errorf("invalid trust anchor %s, must be a DS or DNSKEY record", rr)
+		}
+	}
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("no trust anchor")
+	}
+	return &validator{
+		anchors: anchors,
+		cache:   concurrent_lru.NewConecurrentLRU[string, *zoneState](cacheSize, nil),
+		now:     time.Now,
+	}, nil
+}
+
+func (v *validator) getCache(name string) *zoneState {
+	st, ok := v.cache.Get(name)
+	if !ok || !v.now().Before(st.expire) {
+		return nil
+	}
+	return st
+}
+
+func (v *validator) setCache(name string, st *zoneState) {
+	v.cache.Add(name, st)
+}
+
+// walk follows the chain of trust from the closest trust anchor down to
+// name. It returns the closest enclosing secure zone and its state, or
+// the insecure delegation point.
+func (v *validator) walk(ctx context.Context, query queryFunc, name string) (string, *zoneState, error) {
+	name = dns.CanonicalName(name)
+	anchorZone := ""
+	for c := name; ; c = parentName(c) {
+		if _, ok := v.anchors[c]; ok {
+			anchorZone = c
+			break
+		}
+		if c == "." {
+			break
+		}
+	}
+	if len(anchorZone) == 0 {
+		return "", insecureState, nil
+	}
+
+	zone := anchorZone
+	st, err := v.anchorState(ctx, query, anchorZone)
+	if err != nil {
+		return "", nil, err
+	}
+	if st.kind == zoneInsecure {
+		return zone, st, nil
+	}
+
+	idx := dns.Split(name)
+	for i := len(idx) - dns.CountLabel(anchorZone) - 1; i >= 0; i-- {
+		c := name[idx[i]:]
+		cs, err := v.cutState(ctx, query, zone, st, c)
+		if err != nil {
+			return "", nil, err
+		}
+		switch cs.kind {
+		case zoneSecure:
+			zone, st = c, cs
+		case zoneInsecure:
+			return c, cs, nil
+		}
+	}
+	return zone, st, nil
+}
+
+func (v *validator) anchorState(ctx context.Context, query queryFunc, zone string) (*zoneState, error) {
+	if st := v.getCache(zone); st != nil {
+		return st, nil
+	}
+	a := v.anchors[zone]
+	st, err := v.fetchKeys(ctx, query, zone, a.ds, a.keys, uint32(maxKeyTTL/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	v.setCache(zone, st)
+	return st, nil
+}
+
+// cutState checks whether c is a secure or an insecure zone cut below the
+// secure zone.
+func (v *validator) cutState(ctx context.Context, query queryFunc, zone string, zst *zoneState, c string) (*zoneState, error) {
+	if st := v.getCache(c); st != nil {
+		return st, nil
+	}
+	r, err := query(ctx, c, dns.TypeDS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query ds of %s, %w", c, err)
+	}
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("failed to query ds of %s, rcode %s", c, dns.RcodeToString[r.Rcode])
+	}
+
+	var st *zoneState
+	dsSet, sigs := rrsetOf(r.Answer, c, dns.TypeDS)
+	if len(dsSet) > 0 {
+		if _, err := v.verifyRRset(dsSet, sigs, zone, zst.keys); err != nil {
+			return nil, err
+		}
+		ds := make([]*dns.DS, 0, len(dsSet))
+		for _, rr := range dsSet {
+			ds = append(ds, rr.(*dns.DS))
+		}
+		st, err = v.fetchKeys(ctx, query, c, ds, nil, dsSet[0].Header().Ttl)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// c is an alias, an insecure delegation or not a zone cut.
+		if err := v.verifySection(r.Answer, zone, zst.keys); err != nil {
+			return nil, err
+		}
+		if err := v.verifySection(r.Ns, zone, zst.keys); err != nil {
+			return nil, err
+		}
+		kind := notZoneCut
+		if len(r.Answer) == 0 {
+			if kind, err = cutKind(r, c); err != nil {
+				return nil, err
+			}
+		}
+		st = &zoneState{kind: kind, expire: v.now().Add(min(minTTL(r.Ns), maxNegativeTTL))}
+	}
+	v.setCache(c, st)
+	return st, nil
+}
+
+// fetchKeys fetches and validates the DNSKEY of zone by ds, or by the
+// trusted keys.
+func (v *validator) fetchKeys(ctx context.Context, query queryFunc, zone string, ds []*dns.DS, trustedKeys []*dns.DNSKEY, ttl uint32) (*zoneState, error) {
+	var supportedDS []*dns.DS
+	for _, d := range ds {
+		if supportedAlgorithm(d.Algorithm) && supportedDigest(d.DigestType) {
+			supportedDS = append(supportedDS, d)
+		}
+	}
+	if len(supportedDS) == 0 && len(trustedKeys) == 0 {
+		// RFC 4035 5.2. Treated as insecure.
+		return &zoneState{kind: zoneInsecure, expire: v.now().Add(min(time.Duration(ttl)*time.Second, maxNegativeTTL))}, nil
+	}
+
+	r, err := query(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query dnskey of %s, %w", zone, err)
+	}
+	keySet, sigs := rrsetOf(r.Answer, zone, dns.TypeDNSKEY)
+	if len(keySet) == 0 {
+		return nil, bogus(dns.ExtendedErrorCodeDNSKEYMissing, "no dnskey for %s", zone)
+	}
+	keys := make([]*dns.DNSKEY, 0, len(keySet))
+	var sep []*dns.DNSKEY
+	for _, rr := range keySet {
+		k := rr.(*dns.DNSKEY)
+		if k.Flags&dns.ZONE == 0 || k.Protocol != 3 {
+			continue
+		}
+		keys = append(keys, k)
+		if matchDS(k, supportedDS) || matchKey(k, trustedKeys) {
+			sep = append(sep, k)
+		}
+	}
+	if len(sep) == 0 {
+		return nil, bogus(dns.ExtendedErrorCodeDNSKEYMissing, "no dnskey of %s matches the ds or the trust anchor", zone)
+	}
+	if _, err := v.verifyRRset(keySet, sigs, zone, sep); err != nil {
+		return nil, err
+	}
+	ttl = min(ttl, keySet[0].Header().Ttl)
+	return &zoneState{kind: zoneSecure, keys: keys, expire: v.now().Add(min(time.Duration(ttl)*time.Second, maxKeyTTL))}, nil
+}
+
+func matchDS(k *dns.DNSKEY, ds []*dns.DS) bool {
+	tag := k.KeyTag()
+	for _, d := range ds {
+		if d.KeyTag != tag || d.Algorithm != k.Algorithm {
+			continue
+		}
+		if kds := k.ToDS(d.DigestType); kds != nil && strings.EqualFold(kds.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchKey(k *dns.DNSKEY, keys []*dns.DNSKEY) bool {
+	for _, t := range keys {
+		if t.Algorithm == k.Algorithm && t.Flags == k.Flags && t.PublicKey == k.PublicKey {
+			return true
+		}
+	}
+	return false
+}
+
+func supportedAlgorithm(alg uint8) bool {
+	switch alg {
+	case dns.RSASHA1, dns.RSASHA1NSEC3SHA1, dns.RSASHA256, dns.RSASHA512,
+		dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+		return true
+	}
+	return false
+}
+
+func supportedDigest(t uint8) bool {
+	switch t {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+		return true
+	}
+	return false
+}
+
+// verifyRRset verifies rrset with one of the sigs that is signed by signer
+// with one of the keys. It returns the valid sig.
+func (v *validator) verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, signer string, keys []*dns.DNSKEY) (*dns.RRSIG, error) {
+	h := rrset[0].Header()
+	if len(sigs) == 0 {
+		return nil, bogus(dns.ExtendedErrorCodeRRSIGsMissing, "no rrsig for %s %s", h.Name, dns.TypeToString[h.Rrtype])
+	}
+	now := v.now()
+	var lastErr error
+	for _, sig := range sigs {
+		if !strings.EqualFold(sig.SignerName, signer) {
+			continue
+		}
+		if !sig.ValidityPeriod(now) {
+			if int64(sig.Inception) > now.Unix() {
+				lastErr = bogus(dns.ExtendedErrorCodeSignatureNotYetValid, "rrsig of %s %s is not yet valid", h.Name, dns.TypeToString[h.Rrtype])
+			} else {
+				lastErr = bogus(dns.ExtendedErrorCodeSignatureExpired, "rrsig of %s %s expired", h.Name, dns.TypeToString[h.Rrtype])
+			}
+			continue
+		}
+		for _, k := range keys {
+			if k.Algorithm != sig.Algorithm || k.KeyTag() != sig.KeyTag {
+				continue
+			}
+			if err := sig.Verify(k, rrset); err != nil {
+				lastErr = bogus(dns.ExtendedErrorCodeDNSBogus, "invalid rrsig of %s %s, %s", h.Name, dns.TypeToString[h.Rrtype], err)
+				continue
+			}
+			return sig, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = bogus(dns.ExtendedErrorCodeDNSKEYMissing, "no dnskey of %s for the rrsig of %s %s", signer, h.Name, dns.TypeToString[h.Rrtype])
+	}
+	return nil, lastErr
+}
+
+// verifySection verifies all rrsets in rrs.
+func (v *validator) verifySection(rrs []dns.RR, signer string, keys []*dns.DNSKEY) error {
+	for _, s := range groupRRsets(rrs) {
+		if _, err := v.verifyRRset(s.rrs, s.sigs, signer, keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate validates r, the response of question.
+// It returns true if r is secure, false if r is insecure, a
+// *bogusError if r is bogus. Other errors mean the validation could
+// not be finished.
+func (v *validator) validate(ctx context.Context, query queryFunc, question dns.Question, r *dns.Msg) (bool, error) {
+	if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+		return false, nil
+	}
+	qname := dns.CanonicalName(question.Name)
+
+	secure := true
+	target := qname
+	answered := false
+	sets := groupRRsets(r.Answer)
+	for _, s := range sets {
+		if s.typ == dns.TypeCNAME && len(s.sigs) == 0 && synthesizedByDNAME(sets, s.name) {
+			// RFC 4035 3.2.3. Unsigned CNAME synthesized from a DNAME.
+			target = followCNAME(target, s)
+			continue
+		}
+
+		var signer string
+		if len(s.sigs) > 0 {
+			signer = dns.CanonicalName(s.sigs[0].SignerName)
+			if !dns.IsSubDomain(signer, s.name) {
+				return false, bogus(dns.ExtendedErrorCodeDNSBogus, "signer %s is not a parent of %s", signer, s.name)
+			}
+		} else {
+			signer = s.name
+		}
+		zone, st, err := v.walk(ctx, query, signer)
+		if err != nil {
+			return false, err
+		}
+		if st.kind == zoneInsecure {
+			secure = false
+		} else {
+			if len(s.sigs) > 0 && zone != signer {
+				return false, bogus(dns.ExtendedErrorCodeDNSKEYMissing, "signer %s is not a secure zone", signer)
+			}
+			sig, err := v.verifyRRset(s.rrs, s.sigs, zone, st.keys)
+			if err != nil {
+				return false, err
+			}
+			if labels := int(sig.Labels); labels < dns.CountLabel(s.name) {
+				// Expanded from a wildcard. RFC 4035 5.3.4.
+				if err := v.verifySection(denialRRs(r), zone, st.keys); err != nil {
+					return false, err
+				}
+				if err := checkWildcardDenial(r, s.name, labels); err != nil {
+					return false, err
+				}
+			}
+		}
+
+		if s.name == target && (s.typ == question.Qtype || question.Qtype == dns.TypeANY) {
+			answered = true
+		}
+		target = followCNAME(target, s)
+	}
+	if answered {
+		return secure, nil
+	}
+
+	// Negative response of target.
+	signer := target
+	for _, rr := range r.Ns {
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == dns.TypeSOA {
+			signer = dns.CanonicalName(sig.SignerName)
+		}
+	}
+	zone, st, err := v.walk(ctx, query, signer)
+	if err != nil {
+		return false, err
+	}
+	if st.kind == zoneInsecure {
+		return false, nil
+	}
+	if err := v.verifySection(r.Ns, zone, st.keys); err != nil {
+		return false, err
+	}
+	if err := checkDenial(r, target, question.Qtype); err != nil {
+		return false, err
+	}
+	return secure, nil
+}
+
+func followCNAME(target string, s *rrset) string {
+	if s.name == target && s.typ == dns.TypeCNAME {
+		return dns.CanonicalName(s.rrs[0].(*dns.CNAME).Target)
+	}
+	return target
+}
+
+func synthesizedByDNAME(sets []*rrset, name string) bool {
+	for _, s := range sets {
+		if s.typ == dns.TypeDNAME && s.name != name && dns.IsSubDomain(s.name, name) {
+			return true
+		}
+	}
+	return false
+}
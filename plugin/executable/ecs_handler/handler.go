@@ -29,7 +29,9 @@ import (
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/ip_set"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/IrineSistiana/mosdns/v5/plugin/matcher/base_ip"
 	"github.com/miekg/dns"
 )
 
@@ -51,14 +53,30 @@ type Args struct {
 	Preset  string `yaml:"preset"`
 	Mask4   int    `yaml:"mask4"`
 	Mask6   int    `yaml:"mask6"`
+
+	// Table maps clients to subnets. The first matched subnet is sent.
+	// It has higher priority than Preset and Send.
+	Table []TableArgs `yaml:"table"`
+}
+
+type TableArgs struct {
+	Clients base_ip.Args `yaml:"clients"`
+	// Subnet is the ecs sent for the clients. e.g. 203.0.113.0/24
+	Subnet string `yaml:"subnet"`
 }
 
 type ECSHandler struct {
 	args   Args
 	preset netip.Addr // unmapped
+	table  []tableEntry
+}
+
+type tableEntry struct {
+	clients ip_set.MatcherGroup
+	subnet  netip.Prefix // masked
 }
 
-func NewHandler(args Args) (*ECSHandler, error) {
+func NewHandler(bq sequence.BQ, args Args) (*ECSHandler, error) {
 	var preset netip.Addr
 	if len(args.Preset) > 0 {
 		addr, err := netip.ParseAddr(args.Preset)
@@ -85,20 +103,44 @@ func NewHandler(args Args) (*ECSHandler, error) {
 		return nil, errors.New("invalid mask6")
 	}
 
-	return &ECSHandler{args: args, preset: preset}, nil
+	var table []tableEntry
+	for i, ta := range args.Table {
+		subnet, err := netip.ParsePrefix(ta.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet of table #%d, %w", i, err)
+		}
+		clients, err := base_ip.NewIPMatcher(bq, &ta.Clients)
+		if err != nil {
+			return nil, fmt.Errorf("invalid clients of table #%d, %w", i, err)
+		}
+		table = append(table, tableEntry{clients: clients, subnet: subnet.Masked()})
+	}
+
+	return &ECSHandler{args: args, preset: preset, table: table}, nil
 }
 
-func Init(_ *coremain.BP, args any) (any, error) {
-	return NewHandler(*args.(*Args))
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewHandler(sequence.NewBQ(bp.M(), bp.L()), *args.(*Args))
 }
 
 // Exec tries to append ECS to qCtx.Q().
 func (e *ECSHandler) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
 	forwarded := e.addECS(qCtx)
+	qECS := queryECS(qCtx)
+	source, hasSource := netip.Prefix{}, false
+	if qECS != nil {
+		// The scope is unknown until the response is received.
+		if source, hasSource = subnetPrefix(qECS); hasSource {
+			qCtx.SetECS(query_context.ECS{Source: source, Scope: qECS.SourceNetmask})
+		}
+	}
 	err := next.ExecNext(ctx, qCtx)
 	if err != nil {
 		return err
 	}
+	if hasSource {
+		qCtx.SetECS(query_context.ECS{Source: source, Scope: responseScope(qCtx, qECS, source)})
+	}
 
 	if forwarded {
 		// forward upstream ecs back to client
@@ -143,6 +185,20 @@ func (e *ECSHandler) addECS(qCtx *query_context.Context) (forwarded bool) {
 		}
 	}
 
+	// For DoH behind proxies, the client address is read from the
+	// header by http_server. (See its src_ip_header and trusted_proxies.)
+	clientAddr := qCtx.ServerMeta.ClientAddr.Unmap()
+
+	if clientAddr.IsValid() {
+		for _, te := range e.table {
+			if te.clients.Match(clientAddr) {
+				addr := te.subnet.Addr()
+				queryOpt.Option = append(queryOpt.Option, newSubnet(addr.AsSlice(), uint8(te.subnet.Bits()), addr.Is6()))
+				return false
+			}
+		}
+	}
+
 	if e.preset.IsValid() {
 		clientAddr := e.preset
 		var ecs *dns.EDNS0_SUBNET
@@ -156,9 +212,7 @@ func (e *ECSHandler) addECS(qCtx *query_context.Context) (forwarded bool) {
 	}
 
 	if e.args.Send {
-		clientAddr := qCtx.ServerMeta.ClientAddr
 		if clientAddr.IsValid() {
-			clientAddr = clientAddr.Unmap()
 			var ecs *dns.EDNS0_SUBNET
 			if clientAddr.Is4() {
 				ecs = newSubnet(clientAddr.AsSlice(), uint8(e.args.Mask4), false)
@@ -172,6 +226,54 @@ func (e *ECSHandler) addECS(qCtx *query_context.Context) (forwarded bool) {
 	return false
 }
 
+func queryECS(qCtx *query_context.Context) *dns.EDNS0_SUBNET {
+	for _, o := range qCtx.QOpt().Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// responseScope returns the scope prefix length of the response.
+// See RFC 7871 7.3.
+func responseScope(qCtx *query_context.Context, qECS *dns.EDNS0_SUBNET, source netip.Prefix) uint8 {
+	upstreamOpt := qCtx.UpstreamOpt()
+	if upstreamOpt == nil {
+		return 0
+	}
+	for _, o := range upstreamOpt.Option {
+		rECS, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		// A response that does not match the query is only valid
+		// for the source subnet.
+		if p, ok := subnetPrefix(rECS); !ok || p != source {
+			return qECS.SourceNetmask
+		}
+		return min(rECS.SourceScope, qECS.SourceNetmask)
+	}
+	// No ecs in the response means it is valid for all clients.
+	return 0
+}
+
+// subnetPrefix returns the masked address and source prefix of ecs.
+func subnetPrefix(ecs *dns.EDNS0_SUBNET) (netip.Prefix, bool) {
+	addr, ok := netip.AddrFromSlice(ecs.Address)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	if ecs.Family == 1 {
+		addr = addr.Unmap()
+	}
+	p, err := addr.Prefix(int(ecs.SourceNetmask))
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return p, true
+}
+
 func newSubnet(ip net.IP, mask uint8, v6 bool) *dns.EDNS0_SUBNET {
 	edns0Subnet := new(dns.EDNS0_SUBNET)
 	// edns family: https://www.iana.org/assignments/address-family-numbers/address-family-numbers.xhtml
@@ -213,5 +315,5 @@ func QuickSetupOldECS(bq sequence.BQ, s string) (any, error) {
 			bq.L().Warn("Dual-stack ecs is deprecated. Only the first ip will be used as preset ecs address. Others will be simply ignored")
 		}
 	}
-	return NewHandler(a)
+	return NewHandler(bq, a)
 }
@@ -0,0 +1,241 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package ecs_handler
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/IrineSistiana/mosdns/v5/plugin/matcher/base_ip"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// testUpstream records the ecs of the query and replies with the ecs
+// in resp, if it is not nil.
+type testUpstream struct {
+	queryECS *dns.EDNS0_SUBNET
+	resp     *dns.EDNS0_SUBNET
+}
+
+func (u *testUpstream) Exec(_ context.Context, qCtx *query_context.Context) error {
+	u.queryECS = queryECS(qCtx)
+	r := new(dns.Msg)
+	r.SetReply(qCtx.Q())
+	if u.resp != nil {
+		r.SetEdns0(1232, false)
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option, u.resp)
+	}
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func newTestHandler(t *testing.T, args Args) *ECSHandler {
+	t.Helper()
+	e, err := NewHandler(sequence.NewBQ(coremain.NewTestMosdnsWithPlugins(nil), zap.NewNop()), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func execHandler(t *testing.T, e *ECSHandler, u *testUpstream, meta server.QueryMeta) *query_context.Context {
+	t.Helper()
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	qCtx := query_context.NewContext(q)
+	qCtx.ServerMeta = meta
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: u}}, nil)
+	if err := e.Exec(context.Background(), qCtx, next); err != nil {
+		t.Fatal(err)
+	}
+	return qCtx
+}
+
+func ecsPrefix(t *testing.T, ecs *dns.EDNS0_SUBNET) string {
+	t.Helper()
+	if ecs == nil {
+		return ""
+	}
+	p, ok := subnetPrefix(ecs)
+	if !ok {
+		t.Fatalf("invalid ecs %s", ecs)
+	}
+	return p.String()
+}
+
+func Test_ECSHandler_table(t *testing.T) {
+	e := newTestHandler(t, Args{
+		Send: true,
+		Table: []TableArgs{
+			{Clients: base_ip.Args{IPs: []string{"10.0.0.0/8"}}, Subnet: "203.0.113.9/24"},
+			{Clients: base_ip.Args{IPs: []string{"2001:db8::/32"}}, Subnet: "2001:db8:1::/48"},
+		},
+	})
+
+	tests := []struct {
+		client string
+		want   string
+	}{
+		{client: "10.1.2.3", want: "203.0.113.0/24"},
+		{client: "::ffff:10.1.2.3", want: "203.0.113.0/24"},
+		{client: "2001:db8::1", want: "2001:db8:1::/48"},
+		{client: "192.0.2.1", want: "192.0.2.0/24"}, // not in table, send
+	}
+	for _, tt := range tests {
+		u := new(testUpstream)
+		execHandler(t, e, u, server.QueryMeta{ClientAddr: netip.MustParseAddr(tt.client)})
+		if got := ecsPrefix(t, u.queryECS); got != tt.want {
+			t.Fatalf("client %s: want %s, got %s", tt.client, tt.want, got)
+		}
+	}
+
+	// Table has higher priority than preset.
+	e = newTestHandler(t, Args{
+		Preset: "198.51.100.1",
+		Table:  []TableArgs{{Clients: base_ip.Args{IPs: []string{"10.0.0.0/8"}}, Subnet: "203.0.113.0/24"}},
+	})
+	u := new(testUpstream)
+	execHandler(t, e, u, server.QueryMeta{ClientAddr: netip.MustParseAddr("10.1.2.3")})
+	if got := ecsPrefix(t, u.queryECS); got != "203.0.113.0/24" {
+		t.Fatalf("want table subnet, got %s", got)
+	}
+	u = new(testUpstream)
+	execHandler(t, e, u, server.QueryMeta{ClientAddr: netip.MustParseAddr("192.0.2.1")})
+	if got := ecsPrefix(t, u.queryECS); got != "198.51.100.0/24" {
+		t.Fatalf("want preset subnet, got %s", got)
+	}
+
+	if _, err := NewHandler(sequence.NewBQ(coremain.NewTestMosdnsWithPlugins(nil), zap.NewNop()), Args{
+		Table: []TableArgs{{Subnet: "not_a_subnet"}},
+	}); err == nil {
+		t.Fatal("want err")
+	}
+}
+
+func Test_ECSHandler_scope(t *testing.T) {
+	e := newTestHandler(t, Args{Send: true})
+	meta := server.QueryMeta{ClientAddr: netip.MustParseAddr("192.0.2.1")}
+	source := netip.MustParsePrefix("192.0.2.0/24")
+
+	respECS := func(addr string, source, scope uint8) *dns.EDNS0_SUBNET {
+		ecs := newSubnet(netip.MustParseAddr(addr).AsSlice(), source, false)
+		ecs.SourceScope = scope
+		return ecs
+	}
+	tests := []struct {
+		name string
+		resp *dns.EDNS0_SUBNET
+		want uint8
+	}{
+		{name: "no ecs in resp", want: 0},
+		{name: "narrower scope", resp: respECS("192.0.2.0", 24, 16), want: 16},
+		{name: "scope larger than source", resp: respECS("192.0.2.0", 24, 32), want: 24},
+		{name: "mismatched source", resp: respECS("198.51.100.0", 24, 16), want: 24},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qCtx := execHandler(t, e, &testUpstream{resp: tt.resp}, meta)
+			ecs, ok := qCtx.ECS()
+			if !ok {
+				t.Fatal("ecs is not stored")
+			}
+			if ecs.Source != source || ecs.Scope != tt.want {
+				t.Fatalf("want %s scope %d, got %s scope %d", source, tt.want, ecs.Source, ecs.Scope)
+			}
+		})
+	}
+}
+
+// testDNSHandler runs an ECSHandler for http queries.
+type testDNSHandler struct {
+	t *testing.T
+	e *ECSHandler
+	u *testUpstream
+}
+
+func (h *testDNSHandler) Handle(_ context.Context, q *dns.Msg, meta server.QueryMeta, pack func(m *dns.Msg) (*[]byte, error)) *[]byte {
+	qCtx := query_context.NewContext(q)
+	qCtx.ServerMeta = meta
+	next := sequence.NewChainWalker([]*sequence.ChainNode{{E: h.u}}, nil)
+	if err := h.e.Exec(context.Background(), qCtx, next); err != nil {
+		h.t.Error(err)
+		return nil
+	}
+	b, _ := pack(qCtx.R())
+	return b
+}
+
+func Test_ECSHandler_forwardedFor(t *testing.T) {
+	dh := &testDNSHandler{t: t, e: newTestHandler(t, Args{Send: true}), u: new(testUpstream)}
+	hh := server.NewHttpHandler(dh, server.HttpHandlerOpts{
+		GetSrcIPFromHeader: "X-Forwarded-For",
+		TrustedProxies:     []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8"), netip.MustParsePrefix("10.0.0.0/8")},
+	})
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	b, err := pool.PackBuffer(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.ReleaseBuf(b)
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{name: "from trusted proxy", remote: "127.0.0.1:1234", xff: []string{"198.51.100.7"}, want: "198.51.100.0/24"},
+		{name: "spoofed leftmost entry", remote: "127.0.0.1:1234", xff: []string{"203.0.113.1, 198.51.100.7"}, want: "198.51.100.0/24"},
+		{name: "trusted hops are skipped", remote: "127.0.0.1:1234", xff: []string{"203.0.113.1, 198.51.100.7", "10.0.0.1"}, want: "198.51.100.0/24"},
+		{name: "untrusted remote", remote: "192.0.2.1:1234", xff: []string{"198.51.100.7"}, want: "192.0.2.0/24"},
+		{name: "no header", remote: "127.0.0.1:1234", want: "127.0.0.0/24"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(*b))
+			req.RemoteAddr = tt.remote
+			req.Header.Set("Content-Type", "application/dns-message")
+			for _, v := range tt.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			w := httptest.NewRecorder()
+			hh.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("http status %d", w.Code)
+			}
+			if got := ecsPrefix(t, dh.u.queryECS); got != tt.want {
+				t.Fatalf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
@@ -21,11 +21,12 @@ package fastforward
 
 import (
 	"context"
-	"crypto/tls"
 	"errors"
 	"fmt"
-	"math/rand/v2"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
@@ -48,15 +49,33 @@ func init() {
 
 const (
 	maxConcurrentQueries = 3
-	queryTimeout         = time.Second * 5
+	defaultQueryTimeout  = time.Second * 5
 )
 
 type Args struct {
 	Upstreams  []UpstreamConfig `yaml:"upstreams"`
 	Concurrent int              `yaml:"concurrent"`
 
+	// Timeout is the default query timeout of upstreams in millisecond.
+	// Default is 5000.
+	Timeout int `yaml:"timeout"`
+	// Retries is the number of additional upstreams that will be tried
+	// one by one after all concurrent queries failed. It is capped by the
+	// number of upstreams that have not been tried.
+	Retries int `yaml:"retries"`
+	// FailureRcodes are rcodes (names or numbers) that are considered as
+	// failures. Failed responses are retried and count against the upstream
+	// health. Default is all rcodes except NOERROR and NXDOMAIN.
+	FailureRcodes []string `yaml:"failure_rcodes"`
+
+	// Strategy is the upstream selection strategy. One of
+	// random (default), round_robin, latency, weighted, priority.
+	Strategy    string            `yaml:"strategy"`
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
+
 	// Global options.
 	Socks5       string `yaml:"socks5"`
+	HTTPProxy    string `yaml:"http_proxy"`
 	SoMark       int    `yaml:"so_mark"`
 	BindToDevice string `yaml:"bind_to_device"`
 	Bootstrap    string `yaml:"bootstrap"`
@@ -68,15 +87,71 @@ type UpstreamConfig struct {
 	Addr        string `yaml:"addr"` // Required.
 	DialAddr    string `yaml:"dial_addr"`
 	IdleTimeout int    `yaml:"idle_timeout"`
-
-	// Deprecated: This option has no affect.
+	// Timeout overwrites Args.Timeout for this upstream.
+	Timeout int `yaml:"timeout"`
+
+	// Weight is used by the weighted strategy. Default is 1.
+	Weight int `yaml:"weight"`
+	// Priority is used by the priority strategy. Upstreams with lower
+	// values are preferred.
+	Priority int `yaml:"priority"`
+
+	// Connection pool options. Available for tcp, tls and quic upstreams.
+	// ConnLimit limits the number of connections. Queries wait for a free
+	// connection once the limit is reached. Default is no limit.
+	ConnLimit int `yaml:"conn_limit"`
+	// MinConns is the number of connections that are kept warm.
+	MinConns int `yaml:"min_conns"`
+	// DialTimeout is the connection dial timeout in millisecond.
+	// Default is 5000.
+	DialTimeout int `yaml:"dial_timeout"`
+	// PipelineLimit is the maximum number of concurrent queries in one
+	// pipeline connection. Default is 64.
+	PipelineLimit int `yaml:"pipeline_limit"`
+
+	// Deprecated: This option has no affect. Use ConnLimit instead.
 	// TODO: (v6) Remove this option.
 	MaxConns           int  `yaml:"max_conns"`
 	EnablePipeline     bool `yaml:"enable_pipeline"`
 	EnableHTTP3        bool `yaml:"enable_http3"`
 	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
-
-	Socks5       string `yaml:"socks5"`
+	// AutoPipeline detects whether the tcp/tls server supports query
+	// pipelining and falls back to connection reuse if not.
+	AutoPipeline bool `yaml:"auto_pipeline"`
+	// AutoHTTP3 tries http/3 first and falls back to http/2 if it fails.
+	AutoHTTP3 bool `yaml:"auto_http3"`
+
+	// TLS options for tls, https, h3 and quic upstreams.
+	// CAFile is a pem file of the CAs that verify the server certificate.
+	// System CAs are used if it's empty.
+	CAFile string `yaml:"ca_file"`
+	// ClientCert and ClientKey are pem files of the client certificate.
+	ClientCert string `yaml:"client_cert"`
+	ClientKey  string `yaml:"client_key"`
+	// ServerName overwrites the server name (SNI) inferred from addr.
+	ServerName string `yaml:"server_name"`
+	// SPKIPins are base64 encoded SHA-256 hashes of the SubjectPublicKeyInfo.
+	// One of the server certificates must match one of the pins.
+	SPKIPins []string `yaml:"spki_pins"`
+
+	// Padding pads queries to 128 bytes blocks as RFC 8467 recommended.
+	// Only available for tls, https, h3 and quic upstreams.
+	Padding bool `yaml:"padding"`
+	// Privacy removes ECS, cookies and other client-identifying EDNS0
+	// options from queries before they are sent to this upstream.
+	Privacy bool `yaml:"privacy"`
+	// ClientCookie sends dns cookies to this upstream and drops responses
+	// that have mismatched cookies. Only available for udp upstreams.
+	ClientCookie bool `yaml:"client_cookie"`
+
+	// ODoHProxy is the proxy url of odoh upstream.
+	ODoHProxy string `yaml:"odoh_proxy"`
+
+	Socks5 string `yaml:"socks5"`
+	// Socks5UDP relays udp, quic and h3 packets through the socks5 proxy.
+	// By default, only tcp connections use the proxy.
+	Socks5UDP    bool   `yaml:"socks5_udp"`
+	HTTPProxy    string `yaml:"http_proxy"`
 	SoMark       int    `yaml:"so_mark"`
 	BindToDevice string `yaml:"bind_to_device"`
 	Bootstrap    string `yaml:"bootstrap"`
@@ -92,6 +167,7 @@ func Init(bp *coremain.BP, args any) (any, error) {
 		_ = f.Close()
 		return nil, err
 	}
+	bp.RegAPI(f.Api())
 	return f, nil
 }
 
@@ -104,6 +180,11 @@ type Forward struct {
 	logger       *zap.Logger
 	us           []*upstreamWrapper
 	tag2Upstream map[string]*upstreamWrapper // for fast tag lookup only.
+	failRcodes   map[int]struct{}            // nil means default rule.
+
+	rrCounter   atomic.Uint64
+	closeOnce   sync.Once
+	closeNotify chan struct{}
 }
 
 type Opts struct {
@@ -120,44 +201,85 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 	if opt.Logger == nil {
 		opt.Logger = zap.NewNop()
 	}
+	utils.SetDefaultString(&args.Strategy, strategyRandom)
+	if !validStrategy(args.Strategy) {
+		return nil, fmt.Errorf("invalid strategy %s", args.Strategy)
+	}
+	if args.Strategy == strategyLatency {
+		utils.SetDefaultNum(&args.HealthCheck.MaxFails, defaultLatencyMaxFails)
+	}
+
+	failRcodes, err := parseRcodes(args.FailureRcodes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid failure_rcodes, %w", err)
+	}
 
 	f := &Forward{
 		args:         args,
 		logger:       opt.Logger,
 		tag2Upstream: make(map[string]*upstreamWrapper),
+		failRcodes:   failRcodes,
+		closeNotify:  make(chan struct{}),
 	}
 
 	applyGlobal := func(c *UpstreamConfig) {
 		utils.SetDefaultString(&c.Socks5, args.Socks5)
+		utils.SetDefaultString(&c.HTTPProxy, args.HTTPProxy)
 		utils.SetDefaultUnsignNum(&c.SoMark, args.SoMark)
 		utils.SetDefaultString(&c.BindToDevice, args.BindToDevice)
 		utils.SetDefaultString(&c.Bootstrap, args.Bootstrap)
 		utils.SetDefaultUnsignNum(&c.BootstrapVer, args.BootstrapVer)
+		utils.SetDefaultUnsignNum(&c.Timeout, args.Timeout)
+		utils.SetDefaultUnsignNum(&c.Timeout, int(defaultQueryTimeout/time.Millisecond))
 	}
 
 	for i, c := range args.Upstreams {
 		if len(c.Addr) == 0 {
 			return nil, fmt.Errorf("#%d upstream invalid args, addr is required", i)
 		}
+		if c.Weight < 0 {
+			_ = f.Close()
+			return nil, fmt.Errorf("#%d upstream invalid weight %d", i, c.Weight)
+		}
 		applyGlobal(&c)
+		utils.SetDefaultUnsignNum(&c.Weight, 1)
+
+		if c.Padding && !paddingAvailable(c.Addr) {
+			_ = f.Close()
+			return nil, fmt.Errorf("#%d upstream %s does not support padding", i, c.Addr)
+		}
+
+		tlsConfig, err := newTLSConfig(&c)
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("#%d upstream invalid tls args, %w", i, err)
+		}
 
 		uw := newWrapper(i, c, opt.MetricsTag)
+		uw.health = newUpstreamHealth(args.HealthCheck)
 		uOpt := upstream.Opt{
 			DialAddr:       c.DialAddr,
 			Socks5:         c.Socks5,
+			Socks5UDP:      c.Socks5UDP,
+			HTTPProxy:      c.HTTPProxy,
 			SoMark:         c.SoMark,
 			BindToDevice:   c.BindToDevice,
 			IdleTimeout:    time.Duration(c.IdleTimeout) * time.Second,
 			EnablePipeline: c.EnablePipeline,
+			AutoPipeline:   c.AutoPipeline,
+			PipelineLimit:  c.PipelineLimit,
+			MaxConns:       c.ConnLimit,
+			MinConns:       c.MinConns,
+			DialTimeout:    time.Duration(c.DialTimeout) * time.Millisecond,
 			EnableHTTP3:    c.EnableHTTP3,
+			AutoHTTP3:      c.AutoHTTP3,
+			ODoHProxy:      c.ODoHProxy,
 			Bootstrap:      c.Bootstrap,
 			BootstrapVer:   c.BootstrapVer,
-			TLSConfig: &tls.Config{
-				InsecureSkipVerify: c.InsecureSkipVerify,
-				ClientSessionCache: tls.NewLRUClientSessionCache(4),
-			},
-			Logger:        opt.Logger,
-			EventObserver: uw,
+			TLSConfig:      tlsConfig,
+			ClientCookie:   c.ClientCookie,
+			Logger:         opt.Logger,
+			EventObserver:  uw,
 		}
 
 		u, err := upstream.NewUpstream(c.Addr, uOpt)
@@ -177,6 +299,10 @@ func NewForward(args *Args, opt Opts) (*Forward, error) {
 		}
 	}
 
+	if hc := args.HealthCheck; hc.ProbeInterval > 0 {
+		utils.SetDefaultString(&hc.ProbeDomain, defaultProbeDomain)
+		f.startProbe(time.Duration(hc.ProbeInterval)*time.Second, hc.ProbeDomain)
+	}
 	return f, nil
 }
 
@@ -228,6 +354,9 @@ func (f *Forward) QuickConfigureExec(args string) (any, error) {
 }
 
 func (f *Forward) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.closeNotify)
+	})
 	for _, u := range f.us {
 		_ = u.Close()
 	}
@@ -239,11 +368,14 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 		return nil, errors.New("no upstream to exchange")
 	}
 
-	queryPayload, err := pool.PackBuffer(qCtx.Q())
-	if err != nil {
-		return nil, err
+	us = f.pick(us)
+	payloads := queryPayloads{q: qCtx.Q()}
+	defer payloads.release()
+	for _, u := range us {
+		if _, err := payloads.get(u.queryMode()); err != nil {
+			return nil, err
+		}
 	}
-	defer pool.ReleaseBuf(queryPayload)
 
 	concurrent := f.args.Concurrent
 	if concurrent <= 0 {
@@ -262,18 +394,23 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 	done := make(chan struct{})
 	defer close(done)
 
-	r := rand.IntN(len(us))
-	for i := 0; i < concurrent; i++ {
-		u := us[(r+i)%len(us)]
+	next := 0
+	startQuery := func() {
+		u := us[next%len(us)]
+		next++
+		queryPayload, _ := payloads.get(u.queryMode()) // Already packed.
 		qc := copyPayload(queryPayload)
 		go func(uqid uint32, question dns.Question) {
 			defer pool.ReleaseBuf(qc)
 			// Give each upstream a fixed timeout to finish the query.
-			upstreamCtx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+			// It is canceled once the query is done.
+			upstreamCtx, cancel := context.WithTimeout(ctx, u.timeout())
 			defer cancel()
 
 			var r *dns.Msg
+			start := time.Now()
 			respPayload, err := u.ExchangeContext(upstreamCtx, *qc)
+			latency := time.Since(start)
 			if err != nil {
 				f.logger.Warn(
 					"upstream error",
@@ -292,6 +429,15 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 					r = nil
 				}
 			}
+			switch {
+			case err != nil && ctx.Err() != nil: // The query is done. Not the upstream's fault.
+			case err != nil || f.isFailure(r.Rcode):
+				if u.health.onFailure(time.Now()) {
+					f.logger.Warn("upstream ejected", zap.String("upstream", u.name()), zap.Error(err))
+				}
+			default:
+				u.health.onSuccess(latency)
+			}
 			select {
 			case resChan <- res{r: r, err: err}:
 			case <-done:
@@ -300,25 +446,68 @@ func (f *Forward) exchange(ctx context.Context, qCtx *query_context.Context, us
 	}
 
 	for i := 0; i < concurrent; i++ {
+		startQuery()
+	}
+
+	// Each upstream is tried at most once.
+	retries := min(f.args.Retries, max(len(us)-concurrent, 0))
+	var failedResp *dns.Msg
+	for pending := concurrent; pending > 0; pending-- {
 		select {
 		case res := <-resChan:
 			r, err := res.r, res.err
-			if err != nil {
-				continue
+			if err == nil && !f.isFailure(r.Rcode) {
+				return r, nil
 			}
-
-			// Retry until the last
-			if i < concurrent-1 && r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
-				continue
+			if r != nil {
+				failedResp = r
+			}
+			if retries > 0 {
+				retries--
+				startQuery()
+				pending++
 			}
-			return r, nil
 		case <-ctx.Done():
 			return nil, context.Cause(ctx)
 		}
 	}
+
+	// Still better than nothing.
+	if failedResp != nil {
+		return failedResp, nil
+	}
 	return nil, errors.New("all upstream servers failed")
 }
 
+// isFailure reports whether a response with rcode is considered as a failure.
+func (f *Forward) isFailure(rcode int) bool {
+	if f.failRcodes == nil {
+		return rcode != dns.RcodeSuccess && rcode != dns.RcodeNameError
+	}
+	_, ok := f.failRcodes[rcode]
+	return ok
+}
+
+// parseRcodes parses rcode names or numbers. It returns nil if s is empty.
+func parseRcodes(s []string) (map[int]struct{}, error) {
+	if len(s) == 0 {
+		return nil, nil
+	}
+	m := make(map[int]struct{}, len(s))
+	for _, str := range s {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(str)]
+		if !ok {
+			n, err := strconv.ParseUint(str, 10, 12)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rcode %s", str)
+			}
+			rcode = int(n)
+		}
+		m[rcode] = struct{}{}
+	}
+	return m, nil
+}
+
 func quickSetup(bq sequence.BQ, s string) (any, error) {
 	args := new(Args)
 	args.Concurrent = maxConcurrentQueries
@@ -0,0 +1,179 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// dummyUpstream replies with rcode, or returns err if it is not nil.
+// If wait is set, it returns the ctx err once ctx is done.
+type dummyUpstream struct {
+	rcode int
+	err   error
+	wait  bool
+	calls atomic.Int32
+
+	returned atomic.Int32
+}
+
+func (d *dummyUpstream) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
+	d.calls.Add(1)
+	if d.wait {
+		<-ctx.Done()
+		d.returned.Add(1)
+		return nil, ctx.Err()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	q := new(dns.Msg)
+	if err := q.Unpack(m); err != nil {
+		return nil, err
+	}
+	r := new(dns.Msg)
+	r.SetRcode(q, d.rcode)
+	return pool.PackBuffer(r)
+}
+
+func (d *dummyUpstream) Close() error { return nil }
+
+func newDummyForward(args *Args, us ...*dummyUpstream) *Forward {
+	args.Strategy = strategyPriority
+	f := &Forward{args: args, logger: zap.NewNop(), closeNotify: make(chan struct{})}
+	failRcodes, err := parseRcodes(args.FailureRcodes)
+	if err != nil {
+		panic(err)
+	}
+	f.failRcodes = failRcodes
+	for i, u := range us {
+		uw := newWrapper(i, UpstreamConfig{Priority: i, Timeout: 1000}, "")
+		uw.health = newUpstreamHealth(HealthCheckConfig{})
+		uw.u = u
+		f.us = append(f.us, uw)
+	}
+	return f
+}
+
+func Test_Forward_exchange_retries(t *testing.T) {
+	newQCtx := func() *query_context.Context {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		return query_context.NewContext(q)
+	}
+
+	errU := &dummyUpstream{err: errors.New("dummy err")}
+	servfailU := &dummyUpstream{rcode: dns.RcodeServerFailure}
+	refusedU := &dummyUpstream{rcode: dns.RcodeRefused}
+	okU := &dummyUpstream{rcode: dns.RcodeSuccess}
+
+	// No retries, failed response is returned.
+	f := newDummyForward(&Args{}, servfailU, okU)
+	r, err := f.exchange(context.Background(), newQCtx(), f.us)
+	if err != nil || r.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("want servfail, got %v, %v", r, err)
+	}
+
+	// Retries reach the last upstream.
+	f = newDummyForward(&Args{Retries: 2}, errU, servfailU, okU)
+	r, err = f.exchange(context.Background(), newQCtx(), f.us)
+	if err != nil || r.Rcode != dns.RcodeSuccess {
+		t.Fatalf("want success, got %v, %v", r, err)
+	}
+
+	// REFUSED is not a failure with custom failure rcodes.
+	f = newDummyForward(&Args{Retries: 2, FailureRcodes: []string{"SERVFAIL", "5"}}, servfailU, refusedU, okU)
+	if !f.isFailure(dns.RcodeRefused) {
+		t.Fatal("refused should be a failure")
+	}
+	f = newDummyForward(&Args{Retries: 2, FailureRcodes: []string{"servfail"}}, servfailU, refusedU, okU)
+	r, err = f.exchange(context.Background(), newQCtx(), f.us)
+	if err != nil || r.Rcode != dns.RcodeRefused {
+		t.Fatalf("want refused, got %v, %v", r, err)
+	}
+
+	// All failed.
+	f = newDummyForward(&Args{Retries: 1}, errU, errU)
+	if _, err := f.exchange(context.Background(), newQCtx(), f.us); err == nil {
+		t.Fatal("want err")
+	}
+
+	// Retries are capped by the number of upstreams.
+	countU := &dummyUpstream{err: errors.New("dummy err")}
+	f = newDummyForward(&Args{Retries: 5}, countU)
+	if _, err := f.exchange(context.Background(), newQCtx(), f.us); err == nil {
+		t.Fatal("want err")
+	}
+	if n := countU.calls.Load(); n != 1 {
+		t.Fatalf("want 1 call, got %d", n)
+	}
+
+	if _, err := parseRcodes([]string{"not_a_rcode"}); err == nil {
+		t.Fatal("want err")
+	}
+}
+
+func Test_Forward_exchange_canceled(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	// The upstream timeout is a failure.
+	f := newDummyForward(&Args{}, &dummyUpstream{wait: true})
+	f.us[0].cfg.Timeout = 10
+	if _, err := f.exchange(context.Background(), query_context.NewContext(q), f.us); err == nil {
+		t.Fatal("want err")
+	}
+	if n := f.us[0].health.fails.Load(); n != 1 {
+		t.Fatalf("want 1 failure, got %d", n)
+	}
+
+	// The canceled query is not.
+	u := &dummyUpstream{wait: true}
+	f = newDummyForward(&Args{}, u)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if _, err := f.exchange(ctx, query_context.NewContext(q), f.us); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want context.DeadlineExceeded, got %v", err)
+	}
+	// Wait for the upstream goroutine.
+	for u.returned.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(time.Millisecond * 10)
+	if n := f.us[0].health.fails.Load(); n != 0 {
+		t.Fatalf("canceled query should not be a failure, got %d", n)
+	}
+}
+
+func Test_NewForward_weight(t *testing.T) {
+	_, err := NewForward(&Args{Upstreams: []UpstreamConfig{{Addr: "127.0.0.1", Weight: -1}}}, Opts{})
+	if err == nil {
+		t.Fatal("negative weight should be rejected")
+	}
+}
@@ -0,0 +1,245 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+// Upstream selection strategies.
+const (
+	strategyRandom     = "random"
+	strategyRoundRobin = "round_robin"
+	strategyLatency    = "latency"
+	strategyWeighted   = "weighted"
+	strategyPriority   = "priority"
+)
+
+const (
+	defaultFailTimeout = time.Second * 30
+	defaultProbeDomain = "."
+
+	// The latency strategy prefers upstreams without samples, so an
+	// upstream that always fails must be ejected.
+	defaultLatencyMaxFails = 3
+
+	// Weight of the newest sample in the latency ewma.
+	ewmaAlpha = 0.3
+)
+
+type HealthCheckConfig struct {
+	// MaxFails is the number of consecutive failures before an upstream
+	// is ejected. Zero disables ejection. Default is 3 for the latency
+	// strategy, otherwise 0.
+	MaxFails int `yaml:"max_fails"`
+
+	// FailTimeout is the ejection time in seconds. Default is 30.
+	// After that, the upstream is re-admitted. It will be ejected again
+	// by its next failure unless it succeeds once.
+	FailTimeout int `yaml:"fail_timeout"`
+
+	// ProbeInterval enables active probes in seconds. Upstreams are probed
+	// with a NS query of ProbeDomain (default is root).
+	// A successful probe re-admits an ejected upstream immediately.
+	ProbeInterval int    `yaml:"probe_interval"`
+	ProbeDomain   string `yaml:"probe_domain"`
+}
+
+// upstreamHealth tracks the health of an upstream.
+// It is safe for concurrent use.
+type upstreamHealth struct {
+	maxFails    int32 // Zero means ejection is disabled.
+	failTimeout time.Duration
+
+	fails        atomic.Int32
+	ejectedUntil atomic.Int64  // Unix nano. Zero means not ejected.
+	ewma         atomic.Uint64 // Bits of float64 latency in millisecond. Zero means no sample.
+}
+
+func newUpstreamHealth(cfg HealthCheckConfig) *upstreamHealth {
+	h := &upstreamHealth{
+		maxFails:    int32(cfg.MaxFails),
+		failTimeout: time.Duration(cfg.FailTimeout) * time.Second,
+	}
+	if h.failTimeout <= 0 {
+		h.failTimeout = defaultFailTimeout
+	}
+	return h
+}
+
+// onSuccess resets the failure counter and re-admits the upstream.
+func (h *upstreamHealth) onSuccess(latency time.Duration) {
+	h.fails.Store(0)
+	h.ejectedUntil.Store(0)
+	h.observe(latency)
+}
+
+// onFailure counts a failure. It returns true if the upstream
+// has just been ejected. Latency of failures is not observed, otherwise
+// an upstream that fails fast would be preferred by the latency strategy.
+func (h *upstreamHealth) onFailure(now time.Time) (ejected bool) {
+	n := h.fails.Add(1)
+	if h.maxFails <= 0 || n < h.maxFails {
+		return false
+	}
+	wasHealthy := h.healthy(now)
+	h.ejectedUntil.Store(now.Add(h.failTimeout).UnixNano())
+	return wasHealthy
+}
+
+func (h *upstreamHealth) healthy(now time.Time) bool {
+	until := h.ejectedUntil.Load()
+	return until == 0 || now.UnixNano() >= until
+}
+
+func (h *upstreamHealth) observe(latency time.Duration) {
+	sample := float64(latency) / float64(time.Millisecond)
+	for {
+		old := h.ewma.Load()
+		v := sample
+		if old != 0 {
+			v = ewmaAlpha*sample + (1-ewmaAlpha)*math.Float64frombits(old)
+		}
+		if h.ewma.CompareAndSwap(old, math.Float64bits(v)) {
+			return
+		}
+	}
+}
+
+// latency returns the ewma latency in millisecond.
+// Zero means there is no sample yet.
+func (h *upstreamHealth) latency() float64 {
+	return math.Float64frombits(h.ewma.Load())
+}
+
+// pick returns a copy of us in the order they should be tried,
+// according to the selection strategy. Ejected upstreams are moved to
+// the end, so they are only used if there are not enough healthy ones.
+func (f *Forward) pick(us []*upstreamWrapper) []*upstreamWrapper {
+	s := make([]*upstreamWrapper, len(us))
+	switch f.args.Strategy {
+	case strategyRoundRobin:
+		rotate(s, us, int(f.rrCounter.Add(1)%uint64(len(us))))
+	case strategyLatency:
+		copy(s, us)
+		// Upstreams without samples go first, so they can be measured.
+		sort.SliceStable(s, func(i, j int) bool { return s[i].health.latency() < s[j].health.latency() })
+	case strategyWeighted:
+		// Weighted random sampling without replacement (Efraimidis-Spirakis).
+		keys := make(map[*upstreamWrapper]float64, len(us))
+		for _, u := range us {
+			keys[u] = math.Pow(rand.Float64(), 1/float64(u.cfg.Weight))
+		}
+		copy(s, us)
+		sort.SliceStable(s, func(i, j int) bool { return keys[s[i]] > keys[s[j]] })
+	case strategyPriority:
+		copy(s, us)
+		sort.SliceStable(s, func(i, j int) bool { return s[i].cfg.Priority < s[j].cfg.Priority })
+	default:
+		rotate(s, us, rand.IntN(len(us)))
+	}
+
+	now := time.Now()
+	sort.SliceStable(s, func(i, j int) bool { return s[i].health.healthy(now) && !s[j].health.healthy(now) })
+	return s
+}
+
+func rotate(dst, src []*upstreamWrapper, start int) {
+	n := copy(dst, src[start:])
+	copy(dst[n:], src[:start])
+}
+
+func validStrategy(s string) bool {
+	switch s {
+	case strategyRandom, strategyRoundRobin, strategyLatency, strategyWeighted, strategyPriority:
+		return true
+	}
+	return false
+}
+
+func (f *Forward) startProbe(interval time.Duration, domain string) {
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(domain), dns.TypeNS)
+	payload, err := q.Pack()
+	if err != nil {
+		f.logger.Error("invalid probe domain", zap.String("domain", domain), zap.Error(err))
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				wg := new(sync.WaitGroup)
+				for _, u := range f.us {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						f.probe(u, payload)
+					}()
+				}
+				wg.Wait()
+			case <-f.closeNotify:
+				return
+			}
+		}
+	}()
+}
+
+func (f *Forward) probe(u *upstreamWrapper, payload []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), u.timeout())
+	defer cancel()
+
+	start := time.Now()
+	r, err := u.u.ExchangeContext(ctx, payload)
+	latency := time.Since(start)
+	if err == nil {
+		m := new(dns.Msg)
+		err = m.Unpack(*r)
+		pool.ReleaseBuf(r)
+		if err == nil && f.isFailure(m.Rcode) {
+			err = fmt.Errorf("failure rcode %s", dns.RcodeToString[m.Rcode])
+		}
+	}
+	if err != nil {
+		f.logger.Debug("upstream probe failed", zap.String("upstream", u.name()), zap.Error(err))
+		if u.health.onFailure(time.Now()) {
+			f.logger.Warn("upstream ejected", zap.String("upstream", u.name()), zap.Error(err))
+		}
+		return
+	}
+	if !u.health.healthy(time.Now()) {
+		f.logger.Info("upstream re-admitted by probe", zap.String("upstream", u.name()))
+	}
+	u.health.onSuccess(latency)
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_upstreamHealth(t *testing.T) {
+	h := newUpstreamHealth(HealthCheckConfig{MaxFails: 2, FailTimeout: 10})
+	now := time.Now()
+
+	if h.onFailure(now) {
+		t.Fatal("ejected before max_fails")
+	}
+	if !h.onFailure(now) {
+		t.Fatal("not ejected after max_fails")
+	}
+	if h.healthy(now) {
+		t.Fatal("ejected upstream is healthy")
+	}
+
+	// Re-admitted after fail_timeout, but the next failure ejects it again.
+	later := now.Add(time.Second * 11)
+	if !h.healthy(later) {
+		t.Fatal("upstream should be re-admitted")
+	}
+	if !h.onFailure(later) || h.healthy(later) {
+		t.Fatal("upstream should be ejected again")
+	}
+
+	h.onSuccess(time.Millisecond * 10)
+	if !h.healthy(later) || h.fails.Load() != 0 {
+		t.Fatal("success should reset the upstream")
+	}
+
+	// Ejection disabled.
+	h = newUpstreamHealth(HealthCheckConfig{})
+	for i := 0; i < 10; i++ {
+		if h.onFailure(now) {
+			t.Fatal("ejection should be disabled")
+		}
+	}
+}
+
+func Test_upstreamHealth_latency(t *testing.T) {
+	h := newUpstreamHealth(HealthCheckConfig{})
+	if h.latency() != 0 {
+		t.Fatal("latency should be zero without samples")
+	}
+	h.observe(time.Millisecond * 100)
+	if h.latency() != 100 {
+		t.Fatalf("want 100, got %f", h.latency())
+	}
+	h.observe(0)
+	if l := h.latency(); l != 70 {
+		t.Fatalf("want 70, got %f", l)
+	}
+	h.onFailure(time.Now()) // Failures are not observed.
+	if l := h.latency(); l != 70 {
+		t.Fatalf("want 70 after a failure, got %f", l)
+	}
+}
+
+func newTestForward(strategy string, cfgs ...UpstreamConfig) *Forward {
+	f := &Forward{args: &Args{Strategy: strategy}, closeNotify: make(chan struct{})}
+	for i, c := range cfgs {
+		uw := newWrapper(i, c, "")
+		uw.health = newUpstreamHealth(HealthCheckConfig{MaxFails: 1})
+		f.us = append(f.us, uw)
+	}
+	return f
+}
+
+func Test_Forward_pick(t *testing.T) {
+	names := func(us []*upstreamWrapper) (s []string) {
+		for _, u := range us {
+			s = append(s, u.name())
+		}
+		return s
+	}
+	eq := func(a, b []string) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	t.Run("round_robin", func(t *testing.T) {
+		f := newTestForward(strategyRoundRobin, UpstreamConfig{Addr: "a"}, UpstreamConfig{Addr: "b"}, UpstreamConfig{Addr: "c"})
+		for _, want := range [][]string{{"b", "c", "a"}, {"c", "a", "b"}, {"a", "b", "c"}} {
+			if got := names(f.pick(f.us)); !eq(got, want) {
+				t.Fatalf("want %v, got %v", want, got)
+			}
+		}
+	})
+
+	t.Run("priority", func(t *testing.T) {
+		f := newTestForward(strategyPriority,
+			UpstreamConfig{Addr: "a", Priority: 2},
+			UpstreamConfig{Addr: "b", Priority: 1},
+			UpstreamConfig{Addr: "c", Priority: 1},
+		)
+		if got, want := names(f.pick(f.us)), []string{"b", "c", "a"}; !eq(got, want) {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+
+		// Ejected upstream goes last.
+		f.us[1].health.onFailure(time.Now())
+		if got, want := names(f.pick(f.us)), []string{"c", "a", "b"}; !eq(got, want) {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	})
+
+	t.Run("latency", func(t *testing.T) {
+		f := newTestForward(strategyLatency, UpstreamConfig{Addr: "a"}, UpstreamConfig{Addr: "b"}, UpstreamConfig{Addr: "c"})
+		f.us[0].health.onSuccess(time.Millisecond * 30)
+		f.us[1].health.onSuccess(time.Millisecond * 10)
+		if got, want := names(f.pick(f.us)), []string{"c", "b", "a"}; !eq(got, want) {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		f := newTestForward(strategyWeighted, UpstreamConfig{Addr: "a", Weight: 1}, UpstreamConfig{Addr: "b", Weight: 9})
+		first := make(map[string]int)
+		for i := 0; i < 1000; i++ {
+			first[f.pick(f.us)[0].name()]++
+		}
+		if first["b"] < 800 || first["a"] == 0 {
+			t.Fatalf("unexpected distribution %v", first)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/miekg/dns"
+)
+
+// queryMode is a bit set of the modifications to the query before
+// it is sent to an upstream.
+type queryMode uint8
+
+const (
+	queryModePadding queryMode = 1 << iota
+	queryModePrivacy
+
+	numQueryModes = 1 << iota
+)
+
+// paddingAvailable reports whether the upstream is encrypted by tls
+// or quic, where RFC 8467 padding makes sense.
+// DNSCrypt and ODoH upstreams pad queries themselves.
+func paddingAvailable(addr string) bool {
+	scheme, _, ok := strings.Cut(addr, "://")
+	if !ok {
+		return false
+	}
+	switch scheme {
+	case "tls", "tls+pipeline", "https", "h3", "quic", "doq":
+		return true
+	}
+	return false
+}
+
+func (uw *upstreamWrapper) queryMode() queryMode {
+	var m queryMode
+	if uw.cfg.Padding {
+		m |= queryModePadding
+	}
+	if uw.cfg.Privacy {
+		m |= queryModePrivacy
+	}
+	return m
+}
+
+// queryPayloads packs the query once for each queryMode.
+type queryPayloads struct {
+	q *dns.Msg
+	b [numQueryModes]*[]byte
+}
+
+// get returns the payload for mode. The payload is owned by p
+// and is released by release.
+func (p *queryPayloads) get(mode queryMode) (*[]byte, error) {
+	if b := p.b[mode]; b != nil {
+		return b, nil
+	}
+	q := p.q
+	if mode != 0 {
+		q = q.Copy()
+		if mode&queryModePrivacy != 0 {
+			dnsutils.RemoveIdentifyingEDNS0Options(q)
+		}
+		if mode&queryModePadding != 0 {
+			dnsutils.PadMsg(q, dnsutils.QueryPaddingBlockSize)
+		}
+	}
+	b, err := pool.PackBuffer(q)
+	if err != nil {
+		return nil, err
+	}
+	p.b[mode] = b
+	return b, nil
+}
+
+func (p *queryPayloads) release() {
+	for i, b := range p.b {
+		if b != nil {
+			pool.ReleaseBuf(b)
+			p.b[i] = nil
+		}
+	}
+}
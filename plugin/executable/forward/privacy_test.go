@@ -0,0 +1,73 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/dnsutils"
+	"github.com/miekg/dns"
+)
+
+func Test_queryPayloads(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	q.IsEdns0().Option = append(q.IsEdns0().Option,
+		&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.IPv4(192, 0, 2, 0)},
+	)
+
+	p := queryPayloads{q: q}
+	defer p.release()
+
+	unpack := func(mode queryMode) *dns.Msg {
+		b, err := p.get(mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(*b); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	if m := unpack(0); len(m.IsEdns0().Option) != 1 {
+		t.Fatal("query without mode should not be modified")
+	}
+	if m := unpack(queryModePrivacy); len(m.IsEdns0().Option) != 0 {
+		t.Fatal("ecs should be removed")
+	}
+	b, _ := p.get(queryModePadding | queryModePrivacy)
+	if len(*b)%dnsutils.QueryPaddingBlockSize != 0 {
+		t.Fatalf("query is not padded, length %d", len(*b))
+	}
+	if m := unpack(queryModePadding | queryModePrivacy); m.IsEdns0().Option[0].Option() != dns.EDNS0PADDING {
+		t.Fatal("padded query should only have the padding option")
+	}
+	if len(q.IsEdns0().Option) != 1 {
+		t.Fatal("original query should not be modified")
+	}
+
+	if paddingAvailable("udp://1.1.1.1") || paddingAvailable("1.1.1.1") || !paddingAvailable("tls://1.1.1.1") {
+		t.Fatal("unexpected paddingAvailable result")
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream/transport"
+	"github.com/go-chi/chi/v5"
+)
+
+// upstreamStats is the api output of an upstream.
+type upstreamStats struct {
+	Tag       string  `json:"tag,omitempty"`
+	Addr      string  `json:"addr"`
+	Healthy   bool    `json:"healthy"`
+	InFlight  int     `json:"in_flight"`
+	RTTMs     float64 `json:"rtt_ms"` // Moving average. 0 if no response yet.
+	LastError string  `json:"last_error,omitempty"`
+	// LastErrorTime is a RFC 3339 time. Empty if no error.
+	LastErrorTime string `json:"last_error_time,omitempty"`
+
+	// Pool is nil if the upstream does not have a connection pool. (e.g. doh)
+	Pool *poolStats `json:"pool,omitempty"`
+}
+
+type poolStats struct {
+	transport.Stats
+	// PipelineUsage is InFlight / PipelineCapacity. 0 if the capacity is unknown.
+	PipelineUsage float64 `json:"pipeline_usage"`
+}
+
+func (uw *upstreamWrapper) stats(now time.Time) upstreamStats {
+	s := upstreamStats{
+		Tag:      uw.cfg.Tag,
+		Addr:     uw.cfg.Addr,
+		Healthy:  uw.health.healthy(now),
+		InFlight: int(uw.inFlight.Load()),
+		RTTMs:    uw.health.latency(),
+	}
+	uw.errM.Lock()
+	if uw.lastErr != nil {
+		s.LastError = uw.lastErr.Error()
+		s.LastErrorTime = uw.lastErrAt.Format(time.RFC3339)
+	}
+	uw.errM.Unlock()
+
+	if sr, ok := uw.u.(upstream.StatsReporter); ok {
+		ps := &poolStats{Stats: sr.Stats()}
+		if ps.PipelineCapacity > 0 {
+			ps.PipelineUsage = float64(ps.InFlight) / float64(ps.PipelineCapacity)
+		}
+		s.Pool = ps
+	}
+	return s
+}
+
+func (f *Forward) statsReport() []upstreamStats {
+	now := time.Now()
+	r := make([]upstreamStats, 0, len(f.us))
+	for _, uw := range f.us {
+		r = append(r, uw.stats(now))
+	}
+	return r
+}
+
+func (f *Forward) Api() *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/stats", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f.statsReport()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	return r
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
+	"github.com/miekg/dns"
+)
+
+func Test_Forward_Api_stats(t *testing.T) {
+	bad := &dummyUpstream{err: errors.New("dial failed")}
+	good := &dummyUpstream{rcode: dns.RcodeSuccess}
+	f := newDummyForward(&Args{Retries: 1}, bad, good)
+
+	// A real upstream with a connection pool.
+	u, err := upstream.NewUpstream("tcp://127.0.0.1:53", upstream.Opt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uw := newWrapper(2, UpstreamConfig{Addr: "tcp://127.0.0.1:53", Priority: 2, Timeout: 1000}, "")
+	uw.health = newUpstreamHealth(HealthCheckConfig{})
+	uw.u = u
+	f.us = append(f.us, uw)
+	defer f.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if _, err := f.exchange(context.Background(), query_context.NewContext(q), f.us); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	f.Api().ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	var stats []upstreamStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 3 {
+		t.Fatalf("want 3 upstreams, got %d", len(stats))
+	}
+	if stats[0].LastError != "dial failed" || len(stats[0].LastErrorTime) == 0 {
+		t.Fatalf("unexpected stats of the bad upstream %+v", stats[0])
+	}
+	if stats[1].LastError != "" || stats[1].RTTMs < 0 || stats[1].Pool != nil {
+		t.Fatalf("unexpected stats of the good upstream %+v", stats[1])
+	}
+	if stats[2].Pool == nil {
+		t.Fatal("tcp upstream should report pool stats")
+	}
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+var errSPKIPinMismatch = errors.New("no certificate matches the spki pins")
+
+// newTLSConfig builds the tls.Config for tls, https, h3 and quic upstreams.
+func newTLSConfig(c *UpstreamConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		ClientSessionCache: tls.NewLRUClientSessionCache(4),
+		ServerName:         c.ServerName,
+	}
+
+	if len(c.CAFile) > 0 {
+		pool, err := utils.LoadCertPool([]string{c.CAFile})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ca file, %w", err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(c.ClientCert) > 0 || len(c.ClientKey) > 0 {
+		if len(c.ClientCert) == 0 || len(c.ClientKey) == 0 {
+			return nil, errors.New("client_cert and client_key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client cert, %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(c.SPKIPins) > 0 {
+		pins := make(map[[sha256.Size]byte]struct{}, len(c.SPKIPins))
+		for _, s := range c.SPKIPins {
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid spki pin %s", s)
+			}
+			pins[[sha256.Size]byte(b)] = struct{}{}
+		}
+		// VerifyConnection is called after the normal verification, or
+		// is the only verification if InsecureSkipVerify is set.
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			for _, cert := range cs.PeerCertificates {
+				if _, ok := pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)]; ok {
+					return nil
+				}
+			}
+			return errSPKIPinMismatch
+		}
+	}
+	return tlsConfig, nil
+}
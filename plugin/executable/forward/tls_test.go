@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package fastforward
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+func writeCertFiles(t *testing.T, name string, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	kb, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: kb}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func Test_newTLSConfig(t *testing.T) {
+	serverCert, err := utils.GenerateCertificate("internal.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := utils.GenerateCertificate("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile, _ := writeCertFiles(t, "server", serverCert)
+	clientCertFile, clientKeyFile := writeCertFiles(t, "client", clientCert)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_ = c.(*tls.Conn).Handshake()
+				_, _ = c.Read(make([]byte, 1))
+			}()
+		}
+	}()
+
+	handshake := func(c *UpstreamConfig) error {
+		tlsConfig, err := newTLSConfig(c)
+		if err != nil {
+			return err
+		}
+		conn, err := tls.Dial("tcp", l.Addr().String(), tlsConfig)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// With tls 1.3, client cert is rejected after the client handshake.
+		_ = conn.SetDeadline(time.Now().Add(time.Millisecond * 200))
+		if _, err := conn.Read(make([]byte, 1)); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return err
+		}
+		return nil
+	}
+
+	leaf, _ := x509.ParseCertificate(serverCert.Certificate[0])
+	pin := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	goodPin := base64.StdEncoding.EncodeToString(pin[:])
+	badPin := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	base := UpstreamConfig{CAFile: caFile, ClientCert: clientCertFile, ClientKey: clientKeyFile, ServerName: "internal.test"}
+	tests := []struct {
+		name    string
+		modify  func(c *UpstreamConfig)
+		wantErr bool
+	}{
+		{name: "mtls", modify: func(c *UpstreamConfig) {}},
+		{name: "no client cert", modify: func(c *UpstreamConfig) { c.ClientCert, c.ClientKey = "", "" }, wantErr: true},
+		{name: "wrong server name", modify: func(c *UpstreamConfig) { c.ServerName = "other.test" }, wantErr: true},
+		{name: "no ca", modify: func(c *UpstreamConfig) { c.CAFile = "" }, wantErr: true},
+		{name: "good pin", modify: func(c *UpstreamConfig) { c.SPKIPins = []string{badPin, goodPin} }},
+		{name: "bad pin", modify: func(c *UpstreamConfig) { c.SPKIPins = []string{badPin} }, wantErr: true},
+		{name: "pin only", modify: func(c *UpstreamConfig) {
+			c.CAFile, c.InsecureSkipVerify, c.SPKIPins = "", true, []string{goodPin}
+		}},
+		{name: "key without cert", modify: func(c *UpstreamConfig) { c.ClientCert = "" }, wantErr: true},
+		{name: "invalid pin", modify: func(c *UpstreamConfig) { c.SPKIPins = []string{"abc"} }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := base
+			tt.modify(&c)
+			err := handshake(&c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
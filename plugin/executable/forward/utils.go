@@ -21,6 +21,8 @@ package fastforward
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
@@ -34,6 +36,7 @@ type upstreamWrapper struct {
 	idx             int
 	u               upstream.Upstream
 	cfg             UpstreamConfig
+	health          *upstreamHealth
 	queryTotal      prometheus.Counter
 	errTotal        prometheus.Counter
 	thread          prometheus.Gauge
@@ -41,6 +44,12 @@ type upstreamWrapper struct {
 
 	connOpened prometheus.Counter
 	connClosed prometheus.Counter
+	healthy    prometheus.GaugeFunc
+
+	inFlight  atomic.Int32
+	errM      sync.Mutex
+	lastErr   error
+	lastErrAt time.Time
 }
 
 func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
@@ -56,7 +65,8 @@ func (uw *upstreamWrapper) OnEvent(typ upstream.Event) {
 // Note: upstreamWrapper.u still needs to be set.
 func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper {
 	lb := map[string]string{"upstream": cfg.Tag, "tag": pluginTag}
-	return &upstreamWrapper{
+	uw := &upstreamWrapper{
+		idx: idx,
 		cfg: cfg,
 		queryTotal: prometheus.NewCounter(prometheus.CounterOpts{
 			Name:        "query_total",
@@ -91,6 +101,17 @@ func newWrapper(idx int, cfg UpstreamConfig, pluginTag string) *upstreamWrapper
 			ConstLabels: lb,
 		}),
 	}
+	uw.healthy = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "healthy",
+		Help:        "Whether this upstream is healthy (1) or ejected (0)",
+		ConstLabels: lb,
+	}, func() float64 {
+		if uw.health == nil || uw.health.healthy(time.Now()) {
+			return 1
+		}
+		return 0
+	})
+	return uw
 }
 
 func (uw *upstreamWrapper) registerMetricsTo(r prometheus.Registerer) error {
@@ -101,6 +122,7 @@ func (uw *upstreamWrapper) registerMetricsTo(r prometheus.Registerer) error {
 		uw.responseLatency,
 		uw.connOpened,
 		uw.connClosed,
+		uw.healthy,
 	} {
 		if err := r.Register(collector); err != nil {
 			return err
@@ -118,16 +140,25 @@ func (uw *upstreamWrapper) name() string {
 	return uw.cfg.Addr
 }
 
+func (uw *upstreamWrapper) timeout() time.Duration {
+	return time.Duration(uw.cfg.Timeout) * time.Millisecond
+}
+
 func (uw *upstreamWrapper) ExchangeContext(ctx context.Context, m []byte) (*[]byte, error) {
 	uw.queryTotal.Inc()
 
 	start := time.Now()
 	uw.thread.Inc()
+	uw.inFlight.Add(1)
 	r, err := uw.u.ExchangeContext(ctx, m)
+	uw.inFlight.Add(-1)
 	uw.thread.Dec()
 
 	if err != nil {
 		uw.errTotal.Inc()
+		uw.errM.Lock()
+		uw.lastErr, uw.lastErrAt = err, time.Now()
+		uw.errM.Unlock()
 	} else {
 		uw.responseLatency.Observe(float64(time.Since(start).Milliseconds()))
 	}
@@ -30,6 +30,7 @@ import (
 	"github.com/IrineSistiana/mosdns/v5/pkg/rate_limiter"
 	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
 	"golang.org/x/time/rate"
 )
 
@@ -62,6 +63,7 @@ func (args *Args) init() error {
 }
 
 var _ sequence.Matcher = (*RateLimiter)(nil)
+var _ sequence.Executable = (*RateLimiter)(nil)
 var _ io.Closer = (*RateLimiter)(nil)
 
 type RateLimiter struct {
@@ -90,6 +92,19 @@ func (s *RateLimiter) Match(ctx context.Context, qCtx *query_context.Context) (b
 	return true, nil
 }
 
+// Exec implements sequence.Executable. If the client exceeds the limit,
+// it sets a REFUSED response with an extended dns error.
+func (s *RateLimiter) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	if ok, _ := s.Match(ctx, qCtx); ok {
+		return nil
+	}
+	r := new(dns.Msg)
+	r.SetRcode(qCtx.Q(), dns.RcodeRefused)
+	qCtx.SetResponse(r)
+	qCtx.AddEDE(dns.ExtendedErrorCodeOther, "rate limited")
+	return nil
+}
+
 func (s *RateLimiter) getMaskedClientAddr(qCtx *query_context.Context) netip.Addr {
 	a := qCtx.ServerMeta.ClientAddr
 	if !a.IsValid() {
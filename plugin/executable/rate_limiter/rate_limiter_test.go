@@ -0,0 +1,82 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rate_limiter
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/miekg/dns"
+)
+
+func newQCtx() *query_context.Context {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	q.SetEdns0(1232, false)
+	qCtx := query_context.NewContext(q)
+	qCtx.ServerMeta.ClientAddr = netip.MustParseAddr("192.0.2.1")
+	return qCtx
+}
+
+func Test_RateLimiter(t *testing.T) {
+	l, err := New(Args{Qps: 0.001, Burst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	ctx := context.Background()
+
+	// Match has no side effect.
+	qCtx := newQCtx()
+	if ok, _ := l.Match(ctx, qCtx); !ok {
+		t.Fatal("first query should be allowed")
+	}
+	if ok, _ := l.Match(ctx, qCtx); ok {
+		t.Fatal("second query should be limited")
+	}
+	if qCtx.R() != nil || len(qCtx.RespOpt().Option) != 0 {
+		t.Fatal("match should not modify the query context")
+	}
+
+	// Exec refuses limited queries with an ede.
+	qCtx = newQCtx()
+	if err := l.Exec(ctx, qCtx); err != nil {
+		t.Fatal(err)
+	}
+	r := qCtx.R()
+	if r == nil || r.Rcode != dns.RcodeRefused {
+		t.Fatalf("want refused, got %v", r)
+	}
+	if len(qCtx.RespOpt().Option) != 1 {
+		t.Fatal("want an ede")
+	}
+
+	// Other clients are not limited.
+	qCtx = newQCtx()
+	qCtx.ServerMeta.ClientAddr = netip.MustParseAddr("198.51.100.1")
+	if err := l.Exec(ctx, qCtx); err != nil {
+		t.Fatal(err)
+	}
+	if qCtx.R() != nil {
+		t.Fatal("query should not be refused")
+	}
+}
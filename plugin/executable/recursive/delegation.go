@@ -0,0 +1,152 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursive
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxDelegationTTL caps the cache time of a delegation.
+const maxDelegationTTL = time.Hour * 24
+
+// delegation is a zone cut and its name servers.
+type delegation struct {
+	zone    string
+	nsNames []string
+	expire  time.Time
+
+	m sync.Mutex
+	// addrs are the addresses of name servers, from glue or resolved.
+	// An empty (but non-nil) entry means the name server has been
+	// resolved but has no address.
+	addrs map[string][]netip.Addr
+}
+
+func newDelegation(zone string, expire time.Time) *delegation {
+	return &delegation{
+		zone:   zone,
+		expire: expire,
+		addrs:  make(map[string][]netip.Addr),
+	}
+}
+
+func (d *delegation) addNS(name string) {
+	name = dns.CanonicalName(name)
+	for _, n := range d.nsNames {
+		if n == name {
+			return
+		}
+	}
+	d.nsNames = append(d.nsNames, name)
+}
+
+func (d *delegation) addAddr(name string, addr netip.Addr) {
+	name = dns.CanonicalName(name)
+	addr = addr.Unmap()
+	d.m.Lock()
+	defer d.m.Unlock()
+	for _, a := range d.addrs[name] {
+		if a == addr {
+			return
+		}
+	}
+	d.addrs[name] = append(d.addrs[name], addr)
+}
+
+func (d *delegation) setAddrs(name string, addrs []netip.Addr) {
+	if addrs == nil {
+		addrs = []netip.Addr{}
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.addrs[name] = addrs
+}
+
+// serverAddrs returns all known server addresses in random order.
+func (d *delegation) serverAddrs(ipv6 bool) []netip.Addr {
+	d.m.Lock()
+	defer d.m.Unlock()
+	var s []netip.Addr
+	for _, addrs := range d.addrs {
+		for _, addr := range addrs {
+			if addr.Is6() && !ipv6 {
+				continue
+			}
+			s = append(s, addr)
+		}
+	}
+	rand.Shuffle(len(s), func(i, j int) { s[i], s[j] = s[j], s[i] })
+	return s
+}
+
+// unresolvedNS returns name servers that have no known address yet,
+// in random order.
+func (d *delegation) unresolvedNS() []string {
+	d.m.Lock()
+	defer d.m.Unlock()
+	var s []string
+	for _, n := range d.nsNames {
+		if _, ok := d.addrs[n]; !ok {
+			s = append(s, n)
+		}
+	}
+	rand.Shuffle(len(s), func(i, j int) { s[i], s[j] = s[j], s[i] })
+	return s
+}
+
+// parentZone returns the parent zone of name. The parent of root is root.
+func parentZone(name string) string {
+	i, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+	return name[i:]
+}
+
+// newDelegationFromHints builds the root delegation from root hints,
+// which are NS records of the root zone and the A/AAAA records of them.
+func newDelegationFromHints(rrs []dns.RR) *delegation {
+	d := newDelegation(".", time.Time{})
+	for _, rr := range rrs {
+		if ns, ok := rr.(*dns.NS); ok && ns.Hdr.Name == "." {
+			d.addNS(ns.Ns)
+		}
+	}
+	for _, rr := range rrs {
+		var addr netip.Addr
+		switch rr := rr.(type) {
+		case *dns.A:
+			addr, _ = netip.AddrFromSlice(rr.A.To4())
+		case *dns.AAAA:
+			addr, _ = netip.AddrFromSlice(rr.AAAA)
+		default:
+			continue
+		}
+		if addr.IsValid() {
+			d.addAddr(rr.Header().Name, addr)
+		}
+	}
+	return d
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursive
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "recursive"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.Executable = (*Recursive)(nil)
+
+type Args struct {
+	// RootHints is a root hints file in zone file format.
+	// Default is the built-in hints.
+	RootHints string `yaml:"root_hints"`
+
+	// Limits. Zero means the default value.
+	MaxDepth      int `yaml:"max_depth"`      // Default is 6.
+	MaxReferrals  int `yaml:"max_referrals"`  // Default is 30.
+	MaxCNAMEs     int `yaml:"max_cnames"`     // Default is 8.
+	MaxQueries    int `yaml:"max_queries"`    // Default is 64.
+	ServerTimeout int `yaml:"server_timeout"` // In millisecond. Default is 1500.
+
+	// DisableQnameMinimisation disables RFC 9156 qname minimisation.
+	DisableQnameMinimisation bool `yaml:"disable_qname_minimisation"`
+	// IPv6 enables querying name servers over ipv6.
+	IPv6 bool `yaml:"ipv6"`
+	// CacheSize is the size of delegation cache. Default is 4096.
+	CacheSize int `yaml:"cache_size"`
+}
+
+type Recursive struct {
+	r      *Resolver
+	logger *zap.Logger
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewRecursive(args.(*Args), bp.L())
+}
+
+func NewRecursive(args *Args, logger *zap.Logger) (*Recursive, error) {
+	hints, err := loadRootHints(args.RootHints)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load root hints, %w", err)
+	}
+	r, err := NewResolver(ResolverOpts{
+		RootHints:         hints,
+		MaxDepth:          args.MaxDepth,
+		MaxReferrals:      args.MaxReferrals,
+		MaxCNAMEs:         args.MaxCNAMEs,
+		MaxQueries:        args.MaxQueries,
+		ServerTimeout:     time.Duration(args.ServerTimeout) * time.Millisecond,
+		QnameMinimisation: !args.DisableQnameMinimisation,
+		IPv6:              args.IPv6,
+		CacheSize:         args.CacheSize,
+		Logger:            logger,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Recursive{r: r, logger: logger}, nil
+}
+
+// Exec resolves the query iteratively. Only class INET is supported,
+// other queries are ignored.
+func (e *Recursive) Exec(ctx context.Context, qCtx *query_context.Context) error {
+	q := qCtx.Q()
+	question := q.Question[0]
+	if question.Qclass != dns.ClassINET {
+		return nil
+	}
+	r, err := e.r.Resolve(ctx, question)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s, %w", question.Name, err)
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+	resp.Rcode = r.Rcode
+	resp.Answer = r.Answer
+	resp.Ns = r.Ns
+	qCtx.SetResponse(resp)
+	return nil
+}
+
+func (e *Recursive) Close() error {
+	return e.r.Close()
+}
@@ -0,0 +1,528 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/concurrent_lru"
+	"github.com/IrineSistiana/mosdns/v5/pkg/pool"
+	"github.com/IrineSistiana/mosdns/v5/pkg/upstream"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMaxDepth      = 6
+	defaultMaxReferrals  = 30
+	defaultMaxCNAMEs     = 8
+	defaultMaxQueries    = 64
+	defaultServerTimeout = time.Millisecond * 1500
+	defaultCacheSize     = 4096
+	upstreamPoolSize     = 1024
+
+	// maxMinimiseCount limits the number of minimised queries of
+	// one name. See RFC 9156 2.3.
+	maxMinimiseCount = 10
+	ednsUDPSize      = 1232
+)
+
+var (
+	errTooManyQueries   = errors.New("too many queries")
+	errTooManyReferrals = errors.New("too many referrals")
+	errTooDeep          = errors.New("max recursion depth exceeded")
+	errCNAMELoop        = errors.New("cname loop or chain too long")
+	errNoServer         = errors.New("no reachable name server")
+	errUnexpectedResp   = errors.New("unexpected response")
+)
+
+type ResolverOpts struct {
+	// RootHints are NS records of the root zone and their A/AAAA records.
+	// Required.
+	RootHints []dns.RR
+
+	// MaxDepth limits the recursion depth of resolving name server addresses.
+	MaxDepth int
+	// MaxReferrals limits the number of referrals of one name.
+	MaxReferrals int
+	// MaxCNAMEs limits the length of cname chains.
+	MaxCNAMEs int
+	// MaxQueries limits the number of queries sent to name servers
+	// for one client query.
+	MaxQueries int
+	// ServerTimeout is the timeout of each query to a name server.
+	ServerTimeout time.Duration
+	// QnameMinimisation sends minimised queries as RFC 9156.
+	QnameMinimisation bool
+	// IPv6 enables ipv6 name server addresses.
+	IPv6 bool
+	// CacheSize is the size of delegation cache.
+	CacheSize int
+
+	Logger *zap.Logger
+
+	// port is the port of name servers. Default is 53. For tests only.
+	port uint16
+}
+
+func (opts *ResolverOpts) init() {
+	setDefault := func(v *int, d int) {
+		if *v <= 0 {
+			*v = d
+		}
+	}
+	setDefault(&opts.MaxDepth, defaultMaxDepth)
+	setDefault(&opts.MaxReferrals, defaultMaxReferrals)
+	setDefault(&opts.MaxCNAMEs, defaultMaxCNAMEs)
+	setDefault(&opts.MaxQueries, defaultMaxQueries)
+	setDefault(&opts.CacheSize, defaultCacheSize)
+	if opts.ServerTimeout <= 0 {
+		opts.ServerTimeout = defaultServerTimeout
+	}
+	if opts.port == 0 {
+		opts.port = 53
+	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+}
+
+// Resolver is an iterative resolver. It resolves names from root hints.
+type Resolver struct {
+	opts  ResolverOpts
+	roots *delegation
+	cache *concurrent_lru.ConcurrentLRU[string, *delegation]
+
+	upsM sync.Mutex
+	ups  *concurrent_lru.ConcurrentLRU[netip.AddrPort, upstream.Upstream]
+}
+
+func NewResolver(opts ResolverOpts) (*Resolver, error) {
+	opts.init()
+	roots := newDelegationFromHints(opts.RootHints)
+	if len(roots.nsNames) == 0 || len(roots.serverAddrs(opts.IPv6)) == 0 {
+		return nil, errors.New("root hints have no usable name server")
+	}
+	return &Resolver{
+		opts:  opts,
+		roots: roots,
+		cache: concurrent_lru.NewConecurrentLRU[string, *delegation](opts.CacheSize, nil),
+		ups: concurrent_lru.NewConecurrentLRU[netip.AddrPort, upstream.Upstream](upstreamPoolSize, func(_ netip.AddrPort, u upstream.Upstream) {
+			_ = u.Close()
+		}),
+	}, nil
+}
+
+func (s *Resolver) Close() error {
+	s.upsM.Lock()
+	defer s.upsM.Unlock()
+	s.ups.Clean(func(_ netip.AddrPort, u upstream.Upstream) bool {
+		_ = u.Close()
+		return true
+	})
+	return nil
+}
+
+// request is the state of one client query.
+type request struct {
+	queries int
+}
+
+// Resolve resolves q iteratively. The returned msg contains the answer
+// (including the cname chain), authority and rcode. Other fields are
+// not set.
+func (s *Resolver) Resolve(ctx context.Context, q dns.Question) (*dns.Msg, error) {
+	return s.resolve(ctx, new(request), dns.CanonicalName(q.Name), q.Qtype, 0)
+}
+
+func (s *Resolver) resolve(ctx context.Context, req *request, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	var chain []dns.RR
+	seen := map[string]struct{}{name: {}}
+	target := name
+	for {
+		r, zone, err := s.iterate(ctx, req, target, qtype, depth)
+		if err != nil {
+			return nil, err
+		}
+
+		resp := new(dns.Msg)
+		resp.Rcode = r.Rcode
+		resp.Ns = r.Ns
+
+		// Follow the cname chain in the response, as long as the
+		// names are in the zone of the responding server.
+		cur := target
+		next := ""
+		for {
+			ans, cname := pickAnswer(r.Answer, cur, qtype)
+			if len(ans) == 0 && len(cname) == 0 && cur != target {
+				// The in-zone target is not in the response, e.g. it
+				// is below a delegation. Resolve it again.
+				next = cur
+				break
+			}
+			if len(ans) > 0 || len(cname) == 0 {
+				chain = append(chain, ans...)
+				break
+			}
+			if len(chain) >= s.opts.MaxCNAMEs {
+				return nil, errCNAMELoop
+			}
+			chain = append(chain, findCNAME(r.Answer, cur))
+			if _, dup := seen[cname]; dup {
+				return nil, errCNAMELoop
+			}
+			seen[cname] = struct{}{}
+			if !dns.IsSubDomain(zone, cname) {
+				next = cname
+				break
+			}
+			cur = cname
+		}
+		if len(next) == 0 {
+			resp.Answer = chain
+			if len(chain) > 0 && resp.Rcode == dns.RcodeSuccess {
+				resp.Ns = nil
+			}
+			return resp, nil
+		}
+		target = next
+	}
+}
+
+// pickAnswer returns records of name and qtype in rrs. If there is none,
+// it returns the cname target of name, if any.
+func pickAnswer(rrs []dns.RR, name string, qtype uint16) ([]dns.RR, string) {
+	var ans []dns.RR
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype == qtype && strings.EqualFold(h.Name, name) {
+			ans = append(ans, rr)
+		}
+	}
+	if len(ans) > 0 || qtype == dns.TypeCNAME {
+		return ans, ""
+	}
+	if c := findCNAME(rrs, name); c != nil {
+		return nil, dns.CanonicalName(c.(*dns.CNAME).Target)
+	}
+	return nil, ""
+}
+
+func findCNAME(rrs []dns.RR, name string) dns.RR {
+	for _, rr := range rrs {
+		if c, ok := rr.(*dns.CNAME); ok && strings.EqualFold(c.Hdr.Name, name) {
+			return c
+		}
+	}
+	return nil
+}
+
+// iterate follows referrals from the closest known delegation of name
+// and returns the final response and the zone of its server.
+func (s *Resolver) iterate(ctx context.Context, req *request, name string, qtype uint16, depth int) (*dns.Msg, string, error) {
+	d := s.closestDelegation(name, qtype)
+	minimise := s.opts.QnameMinimisation
+	minimiseCount := 0
+	labels := dns.CountLabel(d.zone) + 1
+	nameLabels := dns.CountLabel(name)
+	for referrals := 0; ; {
+		qname, qt := name, qtype
+		if minimise && labels < nameLabels && minimiseCount < maxMinimiseCount {
+			idx := dns.Split(name)
+			qname, qt = name[idx[nameLabels-labels]:], dns.TypeA
+			minimiseCount++
+		}
+
+		r, err := s.queryDelegation(ctx, req, d, qname, qt, depth)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to query %s servers, %w", d.zone, err)
+		}
+		if ref := s.referral(r, d.zone, qname, qt); ref != nil {
+			referrals++
+			if referrals > s.opts.MaxReferrals {
+				return nil, "", errTooManyReferrals
+			}
+			s.cache.Add(ref.zone, ref)
+			d = ref
+			labels = dns.CountLabel(d.zone) + 1
+			continue
+		}
+		if qname != name {
+			// qname is not a zone cut. Go one label deeper, unless it does
+			// not exist or is an alias, in which case the full name is sent.
+			// See RFC 9156 3.
+			if r.Rcode == dns.RcodeSuccess && findCNAME(r.Answer, qname) == nil {
+				labels++
+			} else {
+				minimise = false
+			}
+			continue
+		}
+		return r, d.zone, nil
+	}
+}
+
+// closestDelegation returns the closest cached delegation of name.
+// DS records are served by the parent zone.
+func (s *Resolver) closestDelegation(name string, qtype uint16) *delegation {
+	n := name
+	if qtype == dns.TypeDS {
+		n = parentZone(name)
+	}
+	now := time.Now()
+	for {
+		if n == "." {
+			return s.roots
+		}
+		if d, ok := s.cache.Get(n); ok {
+			if now.Before(d.expire) {
+				return d
+			}
+			s.cache.Del(n)
+		}
+		n = parentZone(n)
+	}
+}
+
+// referral returns the delegation if r is a referral from zone to a
+// child zone of qname. Glue records are accepted if they are in zone.
+func (s *Resolver) referral(r *dns.Msg, zone, qname string, qtype uint16) *delegation {
+	if r.Rcode != dns.RcodeSuccess || len(r.Answer) > 0 {
+		return nil
+	}
+	var d *delegation
+	ttl := uint32(maxDelegationTTL / time.Second)
+	for _, rr := range r.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		child := dns.CanonicalName(ns.Hdr.Name)
+		if child == zone || !dns.IsSubDomain(zone, child) || !dns.IsSubDomain(child, qname) {
+			continue
+		}
+		if qtype == dns.TypeDS && child == qname {
+			continue // DS is served by the parent.
+		}
+		if d == nil {
+			d = newDelegation(child, time.Time{})
+		} else if d.zone != child {
+			continue
+		}
+		d.addNS(ns.Ns)
+		ttl = min(ttl, ns.Hdr.Ttl)
+	}
+	if d == nil {
+		return nil
+	}
+	d.expire = time.Now().Add(time.Duration(ttl) * time.Second)
+
+	isNS := make(map[string]struct{}, len(d.nsNames))
+	for _, n := range d.nsNames {
+		isNS[n] = struct{}{}
+	}
+	for _, rr := range r.Extra {
+		name := dns.CanonicalName(rr.Header().Name)
+		if _, ok := isNS[name]; !ok || !dns.IsSubDomain(zone, name) {
+			continue
+		}
+		switch rr := rr.(type) {
+		case *dns.A:
+			if addr, ok := netip.AddrFromSlice(rr.A.To4()); ok {
+				d.addAddr(name, addr)
+			}
+		case *dns.AAAA:
+			if addr, ok := netip.AddrFromSlice(rr.AAAA); ok {
+				d.addAddr(name, addr)
+			}
+		}
+	}
+	return d
+}
+
+// queryDelegation sends the query to the servers of d one by one until
+// a usable response is received. Addresses of name servers without glue
+// are resolved on demand.
+func (s *Resolver) queryDelegation(ctx context.Context, req *request, d *delegation, qname string, qtype uint16, depth int) (*dns.Msg, error) {
+	var lastErr error
+	try := func(addrs []netip.Addr) (*dns.Msg, error) {
+		for _, addr := range addrs {
+			r, err := s.exchange(ctx, req, addr, qname, qtype)
+			if err == nil && usableResp(r, d.zone) {
+				return r, nil
+			}
+			if err == nil {
+				err = fmt.Errorf("%w from %s, rcode %s", errUnexpectedResp, addr, dns.RcodeToString[r.Rcode])
+			}
+			s.opts.Logger.Debug("name server failed", zap.String("zone", d.zone), zap.Stringer("addr", addr), zap.Error(err))
+			if errors.Is(err, errTooManyQueries) || ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+		}
+		return nil, nil
+	}
+
+	if r, err := try(d.serverAddrs(s.opts.IPv6)); r != nil || err != nil {
+		return r, err
+	}
+
+	for _, ns := range d.unresolvedNS() {
+		// Glue is required for name servers in the zone.
+		if dns.IsSubDomain(d.zone, ns) {
+			d.setAddrs(ns, nil)
+			continue
+		}
+		if depth+1 > s.opts.MaxDepth {
+			return nil, errTooDeep
+		}
+		addrs, err := s.resolveAddrs(ctx, req, ns, depth+1)
+		if err != nil {
+			if errors.Is(err, errTooManyQueries) || ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+		d.setAddrs(ns, addrs)
+		if r, err := try(addrs); r != nil || err != nil {
+			return r, err
+		}
+	}
+	if lastErr == nil {
+		lastErr = errNoServer
+	}
+	return nil, lastErr
+}
+
+// usableResp reports whether r is an authoritative response or a referral
+// from zone to its child zone. Other responses are lame.
+func usableResp(r *dns.Msg, zone string) bool {
+	switch r.Rcode {
+	case dns.RcodeSuccess:
+		if r.Authoritative {
+			return true
+		}
+		for _, rr := range r.Ns {
+			if ns, ok := rr.(*dns.NS); ok {
+				child := dns.CanonicalName(ns.Hdr.Name)
+				if child != zone && dns.IsSubDomain(zone, child) {
+					return true
+				}
+			}
+		}
+		return false
+	case dns.RcodeNameError:
+		return r.Authoritative
+	default:
+		return false
+	}
+}
+
+// resolveAddrs resolves addresses of a name server.
+func (s *Resolver) resolveAddrs(ctx context.Context, req *request, ns string, depth int) ([]netip.Addr, error) {
+	qtypes := []uint16{dns.TypeA}
+	if s.opts.IPv6 {
+		qtypes = append(qtypes, dns.TypeAAAA)
+	}
+	var addrs []netip.Addr
+	var errs []error
+	for _, qt := range qtypes {
+		r, err := s.resolve(ctx, req, ns, qt, depth)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				if addr, ok := netip.AddrFromSlice(rr.A.To4()); ok {
+					addrs = append(addrs, addr)
+				}
+			case *dns.AAAA:
+				if addr, ok := netip.AddrFromSlice(rr.AAAA); ok {
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+	}
+	if len(addrs) == 0 && len(errs) > 0 {
+		return nil, fmt.Errorf("failed to resolve name server %s, %w", ns, errors.Join(errs...))
+	}
+	return addrs, nil
+}
+
+// exchange sends a non-recursive query to addr.
+func (s *Resolver) exchange(ctx context.Context, req *request, addr netip.Addr, qname string, qtype uint16) (*dns.Msg, error) {
+	req.queries++
+	if req.queries > s.opts.MaxQueries {
+		return nil, errTooManyQueries
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(qname, qtype)
+	q.RecursionDesired = false
+	q.SetEdns0(ednsUDPSize, false)
+	payload, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := s.getUpstream(netip.AddrPortFrom(addr, s.opts.port))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, s.opts.ServerTimeout)
+	defer cancel()
+	b, err := u.ExchangeContext(ctx, payload)
+	if err != nil {
+		return nil, err
+	}
+	defer pool.ReleaseBuf(b)
+	r := new(dns.Msg)
+	if err := r.Unpack(*b); err != nil {
+		return nil, err
+	}
+	if !r.Response || len(r.Question) != 1 || r.Question[0].Qtype != qtype || !strings.EqualFold(r.Question[0].Name, qname) {
+		return nil, fmt.Errorf("%w from %s, question mismatched", errUnexpectedResp, addr)
+	}
+	return r, nil
+}
+
+func (s *Resolver) getUpstream(ap netip.AddrPort) (upstream.Upstream, error) {
+	s.upsM.Lock()
+	defer s.upsM.Unlock()
+	if u, ok := s.ups.Get(ap); ok {
+		return u, nil
+	}
+	u, err := upstream.NewUpstream("udp://"+ap.String(), upstream.Opt{RandomQueryID: true, Logger: s.opts.Logger})
+	if err != nil {
+		return nil, err
+	}
+	s.ups.Add(ap, u)
+	return u, nil
+}
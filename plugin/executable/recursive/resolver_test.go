@@ -0,0 +1,312 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package recursive
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// stubAuth is a minimal authoritative server of one zone.
+type stubAuth struct {
+	zone string
+	rrs  []dns.RR
+
+	m       sync.Mutex
+	queries []string // qnames received
+}
+
+func newStubAuth(zone string, records ...string) *stubAuth {
+	s := &stubAuth{zone: zone}
+	for _, r := range records {
+		s.rrs = append(s.rrs, mustRR(r))
+	}
+	return s
+}
+
+func mustRR(s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		panic(err)
+	}
+	return rr
+}
+
+func (s *stubAuth) soa() dns.RR {
+	return mustRR(s.zone + " 300 IN SOA ns. mbox. 1 3600 600 86400 300")
+}
+
+func (s *stubAuth) seen(qname string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, q := range s.queries {
+		if strings.EqualFold(q, qname) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *stubAuth) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	qname, qtype := q.Question[0].Name, q.Question[0].Qtype
+	s.m.Lock()
+	s.queries = append(s.queries, qname)
+	s.m.Unlock()
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	defer w.WriteMsg(r)
+	if !dns.IsSubDomain(s.zone, qname) {
+		r.Rcode = dns.RcodeRefused
+		return
+	}
+
+	// Delegations.
+	for _, rr := range s.rrs {
+		owner := rr.Header().Name
+		if rr.Header().Rrtype == dns.TypeNS && owner != s.zone && dns.IsSubDomain(owner, qname) && !(qtype == dns.TypeDS && owner == qname) {
+			for _, rr := range s.rrs {
+				if rr.Header().Rrtype == dns.TypeNS && rr.Header().Name == owner {
+					r.Ns = append(r.Ns, rr)
+					for _, glue := range s.rrs {
+						if glue.Header().Rrtype == dns.TypeA && glue.Header().Name == rr.(*dns.NS).Ns {
+							r.Extra = append(r.Extra, glue)
+						}
+					}
+				}
+			}
+			return
+		}
+	}
+
+	r.Authoritative = true
+	name := qname
+	for i := 0; i < 8; i++ {
+		var cname *dns.CNAME
+		found := false
+		for _, rr := range s.rrs {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			if rr.Header().Rrtype == qtype {
+				r.Answer = append(r.Answer, rr)
+				found = true
+			} else if c, ok := rr.(*dns.CNAME); ok {
+				cname = c
+			}
+		}
+		if found || cname == nil {
+			break
+		}
+		r.Answer = append(r.Answer, cname)
+		name = cname.Target
+		if !dns.IsSubDomain(s.zone, name) {
+			return
+		}
+	}
+	if len(r.Answer) > 0 {
+		return
+	}
+	for _, rr := range s.rrs {
+		if dns.IsSubDomain(name, rr.Header().Name) {
+			r.Ns = []dns.RR{s.soa()} // NODATA
+			return
+		}
+	}
+	r.Rcode = dns.RcodeNameError
+	r.Ns = []dns.RR{s.soa()}
+}
+
+// startStubServers starts servers on 127.0.0.x with the same port.
+func startStubServers(t *testing.T, servers map[string]*stubAuth) uint16 {
+	t.Helper()
+	for try := 0; try < 10; try++ {
+		var conns []net.PacketConn
+		var port string
+		ok := true
+		for ip := range servers {
+			c, err := net.ListenPacket("udp", net.JoinHostPort(ip, port))
+			if err != nil {
+				ok = false
+				break
+			}
+			conns = append(conns, c)
+			if port == "" {
+				_, port, _ = net.SplitHostPort(c.LocalAddr().String())
+			}
+		}
+		if !ok {
+			for _, c := range conns {
+				c.Close()
+			}
+			continue
+		}
+		for _, c := range conns {
+			ip, _, _ := net.SplitHostPort(c.LocalAddr().String())
+			s := &dns.Server{PacketConn: c, Handler: servers[ip]}
+			go s.ActivateAndServe()
+			t.Cleanup(func() { s.Shutdown() })
+		}
+		p, _ := net.LookupPort("udp", port)
+		return uint16(p)
+	}
+	t.Fatal("failed to listen stub servers")
+	return 0
+}
+
+func newTestHierarchy(t *testing.T) (*Resolver, map[string]*stubAuth) {
+	servers := map[string]*stubAuth{
+		"127.0.0.2": newStubAuth(".",
+			"com. 3600 IN NS ns.com.",
+			"ns.com. 3600 IN A 127.0.0.3",
+			"net. 3600 IN NS ns.net.",
+			"ns.net. 3600 IN A 127.0.0.5",
+		),
+		"127.0.0.3": newStubAuth("com.",
+			"example.com. 3600 IN NS ns1.example.com.",
+			"ns1.example.com. 3600 IN A 127.0.0.4",
+			"example.com. 3600 IN DS 12345 13 2 0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			"glueless.com. 3600 IN NS ns.glueless.net.",
+		),
+		"127.0.0.4": newStubAuth("example.com.",
+			"example.com. 3600 IN NS ns1.example.com.",
+			"www.example.com. 300 IN A 192.0.2.1",
+			"alias.example.com. 300 IN CNAME www.example.com.",
+			"out.example.com. 300 IN CNAME host.glueless.com.",
+			"loop1.example.com. 300 IN CNAME loop2.example.com.",
+			"loop2.example.com. 300 IN CNAME loop1.example.com.",
+			"a.b.c.example.com. 300 IN A 192.0.2.3",
+			"sub.example.com. 3600 IN NS ns.sub.example.com.",
+			"ns.sub.example.com. 3600 IN A 127.0.0.7",
+			"deleg.example.com. 300 IN CNAME host.sub.example.com.",
+		),
+		"127.0.0.5": newStubAuth("net.",
+			"ns.glueless.net. 3600 IN A 127.0.0.6",
+		),
+		"127.0.0.6": newStubAuth("glueless.com.",
+			"host.glueless.com. 300 IN A 192.0.2.2",
+		),
+		"127.0.0.7": newStubAuth("sub.example.com.",
+			"host.sub.example.com. 300 IN A 192.0.2.4",
+		),
+	}
+	port := startStubServers(t, servers)
+	hints, err := parseRootHints(strings.NewReader(". 3600 IN NS a.root.\na.root. 3600 IN A 127.0.0.2"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewResolver(ResolverOpts{
+		RootHints:         hints,
+		QnameMinimisation: true,
+		ServerTimeout:     time.Millisecond * 500,
+		port:              port,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r, servers
+}
+
+func Test_Resolver(t *testing.T) {
+	r, servers := newTestHierarchy(t)
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		wantRcode int
+		wantAns   []string // rdata of the last answer records
+		wantErr   error
+	}{
+		{name: "a", qname: "www.example.com.", qtype: dns.TypeA, wantAns: []string{"192.0.2.1"}},
+		{name: "case", qname: "WWW.Example.COM.", qtype: dns.TypeA, wantAns: []string{"192.0.2.1"}},
+		{name: "in zone cname", qname: "alias.example.com.", qtype: dns.TypeA, wantAns: []string{"www.example.com.", "192.0.2.1"}},
+		{name: "cname to glueless zone", qname: "out.example.com.", qtype: dns.TypeA, wantAns: []string{"host.glueless.com.", "192.0.2.2"}},
+		{name: "cname to delegated child zone", qname: "deleg.example.com.", qtype: dns.TypeA, wantAns: []string{"host.sub.example.com.", "192.0.2.4"}},
+		{name: "empty non-terminal", qname: "a.b.c.example.com.", qtype: dns.TypeA, wantAns: []string{"192.0.2.3"}},
+		{name: "nodata", qname: "www.example.com.", qtype: dns.TypeAAAA},
+		{name: "nxdomain", qname: "none.example.com.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+		{name: "nxdomain tld", qname: "none.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+		{name: "ds from parent", qname: "example.com.", qtype: dns.TypeDS, wantAns: []string{"12345"}},
+		{name: "cname loop", qname: "loop1.example.com.", qtype: dns.TypeA, wantErr: errCNAMELoop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+			resp, err := r.Resolve(ctx, dns.Question{Name: tt.qname, Qtype: tt.qtype, Qclass: dns.ClassINET})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("want err %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Rcode != tt.wantRcode {
+				t.Fatalf("want rcode %d, got %d", tt.wantRcode, resp.Rcode)
+			}
+			if len(resp.Answer) != len(tt.wantAns) {
+				t.Fatalf("want %d answers, got %v", len(tt.wantAns), resp.Answer)
+			}
+			for i, want := range tt.wantAns {
+				if !strings.Contains(resp.Answer[i].String(), want) {
+					t.Fatalf("answer #%d %s does not contain %s", i, resp.Answer[i], want)
+				}
+			}
+			if len(resp.Answer) == 0 && (len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA) {
+				t.Fatalf("negative response should have a soa, got %v", resp.Ns)
+			}
+		})
+	}
+
+	// Qname minimisation: the root and the tld servers never see the full name.
+	for _, ip := range []string{"127.0.0.2", "127.0.0.3"} {
+		if servers[ip].seen("www.example.com.") {
+			t.Fatalf("server %s received the full qname", ip)
+		}
+	}
+	if !servers["127.0.0.3"].seen("example.com.") {
+		t.Fatal("minimised query is not sent")
+	}
+
+	// Delegations are cached.
+	if d, ok := r.cache.Get("example.com."); !ok || len(d.serverAddrs(false)) != 1 {
+		t.Fatal("delegation of example.com. is not cached")
+	}
+}
+
+func Test_Resolver_limits(t *testing.T) {
+	r, _ := newTestHierarchy(t)
+	r.opts.MaxQueries = 2
+	_, err := r.Resolve(context.Background(), dns.Question{Name: "out.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if !errors.Is(err, errTooManyQueries) {
+		t.Fatalf("want errTooManyQueries, got %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rpz
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/zone_file"
+	"github.com/miekg/dns"
+)
+
+type action uint8
+
+const (
+	actionLocalData action = iota
+	actionNXDOMAIN
+	actionNODATA
+	actionPassthru
+	actionDrop
+	actionTCPOnly
+)
+
+var actionNames = [...]string{"local_data", "nxdomain", "nodata", "passthru", "drop", "tcp_only"}
+
+func (a action) String() string {
+	return actionNames[a]
+}
+
+type trigger uint8
+
+const (
+	triggerClientIP trigger = iota
+	triggerQNAME
+	triggerResponseIP
+	triggerNSDNAME
+)
+
+var triggerNames = [...]string{"client_ip", "qname", "response_ip", "nsdname"}
+
+func (t trigger) String() string {
+	return triggerNames[t]
+}
+
+// rule is the policy of a trigger.
+type rule struct {
+	owner  string // owner name in the policy zone
+	action action
+	rrs    []dns.RR // local data
+}
+
+// policy is the parsed policy zone.
+// See https://datatracker.ietf.org/doc/html/draft-vixie-dnsop-dns-rpz
+type policy struct {
+	soa *dns.SOA
+
+	qname       nameRules
+	nsdname     nameRules
+	clientIP    ipRules
+	responseIP  ipRules
+	unsupported int // number of records with unsupported triggers
+}
+
+type nameRules struct {
+	exact map[string]*rule
+	wild  map[string]*rule // "*.example.com." is stored as "example.com."
+}
+
+func (r *nameRules) add(name string, ru *rule) {
+	if strings.HasPrefix(name, "*.") {
+		if r.wild == nil {
+			r.wild = make(map[string]*rule)
+		}
+		r.wild[dns.Fqdn(name[2:])] = ru
+		return
+	}
+	if r.exact == nil {
+		r.exact = make(map[string]*rule)
+	}
+	r.exact[name] = ru
+}
+
+// match matches the canonical name. Exact rules have higher priority, then
+// wildcard rules that are closer to name.
+func (r *nameRules) match(name string) *rule {
+	if ru := r.exact[name]; ru != nil {
+		return ru
+	}
+	if len(r.wild) == 0 {
+		return nil
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if ru := r.wild[name[off:]]; ru != nil {
+			return ru
+		}
+	}
+	return r.wild["."]
+}
+
+func (r *nameRules) len() int {
+	return len(r.exact) + len(r.wild)
+}
+
+type ipRules struct {
+	m    map[netip.Prefix]*rule
+	bits []int // prefix lengths in m, longest first
+}
+
+func (r *ipRules) add(p netip.Prefix, ru *rule) {
+	if r.m == nil {
+		r.m = make(map[netip.Prefix]*rule)
+	}
+	r.m[p] = ru
+	if !slices.Contains(r.bits, p.Bits()) {
+		r.bits = append(r.bits, p.Bits())
+		slices.Sort(r.bits)
+		slices.Reverse(r.bits)
+	}
+}
+
+// match returns the rule of the longest prefix that contains addr.
+func (r *ipRules) match(addr netip.Addr) *rule {
+	if len(r.m) == 0 || !addr.IsValid() {
+		return nil
+	}
+	addr = addr.Unmap()
+	for _, b := range r.bits {
+		if b > addr.BitLen() {
+			continue
+		}
+		p, _ := addr.Prefix(b)
+		if ru := r.m[p]; ru != nil {
+			return ru
+		}
+	}
+	return nil
+}
+
+// newPolicy parses the policy zone z.
+func newPolicy(z *zone_file.Zone) (*policy, error) {
+	p := &policy{soa: z.SOA()}
+	origin := z.Origin()
+
+	var owners []string
+	rrsOf := make(map[string][]dns.RR)
+	for _, rr := range z.Records() {
+		name := dns.CanonicalName(rr.Header().Name)
+		if name == origin {
+			continue // apex NS
+		}
+		if _, ok := rrsOf[name]; !ok {
+			owners = append(owners, name)
+		}
+		rrsOf[name] = append(rrsOf[name], rr)
+	}
+
+	for _, owner := range owners {
+		ru := newRule(owner, rrsOf[owner])
+		rel := strings.TrimSuffix(owner, "."+origin)
+		name, typ, _ := strings.Cut(rel, ".rpz-")
+		if len(typ) == 0 {
+			if ru.action == actionLocalData && isLegacyPassthru(rel, ru.rrs) {
+				ru.action = actionPassthru
+			}
+			p.qname.add(rel+".", ru)
+			continue
+		}
+		// The label after the trigger name must be the last one.
+		if strings.Contains(typ, ".") {
+			p.qname.add(rel+".", ru)
+			continue
+		}
+		switch typ {
+		case "client-ip", "ip":
+			prefix, err := parseIPTrigger(name)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ip trigger %s, %w", owner, err)
+			}
+			if typ == "client-ip" {
+				p.clientIP.add(prefix, ru)
+			} else {
+				p.responseIP.add(prefix, ru)
+			}
+		case "nsdname":
+			p.nsdname.add(dns.CanonicalName(name), ru)
+		default:
+			p.unsupported++
+		}
+	}
+	return p, nil
+}
+
+// newRule builds the rule from rrs of owner. See draft-vixie-dnsop-dns-rpz 3.
+func newRule(owner string, rrs []dns.RR) *rule {
+	ru := &rule{owner: owner}
+	for _, rr := range rrs {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+		switch dns.CanonicalName(cname.Target) {
+		case ".":
+			ru.action = actionNXDOMAIN
+		case "*.":
+			ru.action = actionNODATA
+		case "rpz-passthru.":
+			ru.action = actionPassthru
+		case "rpz-drop.":
+			ru.action = actionDrop
+		case "rpz-tcp-only.":
+			ru.action = actionTCPOnly
+		default:
+			continue
+		}
+		return ru
+	}
+	ru.rrs = rrs
+	return ru
+}
+
+// isLegacyPassthru reports whether rrs is a CNAME to the trigger name itself,
+// which is the legacy form of PASSTHRU.
+func isLegacyPassthru(name string, rrs []dns.RR) bool {
+	cname, ok := rrs[0].(*dns.CNAME)
+	return ok && len(rrs) == 1 && dns.CanonicalName(cname.Target) == name+"."
+}
+
+// parseIPTrigger parses the reversed ip trigger name. e.g.
+// "24.0.2.0.192" is 192.0.2.0/24, "48.zz.db8.2001" is 2001:db8::/48.
+func parseIPTrigger(s string) (netip.Prefix, error) {
+	labels := strings.Split(s, ".")
+	if len(labels) < 2 {
+		return netip.Prefix{}, fmt.Errorf("too few labels")
+	}
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid prefix length, %w", err)
+	}
+	parts := labels[1:]
+	slices.Reverse(parts)
+
+	var addr netip.Addr
+	if len(parts) == 4 && !slices.Contains(parts, "zz") {
+		addr, err = netip.ParseAddr(strings.Join(parts, "."))
+	} else {
+		for i, part := range parts {
+			if part == "zz" {
+				parts[i] = ""
+			}
+		}
+		s := strings.Join(parts, ":")
+		if strings.HasPrefix(s, ":") {
+			s = ":" + s
+		}
+		if strings.HasSuffix(s, ":") {
+			s += ":"
+		}
+		addr, err = netip.ParseAddr(s)
+	}
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if bits > addr.BitLen() {
+		return netip.Prefix{}, fmt.Errorf("invalid prefix length %d", bits)
+	}
+	return addr.Prefix(bits)
+}
@@ -0,0 +1,415 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rpz
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/pkg/zone_file"
+	"github.com/IrineSistiana/mosdns/v5/plugin/data_provider/shared"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/authoritative"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const PluginType = "rpz"
+
+func init() {
+	coremain.RegNewPluginFunc(PluginType, Init, func() any { return new(Args) })
+}
+
+var _ sequence.RecursiveExecutable = (*RPZ)(nil)
+
+type Args struct {
+	// Zones are policy zones. Earlier zones have higher precedence.
+	Zones      []ZoneArgs `yaml:"zones"`
+	AutoReload bool       `yaml:"auto_reload"`
+}
+
+type ZoneArgs struct {
+	// Origin is the policy zone name. Default is the owner of the SOA.
+	// It is required if the zone is transferred from Primary.
+	Origin string `yaml:"origin"`
+	// File is the zone file. If Primary is set, it is optional and is
+	// where the transferred zone is persisted.
+	File string `yaml:"file"`
+
+	// Primary is the address (ip:port) of the primary server. If set, the
+	// zone is transferred from the primary.
+	Primary string                 `yaml:"primary"`
+	TSIG    authoritative.TSIGArgs `yaml:"tsig"`
+}
+
+// RPZ applies response policy zones.
+// Client IP and QNAME triggers are checked before the query is
+// forwarded to the rest of the sequence, Response IP and NSDNAME triggers
+// are checked in the response. NSDNAME triggers match the NS records
+// in the response.
+type RPZ struct {
+	logger *zap.Logger
+	zones  []*policyZone
+	fw     *shared.FileWatcher
+}
+
+type policyZone struct {
+	file   string
+	origin string
+	sec    *zone_file.Secondary   // nil if the zone is loaded from file
+	p      atomic.Pointer[policy] // nil if a transferred zone is not loaded or expired
+}
+
+func Init(bp *coremain.BP, args any) (any, error) {
+	return NewRPZ(args.(*Args), bp.L())
+}
+
+func NewRPZ(args *Args, logger *zap.Logger) (*RPZ, error) {
+	r := &RPZ{logger: logger}
+	var files []string
+	for i, za := range args.Zones {
+		pz := &policyZone{file: za.File, origin: za.Origin}
+		if len(za.Primary) > 0 {
+			if len(za.Origin) == 0 {
+				return nil, fmt.Errorf("zone #%d, origin is required for transferred zones", i)
+			}
+			pz.origin = dns.CanonicalName(za.Origin)
+			sec, err := newSecondary(pz, za, logger)
+			if err != nil {
+				return nil, fmt.Errorf("invalid zone #%d %s, %w", i, za.Origin, err)
+			}
+			pz.sec = sec
+			r.zones = append(r.zones, pz)
+			continue
+		}
+
+		z, err := zone_file.LoadZoneFile(pz.file, pz.origin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load zone #%d %s, %w", i, za.File, err)
+		}
+		pz.origin = z.Origin()
+		if err := pz.store(z, logger); err != nil {
+			return nil, fmt.Errorf("failed to load zone #%d %s, %w", i, za.File, err)
+		}
+		r.zones = append(r.zones, pz)
+		if !slices.Contains(files, za.File) {
+			files = append(files, za.File)
+		}
+	}
+
+	if args.AutoReload && len(files) > 0 {
+		r.fw = shared.NewFileWatcher(logger, r.reload, 500*time.Millisecond)
+		if err := r.fw.Start(files); err != nil {
+			return nil, fmt.Errorf("failed to start file watcher: %w", err)
+		}
+	}
+	for _, pz := range r.zones {
+		if pz.sec != nil {
+			pz.sec.Start()
+		}
+	}
+	return r, nil
+}
+
+func newSecondary(pz *policyZone, args ZoneArgs, logger *zap.Logger) (*zone_file.Secondary, error) {
+	primary, err := zone_file.ParsePrimary(args.Primary)
+	if err != nil {
+		return nil, err
+	}
+	tsig, err := args.TSIG.NewTSIG()
+	if err != nil {
+		return nil, err
+	}
+	return zone_file.NewSecondary(zone_file.SecondaryOpts{
+		Origin: pz.origin,
+		Client: &zone_file.Client{Primary: primary, TSIG: tsig},
+		File:   pz.file,
+		Logger: logger,
+		OnUpdate: func(z *zone_file.Zone, _ []*zone_file.Diff) {
+			if z == nil {
+				pz.p.Store(nil)
+				return
+			}
+			if err := pz.store(z, logger); err != nil {
+				logger.Error("invalid policy zone", zap.String("zone", pz.origin), zap.Error(err))
+			}
+		},
+	}), nil
+}
+
+func (pz *policyZone) store(z *zone_file.Zone, logger *zap.Logger) error {
+	p, err := newPolicy(z)
+	if err != nil {
+		return err
+	}
+	if p.unsupported > 0 {
+		logger.Warn("policy zone has unsupported triggers", zap.String("zone", pz.origin), zap.Int("records", p.unsupported))
+	}
+	pz.p.Store(p)
+	logger.Info(
+		"policy zone loaded",
+		zap.String("zone", pz.origin),
+		zap.Uint32("serial", p.soa.Serial),
+		zap.Int("qname", p.qname.len()),
+		zap.Int("nsdname", p.nsdname.len()),
+		zap.Int("client_ip", len(p.clientIP.m)),
+		zap.Int("response_ip", len(p.responseIP.m)),
+	)
+	return nil
+}
+
+// reload reloads zones from file.
+func (r *RPZ) reload(file string) error {
+	for _, pz := range r.zones {
+		if pz.file != file || pz.sec != nil {
+			continue
+		}
+		z, err := zone_file.LoadZoneFile(pz.file, pz.origin)
+		if err != nil {
+			return fmt.Errorf("failed to reload zone from %s, %w", file, err)
+		}
+		if err := pz.store(z, r.logger); err != nil {
+			return fmt.Errorf("failed to reload zone from %s, %w", file, err)
+		}
+	}
+	return nil
+}
+
+type hit struct {
+	soa     *dns.SOA
+	trigger trigger
+	rule    *rule
+}
+
+func (r *RPZ) policies() []*policy {
+	ps := make([]*policy, 0, len(r.zones))
+	for _, pz := range r.zones {
+		if p := pz.p.Load(); p != nil {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// matchQuery checks Client IP and QNAME triggers.
+func matchQuery(p *policy, qCtx *query_context.Context) (trigger, *rule) {
+	if ru := p.clientIP.match(qCtx.ServerMeta.ClientAddr); ru != nil {
+		return triggerClientIP, ru
+	}
+	if ru := p.qname.match(dns.CanonicalName(qCtx.QQuestion().Name)); ru != nil {
+		return triggerQNAME, ru
+	}
+	return 0, nil
+}
+
+// matchResponse checks Response IP and NSDNAME triggers.
+func matchResponse(p *policy, resp *dns.Msg) (trigger, *rule) {
+	if len(p.responseIP.m) > 0 {
+		for _, rr := range resp.Answer {
+			var ru *rule
+			switch rr := rr.(type) {
+			case *dns.A:
+				ru = p.responseIP.match(addrOf(rr.A))
+			case *dns.AAAA:
+				ru = p.responseIP.match(addrOf(rr.AAAA))
+			}
+			if ru != nil {
+				return triggerResponseIP, ru
+			}
+		}
+	}
+	if p.nsdname.len() > 0 {
+		for _, section := range [][]dns.RR{resp.Answer, resp.Ns} {
+			for _, rr := range section {
+				if ns, ok := rr.(*dns.NS); ok {
+					if ru := p.nsdname.match(dns.CanonicalName(ns.Ns)); ru != nil {
+						return triggerNSDNAME, ru
+					}
+				}
+			}
+		}
+	}
+	return 0, nil
+}
+
+func hasResponseTriggers(p *policy) bool {
+	return len(p.responseIP.m) > 0 || p.nsdname.len() > 0
+}
+
+// Exec implements sequence.RecursiveExecutable. Policies are selected by
+// zone order first, then by trigger type.
+func (r *RPZ) Exec(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker) error {
+	ps := r.policies()
+	var pre *hit
+	preIdx := len(ps)
+	for i, p := range ps {
+		if t, ru := matchQuery(p, qCtx); ru != nil {
+			pre, preIdx = &hit{soa: p.soa, trigger: t, rule: ru}, i
+			break
+		}
+	}
+	// No higher precedence zone can be triggered by the response.
+	if pre != nil && !slices.ContainsFunc(ps[:preIdx], hasResponseTriggers) {
+		return r.apply(ctx, qCtx, next, pre, false)
+	}
+
+	if err := next.ExecNext(ctx, qCtx); err != nil {
+		return err
+	}
+	if resp := qCtx.R(); resp != nil {
+		for _, p := range ps[:preIdx] {
+			if t, ru := matchResponse(p, resp); ru != nil {
+				return r.apply(ctx, qCtx, next, &hit{soa: p.soa, trigger: t, rule: ru}, true)
+			}
+		}
+	}
+	if pre != nil {
+		return r.apply(ctx, qCtx, next, pre, true)
+	}
+	return nil
+}
+
+// apply applies the policy. resolved indicates whether the query was
+// forwarded to the rest of the sequence.
+func (r *RPZ) apply(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker, h *hit, resolved bool) error {
+	r.logger.Info(
+		"rpz policy hit",
+		zap.String("zone", h.soa.Hdr.Name),
+		zap.Stringer("trigger", h.trigger),
+		zap.String("rule", h.rule.owner),
+		zap.Stringer("action", h.rule.action),
+		qCtx.InfoField(),
+	)
+
+	q := qCtx.Q()
+	switch h.rule.action {
+	case actionPassthru:
+		if !resolved {
+			return next.ExecNext(ctx, qCtx)
+		}
+		return nil
+	case actionDrop:
+		qCtx.SetResponse(nil)
+		qCtx.Drop()
+		return nil
+	case actionTCPOnly:
+		if qCtx.ServerMeta.FromUDP {
+			resp := new(dns.Msg)
+			resp.SetReply(q)
+			resp.Truncated = true
+			qCtx.SetResponse(resp)
+			return nil
+		}
+		if !resolved {
+			return next.ExecNext(ctx, qCtx)
+		}
+		return nil
+	case actionNXDOMAIN, actionNODATA:
+		resp := new(dns.Msg)
+		resp.SetReply(q)
+		if h.rule.action == actionNXDOMAIN {
+			resp.Rcode = dns.RcodeNameError
+		}
+		resp.Ns = []dns.RR{negativeSOA(h.soa)}
+		qCtx.SetResponse(resp)
+		qCtx.AddEDE(dns.ExtendedErrorCodeBlocked, "")
+		return nil
+	default:
+		return r.localData(ctx, qCtx, next, h)
+	}
+}
+
+// localData answers the query with the local data of the rule. A CNAME
+// target is resolved by the rest of the sequence.
+func (r *RPZ) localData(ctx context.Context, qCtx *query_context.Context, next sequence.ChainWalker, h *hit) error {
+	q := qCtx.Q()
+	question := q.Question[0]
+	resp := new(dns.Msg)
+	resp.SetReply(q)
+
+	var cname *dns.CNAME
+	for _, rr := range h.rule.rrs {
+		typ := rr.Header().Rrtype
+		if typ != question.Qtype && typ != dns.TypeCNAME && question.Qtype != dns.TypeANY {
+			continue
+		}
+		rr = dns.Copy(rr)
+		rr.Header().Name = question.Name
+		if c, ok := rr.(*dns.CNAME); ok {
+			// "*.example." is replaced by the qname.
+			if strings.HasPrefix(c.Target, "*.") {
+				c.Target = dns.Fqdn(strings.TrimSuffix(question.Name, ".") + c.Target[1:])
+			}
+			cname = c
+		}
+		resp.Answer = append(resp.Answer, rr)
+	}
+	if len(resp.Answer) == 0 {
+		resp.Ns = []dns.RR{negativeSOA(h.soa)}
+	}
+
+	if cname != nil && question.Qtype != dns.TypeCNAME && question.Qtype != dns.TypeANY {
+		subCtx := qCtx.Copy()
+		subCtx.Q().Question[0].Name = cname.Target
+		subCtx.SetResponse(nil)
+		if err := next.ExecNext(ctx, subCtx); err != nil {
+			return err
+		}
+		if sr := subCtx.R(); sr != nil {
+			resp.Answer = append(resp.Answer, sr.Answer...)
+			resp.Rcode = sr.Rcode
+		}
+	}
+	qCtx.SetResponse(resp)
+	qCtx.AddEDE(dns.ExtendedErrorCodeForgedAnswer, "")
+	return nil
+}
+
+func addrOf(ip net.IP) netip.Addr {
+	addr, _ := netip.AddrFromSlice(ip)
+	return addr
+}
+
+func negativeSOA(soa *dns.SOA) dns.RR {
+	s := dns.Copy(soa).(*dns.SOA)
+	s.Hdr.Ttl = min(s.Hdr.Ttl, s.Minttl)
+	return s
+}
+
+// Close stops transferred zones and the optional file watcher.
+func (r *RPZ) Close() error {
+	for _, pz := range r.zones {
+		if pz.sec != nil {
+			pz.sec.Close()
+		}
+	}
+	if r.fw != nil {
+		return r.fw.Close()
+	}
+	return nil
+}
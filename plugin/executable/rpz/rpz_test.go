@@ -0,0 +1,204 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package rpz
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/pkg/query_context"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+const (
+	testZone = `
+$ORIGIN rpz.local.
+@                             SOA   localhost. root.localhost. 1 3600 600 86400 60
+@                             NS    localhost.
+nx.example                    CNAME .
+nodata.example                CNAME *.
+*.wild.example                CNAME .
+pass.wild.example             CNAME rpz-passthru.
+drop.example                  CNAME rpz-drop.
+tcp.example                   CNAME rpz-tcp-only.
+local.example                 A     10.0.0.1
+local.example                 TXT   "blocked"
+alias.example                 CNAME target.example.
+*.garden.example              CNAME *.walled.example.
+32.9.0.0.10.rpz-client-ip     CNAME .
+48.zz.db8.2001.rpz-client-ip  CNAME rpz-drop.
+24.0.100.51.198.rpz-ip        CNAME *.
+ns1.evil.example.rpz-nsdname  CNAME .
+`
+	// A lower precedence zone.
+	testZone2 = `
+$ORIGIN rpz2.local.
+@                  SOA   localhost. root.localhost. 1 3600 600 86400 60
+@                  NS    localhost.
+bad-ip.example     A     10.0.0.2
+`
+)
+
+// upstream answers A queries with 192.0.2.1, except bad-ip.example. and
+// evil-ns.example.
+type upstream struct {
+	calls int
+}
+
+func (u *upstream) Exec(_ context.Context, qCtx *query_context.Context) error {
+	u.calls++
+	q := qCtx.Q()
+	r := new(dns.Msg)
+	r.SetReply(q)
+	name := q.Question[0].Name
+	ip := net.IPv4(192, 0, 2, 1)
+	switch name {
+	case "bad-ip.example.":
+		ip = net.IPv4(198, 51, 100, 1)
+	case "evil-ns.example.":
+		r.Ns = append(r.Ns, &dns.NS{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 300}, Ns: "ns1.evil.example."})
+	}
+	r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300}, A: ip})
+	qCtx.SetResponse(r)
+	return nil
+}
+
+func writeFile(t *testing.T, name, s string) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(f, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func Test_RPZ(t *testing.T) {
+	r, err := NewRPZ(&Args{Zones: []ZoneArgs{
+		{File: writeFile(t, "rpz", testZone)},
+		{File: writeFile(t, "rpz2", testZone2)},
+	}}, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	tests := []struct {
+		name         string
+		qname        string
+		qtype        uint16
+		client       string
+		udp          bool
+		wantRcode    int
+		wantDrop     bool
+		wantTC       bool
+		wantAns      []string // answers contain
+		wantUpstream int
+	}{
+		{name: "no hit", qname: "www.example.", qtype: dns.TypeA, wantAns: []string{"192.0.2.1"}, wantUpstream: 1},
+		{name: "nxdomain", qname: "nx.example.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+		{name: "nodata", qname: "nodata.example.", qtype: dns.TypeA},
+		{name: "wildcard", qname: "a.b.wild.example.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+		{name: "wildcard not apex", qname: "wild.example.", qtype: dns.TypeA, wantAns: []string{"192.0.2.1"}, wantUpstream: 1},
+		{name: "passthru", qname: "pass.wild.example.", qtype: dns.TypeA, wantAns: []string{"192.0.2.1"}, wantUpstream: 1},
+		{name: "drop", qname: "drop.example.", qtype: dns.TypeA, wantDrop: true},
+		{name: "tcp only udp", qname: "tcp.example.", qtype: dns.TypeA, udp: true, wantTC: true},
+		{name: "tcp only tcp", qname: "tcp.example.", qtype: dns.TypeA, wantAns: []string{"192.0.2.1"}, wantUpstream: 1},
+		{name: "local data", qname: "local.example.", qtype: dns.TypeA, wantAns: []string{"local.example.\t3600\tIN\tA\t10.0.0.1"}},
+		{name: "local data txt", qname: "local.example.", qtype: dns.TypeTXT, wantAns: []string{"blocked"}},
+		{name: "local data nodata", qname: "local.example.", qtype: dns.TypeAAAA},
+		{name: "local cname", qname: "alias.example.", qtype: dns.TypeA, wantAns: []string{"target.example.", "192.0.2.1"}, wantUpstream: 1},
+		{name: "wildcard cname", qname: "x.garden.example.", qtype: dns.TypeA, wantAns: []string{"x.garden.example.walled.example.", "192.0.2.1"}, wantUpstream: 1},
+		{name: "client ip", qname: "www.example.", qtype: dns.TypeA, client: "10.0.0.9", wantRcode: dns.RcodeNameError},
+		{name: "client ipv6", qname: "www.example.", qtype: dns.TypeA, client: "2001:db8::1", wantDrop: true},
+		{name: "response ip", qname: "bad-ip.example.", qtype: dns.TypeA, wantUpstream: 1},
+		{name: "nsdname", qname: "evil-ns.example.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError, wantUpstream: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := new(upstream)
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qname, tt.qtype)
+			qCtx := query_context.NewContext(q)
+			qCtx.ServerMeta.FromUDP = tt.udp
+			if len(tt.client) > 0 {
+				qCtx.ServerMeta.ClientAddr = netip.MustParseAddr(tt.client)
+			}
+			walker := sequence.NewChainWalker([]*sequence.ChainNode{{E: u}}, nil)
+			if err := r.Exec(context.Background(), qCtx, walker); err != nil {
+				t.Fatal(err)
+			}
+			if u.calls != tt.wantUpstream {
+				t.Fatalf("want %d upstream calls, got %d", tt.wantUpstream, u.calls)
+			}
+			if qCtx.Dropped() != tt.wantDrop {
+				t.Fatalf("want drop %v, got %v", tt.wantDrop, qCtx.Dropped())
+			}
+			if tt.wantDrop {
+				return
+			}
+			resp := qCtx.R()
+			if resp.Rcode != tt.wantRcode || resp.Truncated != tt.wantTC {
+				t.Fatalf("unexpected response %v", resp)
+			}
+			if len(resp.Answer) != len(tt.wantAns) {
+				t.Fatalf("want %d answers, got %v", len(tt.wantAns), resp.Answer)
+			}
+			for i, s := range tt.wantAns {
+				if !strings.Contains(resp.Answer[i].String(), s) {
+					t.Fatalf("answer %s does not contain %s", resp.Answer[i], s)
+				}
+			}
+			if len(resp.Answer) == 0 && !tt.wantTC && (len(resp.Ns) != 1 || resp.Ns[0].Header().Ttl != 60) {
+				t.Fatalf("want the policy soa in authority, got %v", resp.Ns)
+			}
+		})
+	}
+}
+
+func Test_parseIPTrigger(t *testing.T) {
+	tests := map[string]string{
+		"32.1.0.0.127":      "127.0.0.1/32",
+		"24.0.2.0.192":      "192.0.2.0/24",
+		"128.1.zz.db8.2001": "2001:db8::1/128",
+		"48.zz.db8.2001":    "2001:db8::/48",
+		"128.1.zz":          "::1/128",
+	}
+	for s, want := range tests {
+		p, err := parseIPTrigger(s)
+		if err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+		if p.String() != want {
+			t.Fatalf("%s: want %s, got %s", s, want, p)
+		}
+	}
+	for _, s := range []string{"33.1.0.0.127", "x.1.0.0.127", "32"} {
+		if _, err := parseIPTrigger(s); err == nil {
+			t.Fatalf("%s: want err", s)
+		}
+	}
+}
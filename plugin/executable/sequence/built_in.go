@@ -50,6 +50,9 @@ func (a ActionReject) Exec(_ context.Context, qCtx *query_context.Context, _ Cha
 	r.SetReply(qCtx.Q())
 	r.Rcode = a.Rcode
 	qCtx.SetResponse(r)
+	if a.Rcode == dns.RcodeRefused || a.Rcode == dns.RcodeNameError {
+		qCtx.AddEDE(dns.ExtendedErrorCodeBlocked, "")
+	}
 	return nil
 }
 
@@ -197,3 +197,27 @@ func Test_sequence_Exec(t *testing.T) {
 		})
 	}
 }
+
+func Test_ActionReject_EDE(t *testing.T) {
+	for rcode, wantEDE := range map[int]bool{
+		dns.RcodeRefused:        true,
+		dns.RcodeNameError:      true,
+		dns.RcodeServerFailure:  false,
+		dns.RcodeNotImplemented: false,
+	} {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		q.SetEdns0(1232, false)
+		qCtx := query_context.NewContext(q)
+		if err := (ActionReject{Rcode: rcode}).Exec(context.Background(), qCtx, ChainWalker{}); err != nil {
+			t.Fatal(err)
+		}
+		if qCtx.R().Rcode != rcode {
+			t.Fatalf("want rcode %d, got %d", rcode, qCtx.R().Rcode)
+		}
+		hasEDE := len(qCtx.RespOpt().Option) > 0
+		if hasEDE != wantEDE {
+			t.Fatalf("rcode %d: want ede %v, got %v", rcode, wantEDE, hasEDE)
+		}
+	}
+}
@@ -51,9 +51,16 @@ func (m *Matcher) Match(_ context.Context, qCtx *query_context.Context) (matched
 }
 
 func NewMatcher(bq sequence.BQ, args *Args, f MatchFunc) (m *Matcher, err error) {
-	m = &Matcher{
-		match: f,
+	mg, err := NewIPMatcher(bq, args)
+	if err != nil {
+		return nil, err
 	}
+	return &Matcher{match: f, mg: mg}, nil
+}
+
+// NewIPMatcher builds an ip matcher from ip_sets, ips and files in args.
+func NewIPMatcher(bq sequence.BQ, args *Args) (ip_set.MatcherGroup, error) {
+	var mg ip_set.MatcherGroup
 
 	// Acquire lists from other plugins or files.
 	for _, tag := range args.IPSets {
@@ -63,7 +70,7 @@ func NewMatcher(bq sequence.BQ, args *Args, f MatchFunc) (m *Matcher, err error)
 			return nil, fmt.Errorf("cannot find ipset %s", tag)
 		}
 		l := provider.GetIPMatcher()
-		m.mg = append(m.mg, l)
+		mg = append(mg, l)
 	}
 
 	// Anonymous set from plugin's args and files.
@@ -74,11 +81,10 @@ func NewMatcher(bq sequence.BQ, args *Args, f MatchFunc) (m *Matcher, err error)
 		}
 		anonymousList.Sort()
 		if anonymousList.Len() > 0 {
-			m.mg = append(m.mg, anonymousList)
+			mg = append(mg, anonymousList)
 		}
 	}
-
-	return m, nil
+	return mg, nil
 }
 
 // ParseQuickSetupArgs parses expressions and "ip_set"s to args.
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
 	"time"
 
@@ -51,6 +52,10 @@ type Args struct {
 	Cert        string `yaml:"cert"`
 	Key         string `yaml:"key"`
 	IdleTimeout int    `yaml:"idle_timeout"`
+
+	// TrustedProxies are ips/cidrs of proxies that src_ip_header is read
+	// from. If set, the rightmost untrusted address in the header is used.
+	TrustedProxies []string `yaml:"trusted_proxies"`
 }
 
 func (a *Args) init() {
@@ -72,6 +77,15 @@ func Init(bp *coremain.BP, args any) (any, error) {
 }
 
 func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
+	var trustedProxies []netip.Prefix
+	for _, s := range args.TrustedProxies {
+		p, err := utils.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s, %w", s, err)
+		}
+		trustedProxies = append(trustedProxies, p)
+	}
+
 	mux := http.NewServeMux()
 	for _, entry := range args.Entries {
 		dh, err := server_utils.NewHandler(bp, entry.Exec)
@@ -80,6 +94,7 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 		}
 		hhOpts := server.HttpHandlerOpts{
 			GetSrcIPFromHeader: args.SrcIPHeader,
+			TrustedProxies:     trustedProxies,
 			Logger:             bp.L(),
 		}
 		hh := server.NewHttpHandler(dh, hhOpts)
@@ -101,6 +116,13 @@ func StartServer(bp *coremain.BP, args *Args) (*HttpServer, error) {
 		return nil, fmt.Errorf("failed to listen socket, %w", err)
 	}
 	bp.L().Info("http server started", zap.Stringer("addr", l.Addr()))
+	if len(args.Key)+len(args.Cert) > 0 && listenerNetwork == "tcp" {
+		for _, entry := range args.Entries {
+			if err := server_utils.RegDDREndpoint(bp, l.Addr(), args.Cert, []string{"h2"}, entry.Path+"{?dns}"); err != nil {
+				bp.L().Warn("failed to register ddr endpoint", zap.Error(err))
+			}
+		}
+	}
 
 	hs := &http.Server{
 		Handler:        mux,
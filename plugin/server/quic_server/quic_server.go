@@ -118,6 +118,9 @@ func StartServer(bp *coremain.BP, args *Args) (*QuicServer, error) {
 		return nil, fmt.Errorf("failed to listen quic, %w", err)
 	}
 	bp.L().Info("quic server started", zap.Stringer("addr", quicListener.Addr()))
+	if err := server_utils.RegDDREndpoint(bp, quicListener.Addr(), args.Cert, []string{"doq"}, ""); err != nil {
+		bp.L().Warn("failed to register ddr endpoint", zap.Error(err))
+	}
 
 	go func() {
 		defer quicListener.Close()
@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_utils
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/server_handler"
+)
+
+// ddrReg holds the encrypted endpoints of each mosdns instance.
+var ddrReg struct {
+	sync.RWMutex
+	m map[*coremain.Mosdns][]server_handler.DDREndpoint
+}
+
+// RegDDREndpoint registers an encrypted endpoint of the server. Handlers
+// from NewHandler will answer the DDR query with all registered endpoints.
+// The alpn and port are from the listener address addr. Target is the
+// first dns name of the certificate in certFile.
+func RegDDREndpoint(bp *coremain.BP, addr net.Addr, certFile string, alpn []string, dohPath string) error {
+	ep := server_handler.DDREndpoint{ALPN: alpn, DoHPath: dohPath}
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ep.Port = uint16(a.Port)
+		ep.Addr = a.AddrPort().Addr().Unmap()
+	case *net.UDPAddr:
+		ep.Port = uint16(a.Port)
+		ep.Addr = a.AddrPort().Addr().Unmap()
+	default:
+		return fmt.Errorf("unsupported listener address %s", addr)
+	}
+	target, err := certDNSName(certFile)
+	if err != nil {
+		return err
+	}
+	ep.Target = target
+
+	m := bp.M()
+	ddrReg.Lock()
+	defer ddrReg.Unlock()
+	if ddrReg.m == nil {
+		ddrReg.m = make(map[*coremain.Mosdns][]server_handler.DDREndpoint)
+	}
+	if _, ok := ddrReg.m[m]; !ok {
+		m.GetSafeClose().Attach(func(done func(), closeSignal <-chan struct{}) {
+			go func() {
+				defer done()
+				<-closeSignal
+				ddrReg.Lock()
+				delete(ddrReg.m, m)
+				ddrReg.Unlock()
+			}()
+		})
+	}
+	ddrReg.m[m] = append(ddrReg.m[m], ep)
+	return nil
+}
+
+func ddrEndpoints(m *coremain.Mosdns) []server_handler.DDREndpoint {
+	ddrReg.RLock()
+	defer ddrReg.RUnlock()
+	return ddrReg.m[m]
+}
+
+// certDNSName returns the first dns name of the leaf certificate in the pem file.
+func certDNSName(certFile string) (string, error) {
+	b, err := os.ReadFile(certFile)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", errors.New("no certificate in pem file")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("invalid certificate, %w", err)
+	}
+	if len(cert.DNSNames) == 0 {
+		return "", errors.New("certificate has no dns name")
+	}
+	return cert.DNSNames[0], nil
+}
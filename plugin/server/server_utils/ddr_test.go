@@ -0,0 +1,108 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server_utils
+
+import (
+	"encoding/pem"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/IrineSistiana/mosdns/v5/coremain"
+	"github.com/IrineSistiana/mosdns/v5/pkg/utils"
+)
+
+func writePem(t *testing.T, blockType string, b []byte) string {
+	t.Helper()
+	f := filepath.Join(t.TempDir(), "cert.pem")
+	if err := os.WriteFile(f, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: b}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func Test_certDNSName(t *testing.T) {
+	cert, err := utils.GenerateCertificate("dns.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := certDNSName(writePem(t, "CERTIFICATE", cert.Certificate[0]))
+	if err != nil || name != "dns.example.com" {
+		t.Fatalf("want dns.example.com, got %s, %v", name, err)
+	}
+
+	for _, f := range []string{
+		filepath.Join(t.TempDir(), "missing.pem"),
+		writePem(t, "PRIVATE KEY", []byte("key")),
+		writePem(t, "CERTIFICATE", []byte("invalid")),
+	} {
+		if _, err := certDNSName(f); err == nil {
+			t.Fatalf("%s: want err", f)
+		}
+	}
+}
+
+func Test_RegDDREndpoint(t *testing.T) {
+	cert, err := utils.GenerateCertificate("dns.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := writePem(t, "CERTIFICATE", cert.Certificate[0])
+	m := coremain.NewTestMosdnsWithPlugins(nil)
+	bp := coremain.NewBP("test", m)
+
+	tcpAddr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}
+	if err := RegDDREndpoint(bp, tcpAddr, certFile, []string{"h2"}, "/dns-query{?dns}"); err != nil {
+		t.Fatal(err)
+	}
+	udpAddr := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 853}
+	if err := RegDDREndpoint(bp, udpAddr, certFile, []string{"doq"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegDDREndpoint(bp, &net.UnixAddr{Name: "@dns", Net: "unix"}, certFile, []string{"dot"}, ""); err == nil {
+		t.Fatal("unix address should be rejected")
+	}
+	if err := RegDDREndpoint(bp, tcpAddr, filepath.Join(t.TempDir(), "missing.pem"), []string{"dot"}, ""); err == nil {
+		t.Fatal("missing cert should be rejected")
+	}
+
+	eps := ddrEndpoints(m)
+	if len(eps) != 2 {
+		t.Fatalf("want 2 endpoints, got %v", eps)
+	}
+	if ep := eps[0]; ep.Target != "dns.example.com" || ep.Port != 443 || ep.Addr != netip.MustParseAddr("192.0.2.1") || ep.DoHPath != "/dns-query{?dns}" || ep.ALPN[0] != "h2" {
+		t.Fatalf("invalid tcp endpoint %+v", ep)
+	}
+	if ep := eps[1]; ep.Target != "dns.example.com" || ep.Port != 853 || ep.Addr != netip.MustParseAddr("2001:db8::1") || ep.DoHPath != "" || ep.ALPN[0] != "doq" {
+		t.Fatalf("invalid udp endpoint %+v", ep)
+	}
+	if eps := ddrEndpoints(coremain.NewTestMosdnsWithPlugins(nil)); len(eps) != 0 {
+		t.Fatalf("endpoints should be per instance, got %v", eps)
+	}
+
+	// Endpoints are removed once the instance is closed.
+	m.CloseWithErr(nil)
+	_ = m.GetSafeClose().WaitClosed()
+	if eps := ddrEndpoints(m); len(eps) != 0 {
+		t.Fatalf("endpoints should be removed after close, got %v", eps)
+	}
+}
@@ -20,7 +20,9 @@
 package server_utils
 
 import (
+	"encoding/hex"
 	"fmt"
+	"time"
 
 	"github.com/IrineSistiana/mosdns/v5/coremain"
 	"github.com/IrineSistiana/mosdns/v5/pkg/server"
@@ -28,16 +30,51 @@ import (
 	"github.com/IrineSistiana/mosdns/v5/plugin/executable/sequence"
 )
 
+// CookieArgs configures server side dns cookies. See RFC 7873.
+type CookieArgs struct {
+	// Secrets are hex encoded secrets. The first one generates new cookies.
+	// If empty, a random secret will be used and rotated.
+	Secrets []string `yaml:"secrets"`
+	// RotateInterval is the random secret rotation interval in seconds.
+	// Default is 86400.
+	RotateInterval int `yaml:"rotate_interval"`
+	// UDPSizeLimit is the maximum udp response size to queries that don't
+	// have a valid server cookie. 0 means no limit.
+	UDPSizeLimit int `yaml:"udp_size_limit"`
+}
+
 func NewHandler(bp *coremain.BP, entry string) (server.Handler, error) {
+	return NewCookieHandler(bp, entry, nil)
+}
+
+// NewCookieHandler is like NewHandler but the handler supports dns cookies.
+// cookie can be nil, which disables dns cookies.
+func NewCookieHandler(bp *coremain.BP, entry string, cookie *CookieArgs) (server.Handler, error) {
 	p := bp.M().GetPlugin(entry)
 	exec := sequence.ToExecutable(p)
 	if exec == nil {
 		return nil, fmt.Errorf("cannot find executable entry by tag %s", entry)
 	}
 
+	m := bp.M()
 	handlerOpts := server_handler.EntryHandlerOpts{
-		Logger: bp.L(),
-		Entry:  exec,
+		Logger:       bp.L(),
+		Entry:        exec,
+		DDREndpoints: func() []server_handler.DDREndpoint { return ddrEndpoints(m) },
+	}
+	if cookie != nil {
+		opts := server_handler.CookieOpts{
+			RotateInterval: time.Duration(cookie.RotateInterval) * time.Second,
+			UDPSizeLimit:   cookie.UDPSizeLimit,
+		}
+		for _, s := range cookie.Secrets {
+			b, err := hex.DecodeString(s)
+			if err != nil || len(b) < 16 {
+				return nil, fmt.Errorf("invalid cookie secret, must be at least 16 hex encoded bytes")
+			}
+			opts.Secrets = append(opts.Secrets, b)
+		}
+		handlerOpts.Cookies = server_handler.NewCookies(opts)
 	}
 	return server_handler.NewEntryHandler(handlerOpts), nil
 }
@@ -99,6 +99,11 @@ func StartServer(bp *coremain.BP, args *Args) (*TcpServer, error) {
 		l = tls.NewListener(l, tc)
 	}
 	bp.L().Info("tcp server started", zap.Stringer("addr", l.Addr()), zap.Bool("tls", tc != nil))
+	if tc != nil && listenerNetwork == "tcp" {
+		if err := server_utils.RegDDREndpoint(bp, l.Addr(), args.Cert, []string{"dot"}, ""); err != nil {
+			bp.L().Warn("failed to register ddr endpoint", zap.Error(err))
+		}
+	}
 
 	go func() {
 		defer l.Close()
@@ -40,6 +40,9 @@ func init() {
 type Args struct {
 	Entry  string `yaml:"entry"`
 	Listen string `yaml:"listen"`
+
+	// Cookie enables dns cookies. Optional.
+	Cookie *server_utils.CookieArgs `yaml:"cookie"`
 }
 
 func (a *Args) init() {
@@ -61,7 +64,7 @@ func Init(bp *coremain.BP, args any) (any, error) {
 }
 
 func StartServer(bp *coremain.BP, args *Args) (*UdpServer, error) {
-	dh, err := server_utils.NewHandler(bp, args.Entry)
+	dh, err := server_utils.NewCookieHandler(bp, args.Entry, args.Cookie)
 	if err != nil {
 		return nil, fmt.Errorf("failed to init dns handler, %w", err)
 	}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (C) 2020-2022, IrineSistiana
+ *
+ * This file is part of mosdns.
+ *
+ * mosdns is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * mosdns is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package tools
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/IrineSistiana/mosdns/v5/mlog"
+	"github.com/IrineSistiana/mosdns/v5/plugin/executable/cache"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func newCacheConvCmd() *cobra.Command {
+	var (
+		in        string
+		out       string
+		inFormat  string
+		outFormat string
+	)
+
+	c := &cobra.Command{
+		Use:   "conv -i input_dump -o output_dump [--from format] [--to format]",
+		Args:  cobra.NoArgs,
+		Short: "Convert cache dump format. Supported formats: binary, jsonl, zone. Use \"-\" for stdin/stdout.",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := convCacheDump(in, inFormat, out, outFormat); err != nil {
+				mlog.S().Fatal(err)
+			}
+		},
+		DisableFlagsInUseLine: true,
+	}
+	c.Flags().StringVarP(&in, "in", "i", "", "input dump")
+	c.Flags().StringVarP(&out, "out", "o", "", "output dump")
+	c.Flags().StringVar(&inFormat, "from", cache.DumpFormatBinary, "input dump format")
+	c.Flags().StringVar(&outFormat, "to", cache.DumpFormatJSONL, "output dump format")
+	c.MarkFlagRequired("in")
+	c.MarkFlagRequired("out")
+	c.MarkFlagFilename("in")
+	c.MarkFlagFilename("out")
+	return c
+}
+
+func convCacheDump(in, inFormat, out, outFormat string) (retErr error) {
+	var r io.Reader = os.Stdin
+	if in != "-" {
+		f, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var w io.Writer = os.Stdout
+	if out != "-" {
+		f, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := f.Close(); err != nil && retErr == nil {
+				retErr = fmt.Errorf("failed to close output dump, %w", err)
+			}
+		}()
+		w = f
+	}
+
+	n, skipped, err := cache.ConvertDump(w, outFormat, r, inFormat)
+	if err != nil {
+		return fmt.Errorf("failed to convert cache dump, %w", err)
+	}
+	if skipped > 0 {
+		mlog.L().Warn("entries with invalid keys were skipped", zap.Int("skipped", skipped))
+	}
+	mlog.L().Info("cache dump converted", zap.Int("entries", n))
+	return nil
+}
@@ -42,4 +42,11 @@ func init() {
 	}
 	configCmd.AddCommand(newGenCmd(), newConvCmd())
 	coremain.AddSubCmd(configCmd)
+
+	cacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Tools that can inspect/convert cache dumps.",
+	}
+	cacheCmd.AddCommand(newCacheConvCmd())
+	coremain.AddSubCmd(cacheCmd)
 }